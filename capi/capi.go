@@ -0,0 +1,99 @@
+package main
+
+//
+// C API
+//
+// Exposes the processing pipeline to C, and languages with a C FFI, as a
+// shared library:
+//
+//   go build -buildmode=c-shared -o libgocnc.so ./capi
+//
+// This also generates libgocnc.h. All functions take NUL-terminated gcode, and
+// return 0 on success. Results and error messages are returned as strings
+// allocated by the library, which must be released with gocnc_free.
+//
+
+// #include <stdlib.h>
+import "C"
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/pipeline"
+import "github.com/joushou/gocnc/vm"
+import "encoding/json"
+import "strings"
+import "unsafe"
+
+// Stores the result or error in the output parameters
+func result(res string, err error, out, errOut **C.char) C.int {
+	if err != nil {
+		if errOut != nil {
+			*errOut = C.CString(err.Error())
+		}
+		return 1
+	}
+	if out != nil {
+		*out = C.CString(res)
+	}
+	return 0
+}
+
+// Recovers panics into errors, as they must not cross the C boundary
+func protect(fn func() (string, error)) (res string, err error) {
+	defer vm.Recover(&err)
+	return fn()
+}
+
+//export gocnc_free
+func gocnc_free(p *C.char) {
+	C.free(unsafe.Pointer(p))
+}
+
+// Parses gcode, returning it normalized with the given precision
+//
+//export gocnc_parse
+func gocnc_parse(code *C.char, precision C.int, out, errOut **C.char) C.int {
+	res, err := protect(func() (string, error) {
+		doc, err := gcode.Parse(C.GoString(code))
+		if err != nil {
+			return "", err
+		}
+		return doc.Export(int(precision)), nil
+	})
+	return result(res, err, out, errOut)
+}
+
+// Processes gcode, returning the positions as a JSON array
+//
+//export gocnc_process
+func gocnc_process(code *C.char, optimize C.int, out, errOut **C.char) C.int {
+	res, err := protect(func() (string, error) {
+		m, err := load(C.GoString(code), optimize != 0).Machine()
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(m.Positions())
+		return string(b), err
+	})
+	return result(res, err, out, errOut)
+}
+
+// Processes gcode, returning exported gcode with the given precision
+//
+//export gocnc_export
+func gocnc_export(code *C.char, optimize C.int, precision C.int, out, errOut **C.char) C.int {
+	res, err := protect(func() (string, error) {
+		return load(C.GoString(code), optimize != 0).String(int(precision))
+	})
+	return result(res, err, out, errOut)
+}
+
+// Parses and processes gcode, applying the default optimizations if requested
+func load(code string, optimize bool) *pipeline.Pipeline {
+	p := pipeline.Parse(strings.NewReader(code))
+	if optimize {
+		p.Optimize()
+	}
+	return p
+}
+
+func main() {}
@@ -0,0 +1,248 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/vector"
+import "context"
+import "math"
+
+//
+// Arc fitting
+//
+// The vm approximates arcs with lines, which makes exported programs large,
+// and lets controllers see only short lines where there were smooth curves.
+// When exporting with arc fitting, runs of feed moves in the XY plane lying
+// on a circle are found, and passed to generators with ArcHandler as a single
+// arc. Other generators get the lines as usual.
+//
+// A run is fitted if every line of it stays within the tolerance of the arc,
+// including the middle of every line. Runs must share state, height, work
+// offset and rotary angles, turn one way, and be shorter than a full circle. Runs that are
+// straight within the tolerance are left as lines. Runs in inverse time mode
+// are left as lines too, as the feedrate of every line is that of the line
+// alone, as are runs in diameter mode, and runs scaled unequally in X and Y,
+// which are not circles to controllers scaling themselves.
+//
+// Segments are read in order, keeping only the run being fitted, so that
+// spilled programs can be fitted too.
+//
+
+// Fewest lines fitted with an arc
+const minArcLines = 3
+
+// Most segments kept while fitting a run
+const maxArcRun = 4096
+
+// Generators that can move along arcs in the XY plane (G2/G3). The center is
+// given relative to the start (I and J). As arcs leave the motion mode changed,
+// the next move must write its mode.
+type ArcHandler interface {
+	Arc(x, y, z, i, j float64, clockwise bool)
+}
+
+// A run of feed moves fitted with an arc
+type Arc struct {
+	Start, End int           // Indexes of the first and last segment of the run
+	Last       vm.Segment    // Segment at End
+	I, J       float64       // Center, relative to the position before the run
+	Center     vector.Vector // Center, in the coordinates of the segments
+	Clockwise  bool
+}
+
+// Finds the runs of feed moves in the position stack that fit arcs within
+// the tolerance (mm), in order.
+func FitArcs(m *vm.Machine, tolerance float64) []Arc {
+	var (
+		res  []Arc
+		run  []vm.Segment // Segments from index base on, starting with the position before a run
+		base int
+	)
+
+	// Fits the runs starting at the front, until one needs more segments, unless final
+	fit := func(final bool) {
+		for len(run) > minArcLines {
+			arc, ok, complete := longestArc(run, tolerance)
+			if !complete && !final {
+				return
+			}
+			if !ok {
+				run, base = run[1:], base+1
+				continue
+			}
+			arc.Start, arc.End = arc.Start+base, arc.End+base
+			res = append(res, arc)
+			n := arc.End - base
+			run, base = run[n:], base+n
+		}
+	}
+
+	for idx, seg := range m.All() {
+		if len(run) == 0 {
+			base = idx
+		}
+		run = append(run, seg)
+		if len(run) > 2 && !continues(run[0], run[1], seg) || len(run) >= maxArcRun {
+			// Overly long runs are cut short
+			fit(len(run) >= maxArcRun)
+		}
+	}
+	fit(true)
+	return res
+}
+
+// Fits the longest arc to the run starting after the first segment. Unless
+// complete, the arc may go on past the segments given.
+func longestArc(segs []vm.Segment, tolerance float64) (best Arc, ok, complete bool) {
+	for b := 1; b < len(segs); b++ {
+		if !continues(segs[0], segs[1], segs[b]) {
+			return best, ok, true
+		}
+		if b < minArcLines {
+			continue
+		}
+		arc, fits := fitArc(segs[:b+1], tolerance)
+		if !fits {
+			return best, ok, true
+		}
+		arc.Start, arc.End, arc.Last = 1, b, segs[b]
+		best, ok = arc, true
+	}
+	return best, ok, false
+}
+
+// Tests if a segment can be part of a run starting at first, after the position from
+func continues(from, first, seg vm.Segment) bool {
+	st := seg.State
+	factors := st.Scaling.Factors
+	return seg.Kind == vm.SegmentMove && !seg.Machine &&
+		st.MoveMode == vm.MoveModeLinear && st.FeedMode != vm.FeedModeInvTime && !st.DiameterMode &&
+		math.Abs(factors.X) == math.Abs(factors.Y) &&
+		*st == *first.State &&
+		seg.Offset == from.Offset && seg.Z == from.Z && seg.Angles() == from.Angles()
+}
+
+// Fits an arc to the lines between the positions, which are at the same height
+func fitArc(segs []vm.Segment, tolerance float64) (Arc, bool) {
+	var (
+		p     = make([]vector.Vector, len(segs))
+		first = 0
+		last  = len(segs) - 1
+	)
+	for idx, seg := range segs {
+		p[idx] = seg.Vector()
+	}
+
+	// Circle through the ends and the middle
+	center, ok := circle(p[first], p[last/2], p[last])
+	if !ok {
+		return Arc{}, false
+	}
+	radius := math.Hypot(p[first].X-center.X, p[first].Y-center.Y)
+
+	// Straight runs are better left as lines
+	chord := p[last].Diff(p[first])
+	straight := true
+	for _, v := range p {
+		d := v.Diff(p[first])
+		if math.Abs(chord.X*d.Y-chord.Y*d.X)/chord.Norm() > tolerance {
+			straight = false
+			break
+		}
+	}
+	if straight {
+		return Arc{}, false
+	}
+
+	var (
+		total     float64
+		clockwise bool
+	)
+	for idx := 1; idx < len(p); idx++ {
+		if math.Abs(math.Hypot(p[idx].X-center.X, p[idx].Y-center.Y)-radius) > tolerance {
+			return Arc{}, false
+		}
+
+		// Deviation of the middle of the line from the arc
+		half := p[idx].Diff(p[idx-1]).Norm() / 2
+		if half > radius || radius-math.Sqrt(radius*radius-half*half) > tolerance {
+			return Arc{}, false
+		}
+
+		// Turning angle around the center, all in the same direction
+		u := p[idx-1].Diff(center)
+		v := p[idx].Diff(center)
+		angle := math.Atan2(u.X*v.Y-u.Y*v.X, u.X*v.X+u.Y*v.Y)
+		if math.Abs(angle) < 1e-9 {
+			// Too short to have a direction, such as the exact end point of an arc
+		} else if total == 0 {
+			clockwise = angle < 0
+		} else if (angle < 0) != clockwise {
+			return Arc{}, false
+		}
+		if math.Abs(angle) > math.Pi/2 {
+			return Arc{}, false
+		}
+		total += math.Abs(angle)
+	}
+	if total >= 2*math.Pi-1e-6 {
+		return Arc{}, false
+	}
+
+	return Arc{I: center.X - p[first].X, J: center.Y - p[first].Y, Center: center, Clockwise: clockwise}, true
+}
+
+// Finds the center of the circle through three points in the XY plane
+func circle(a, b, c vector.Vector) (vector.Vector, bool) {
+	d := 2 * (a.X*(b.Y-c.Y) + b.X*(c.Y-a.Y) + c.X*(a.Y-b.Y))
+	if math.Abs(d) < 1e-12 {
+		return vector.Vector{}, false
+	}
+	a2, b2, c2 := a.X*a.X+a.Y*a.Y, b.X*b.X+b.Y*b.Y, c.X*c.X+c.Y*c.Y
+	return vector.Vector{
+		(a2*(b.Y-c.Y) + b2*(c.Y-a.Y) + c2*(a.Y-b.Y)) / d,
+		(a2*(c.X-b.X) + b2*(a.X-c.X) + c2*(b.X-a.X)) / d,
+		a.Z,
+	}, true
+}
+
+// Calls HandleSegment for all segments in the vm, passing runs of moves fitting
+// arcs within the tolerance (mm) to generators with ArcHandler. Stops with the
+// context error if the context is cancelled.
+func HandleAllPositionsWithArcs(ctx context.Context, m *vm.Machine, tolerance float64, gens ...CodeGenerator) error {
+	var arcs []Arc
+	if err := catch(func() { arcs = FitArcs(m, tolerance) }); err != nil {
+		return err
+	}
+	return eachSegment(ctx, m, func(idx int, seg vm.Segment) error {
+		for len(arcs) > 0 && arcs[0].End < idx {
+			arcs = arcs[1:]
+		}
+		return each(gens, func(s CodeGenerator) {
+			h, ok := s.(ArcHandler)
+			switch {
+			case !ok || len(arcs) == 0 || idx < arcs[0].Start:
+				handleSegment(s, seg)
+			case idx == arcs[0].Start:
+				handleArc(s, h, seg, arcs[0])
+			}
+		})
+	})
+}
+
+// Calls Arc of a generator for a fitted run, starting with its first segment.
+// The center is converted like the positions, turning the other way if that
+// mirrors it.
+func handleArc(s CodeGenerator, h ArcHandler, first vm.Segment, arc Arc) {
+	handleState(s, *first.State)
+	from, pos := s.GetPosition(), positionFor(s, arc.Last)
+	c := arc.Last
+	c.X, c.Y = arc.Center.X, arc.Center.Y
+	center := positionFor(s, c)
+
+	clockwise := arc.Clockwise
+	factors := first.State.Scaling.Factors
+	if _, ok := s.(ScalingHandler); ok && first.State.Scaling.Active() && !machineCoordinates(s) && (factors.X < 0) != (factors.Y < 0) {
+		clockwise = !clockwise
+	}
+	h.Arc(pos.X, pos.Y, pos.Z, center.X-from.X, center.Y-from.Y, clockwise)
+	s.SetPosition(pos)
+}
@@ -0,0 +1,91 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "math"
+import "strings"
+import "testing"
+
+func TestFitArcs(t *testing.T) {
+	tests := []struct {
+		name      string
+		program   string
+		arcs      int
+		clockwise bool
+		i, j      float64
+	}{
+		{"counterclockwise", "G21 G90 G0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\n", 1, false, -10, 0},
+		{"clockwise", "G21 G90 G0 X0 Y5 Z-1\nG1 F100\nG2 X5 Y0 I0 J-5\n", 1, true, 0, -5},
+		{"after lines", "G21 G90 G0 X0 Y0 Z0\nG1 X10 F100\nG3 X-10 Y0 I-10 J0\nG1 X-20\n", 1, false, -10, 0},
+		{"straight", "G21 G90 G0 X0 Y0 Z0\nG1 X10 F100\nX20\nX30\nX40\nX50\n", 0, false, 0, 0},
+		{"inverse time", "G21 G90 G0 X10 Y0 Z0\nG93 G3 X-10 Y0 I-10 J0 F2\n", 0, false, 0, 0},
+		{"unequal scaling", "G21 G90 G51 X0 Y0 I2 J1\nG0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\n", 0, false, 0, 0},
+	}
+	for _, test := range tests {
+		m := processProgram(t, test.program)
+		arcs := FitArcs(m, 0.01)
+		if len(arcs) != test.arcs {
+			t.Errorf("%s: got %d arcs, expected %d", test.name, len(arcs), test.arcs)
+			continue
+		}
+		for _, arc := range arcs {
+			if arc.Clockwise != test.clockwise {
+				t.Errorf("%s: got clockwise %t", test.name, arc.Clockwise)
+			}
+			if math.Abs(arc.I-test.i) > 0.01 || math.Abs(arc.J-test.j) > 0.01 {
+				t.Errorf("%s: got center I%g J%g, expected I%g J%g", test.name, arc.I, arc.J, test.i, test.j)
+			}
+		}
+	}
+}
+
+func TestFitArcsSpilled(t *testing.T) {
+	program := "G21 G90 G0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\nG1 X-20\nG2 X-40 Y0 I-10 J0\nG0 Z5\n"
+	expected := FitArcs(processProgram(t, program), 0.01)
+	m := processProgram(t, program, vm.WithSpill(t.TempDir(), 16))
+	defer m.Close()
+	if !m.Spilled() {
+		t.Fatal("Program not spilled")
+	}
+	arcs := FitArcs(m, 0.01)
+	if len(arcs) != len(expected) || len(arcs) != 2 {
+		t.Fatalf("Got %d arcs when spilled, expected %d", len(arcs), len(expected))
+	}
+	for idx := range arcs {
+		if arcs[idx].Start != expected[idx].Start || arcs[idx].End != expected[idx].End {
+			t.Errorf("Arc %d is %d to %d when spilled, expected %d to %d", idx,
+				arcs[idx].Start, arcs[idx].End, expected[idx].Start, expected[idx].End)
+		}
+	}
+}
+
+// The arcs of a program exported with arc fitting
+func exportedArcs(t *testing.T, program, generator string) []string {
+	m := processProgram(t, program)
+	var res []string
+	for _, l := range exportLines(t, m, generator, func(gens ...CodeGenerator) error {
+		return HandleAllPositionsWithArcs(context.Background(), m, 0.01, gens...)
+	}) {
+		if strings.HasPrefix(l, "G2X") || strings.HasPrefix(l, "G3X") {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+func TestArcCenterConverted(t *testing.T) {
+	tests := []struct {
+		name, program, generator, arc string
+	}{
+		{"work coordinates", "G21 G90 G0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\n", "linuxcnc", "G3X-10Y0I-10J0"},
+		{"scaled", "G21 G90 G51 X0 Y0 P2\nG0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\n", "mach", "G3X-10Y0I-10J0"},
+		{"mirrored", "G21 G90 G51 X0 Y0 I-1 J1\nG0 X10 Y0 Z0\nG1 F100\nG3 X0 Y10 I-10 J0\n", "mach", "G3X0Y10I-10J0"},
+		{"scaled without scaling", "G21 G90 G51 X0 Y0 P2\nG0 X10 Y0 Z0\nG1 F100\nG3 X-10 Y0 I-10 J0\n", "linuxcnc", "G3X-20Y0I-20J0"},
+	}
+	for _, test := range tests {
+		arcs := exportedArcs(t, test.program, test.generator)
+		if len(arcs) != 1 || arcs[0] != test.arc {
+			t.Errorf("%s: got %q, expected %q", test.name, arcs, test.arc)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package export
+
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "strings"
+
+//
+// Capabilities
+//
+// CodeGenerator only covers what every exporter must handle. Exporters that
+// can do more implement the optional interfaces below, which are detected by
+// type assertion when handling segments, like ModalResetter in restart.go.
+//
+// Passthrough segments are skipped by generators without PassthroughHandler,
+// as they do not change the toolpath. Probing and rotary moves do, so
+// handling them with a generator lacking the capability is an error. This includes moves changing
+// the angles of the rotary axes, which need RotaryMoveHandler.
+//
+
+// Generators that can probe (G38.2 to G38.5). The code is that of the segment.
+// As probing leaves the motion mode changed, the next move must write its mode.
+type ProbeHandler interface {
+	Probe(x, y, z, code float64)
+}
+
+// Generators that can move rotary axes. The angle is absolute, in degrees.
+type RotaryHandler interface {
+	Rotate(axis rune, angle float64, moveMode int)
+}
+
+// Generators that can move rotary axes together with X, Y and Z. Moves changing
+// the angles of the rotary axes are passed to MoveRotary instead of Move, with
+// the absolute angles in degrees.
+type RotaryMoveHandler interface {
+	MoveRotary(x, y, z, a, b, c float64, moveMode int)
+}
+
+// Generators that can pass on blocks verbatim, such as the heater and fan codes
+// of the Marlin dialect (see vm/dialect.go)
+type PassthroughHandler interface {
+	Passthrough(text string)
+}
+
+// Generators that can move in machine coordinates (G53). Segments programmed in
+// machine coordinates are passed to MachineMove in machine coordinates, and to
+// Move in work coordinates for generators without it.
+type MachineMoveHandler interface {
+	MachineMove(x, y, z float64, moveMode int)
+}
+
+// Generators that set the axis offset (G92) themselves. Other generators are
+// given positions with the axis offset added, so that their output does not
+// depend on it. SetAxisOffset is called with the axis offset of every segment
+// before it is handled, and must set the offset if it differs from the one in
+// effect, as positions of the segment are given without it.
+type AxisOffsetHandler interface {
+	SetAxisOffset(offset vector.Vector)
+}
+
+// Generators that scale (G51) themselves, about the origin. Other generators
+// are given the positions as scaled by the vm. SetScaling is called with the
+// factors of X, Y and Z whenever those of the state change (see
+// vm/scaling.go), all zero when scaling ends, and positions are then given
+// with the scaling reverted, so that the controller scales them back.
+type ScalingHandler interface {
+	SetScaling(factors vector.Vector)
+}
+
+// Generators choosing the coordinates of the positions they are given. Generators
+// returning true get machine instead of work coordinates (see vm/offsets.go), such
+// as previews of programs using several work offsets.
+type CoordinateChooser interface {
+	MachineCoordinates() bool
+}
+
+// Generators that can enable and disable feed and speed overrides (M48/M49),
+// which programs disable for sections where the programmed values are critical
+type OverrideHandler interface {
+	Overrides(enabled bool)
+}
+
+// Generators that end the program explicitly (such as with M2), called by
+// EndProgram after the last segment
+type ProgramEnder interface {
+	End()
+}
+
+// Generators for laser machines, receiving spindle changes as laser power
+// instead of Spindle. Counterclockwise spindle (M4) means dynamic power,
+// scaled with the speed of the machine.
+type LaserHandler interface {
+	Laser(enabled, dynamic bool, power float64)
+}
+
+// Generators for plasma cutters, receiving spindle changes as the torch being
+// fired or extinguished instead of Spindle, and changes to torch height control
+// (see vm/plasma.go)
+type PlasmaHandler interface {
+	Torch(on bool)
+	THC(enabled bool)
+}
+
+// Generators for lathe controllers, receiving the lathe modes of the state
+// (see vm/lathe.go). In diameter mode, positions are given with X as a
+// diameter. SpindleMode is called when constant surface speed mode (G96) is
+// entered or changed, with the surface speed in m/min and the spindle speed
+// limit, if any, and when it is left (G97), with the spindle speed in RPM.
+// Other generators are given X as a radius, and fail on constant surface speed.
+type LatheHandler interface {
+	DiameterMode(enabled bool)
+	SpindleMode(constantSurfaceSpeed bool, speed, maxSpindleSpeed float64)
+}
+
+// Generators that can trace their output back to the input with comments.
+// Source is called with the line and text of the input block of every
+// segment before it is handled, and, when enabled with SetSourceComments,
+// comments the output with it whenever the line changes.
+type SourceCommenter interface {
+	SetSourceComments(enabled bool)
+	Source(line int, text string)
+}
+
+// Generators that can comment the output, such as with the names of the
+// sections of a split program (see split.go)
+type Commenter interface {
+	Comment(text string)
+}
+
+// Calls the generator for a dwell or pause, and its capabilities for a probe, rotary or passthrough segment
+func handleEvent(s CodeGenerator, seg vm.Segment) {
+	switch seg.Kind {
+	case vm.SegmentDwell:
+		handleState(s, *seg.State)
+		s.Dwell(seg.Param)
+	case vm.SegmentPause:
+		handleState(s, *seg.State)
+		s.Pause(int(seg.Param))
+	case vm.SegmentProbe:
+		h, ok := s.(ProbeHandler)
+		if !ok {
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Probing not supported by generator"))
+		}
+		handleState(s, *seg.State)
+		pos := positionFor(s, seg)
+		h.Probe(pos.X, pos.Y, pos.Z, seg.Param)
+	case vm.SegmentRotary:
+		h, ok := s.(RotaryHandler)
+		if !ok {
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Rotary axes not supported by generator"))
+		}
+		handleState(s, *seg.State)
+		h.Rotate(seg.Axis, seg.Param, seg.State.MoveMode)
+	case vm.SegmentPassthrough:
+		handleState(s, *seg.State)
+		if h, ok := s.(PassthroughHandler); ok {
+			h.Passthrough(seg.Text)
+		}
+	}
+	s.SetPosition(positionFor(s, seg))
+}
+
+// Calls MachineMove of a generator for a segment in machine coordinates
+func handleMachineMove(s CodeGenerator, h MachineMoveHandler, seg vm.Segment) {
+	handleState(s, *seg.State)
+	pos := positionFor(s, seg)
+	if s.GetPosition() != pos {
+		mp := seg.MachinePosition()
+		if diameterMode(s, seg) {
+			mp.X *= 2
+		}
+		h.MachineMove(mp.X, mp.Y, mp.Z, seg.State.MoveMode)
+	}
+	s.SetPosition(pos)
+}
+
+// Tests if the generator is given machine coordinates
+func machineCoordinates(s CodeGenerator) bool {
+	c, ok := s.(CoordinateChooser)
+	return ok && c.MachineCoordinates()
+}
+
+// The position at the end of the segment, in the coordinates chosen by the generator,
+// with the axis offset added for generators not setting it, and the scaling
+// reverted for generators scaling themselves
+func positionFor(s CodeGenerator, seg vm.Segment) vm.Position {
+	var pos vm.Position
+	if machineCoordinates(s) {
+		pos = seg.MachinePosition()
+	} else if _, ok := s.(AxisOffsetHandler); ok {
+		pos = seg.Position()
+	} else {
+		pos = withAxisOffset(seg.Position(), seg.AxisOffset)
+	}
+	if _, ok := s.(ScalingHandler); ok && seg.State.Scaling.Active() && !machineCoordinates(s) {
+		pos = unscaled(pos, seg.State.Scaling.Factors)
+	}
+	if diameterMode(s, seg) {
+		pos.X *= 2
+	}
+	return pos
+}
+
+// Tests if the generator is given X as a diameter for the segment
+func diameterMode(s CodeGenerator, seg vm.Segment) bool {
+	_, ok := s.(LatheHandler)
+	return ok && seg.State.DiameterMode
+}
+
+// Reverts scaling by the factors about the origin
+func unscaled(pos vm.Position, factors vector.Vector) vm.Position {
+	pos.X, pos.Y, pos.Z = pos.X/factors.X, pos.Y/factors.Y, pos.Z/factors.Z
+	return pos
+}
+
+// Adds an axis offset to a position
+func withAxisOffset(pos vm.Position, offset vector.Vector) vm.Position {
+	pos.X, pos.Y, pos.Z = pos.X+offset.X, pos.Y+offset.Y, pos.Z+offset.Z
+	return pos
+}
+
+// Line of the last source comment, for generators implementing SourceCommenter
+type sourceComments struct {
+	enabled bool
+	line    int
+}
+
+// Enables or disables comments with the input line of the output
+func (s *sourceComments) SetSourceComments(enabled bool) {
+	s.enabled = enabled
+}
+
+// Tests if a source comment is due for a segment of the line, expecting it to be written
+func (s *sourceComments) due(line int) bool {
+	if !s.enabled || line == 0 || line == s.line {
+		return false
+	}
+	s.line = line
+	return true
+}
+
+// The text of a source comment
+func sourceComment(line int, text string) string {
+	return fmt.Sprintf("%d: %s", line, text)
+}
+
+// Makes text fit in a parenthesized comment. Comments cannot nest or span
+// lines, so parentheses and line breaks are replaced.
+func commentText(text string) string {
+	text = strings.NewReplacer("(", "[", ")", "]", "\r", " ", "\n", " ").Replace(text)
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,199 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "math"
+import "strings"
+
+//
+// DXF export
+//
+// Writes the XY projection of the toolpath as a DXF (R12) drawing, so that
+// the path actually cut can be brought back into CAD, for instance to design
+// fixtures around it. Moves are drawn as polylines, and arcs passed to Arc
+// (see arcs.go) as arcs or circles. Rapid moves go on the RAPID layer, and
+// cutting moves on a layer per tool and depth, such as T1_Z-1p5 for a depth
+// of -1.5, as R12 layer names cannot contain '.', with the cuts drawn at
+// their depth. Moves along Z only are not visible from above,
+// and left out.
+//
+
+// Layer of rapid moves
+const dxfRapidLayer = "RAPID"
+
+type DXFGenerator struct {
+	BaseGenerator
+	Precision     int
+	MachineCoords bool // Draw in machine coordinates, for programs using several work offsets
+	entities      []dxfShape
+	layers        []string
+	tool          int
+}
+
+// A polyline of moves on the same layer, or an arc if radius is set
+type dxfShape struct {
+	layer      string
+	z          float64
+	points     [][2]float64
+	center     [2]float64
+	radius     float64
+	start, end float64 // Angles of arcs, counterclockwise in degrees
+}
+
+func (s *DXFGenerator) Init() {
+	s.BaseGenerator.Init()
+	s.entities = nil
+	s.layers = nil
+	s.tool = 0
+}
+
+func (s *DXFGenerator) MachineCoordinates() bool {
+	return s.MachineCoords
+}
+
+func (s *DXFGenerator) Toolchange(tool int) {
+	s.tool = tool
+}
+
+// The layer of a move, adding it to the layers if new
+func (s *DXFGenerator) layer(z float64, moveMode int) string {
+	name := dxfRapidLayer
+	if moveMode != vm.MoveModeRapid {
+		name = fmt.Sprintf("T%d_Z%s", s.tool, strings.Replace(gcode.FormatFloat(z, s.Precision), ".", "p", 1))
+	}
+	for _, l := range s.layers {
+		if l == name {
+			return name
+		}
+	}
+	s.layers = append(s.layers, name)
+	return name
+}
+
+func (s *DXFGenerator) Move(x, y, z float64, moveMode int) {
+	if moveMode == vm.MoveModeNone {
+		return
+	}
+
+	pos := s.GetPosition()
+	if pos.X == x && pos.Y == y {
+		// Not visible from above
+		return
+	}
+
+	layer := s.layer(z, moveMode)
+	if moveMode == vm.MoveModeRapid {
+		z = 0
+	}
+	if n := len(s.entities); n == 0 || s.entities[n-1].radius != 0 || s.entities[n-1].layer != layer ||
+		s.entities[n-1].points[len(s.entities[n-1].points)-1] != [2]float64{pos.X, pos.Y} {
+		s.entities = append(s.entities, dxfShape{layer: layer, z: z, points: [][2]float64{{pos.X, pos.Y}}})
+	}
+
+	p := &s.entities[len(s.entities)-1]
+	p.points = append(p.points, [2]float64{x, y})
+}
+
+// Adds an arc in the XY plane, a circle if it ends where it starts
+func (s *DXFGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	pos := s.GetPosition()
+	center := [2]float64{pos.X + i, pos.Y + j}
+	start := math.Atan2(pos.Y-center[1], pos.X-center[0]) * 180 / math.Pi
+	end := math.Atan2(y-center[1], x-center[0]) * 180 / math.Pi
+	if clockwise {
+		start, end = end, start
+	}
+	s.entities = append(s.entities, dxfShape{
+		layer:  s.layer(z, vm.MoveModeLinear),
+		z:      z,
+		center: center,
+		radius: math.Hypot(i, j),
+		start:  start,
+		end:    end,
+	})
+}
+
+// Fetch the generated DXF drawing
+func (s *DXFGenerator) Retrieve() string {
+	var b strings.Builder
+	pair := func(code int, value string) {
+		fmt.Fprintf(&b, "%d\n%s\n", code, value)
+	}
+	num := func(code int, v float64) {
+		pair(code, gcode.FormatFloat(v, s.Precision))
+	}
+
+	pair(0, "SECTION")
+	pair(2, "TABLES")
+	pair(0, "TABLE")
+	pair(2, "LTYPE")
+	pair(70, "1")
+	pair(0, "LTYPE")
+	pair(2, "CONTINUOUS")
+	pair(70, "0")
+	pair(3, "Solid line")
+	pair(72, "65")
+	pair(73, "0")
+	pair(40, "0.0")
+	pair(0, "ENDTAB")
+	pair(0, "TABLE")
+	pair(2, "LAYER")
+	pair(70, fmt.Sprint(len(s.layers)))
+	for idx, l := range s.layers {
+		// Rapids in red, and cut layers in turn in the other standard colors
+		color := 1
+		if l != dxfRapidLayer {
+			color = 2 + idx%6
+		}
+		pair(0, "LAYER")
+		pair(2, l)
+		pair(70, "0")
+		pair(62, fmt.Sprint(color))
+		pair(6, "CONTINUOUS")
+	}
+	pair(0, "ENDTAB")
+	pair(0, "ENDSEC")
+
+	pair(0, "SECTION")
+	pair(2, "ENTITIES")
+	for _, e := range s.entities {
+		switch {
+		case e.radius != 0 && e.start == e.end:
+			pair(0, "CIRCLE")
+			pair(8, e.layer)
+			num(10, e.center[0])
+			num(20, e.center[1])
+			num(30, e.z)
+			num(40, e.radius)
+		case e.radius != 0:
+			pair(0, "ARC")
+			pair(8, e.layer)
+			num(10, e.center[0])
+			num(20, e.center[1])
+			num(30, e.z)
+			num(40, e.radius)
+			num(50, e.start)
+			num(51, e.end)
+		default:
+			pair(0, "POLYLINE")
+			pair(8, e.layer)
+			pair(66, "1")
+			num(10, 0)
+			num(20, 0)
+			num(30, e.z)
+			for _, pt := range e.points {
+				pair(0, "VERTEX")
+				pair(8, e.layer)
+				num(10, pt[0])
+				num(20, pt[1])
+				num(30, e.z)
+			}
+			pair(0, "SEQEND")
+			pair(8, e.layer)
+		}
+	}
+	pair(0, "ENDSEC")
+	pair(0, "EOF")
+	return b.String()
+}
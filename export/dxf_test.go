@@ -0,0 +1,40 @@
+package export
+
+import "strings"
+import "testing"
+
+func TestDXFLayerNames(t *testing.T) {
+	tests := []struct {
+		program string
+		layers  []string
+	}{
+		{"G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nX10\n", []string{"T0_Z-1"}},
+		{"G21 G90 G0 X0 Y0 Z1\nG1 Z-1.5 F100\nX10\nZ-0.25\nX0\n", []string{"T0_Z-1p5", "T0_Z-0p25"}},
+		{"G21 G90 T2 M6\nG0 X0 Y0 Z1\nG1 Z0.5 F100\nX10\n", []string{"T2_Z0p5"}},
+	}
+	for _, test := range tests {
+		m := processProgram(t, test.program)
+		g := &DXFGenerator{Precision: 4}
+		g.Init()
+		if err := HandleAllPositions(m, g); err != nil {
+			t.Fatal(err)
+		}
+
+		// Layer names follow group code 2 in the layer table
+		var layers []string
+		lines := strings.Split(g.Retrieve(), "\n")
+		for idx := 0; idx+3 < len(lines); idx++ {
+			if lines[idx] == "0" && lines[idx+1] == "LAYER" && lines[idx+2] == "2" {
+				layers = append(layers, lines[idx+3])
+			}
+		}
+		if strings.Join(layers, " ") != strings.Join(test.layers, " ") {
+			t.Errorf("%q: got layers %v, expected %v", test.program, layers, test.layers)
+		}
+		for _, l := range layers {
+			if strings.Trim(l, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789$-_p") != "" {
+				t.Errorf("%q: invalid layer name %q", test.program, l)
+			}
+		}
+	}
+}
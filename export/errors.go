@@ -0,0 +1,79 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "strings"
+
+//
+// Generator errors
+//
+// With multiple generators, a failing generator does not stop the others.
+// Its error is recorded together with the identity of the generator, the
+// failed generator is left out for the rest of the export, and the errors
+// of all failed generators are returned together as GeneratorErrors. With
+// a single generator, its error is returned as is.
+//
+
+// An error from one of several generators
+type GeneratorError struct {
+	Index     int // Position in the list of generators
+	Generator CodeGenerator
+	Err       error
+}
+
+func (e *GeneratorError) Error() string {
+	return fmt.Sprintf("Generator %d (%T): %s", e.Index, e.Generator, e.Err)
+}
+
+func (e *GeneratorError) Unwrap() error {
+	return e.Err
+}
+
+// Errors from one or more of several generators, in the order of the generators
+type GeneratorErrors []*GeneratorError
+
+func (e GeneratorErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, x := range e {
+		msgs[i] = x.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e GeneratorErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, x := range e {
+		errs[i] = x
+	}
+	return errs
+}
+
+// Returns nil if there are no errors, so that the result can be returned as an error
+func (e GeneratorErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Calls fn, recovering a panic as an error
+func catch(fn func()) (err error) {
+	defer vm.Recover(&err)
+	fn()
+	return nil
+}
+
+// Calls fn for every generator, continuing with the rest if one fails
+func each(gens []CodeGenerator, fn func(CodeGenerator)) error {
+	if len(gens) == 1 {
+		return catch(func() { fn(gens[0]) })
+	}
+
+	var errs GeneratorErrors
+	for i, g := range gens {
+		if err := catch(func() { fn(g) }); err != nil {
+			errs = append(errs, &GeneratorError{i, g, err})
+		}
+	}
+	return errs.orNil()
+}
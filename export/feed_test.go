@@ -0,0 +1,70 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "strings"
+import "testing"
+
+// Runs the program through a vm with the options
+func processProgram(t *testing.T, program string, opts ...vm.Option) *vm.Machine {
+	doc, err := gcode.Parse(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vm.New(opts...)
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Exports the machine with the named generator, using fn to handle the segments
+func exportLines(t *testing.T, m *vm.Machine, generator string, fn func(...CodeGenerator) error) []string {
+	var lines []string
+	g, err := NewGenerator(generator, 4, func(l string) {
+		lines = append(lines, strings.Split(l, "\n")...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Init()
+	if err := fn(g); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// Exports the program with the named generator
+func exportProgram(t *testing.T, program, generator string) []string {
+	m := processProgram(t, program)
+	return exportLines(t, m, generator, func(gens ...CodeGenerator) error {
+		return HandleAllPositions(m, gens...)
+	})
+}
+
+func TestInverseTimeFeedOnEveryMove(t *testing.T) {
+	programs := []string{
+		"G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nG93 G1 X10 F60\nX20 F60\nG2 X30 Y10 I10 J0 F6\nG94 G1 X0 F200\n",
+		"G21 G90 G0 X10 Y0 Z0\nG93 G3 X-10 Y0 I-10 J0 F2\n",
+	}
+	for _, generator := range []string{"linuxcnc", "grbl", "string"} {
+		for _, program := range programs {
+			var inverse bool
+			for _, l := range exportProgram(t, program, generator) {
+				l = strings.ToUpper(strings.Replace(l, " ", "", -1))
+				if strings.Contains(l, "G93") {
+					inverse = true
+				}
+				if strings.Contains(l, "G94") {
+					inverse = false
+				}
+				if !inverse || strings.HasPrefix(l, "(") || !strings.ContainsAny(l, "XYZ") || strings.HasPrefix(l, "G0") {
+					continue
+				}
+				if !strings.Contains(l, "F") {
+					t.Errorf("%s: inverse time move without F: %q", generator, l)
+				}
+			}
+		}
+	}
+}
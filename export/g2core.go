@@ -0,0 +1,48 @@
+package export
+
+import "strings"
+
+//
+// g2core
+//
+// g2core, and TinyG before it, accept plain gcode, but are best driven in
+// JSON mode, where every block is sent as a gcode command:
+//
+//   {"gc":"G1X10Y20F500"}
+//
+// and acknowledged with a response carrying a status code, which makes
+// errors attributable to the block causing them (see streaming/g2core.go).
+// G2CoreGenerator produces the gcode of StringCodeGenerator wrapped this way,
+// one command per line, for senders passing lines on as they are.
+//
+
+type G2CoreGenerator struct {
+	StringCodeGenerator
+	Write func(string) // Receives the commands as they are generated instead of Lines, if set
+}
+
+// Initializes state, and puts in a header block.
+func (s *G2CoreGenerator) Init() {
+	s.StringCodeGenerator.Write = s.wrap
+	s.StringCodeGenerator.Init()
+}
+
+// Wraps the lines of a block as gcode commands
+func (s *G2CoreGenerator) wrap(block string) {
+	for _, line := range strings.Split(block, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		cmd := G2CoreCommand(line)
+		if s.Write != nil {
+			s.Write(cmd)
+		} else {
+			s.Lines = append(s.Lines, cmd)
+		}
+	}
+}
+
+// Wraps a line of gcode as a g2core JSON gcode command
+func G2CoreCommand(line string) string {
+	return `{"gc":"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(line) + `"}`
+}
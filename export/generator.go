@@ -1,27 +1,13 @@
 package export
 
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
 import "github.com/joushou/gocnc/vm"
-import "strconv"
-import "strings"
+import "github.com/joushou/gocnc/warnings"
+import "context"
 import "errors"
 import "fmt"
 
-func floatToString(f float64, p int) string {
-	x := strconv.FormatFloat(f, 'f', p, 64)
-
-	// Hacky way to remove silly zeroes
-	if strings.IndexRune(x, '.') != -1 {
-		for x[len(x)-1] == '0' {
-			x = x[:len(x)-1]
-		}
-		if x[len(x)-1] == '.' {
-			x = x[:len(x)-1]
-		}
-	}
-
-	return x
-}
-
 // Interface for exporting a vm position stack.
 type CodeGenerator interface {
 	GetPosition() vm.Position
@@ -33,6 +19,8 @@ type CodeGenerator interface {
 	Feedrate(float64)
 	CutterCompensation(int)
 	Move(float64, float64, float64, int)
+	Dwell(float64)
+	Pause(int)
 	Init()
 }
 
@@ -79,73 +67,256 @@ func (s *BaseGenerator) CutterCompensation(int) {
 func (s *BaseGenerator) Move(float64, float64, float64, int) {
 }
 
+// Dummy implementation
+func (s *BaseGenerator) Dwell(float64) {
+}
+
+// Dummy implementation
+func (s *BaseGenerator) Pause(int) {
+}
+
+// The state of generators before the first position, with the feed mode, tool
+// and cutter compensation unknown
+func initialState() vm.State {
+	return vm.State{FeedMode: -1, Tool: -1, CutterCompensation: -1}
+}
+
 // Initializes the current position.
 func (s *BaseGenerator) Init() {
-	s.Position = vm.Position{State: vm.State{0, 0, 0, -1, false, false, false, false, -1, -1}}
+	s.Position = vm.Position{State: initialState()}
+}
+
+// The feedrate of inverse time mode (G93), for generators writing gcode. In
+// inverse time mode, every feed move needs an F word of its own, even with
+// the same feedrate as the previous move, so the feedrate is written with the
+// moves instead of when it changes.
+type inverseTimeFeed struct {
+	active   bool
+	feedrate float64
+}
+
+// Records the feed mode
+func (t *inverseTimeFeed) setMode(feedMode int) {
+	t.active = feedMode == vm.FeedModeInvTime
+}
+
+// Records the feedrate, returning false if not in inverse time mode, where
+// it is to be written as usual
+func (t *inverseTimeFeed) setFeedrate(feedrate float64) bool {
+	t.feedrate = feedrate
+	return t.active
+}
+
+// The F word of a move in inverse time mode, empty for rapid moves and in
+// other modes
+func (t inverseTimeFeed) word(moveMode, precision int) string {
+	if !t.active || moveMode == vm.MoveModeRapid || moveMode == vm.MoveModeNone {
+		return ""
+	}
+	return "F" + gcode.FormatFloat(t.feedrate, precision)
 }
 
 // Calls the CodeGenerator for all changed states.
-func HandlePosition(pos vm.Position, gens ...CodeGenerator) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
+func HandlePosition(pos vm.Position, gens ...CodeGenerator) error {
+	return each(gens, func(s CodeGenerator) {
+		handlePosition(s, pos)
+	})
+}
+
+func handlePosition(s CodeGenerator, pos vm.Position) {
+	cp := s.GetPosition()
+	handleState(s, pos.State)
+	if cp.A != pos.A || cp.B != pos.B || cp.C != pos.C {
+		h, ok := s.(RotaryMoveHandler)
+		if !ok {
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Rotary axes not supported by generator"))
+		}
+		h.MoveRotary(pos.X, pos.Y, pos.Z, pos.A, pos.B, pos.C, pos.State.MoveMode)
+	} else if cp.X != pos.X || cp.Y != pos.Y || cp.Z != pos.Z {
+		s.Move(pos.X, pos.Y, pos.Z, pos.State.MoveMode)
+	}
+	s.SetPosition(pos)
+}
+
+// Calls the CodeGenerator for all changed states, except for the move mode.
+// Spindle changes go to Laser instead of Spindle for a LaserHandler, and to
+// Torch for a PlasmaHandler. Lathe modes go to a LatheHandler.
+func handleState(s CodeGenerator, ns vm.State) {
+	cs := s.GetPosition().State
+
+	if ns.Tool != cs.Tool {
+		s.Toolchange(ns.Tool)
+	}
+
+	if h, ok := s.(LatheHandler); ok {
+		if ns.DiameterMode != cs.DiameterMode {
+			h.DiameterMode(ns.DiameterMode)
 		}
-	}()
-	for _, s := range gens {
-		cp := s.GetPosition()
-		cs := cp.State
-		ns := pos.State
-
-		if ns.Tool != cs.Tool {
-			s.Toolchange(ns.Tool)
+		if ns.ConstantSurfaceSpeed != cs.ConstantSurfaceSpeed ||
+			ns.ConstantSurfaceSpeed && (ns.SurfaceSpeed != cs.SurfaceSpeed || ns.MaxSpindleSpeed != cs.MaxSpindleSpeed) {
+			if ns.ConstantSurfaceSpeed {
+				h.SpindleMode(true, ns.SurfaceSpeed, ns.MaxSpindleSpeed)
+			} else {
+				h.SpindleMode(false, ns.SpindleSpeed, 0)
+			}
 		}
+	} else if ns.ConstantSurfaceSpeed {
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Constant surface speed not supported by generator"))
+	}
 
-		if ns.SpindleEnabled != cs.SpindleEnabled ||
-			ns.SpindleClockwise != cs.SpindleClockwise ||
-			ns.SpindleSpeed != cs.SpindleSpeed {
+	if ns.SpindleEnabled != cs.SpindleEnabled ||
+		ns.SpindleClockwise != cs.SpindleClockwise ||
+		ns.SpindleSpeed != cs.SpindleSpeed {
+		if l, ok := s.(LaserHandler); ok {
+			l.Laser(ns.SpindleEnabled, !ns.SpindleClockwise, ns.SpindleSpeed)
+		} else if p, ok := s.(PlasmaHandler); ok {
+			if ns.SpindleEnabled != cs.SpindleEnabled {
+				p.Torch(ns.SpindleEnabled)
+			}
+		} else {
 			s.Spindle(ns.SpindleEnabled, ns.SpindleClockwise, ns.SpindleSpeed)
 		}
+	}
 
-		if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
-			s.Coolant(ns.FloodCoolant, ns.MistCoolant)
-		}
+	if ns.FloodCoolant != cs.FloodCoolant || ns.MistCoolant != cs.MistCoolant {
+		s.Coolant(ns.FloodCoolant, ns.MistCoolant)
+	}
+
+	if ns.FeedMode != cs.FeedMode {
+		s.FeedMode(ns.FeedMode)
+	}
+
+	if ns.Feedrate != cs.Feedrate {
+		s.Feedrate(ns.Feedrate)
+	}
 
-		if ns.FeedMode != cs.FeedMode {
-			s.FeedMode(ns.FeedMode)
+	if ns.CutterCompensation != cs.CutterCompensation {
+		s.CutterCompensation(ns.CutterCompensation)
+	}
+
+	if ns.Scaling.Factors != cs.Scaling.Factors {
+		if h, ok := s.(ScalingHandler); ok {
+			h.SetScaling(ns.Scaling.Factors)
 		}
+	}
 
-		if ns.Feedrate != cs.Feedrate {
-			s.Feedrate(ns.Feedrate)
+	if ns.OverridesDisabled != cs.OverridesDisabled {
+		if h, ok := s.(OverrideHandler); ok {
+			h.Overrides(!ns.OverridesDisabled)
 		}
+	}
 
-		if ns.CutterCompensation != cs.CutterCompensation {
-			s.CutterCompensation(ns.CutterCompensation)
+	if ns.THCDisabled != cs.THCDisabled {
+		if h, ok := s.(PlasmaHandler); ok {
+			h.THC(!ns.THCDisabled)
 		}
+	}
+}
 
-		if cp.X != pos.X || cp.Y != pos.Y || cp.Z != pos.Z {
-			s.Move(pos.X, pos.Y, pos.Z, ns.MoveMode)
+// Calls the CodeGenerator for a segment. Probe, rotary and passthrough
+// segments are passed to the capabilities of the generator, see capabilities.go.
+func HandleSegment(seg vm.Segment, gens ...CodeGenerator) error {
+	return each(gens, func(s CodeGenerator) {
+		handleSegment(s, seg)
+	})
+}
+
+func handleSegment(s CodeGenerator, seg vm.Segment) {
+	if h, ok := s.(SourceCommenter); ok {
+		h.Source(seg.Line, seg.Source)
+	}
+	if h, ok := s.(AxisOffsetHandler); ok {
+		h.SetAxisOffset(seg.AxisOffset)
+	}
+
+	switch seg.Kind {
+	case vm.SegmentMove:
+		pos := positionFor(s, seg)
+		if h, ok := s.(MachineMoveHandler); ok && seg.Machine && !machineCoordinates(s) {
+			handleMachineMove(s, h, seg)
+		} else {
+			handlePosition(s, pos)
 		}
-		s.SetPosition(pos)
+	case vm.SegmentDwell, vm.SegmentProbe, vm.SegmentRotary, vm.SegmentPassthrough, vm.SegmentPause:
+		handleEvent(s, seg)
+	default:
+		panic(fmt.Sprintf("Unknown segment kind %d", seg.Kind))
 	}
-	return nil
 }
 
-// Calls HandlePosition for all positions in the vm.
+// Returns a function calling HandleSegment for the generators, for exporting
+// segments as they are produced with vm.WithStream (see vm/spill.go).
+func Stream(gens ...CodeGenerator) func(idx int, seg vm.Segment) error {
+	return func(idx int, seg vm.Segment) error {
+		return HandleSegment(seg, gens...)
+	}
+}
+
+// Ends the program for generators with ProgramEnder. Called after the last
+// segment, as generators are not told where the program ends.
+func EndProgram(gens ...CodeGenerator) error {
+	return each(gens, func(s CodeGenerator) {
+		if e, ok := s.(ProgramEnder); ok {
+			e.End()
+		}
+	})
+}
+
+// Calls HandleSegment for all segments in the vm.
 func HandleAllPositions(m *vm.Machine, gens ...CodeGenerator) error {
-	for _, x := range m.Positions {
-		if err := HandlePosition(x, gens...); err != nil {
+	return HandleAllPositionsContext(context.Background(), m, gens...)
+}
+
+// Calls HandleSegment for all segments in the vm, stopping with the context
+// error if the context is cancelled. Work offset changes are added to the warnings of the vm.
+// Multiple generators are run concurrently, see parallel.go.
+func HandleAllPositionsContext(ctx context.Context, m *vm.Machine, gens ...CodeGenerator) error {
+	if len(gens) > 1 {
+		return handleParallel(ctx, m, 0, gens)
+	}
+	return eachSegment(ctx, m, func(idx int, seg vm.Segment) error {
+		return HandleSegment(seg, gens...)
+	})
+}
+
+// Calls fn for all segments in the vm, checking the context and adding warnings
+func eachSegment(ctx context.Context, m *vm.Machine, fn func(int, vm.Segment) error) (err error) {
+	// Reading spilled segments may fail
+	defer vm.Recover(&err)
+
+	var (
+		offsetChanged bool
+		offset        vector.Vector
+	)
+	for idx, x := range m.All() {
+		if idx%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Axis offsets are set or added to positions, see capabilities.go
+		if idx == 0 {
+			offset = x.Offset.Diff(x.AxisOffset)
+		} else if !offsetChanged && x.Offset.Diff(x.AxisOffset) != offset {
+			m.Warnings.Add(warnings.StageExport, x.Line, warnings.SeverityWarning, "Work offset changed, which is only exported in machine coordinates")
+			offsetChanged = true
+		}
+		if err := fn(idx, x); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Calls HandlePosition for all generators at an index in the vm
+// Calls HandleSegment for all generators at an index in the vm. Generators
+// that did not handle the previous segment are restarted using HandleRestart.
+// Fails for spilled programs, whose segments are not all in memory.
 func HandlePositionAtIndex(m *vm.Machine, idx int, gens ...CodeGenerator) error {
-	for _, x := range gens {
-		if err := HandlePosition(m.Positions[idx], x); err != nil {
-			return err
-		}
+	if m.Spilled() {
+		return errors.New("Cannot handle a position of a spilled program by index")
 	}
-	return nil
+	return each(gens, func(x CodeGenerator) {
+		if idx > 0 && x.GetPosition() != positionFor(x, m.Segments[idx-1]) {
+			restarter(m, idx)(x)
+		}
+		handleSegment(x, m.Segments[idx])
+	})
 }
@@ -1,18 +1,131 @@
 package export
 
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
 import "github.com/joushou/gocnc/vm"
 import "fmt"
+import "strings"
+import "unicode/utf8"
+
+//
+// Grbl
+//
+// Grbl 1.1 alarms or stops on much of what other controllers accept. What
+// can be left out without changing the toolpath is stripped, such as mist
+// coolant (M7) when Grbl is built without it, feed overrides (M48/M49) and
+// tool changes. What cannot, such as cutter compensation, units per
+// revolution feed mode (G95) and rotary axes, is an error.
+//
+// Arcs and canned cycles are already expanded to lines by the vm, so neither
+// is ever exported. In laser mode ($32=1), spindle changes are laser power,
+// M4 being dynamic power, and the laser is turned off with S0 instead of M5
+// while in dynamic power mode, as M5 would stop motion to sync. Grbl turns
+// the laser off for rapid moves on its own.
+//
+
+// Capabilities of the Grbl being exported to
+type GrblSettings struct {
+	LaserMode        bool // Laser mode ($32=1)
+	MistCoolant      bool // Built with mist coolant (M7)
+	LineLimit        int  // Longest line accepted, 0 for no limit
+	ManualToolchange bool // Pause (M0) for tool changes instead of ignoring them
+}
+
+// Settings of a default build of Grbl 1.1, which accepts lines of at most 79 characters
+func DefaultGrblSettings() GrblSettings {
+	return GrblSettings{false, false, 79, false}
+}
 
 type GrblGenerator struct {
 	BaseGenerator
 	Precision      int
-	Write          func(string)
+	Lines          []string
+	Write          func(string) // Receives lines as they are generated instead of Lines, if set
 	ForceModeWrite bool
+	Settings       GrblSettings
+	axisOffset     vector.Vector // Axis offset in effect (G92)
+	laser          string        // Laser mode code in effect in laser mode, "" if off
+	power          float64       // Laser power in effect in laser mode
+	inverseTime    inverseTimeFeed
+	sourceComments
+}
+
+// Initializes the current position and laser state.
+func (s *GrblGenerator) Init() {
+	s.BaseGenerator.Init()
+	s.Lines = nil
+	s.laser, s.power = "", -1
+	s.axisOffset = vector.Vector{}
+	s.inverseTime = inverseTimeFeed{}
+	s.sourceComments.line = 0
+}
+
+// Writes a line, failing if Grbl would not accept it
+func (s *GrblGenerator) put(x string) {
+	if s.Settings.LineLimit > 0 && len(x) > s.Settings.LineLimit {
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Line %q exceeds the Grbl limit of %d characters", x, s.Settings.LineLimit))
+	}
+	if s.Write != nil {
+		s.Write(x)
+		return
+	}
+	s.Lines = append(s.Lines, x)
+}
+
+// Fetch the generated gcodes.
+func (s *GrblGenerator) Retrieve() string {
+	if len(s.Lines) == 0 {
+		return ""
+	}
+	return strings.Join(s.Lines, "\n") + "\n"
+}
+
+// Adds a comment, shortened to fit the line limit, or left out if none of it fits
+func (s *GrblGenerator) Comment(text string) {
+	text = commentText(text)
+	if limit := s.Settings.LineLimit - 2; s.Settings.LineLimit > 0 && len(text) > limit {
+		for limit > 0 && !utf8.RuneStart(text[limit]) {
+			limit--
+		}
+		if limit <= 0 {
+			return
+		}
+		text = text[:limit]
+	}
+	s.put(fmt.Sprintf("(%s)", text))
+}
+
+// Comments the output with the input line, if enabled and the line changed
+func (s *GrblGenerator) Source(line int, text string) {
+	if s.due(line) {
+		s.Comment(sourceComment(line, text))
+	}
+}
+
+// Resets units, distance mode, plane, tool length offset, canned cycles and the axis offset.
+func (s *GrblGenerator) ResetModes() {
+	s.put("G21G90G17G49G80G92.1")
+	s.axisOffset = vector.Vector{}
+	s.ForceModeWrite = true
+}
+
+// Sets the axis offset (G92 [Xn] [Yn] [Zn]), or clears it (G92.1)
+func (s *GrblGenerator) SetAxisOffset(offset vector.Vector) {
+	if offset == s.axisOffset {
+		return
+	}
+	w, pos := axisOffsetBlock(s.GetPosition(), s.axisOffset, offset, s.Precision)
+	s.put(w)
+	s.axisOffset = offset
+	s.SetPosition(pos)
 }
 
-// A no-op toolchange, as Grbl doesn't support it
+// Pauses for a manual tool change if enabled, as Grbl does not support M6
 func (s *GrblGenerator) Toolchange(t int) {
-	// TODO Implement manual tool-change
+	if s.Settings.ManualToolchange {
+		s.put(fmt.Sprintf("M0(Change to tool %d)", t))
+		s.ForceModeWrite = true
+	}
 }
 
 func (s *GrblGenerator) Spindle(enabled, clockwise bool, speed float64) {
@@ -30,46 +143,94 @@ func (s *GrblGenerator) Spindle(enabled, clockwise bool, speed float64) {
 	}
 
 	if enabled && state.SpindleSpeed != speed {
-		x += fmt.Sprintf("S%s", floatToString(speed, s.Precision))
+		x += fmt.Sprintf("S%s", gcode.FormatFloat(speed, s.Precision))
 	}
-	s.Write(x)
+	s.put(x)
 }
 
+// Sets the laser power in laser mode (M3/M4/M5 [Sn]), and the spindle otherwise
+func (s *GrblGenerator) Laser(enabled, dynamic bool, power float64) {
+	if !s.Settings.LaserMode {
+		s.Spindle(enabled, !dynamic, power)
+		return
+	}
+
+	x := ""
+	switch {
+	case !enabled && s.laser == "M4":
+		// Dynamic power is zero when not moving, so S0 keeps the laser off
+		power = 0
+	case !enabled:
+		if s.laser != "" {
+			x = "M5"
+			s.laser = ""
+			s.ForceModeWrite = true
+		}
+	case dynamic && s.laser != "M4":
+		x = "M4"
+	case !dynamic && s.laser != "M3":
+		x = "M3"
+	}
+	if enabled && x != "" {
+		s.laser = x
+		s.ForceModeWrite = true
+	}
+
+	if (enabled || s.laser != "") && power != s.power {
+		x += fmt.Sprintf("S%s", gcode.FormatFloat(power, s.Precision))
+		s.power = power
+	}
+	if x != "" {
+		s.put(x)
+	}
+}
+
+// Sets coolant (M7/M8/M9), leaving out mist coolant if not supported
 func (s *GrblGenerator) Coolant(floodCoolant, mistCoolant bool) {
+	mistCoolant = mistCoolant && s.Settings.MistCoolant
+	cs := s.Position.State
+	if floodCoolant == cs.FloodCoolant && mistCoolant == (cs.MistCoolant && s.Settings.MistCoolant) {
+		return
+	}
 	if !floodCoolant && !mistCoolant {
-		s.Write("M9")
+		s.put("M9")
 	} else {
 		if floodCoolant {
-			s.Write("M8")
+			s.put("M8")
 		}
 		if mistCoolant {
-			s.Write("M7")
+			s.put("M7")
 		}
 	}
 	s.ForceModeWrite = true
 }
 
 func (s *GrblGenerator) FeedMode(feedMode int) {
+	s.inverseTime.setMode(feedMode)
 	switch feedMode {
 	case vm.FeedModeInvTime:
-		s.Write("G93")
+		s.put("G93")
 	case vm.FeedModeUnitsMin:
-		s.Write("G94")
+		s.put("G94")
 	case vm.FeedModeUnitsRev:
-		s.Write("G95")
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Units per revolution feed mode (G95) not supported by Grbl"))
 	default:
 		panic("Unknown feed mode")
 	}
 }
 
+// Sets the feedrate (Fn), written with every feed move in inverse time mode
 func (s *GrblGenerator) Feedrate(feedrate float64) {
-	s.Write(fmt.Sprintf("F%s", floatToString(feedrate, s.Precision)))
+	if s.inverseTime.setFeedrate(feedrate) {
+		return
+	}
+	s.put(fmt.Sprintf("F%s", gcode.FormatFloat(feedrate, s.Precision)))
 }
 
-// A no-op cutter-compensation, as Grbl doesn't support it
+// Fails on cutter compensation, as Grbl doesn't support it
 func (s *GrblGenerator) CutterCompensation(cutComp int) {
 	if cutComp != vm.CutCompModeNone {
-		panic("Cutter compensation not supported by Grbl")
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Cutter compensation not supported by Grbl"))
 	}
 }
 
@@ -85,9 +246,9 @@ func (s *GrblGenerator) Move(x, y, z float64, moveMode int) {
 		case vm.MoveModeLinear:
 			w = "G1"
 		case vm.MoveModeCWArc:
-			panic("Cannot export arcs")
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Cannot export arcs"))
 		case vm.MoveModeCCWArc:
-			panic("Cannot export arcs")
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Cannot export arcs"))
 		default:
 			panic("Unknown move mode")
 		}
@@ -95,14 +256,63 @@ func (s *GrblGenerator) Move(x, y, z float64, moveMode int) {
 	s.ForceModeWrite = false
 
 	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+		w += fmt.Sprintf("X%s", gcode.FormatFloat(x, s.Precision))
 	}
 	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+		w += fmt.Sprintf("Y%s", gcode.FormatFloat(y, s.Precision))
 	}
 	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+		w += fmt.Sprintf("Z%s", gcode.FormatFloat(z, s.Precision))
 	}
+	w += s.inverseTime.word(moveMode, s.Precision)
+
+	s.put(w)
+}
 
-	s.Write(w)
+// Issues an arc in the XY plane (G2/G3 Xn Yn [Zn] In Jn)
+func (s *GrblGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	w := "G3"
+	if clockwise {
+		w = "G2"
+	}
+	w += fmt.Sprintf("X%sY%s", gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision))
+	if s.Position.Z != z {
+		w += fmt.Sprintf("Z%s", gcode.FormatFloat(z, s.Precision))
+	}
+	w += fmt.Sprintf("I%sJ%s", gcode.FormatFloat(i, s.Precision), gcode.FormatFloat(j, s.Precision))
+	w += s.inverseTime.word(vm.MoveModeLinear, s.Precision)
+	s.put(w)
+	s.ForceModeWrite = true
+}
+
+func (s *GrblGenerator) Dwell(seconds float64) {
+	s.put(fmt.Sprintf("G4P%s", gcode.FormatFloat(seconds, s.Precision)))
+}
+
+// Pauses the program (M0), or optionally (M1). Grbl has no pallet changer,
+// so pallet changes (M60) pause for the operator.
+func (s *GrblGenerator) Pause(code int) {
+	if code == 60 {
+		s.put("M0(Change pallet)")
+	} else {
+		s.put(fmt.Sprintf("M%d", code))
+	}
+}
+
+func (s *GrblGenerator) Probe(x, y, z, code float64) {
+	s.put(fmt.Sprintf("G%sX%sY%sZ%s%s", gcode.FormatFloat(code, 1),
+		gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision), gcode.FormatFloat(z, s.Precision),
+		s.inverseTime.word(vm.MoveModeLinear, s.Precision)))
+	s.ForceModeWrite = true
+}
+
+func (s *GrblGenerator) MachineMove(x, y, z float64, moveMode int) {
+	mode := "G1"
+	if moveMode == vm.MoveModeRapid {
+		mode = "G0"
+	}
+	s.put(fmt.Sprintf("G53%sX%sY%sZ%s%s", mode,
+		gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision), gcode.FormatFloat(z, s.Precision),
+		s.inverseTime.word(moveMode, s.Precision)))
+	s.ForceModeWrite = false
 }
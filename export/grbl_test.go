@@ -0,0 +1,65 @@
+package export
+
+import "strings"
+import "testing"
+import "unicode/utf8"
+
+func TestGrblCommentLimit(t *testing.T) {
+	tests := []struct {
+		limit    int
+		text     string
+		expected string // "" if left out
+	}{
+		{0, "A long comment", "(A long comment)"},
+		{79, "A long comment", "(A long comment)"},
+		{10, "A long comment", "(A long c)"},
+		{3, "A long comment", "(A)"},
+		{2, "A long comment", ""},
+		{1, "A long comment", ""},
+		{6, "Åå", "(Åå)"},
+		{5, "Ååå", "(Å)"},
+		{4, "Åå", "(Å)"},
+		{3, "Åå", ""},
+	}
+	for _, test := range tests {
+		var lines []string
+		g := &GrblGenerator{Write: func(l string) { lines = append(lines, l) }, Settings: DefaultGrblSettings()}
+		g.Settings.LineLimit = test.limit
+		g.Init()
+		if err := catch(func() { g.Comment(test.text) }); err != nil {
+			t.Errorf("%q in %d characters: %s", test.text, test.limit, err)
+			continue
+		}
+		got := strings.Join(lines, "\n")
+		if got != test.expected || !utf8.ValidString(got) {
+			t.Errorf("%q in %d characters: got %q, expected %q", test.text, test.limit, got, test.expected)
+		}
+	}
+}
+
+func TestGeneratorsWithoutWrite(t *testing.T) {
+	m := processProgram(t, "G21 G90 G0 X0 Y0 Z1\n(A comment)\nG1 Z-1 F100\nX10\nG0 Z5\n")
+	for _, name := range Generators() {
+		g, err := NewGenerator(name, 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := catch(func() {
+			g.Init()
+			if err := HandleAllPositions(m, g); err != nil {
+				panic(err)
+			}
+		}); err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		r, ok := g.(interface{ Retrieve() string })
+		if !ok {
+			t.Errorf("%s: lines cannot be retrieved", name)
+			continue
+		}
+		if !strings.Contains(r.Retrieve(), "X10") {
+			t.Errorf("%s: move missing from\n%s", name, r.Retrieve())
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "strings"
+import "unicode"
+
+//
+// LinuxCNC
+//
+// Generates RS274NGC as LinuxCNC expects it, instead of the output of
+// StringCodeGenerator, which any controller should accept:
+//
+//   path blending is set with G64 Pn, or exact path (G61)
+//   toolchanges select the tool before changing it (Tn M6), and apply the
+//   length offset of the new tool from the tool table of LinuxCNC (G43 Hn)
+//   comments are kept passive, as LinuxCNC acts on comments such as
+//   (MSG,...) and (DEBUG,...), and expands named parameters in them
+//   the program is ended with M2 by End
+//   source comments are kept passive like other comments
+//   lathe diameter mode (G7) and constant surface speed (G96 D) are kept,
+//   with X given as a diameter in diameter mode
+//
+// Positions are in tool tip coordinates (see vm/tools.go), so applying the
+// length offsets of LinuxCNC is right whether the program used G43 or not.
+//
+
+// Default path blending tolerance of LinuxCNCGenerator (mm)
+const DefaultLinuxCNCBlending = 0.01
+
+// Comments LinuxCNC acts on, by their first word
+var activeComments = map[string]bool{
+	"msg": true, "debug": true, "print": true, "abort": true,
+	"log": true, "logopen": true, "logappend": true, "logclose": true,
+	"probeopen": true, "probeclose": true, "py": true, "pyrun": true,
+}
+
+type LinuxCNCGenerator struct {
+	StringCodeGenerator
+	Blending       float64 // Path blending tolerance (G64 Pn) in mm, exact path (G61) if 0
+	NoLengthOffset bool    // Leave out applying the tool length offset after toolchanges
+	diameter       bool    // X written as diameter (G7)
+}
+
+// Initializes state, and puts in a header block.
+func (s *LinuxCNCGenerator) Init() {
+	s.Position = vm.Position{State: initialState()}
+	s.Lines = nil
+	s.axisOffset = vector.Vector{}
+	s.inverseTime = inverseTimeFeed{}
+	s.diameter = false
+	s.sourceComments.line = 0
+	s.Comment("Exported by gocnc")
+	s.ResetModes()
+	s.put("")
+}
+
+// Resets units, distance mode, plane, cutter and tool length compensation,
+// canned cycles and path blending.
+func (s *LinuxCNCGenerator) ResetModes() {
+	s.StringCodeGenerator.ResetModes()
+	if s.Blending > 0 {
+		s.put(fmt.Sprintf("G64 P%s", gcode.FormatFloat(s.Blending, s.Precision)))
+	} else {
+		s.put("G61")
+	}
+}
+
+// Adds a toolchange operation (Tn M6), followed by the tool length offset of
+// the new tool (G43 Hn), or cancelling it (G49) for tool 0.
+func (s *LinuxCNCGenerator) Toolchange(t int) {
+	s.put(fmt.Sprintf("T%d M6", t))
+	if !s.NoLengthOffset {
+		if t > 0 {
+			s.put(fmt.Sprintf("G43 H%d", t))
+		} else {
+			s.put("G49")
+		}
+	}
+	s.ForceModeWrite = true
+}
+
+// Adds a comment, which LinuxCNC will not act on
+func (s *LinuxCNCGenerator) Comment(text string) {
+	s.put(linuxCNCComment(text))
+}
+
+// Comments the output with the input line, if enabled and the line changed
+func (s *LinuxCNCGenerator) Source(line int, text string) {
+	if s.due(line) {
+		s.Comment(sourceComment(line, text))
+	}
+}
+
+// Sets lathe diameter (G7) or radius (G8) mode. The axis offset in effect is
+// rescaled, as LinuxCNC keeps it as a radius.
+func (s *LinuxCNCGenerator) DiameterMode(enabled bool) {
+	if enabled {
+		s.put("G7")
+		s.axisOffset.X *= 2
+	} else {
+		s.put("G8")
+		s.axisOffset.X /= 2
+	}
+	s.diameter = enabled
+}
+
+// Sets the axis offset (G92), with X as a diameter in diameter mode
+func (s *LinuxCNCGenerator) SetAxisOffset(offset vector.Vector) {
+	if s.diameter {
+		offset.X *= 2
+	}
+	s.StringCodeGenerator.SetAxisOffset(offset)
+}
+
+// Sets constant surface speed (G96 Sn [Dn]), or spindle speed (G97 Sn) mode
+func (s *LinuxCNCGenerator) SpindleMode(constantSurfaceSpeed bool, speed, maxSpindleSpeed float64) {
+	if !constantSurfaceSpeed {
+		s.put(fmt.Sprintf("G97 S%s", gcode.FormatFloat(speed, s.Precision)))
+		return
+	}
+	w := fmt.Sprintf("G96 S%s", gcode.FormatFloat(speed, s.Precision))
+	if maxSpindleSpeed > 0 {
+		w += fmt.Sprintf(" D%s", gcode.FormatFloat(maxSpindleSpeed, s.Precision))
+	}
+	s.put(w)
+}
+
+// Ends the program (M2). Generators are not told where the program ends, so
+// this is called by EndProgram after the last segment.
+func (s *LinuxCNCGenerator) End() {
+	s.put("M2")
+}
+
+// Makes a comment LinuxCNC will not act on. Comments starting with the word
+// of an active comment are prefixed.
+func linuxCNCComment(text string) string {
+	text = commentText(text)
+	rest := strings.TrimLeftFunc(text, unicode.IsLetter)
+	if activeComments[strings.ToLower(text[:len(text)-len(rest)])] {
+		text = "- " + text
+	}
+	return fmt.Sprintf("(%s)", text)
+}
@@ -0,0 +1,47 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+
+// Generates gcode for Mach3/Mach4, which wants the tool before M6, and a
+// diameter offset register for cutter compensation. Scaling is passed on as
+// G51 with the factors of the axes, which Mach applies about the origin.
+type MachGenerator struct {
+	StringCodeGenerator
+	tool int
+}
+
+// Adds a toolchange operation (Tn M6).
+func (s *MachGenerator) Toolchange(t int) {
+	s.put(fmt.Sprintf("T%d M6", t))
+	s.tool = t
+	s.ForceModeWrite = true
+}
+
+// Sets cutter compensation mode (G40/G41 Dn/G42 Dn), using the diameter offset of the current tool
+func (s *MachGenerator) CutterCompensation(cutComp int) {
+	switch cutComp {
+	case vm.CutCompModeNone:
+		s.put("G40")
+	case vm.CutCompModeOuter:
+		s.put(fmt.Sprintf("G41 D%d", s.tool))
+	case vm.CutCompModeInner:
+		s.put(fmt.Sprintf("G42 D%d", s.tool))
+	default:
+		panic("Unknown cutter compensation mode")
+	}
+}
+
+// Sets scaling about the origin (G51 Xn Yn Zn), or cancels it (G50)
+func (s *MachGenerator) SetScaling(factors vector.Vector) {
+	if factors == (vector.Vector{}) {
+		s.put("G50")
+		return
+	}
+	f := func(v float64) string {
+		return gcode.FormatFloat(v, s.Precision)
+	}
+	s.put(fmt.Sprintf("G51 X%s Y%s Z%s", f(factors.X), f(factors.Y), f(factors.Z)))
+}
@@ -0,0 +1,256 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "strings"
+
+//
+// Marlin
+//
+// Marlin and RepRap firmwares, as found on engravers built from 3D printers,
+// run one command per line, and have no modal motion, so every move is
+// written with its G0/G1 and the feedrate is written with the moves. G0 and
+// G1 share the feedrate, so rapids move at the last feedrate unless
+// RapidFeedrate is set. Dwells are in milliseconds.
+//
+// Coolant is mapped to a fan (M106/M107), such as for air assist, as few
+// builds have coolant control. Tool changes pause (M0), and passthrough
+// blocks of the Marlin dialect, such as heater codes (M104/M109), are passed
+// on verbatim (see vm/dialect.go).
+//
+// With LineNumbers, lines are numbered (Nn) and checksummed (*n), as when
+// sending them over serial, after resetting the line number with M110.
+//
+
+// Fan used for coolant by default
+const DefaultMarlinFan = 0
+
+type MarlinGenerator struct {
+	BaseGenerator
+	Precision     int
+	Lines         []string
+	Write         func(string) // Receives lines as they are generated instead of Lines, if set
+	LineNumbers   bool         // Number and checksum lines
+	Fan           int          // Fan turned on for coolant (M106 Pn), -1 for coolant codes (M7/M8/M9)
+	RapidFeedrate float64      // Feedrate of rapid moves (mm/min), 0 to leave it to the firmware
+	line          int          // Number of the last line written
+	feedrate      float64      // Feedrate of feed moves
+	written       float64      // Feedrate last written, -1 if none
+	sourceComments
+}
+
+// Initializes state, and puts in a header block.
+func (s *MarlinGenerator) Init() {
+	s.BaseGenerator.Init()
+	s.Lines = nil
+	s.line, s.feedrate, s.written = 0, 0, -1
+	s.sourceComments.line = 0
+	if s.LineNumbers {
+		s.write("M110 N0")
+	} else {
+		s.write("; Exported by gocnc")
+	}
+	s.ResetModes()
+}
+
+// Writes a line, numbered and checksummed if enabled
+func (s *MarlinGenerator) put(x string) {
+	if s.LineNumbers {
+		s.line++
+		x = fmt.Sprintf("N%d %s", s.line, x)
+		x = fmt.Sprintf("%s*%d", x, marlinChecksum(x))
+	}
+	s.write(x)
+}
+
+// Writes a line as it is
+func (s *MarlinGenerator) write(x string) {
+	if s.Write != nil {
+		s.Write(x)
+		return
+	}
+	s.Lines = append(s.Lines, x)
+}
+
+// Fetch the generated gcodes.
+func (s *MarlinGenerator) Retrieve() string {
+	if len(s.Lines) == 0 {
+		return ""
+	}
+	return strings.Join(s.Lines, "\n") + "\n"
+}
+
+// Adds a comment (; text). Comments are left out with LineNumbers, as they
+// are not sent over serial.
+func (s *MarlinGenerator) Comment(text string) {
+	if !s.LineNumbers {
+		s.write("; " + strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(text)))
+	}
+}
+
+// Comments the output with the input line, if enabled and the line changed
+func (s *MarlinGenerator) Source(line int, text string) {
+	if s.due(line) {
+		s.Comment(sourceComment(line, text))
+	}
+}
+
+// The checksum of a line, the exclusive or of its bytes
+func marlinChecksum(x string) int {
+	var c byte
+	for idx := 0; idx < len(x); idx++ {
+		c ^= x[idx]
+	}
+	return int(c)
+}
+
+// Resets units and distance mode.
+func (s *MarlinGenerator) ResetModes() {
+	s.put("G21")
+	s.put("G90")
+	s.written = -1
+}
+
+// Pauses for a manual tool change (M0), as Marlin does not support M6
+func (s *MarlinGenerator) Toolchange(t int) {
+	if t > 0 {
+		s.put(fmt.Sprintf("M0 Change to tool %d", t))
+	}
+}
+
+// Adds a spindle or laser operation (M3/M4 Sn/M5). The speed is only taken with M3 or M4.
+func (s *MarlinGenerator) Spindle(enabled, clockwise bool, speed float64) {
+	switch {
+	case !enabled:
+		s.put("M5")
+	case clockwise:
+		s.put(fmt.Sprintf("M3 S%s", gcode.FormatFloat(speed, s.Precision)))
+	default:
+		s.put(fmt.Sprintf("M4 S%s", gcode.FormatFloat(speed, s.Precision)))
+	}
+}
+
+// Turns the coolant fan on or off (M106 Pn S255/M107 Pn), or sets coolant
+// (M7/M8/M9) without a fan
+func (s *MarlinGenerator) Coolant(floodCoolant, mistCoolant bool) {
+	switch {
+	case s.Fan >= 0 && (floodCoolant || mistCoolant):
+		s.put(fmt.Sprintf("M106 P%d S255", s.Fan))
+	case s.Fan >= 0:
+		s.put(fmt.Sprintf("M107 P%d", s.Fan))
+	case !floodCoolant && !mistCoolant:
+		s.put("M9")
+	default:
+		if floodCoolant {
+			s.put("M8")
+		}
+		if mistCoolant {
+			s.put("M7")
+		}
+	}
+}
+
+// Fails on inverse time and units per revolution feed modes, as Marlin only has units per minute
+func (s *MarlinGenerator) FeedMode(feedMode int) {
+	if feedMode != vm.FeedModeUnitsMin {
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Only units per minute feed mode (G94) is supported by Marlin"))
+	}
+}
+
+// Sets the feedrate of the following feed moves
+func (s *MarlinGenerator) Feedrate(feedrate float64) {
+	s.feedrate = feedrate
+}
+
+// Fails on cutter compensation, as Marlin doesn't support it
+func (s *MarlinGenerator) CutterCompensation(cutComp int) {
+	if cutComp != vm.CutCompModeNone {
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Cutter compensation not supported by Marlin"))
+	}
+}
+
+// The feedrate word for a move, if the feedrate changed
+func (s *MarlinGenerator) feed(rapid bool) string {
+	f := s.feedrate
+	if rapid {
+		f = s.RapidFeedrate
+		if f <= 0 {
+			return ""
+		}
+	}
+	if f == s.written {
+		return ""
+	}
+	s.written = f
+	return fmt.Sprintf(" F%s", gcode.FormatFloat(f, s.Precision))
+}
+
+// Issues a move (G0/G1 [Xn] [Yn] [Zn] [Fn])
+func (s *MarlinGenerator) Move(x, y, z float64, moveMode int) {
+	w := ""
+	switch moveMode {
+	case vm.MoveModeNone:
+		return
+	case vm.MoveModeRapid:
+		w = "G0"
+	case vm.MoveModeLinear:
+		w = "G1"
+	case vm.MoveModeCWArc, vm.MoveModeCCWArc:
+		panic(vm.Errorf(vm.ErrUnsupportedWord, "Cannot export arcs"))
+	default:
+		panic("Unknown move mode")
+	}
+
+	pos := s.GetPosition()
+	if pos.X != x {
+		w += fmt.Sprintf(" X%s", gcode.FormatFloat(x, s.Precision))
+	}
+	if pos.Y != y {
+		w += fmt.Sprintf(" Y%s", gcode.FormatFloat(y, s.Precision))
+	}
+	if pos.Z != z {
+		w += fmt.Sprintf(" Z%s", gcode.FormatFloat(z, s.Precision))
+	}
+	s.put(w + s.feed(moveMode == vm.MoveModeRapid))
+}
+
+// Issues an arc in the XY plane (G2/G3 Xn Yn [Zn] In Jn [Fn])
+func (s *MarlinGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	w := "G3"
+	if clockwise {
+		w = "G2"
+	}
+	w += fmt.Sprintf(" X%s Y%s", gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision))
+	if s.Position.Z != z {
+		w += fmt.Sprintf(" Z%s", gcode.FormatFloat(z, s.Precision))
+	}
+	w += fmt.Sprintf(" I%s J%s", gcode.FormatFloat(i, s.Precision), gcode.FormatFloat(j, s.Precision))
+	s.put(w + s.feed(false))
+}
+
+// Adds a dwell (G4 Pn), in milliseconds
+func (s *MarlinGenerator) Dwell(seconds float64) {
+	s.put(fmt.Sprintf("G4 P%d", int(seconds*1000+0.5)))
+}
+
+// Pauses the program (M0). Marlin pauses on M1 as well, and has no pallet
+// changer, so pallet changes (M60) pause for the operator.
+func (s *MarlinGenerator) Pause(code int) {
+	if code == 60 {
+		s.put("M0 Change pallet")
+	} else {
+		s.put(fmt.Sprintf("M%d", code))
+	}
+}
+
+// Adds a probing move (G38.n Xn Yn Zn [Fn])
+func (s *MarlinGenerator) Probe(x, y, z, code float64) {
+	s.put(fmt.Sprintf("G%s X%s Y%s Z%s%s", gcode.FormatFloat(code, 1),
+		gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision), gcode.FormatFloat(z, s.Precision), s.feed(false)))
+}
+
+// Passes a block of the Marlin dialect on verbatim
+func (s *MarlinGenerator) Passthrough(text string) {
+	s.put(text)
+}
@@ -0,0 +1,89 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "sync"
+
+//
+// Parallel export
+//
+// With multiple generators, every generator runs in its own goroutine. The
+// segments are read once, and passed to all generators in shared batches,
+// which must be treated as read-only. Generators keep their own state, so
+// they must not depend on each other or on the order between them. Use
+// HandlePositionAtIndex to drive generators that do, such as a streamer
+// with helpers waiting for manual operations.
+//
+
+const exportBatchSize = 1024
+
+// Calls HandleSegment for all segments from the index, with a goroutine per generator.
+// Generators are restarted at the index using HandleRestart. A failing generator is
+// left out, while the others continue. Returns the error stopping the iteration, or
+// the errors of the failed generators as GeneratorErrors.
+func handleParallel(ctx context.Context, m *vm.Machine, start int, gens []CodeGenerator) error {
+	var (
+		wg      sync.WaitGroup
+		errs    = make([]error, len(gens))
+		chans   = make([]chan []vm.Segment, len(gens))
+		restart = restarter(m, start)
+	)
+
+	for i, g := range gens {
+		chans[i] = make(chan []vm.Segment, 4)
+		wg.Add(1)
+		go func(i int, g CodeGenerator) {
+			defer wg.Done()
+			err := catch(func() { restart(g) })
+			for batch := range chans[i] {
+				if err != nil {
+					// Drain, so the reader never blocks
+					continue
+				}
+				err = catch(func() {
+					for _, seg := range batch {
+						handleSegment(g, seg)
+					}
+				})
+			}
+			errs[i] = err
+		}(i, g)
+	}
+
+	batch := make([]vm.Segment, 0, exportBatchSize)
+	send := func() {
+		for _, c := range chans {
+			c <- batch
+		}
+		batch = make([]vm.Segment, 0, exportBatchSize)
+	}
+
+	err := eachSegment(ctx, m, func(idx int, seg vm.Segment) error {
+		if idx < start {
+			return nil
+		}
+		batch = append(batch, seg)
+		if len(batch) == exportBatchSize {
+			send()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		send()
+	}
+	for _, c := range chans {
+		close(c)
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	var failed GeneratorErrors
+	for i, e := range errs {
+		if e != nil {
+			failed = append(failed, &GeneratorError{i, gens[i], e})
+		}
+	}
+	return failed.orNil()
+}
@@ -0,0 +1,32 @@
+package export
+
+import "fmt"
+
+// Generates gcode for plasma cutters, firing the torch with M3 and controlling
+// torch height control with a digital output, as the LinuxCNC plasma configurations.
+type PlasmaGenerator struct {
+	StringCodeGenerator
+	THCOutput int // Digital output disabling torch height control, -1 to leave it out
+}
+
+// Fires or extinguishes the torch (M3/M5)
+func (s *PlasmaGenerator) Torch(on bool) {
+	if on {
+		s.put("M3")
+	} else {
+		s.put("M5")
+	}
+	s.ForceModeWrite = true
+}
+
+// Enables or disables torch height control (M63 Pn/M62 Pn)
+func (s *PlasmaGenerator) THC(enabled bool) {
+	if s.THCOutput < 0 {
+		return
+	}
+	if enabled {
+		s.put(fmt.Sprintf("M63 P%d", s.THCOutput))
+	} else {
+		s.put(fmt.Sprintf("M62 P%d", s.THCOutput))
+	}
+}
@@ -0,0 +1,94 @@
+package export
+
+import "errors"
+import "fmt"
+import "sort"
+import "sync"
+
+//
+// Generator registry
+//
+// Generators register themselves by name, so that machine-specific posts can
+// live in separate packages or plugins, and be selected at runtime.
+//
+
+// Creates a code generator writing lines of gcode through write, with the given precision
+type GeneratorFactory func(precision int, write func(string)) CodeGenerator
+
+var (
+	generatorsLock sync.RWMutex
+	generators     = make(map[string]GeneratorFactory)
+)
+
+func init() {
+	RegisterGenerator("grbl", func(precision int, write func(string)) CodeGenerator {
+		return &GrblGenerator{Precision: precision, Write: write, Settings: DefaultGrblSettings()}
+	})
+	RegisterGenerator("grbl-laser", func(precision int, write func(string)) CodeGenerator {
+		g := &GrblGenerator{Precision: precision, Write: write, Settings: DefaultGrblSettings()}
+		g.Settings.LaserMode = true
+		return g
+	})
+	RegisterGenerator("g2core", func(precision int, write func(string)) CodeGenerator {
+		g := &G2CoreGenerator{Write: write}
+		g.Precision = precision
+		return g
+	})
+	RegisterGenerator("linuxcnc", func(precision int, write func(string)) CodeGenerator {
+		g := &LinuxCNCGenerator{Blending: DefaultLinuxCNCBlending}
+		g.Precision, g.Write = precision, write
+		return g
+	})
+	RegisterGenerator("mach", func(precision int, write func(string)) CodeGenerator {
+		g := &MachGenerator{}
+		g.Precision, g.Write = precision, write
+		return g
+	})
+	RegisterGenerator("marlin", func(precision int, write func(string)) CodeGenerator {
+		return &MarlinGenerator{Precision: precision, Write: write, Fan: DefaultMarlinFan}
+	})
+	RegisterGenerator("marlin-serial", func(precision int, write func(string)) CodeGenerator {
+		return &MarlinGenerator{Precision: precision, Write: write, Fan: DefaultMarlinFan, LineNumbers: true}
+	})
+	RegisterGenerator("plasma", func(precision int, write func(string)) CodeGenerator {
+		g := &PlasmaGenerator{THCOutput: 2}
+		g.Precision, g.Write = precision, write
+		return g
+	})
+	RegisterGenerator("string", func(precision int, write func(string)) CodeGenerator {
+		return &StringCodeGenerator{Precision: precision, Write: write}
+	})
+}
+
+// Registers a code generator. Panics if the name is already taken.
+func RegisterGenerator(name string, factory GeneratorFactory) {
+	generatorsLock.Lock()
+	defer generatorsLock.Unlock()
+	if _, ok := generators[name]; ok {
+		panic(fmt.Sprintf("Code generator %s registered twice", name))
+	}
+	generators[name] = factory
+}
+
+// Creates a registered code generator. The generator still has to be initialized.
+func NewGenerator(name string, precision int, write func(string)) (CodeGenerator, error) {
+	generatorsLock.RLock()
+	factory, ok := generators[name]
+	generatorsLock.RUnlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown code generator: %s", name))
+	}
+	return factory(precision, write), nil
+}
+
+// Lists the names of all registered code generators
+func Generators() []string {
+	generatorsLock.RLock()
+	defer generatorsLock.RUnlock()
+	res := make([]string, 0, len(generators))
+	for name, _ := range generators {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,144 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "errors"
+import "math"
+
+//
+// Mid-program start
+//
+// A program can be started at any segment, such as the first segment of a
+// line (see vm.IndexOfLine). The generators are given a safe-start prologue,
+// bringing the machine from an unknown state to the state and position at the
+// end of the previous segment, after which the rest of the program follows.
+// As the machine may be left in any state, such as after a crash, the whole
+// modal state is written in the prologue, including what the generator
+// already wrote: tool, spindle, coolant, feed mode, feedrate and cutter
+// compensation, along with the modes reset by ModalResetter.
+//
+
+// Implemented by generators that can reset the modal state of the machine to
+// what the rest of the output assumes (units, distance mode, plane and offsets)
+type ModalResetter interface {
+	ResetModes()
+}
+
+// Brings the generators from an unknown machine state to the end of the segment
+// before the index, so that the segment at the index can be handled next. Modes are
+// reset, the tool is lifted to the safety height, moved above the restart point using
+// the state of the previous segment (tool, spindle, coolant and feed), and fed down to it.
+// Rotary axes are rotated to their angles at the restart point while above it.
+func HandleRestart(m *vm.Machine, idx int, gens ...CodeGenerator) error {
+	if idx <= 0 {
+		return nil
+	}
+	return each(gens, restarter(m, idx))
+}
+
+// Returns a function restarting a generator at the index, as described for HandleRestart
+func restarter(m *vm.Machine, idx int) func(CodeGenerator) {
+	if idx <= 0 {
+		return func(CodeGenerator) {}
+	}
+	return restarterWith(m, idx, *m.Segments[idx-1].State)
+}
+
+// Like restarter, but approaching the end of the previous segment in the given state
+func restarterWith(m *vm.Machine, idx int, state vm.State) func(CodeGenerator) {
+	prev := m.Segments[idx-1]
+	prev.SetState(state)
+
+	var (
+		at     = m.Segments[idx-1]
+		safety = m.FindSafetyHeight()
+		nan    = math.NaN()
+	)
+
+	// State changes without motion are not positioned, so approach the last move instead
+	for i := idx - 1; i > 0 && at.State.MoveMode == vm.MoveModeNone; i-- {
+		at = m.Segments[i-1]
+	}
+
+	rapid := prev.Modify(func(st *vm.State) {
+		st.MoveMode = vm.MoveModeRapid
+	})
+	feed := prev.Modify(func(st *vm.State) {
+		st.MoveMode = vm.MoveModeLinear
+	})
+
+	return func(x CodeGenerator) {
+		if r, ok := x.(ModalResetter); ok {
+			r.ResetModes()
+		}
+
+		// Coordinates set to NaN never match, so all axes are written
+		lift := x.GetPosition()
+		lift.Z = nan
+		x.SetPosition(lift)
+		lift.State.MoveMode = vm.MoveModeRapid
+		lift.Z = safety
+
+		a, p := positionFor(x, at), positionFor(x, prev)
+		// The approach ends feeding, which the next segment must not take for granted
+		p.State.MoveMode = vm.MoveModeLinear
+		h, setsOffset := x.(AxisOffsetHandler)
+		if setsOffset {
+			// Approached without the axis offset, which is set once there
+			a, p = withAxisOffset(a, at.AxisOffset), withAxisOffset(p, prev.AxisOffset)
+		}
+		steps := []vm.Position{
+			lift,
+			{State: *rapid.State, X: a.X, Y: a.Y, Z: safety, A: a.A, B: a.B, C: a.C},
+			{State: *feed.State, X: a.X, Y: a.Y, Z: a.Z, A: a.A, B: a.B, C: a.C},
+			p,
+		}
+		for i, pos := range steps {
+			handlePosition(x, pos)
+			if i == 0 {
+				x.SetPosition(vm.Position{State: unknownState(*rapid.State), X: nan, Y: nan, Z: safety, A: lift.A, B: lift.B, C: lift.C})
+			}
+		}
+		if setsOffset {
+			h.SetAxisOffset(prev.AxisOffset)
+		}
+	}
+}
+
+// A state differing from the given one in all modes written by the prologue,
+// so that the generators write all of them
+func unknownState(st vm.State) vm.State {
+	st.MoveMode = -1
+	st.Tool = -1
+	st.SpindleEnabled = !st.SpindleEnabled
+	st.SpindleSpeed = math.NaN()
+	st.FloodCoolant = !st.FloodCoolant
+	st.MistCoolant = !st.MistCoolant
+	st.FeedMode = -1
+	st.Feedrate = math.NaN()
+	st.CutterCompensation = -1
+	return st
+}
+
+// Exports the program from the segment index, starting with a safe-start prologue.
+// The generators must be initialized. Multiple generators are run concurrently.
+func HandleAllPositionsFrom(ctx context.Context, m *vm.Machine, idx int, gens ...CodeGenerator) error {
+	if m.Spilled() {
+		return errors.New("Cannot start in the middle of a spilled program")
+	}
+	if len(gens) > 1 {
+		return handleParallel(ctx, m, idx, gens)
+	}
+	if err := HandleRestart(m, idx, gens...); err != nil {
+		return err
+	}
+	for ; idx < len(m.Segments); idx++ {
+		if idx%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := HandleSegment(m.Segments[idx], gens...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
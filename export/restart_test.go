@@ -0,0 +1,22 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "testing"
+
+func TestSpilledByIndex(t *testing.T) {
+	program := "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nX10\nY10\nX0\nY0\nX10\nY10\nX0\nY0\nG0 Z5\n"
+	m := processProgram(t, program, vm.WithSpill(t.TempDir(), 4))
+	defer m.Close()
+	if !m.Spilled() {
+		t.Fatal("Program not spilled")
+	}
+	g := &StringCodeGenerator{Precision: 4}
+	g.Init()
+	if err := HandlePositionAtIndex(m, 2, g); err == nil {
+		t.Error("Handled a position of a spilled program by index")
+	}
+	if err := HandleAllPositionsFrom(context.Background(), m, 2, g); err == nil {
+		t.Error("Started in the middle of a spilled program")
+	}
+}
@@ -0,0 +1,201 @@
+package export
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "errors"
+import "fmt"
+import "math"
+
+//
+// Split programs
+//
+// Programs can be exported in parts, such as one per tool for machines
+// without a tool changer, where the operator changes the tool between the
+// parts. Every part is a program of its own: it starts with the safe-start
+// prologue of mid-program starts (see restart.go), bringing the machine to
+// where the previous part left it in the state of the part, with its tool
+// and spindle, and ends lifted to the safety height with the spindle and
+// coolant off.
+//
+// Programs split at tool changes, at the Z levels of the cuts, or at the
+// retracts to the safety height between operations. Parts can be exported
+// as programs of their own, or as named sections of one program, which can
+// be started at any section (see vm.IndexOfLine), as when resuming a job
+// that failed partway through.
+//
+
+// Lists the indexes of the segments changing the tool, where parts split at
+// tool changes start. Tool changes before anything moves start no part.
+func ToolSplits(m *vm.Machine) []int {
+	var (
+		res   []int
+		moved bool // Since the start of the part
+	)
+	for idx := 1; idx < len(m.Segments); idx++ {
+		seg := m.Segments[idx]
+		if seg.State.Tool != m.Segments[idx-1].State.Tool && moved {
+			res = append(res, idx)
+			moved = false
+		}
+		moved = moved || seg.Kind != vm.SegmentMove || seg.State.MoveMode != vm.MoveModeNone
+	}
+	return res
+}
+
+// Lists the indexes where parts split at Z levels start. The level of a part
+// is the Z of its horizontal cuts, and a part ends after its last horizontal
+// cut, so the next part starts with the moves to the next level, such as a
+// step-down or ramp. Parts also split at tool changes between horizontal cuts.
+func LevelSplits(m *vm.Machine) []int {
+	var (
+		res   []int
+		level = math.NaN()
+		tool  int
+		after int // Index after the last horizontal cut
+	)
+	for idx := 1; idx < len(m.Segments); idx++ {
+		prev, seg := m.Segments[idx-1], m.Segments[idx]
+		if !cutting(seg) || seg.Z != prev.Z {
+			continue
+		}
+		if seg.State.MoveMode == vm.MoveModeLinear && seg.X == prev.X && seg.Y == prev.Y {
+			continue
+		}
+		if !math.IsNaN(level) && (seg.Z != level || seg.State.Tool != tool) {
+			res = append(res, after)
+		}
+		level, tool, after = seg.Z, seg.State.Tool, idx+1
+	}
+	return res
+}
+
+// Lists the indexes where parts split at operations start, after every
+// retract to the safety height following a cut. Parts also split at tool
+// changes following a cut.
+func OperationSplits(m *vm.Machine) []int {
+	var (
+		res    []int
+		safety = m.FindSafetyHeight()
+		cut    bool // Anything yet
+		next   int  // Start of the next part, split at once it cuts
+	)
+	for idx := 1; idx < len(m.Segments); idx++ {
+		prev, seg := m.Segments[idx-1], m.Segments[idx]
+		if cut && next == 0 && (prev.Z >= safety || seg.State.Tool != prev.State.Tool) {
+			next = idx
+		}
+		if cutting(seg) {
+			if next != 0 {
+				res = append(res, next)
+				next = 0
+			}
+			cut = true
+		}
+	}
+	return res
+}
+
+// Tests if a segment is a cutting move
+func cutting(seg vm.Segment) bool {
+	if seg.Kind != vm.SegmentMove {
+		return false
+	}
+	mode := seg.State.MoveMode
+	return mode == vm.MoveModeLinear || mode == vm.MoveModeCWArc || mode == vm.MoveModeCCWArc
+}
+
+// The tool of the part from one index up to, but not including, another,
+// being that of its first cut
+func PartTool(m *vm.Machine, from, to int) int {
+	for idx := from; idx < to; idx++ {
+		if cutting(m.Segments[idx]) {
+			return m.Segments[idx].State.Tool
+		}
+	}
+	return m.Segments[to-1].State.Tool
+}
+
+// The name of the part from one index up to, but not including, another,
+// numbered from 1, with its tool and first input line
+func PartName(m *vm.Machine, n, from, to int) string {
+	line := 0
+	for idx := from; idx < to && line == 0; idx++ {
+		line = m.Segments[idx].Line
+	}
+	return fmt.Sprintf("Part %d, T%d, line %d", n, PartTool(m, from, to), line)
+}
+
+// Exports the segments from one index up to, but not including, another as a
+// program of its own. The generators must be initialized, and the program is
+// ended with EndProgram.
+func HandlePart(ctx context.Context, m *vm.Machine, from, to int, gens ...CodeGenerator) error {
+	if err := checkPart(m, from, to); err != nil {
+		return err
+	}
+	return handlePart(ctx, m, from, to, gens)
+}
+
+// Exports the parts between the bounds, the indexes where they start followed
+// by the end of the last, as sections of one program. Sections are commented
+// with their names for generators implementing Commenter, and every section
+// but the first at index 0 starts with the safe-start prologue. The
+// generators must be initialized, and the program is ended with EndProgram.
+func HandleSections(ctx context.Context, m *vm.Machine, bounds []int, gens ...CodeGenerator) error {
+	for n := 0; n+1 < len(bounds); n++ {
+		if err := checkPart(m, bounds[n], bounds[n+1]); err != nil {
+			return err
+		}
+	}
+	for n := 0; n+1 < len(bounds); n++ {
+		name := PartName(m, n+1, bounds[n], bounds[n+1])
+		err := each(gens, func(g CodeGenerator) {
+			if c, ok := g.(Commenter); ok {
+				c.Comment(name)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if err := handlePart(ctx, m, bounds[n], bounds[n+1], gens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPart(m *vm.Machine, from, to int) error {
+	if m.Spilled() {
+		return errors.New("Cannot split a spilled program")
+	}
+	if from < 0 || to > len(m.Segments) || from >= to {
+		return errors.New("Invalid part of the program")
+	}
+	return nil
+}
+
+func handlePart(ctx context.Context, m *vm.Machine, from, to int, gens []CodeGenerator) error {
+	if from > 0 {
+		if err := each(gens, restarterWith(m, from, *m.Segments[from].State)); err != nil {
+			return err
+		}
+	}
+	for idx := from; idx < to; idx++ {
+		if idx%1024 == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := HandleSegment(m.Segments[idx], gens...); err != nil {
+			return err
+		}
+	}
+
+	last := m.Segments[to-1]
+	end := last.Modify(func(st *vm.State) {
+		st.MoveMode = vm.MoveModeRapid
+		st.SpindleEnabled = false
+		st.FloodCoolant = false
+		st.MistCoolant = false
+	})
+	end.Kind = vm.SegmentMove
+	end.Z = math.Max(last.Z, m.FindSafetyHeight())
+	return HandleSegment(end, gens...)
+}
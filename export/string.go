@@ -1,32 +1,78 @@
 package export
 
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
 import "github.com/joushou/gocnc/vm"
 import "fmt"
+import "strings"
 
 type StringCodeGenerator struct {
 	BaseGenerator
 	Precision      int
 	Lines          []string
+	Write          func(string) // Receives lines as they are generated instead of Lines, if set, see writer.go
 	ForceModeWrite bool
+	axisOffset     vector.Vector // Axis offset in effect (G92)
+	inverseTime    inverseTimeFeed
+	sourceComments
 }
 
 // Initializes state, and puts in a header block.
 func (s *StringCodeGenerator) Init() {
-	s.Position = vm.Position{State: vm.State{0, 0, 0, -1, false, false, false, false, -1, -1}}
-	s.Lines = []string{"(Exported by gocnc)", "G21G90\n"}
+	s.Position = vm.Position{State: initialState()}
+	s.Lines = nil
+	s.axisOffset = vector.Vector{}
+	s.inverseTime = inverseTimeFeed{}
+	s.sourceComments.line = 0
+	s.put("(Exported by gocnc)")
+	s.put("G21G90\n")
+}
+
+// Resets units, distance mode, plane, cutter and tool length compensation,
+// canned cycles and the axis offset.
+func (s *StringCodeGenerator) ResetModes() {
+	s.put("G21G90G17G40G49G80G92.1")
+	s.axisOffset = vector.Vector{}
+	s.ForceModeWrite = true
+}
+
+// Sets the axis offset (G92 [Xn] [Yn] [Zn]), or clears it (G92.1)
+func (s *StringCodeGenerator) SetAxisOffset(offset vector.Vector) {
+	if offset == s.axisOffset {
+		return
+	}
+	w, pos := axisOffsetBlock(s.GetPosition(), s.axisOffset, offset, s.Precision)
+	s.put(w)
+	s.axisOffset = offset
+	s.SetPosition(pos)
+}
+
+// Adds a comment
+func (s *StringCodeGenerator) Comment(text string) {
+	s.put(fmt.Sprintf("(%s)", commentText(text)))
+}
+
+// Comments the output with the input line, if enabled and the line changed
+func (s *StringCodeGenerator) Source(line int, text string) {
+	if s.due(line) {
+		s.Comment(sourceComment(line, text))
+	}
 }
 
 func (s *StringCodeGenerator) put(x string) {
+	if s.Write != nil {
+		s.Write(x)
+		return
+	}
 	s.Lines = append(s.Lines, x)
 }
 
 // Fetch the generated gcodes.
 func (s *StringCodeGenerator) Retrieve() string {
-	z := ""
-	for _, x := range s.Lines {
-		z += fmt.Sprintf("%s\n", x)
+	if len(s.Lines) == 0 {
+		return ""
 	}
-	return z
+	return strings.Join(s.Lines, "\n") + "\n"
 }
 
 // Adds a toolchange operation (M6 Tn).
@@ -50,7 +96,7 @@ func (s *StringCodeGenerator) Spindle(enabled, clockwise bool, speed float64) {
 	}
 
 	if enabled && s.Position.State.SpindleSpeed != speed {
-		x += fmt.Sprintf("S%s", floatToString(speed, s.Precision))
+		x += fmt.Sprintf("S%s", gcode.FormatFloat(speed, s.Precision))
 	}
 
 	s.put(x)
@@ -73,6 +119,7 @@ func (s *StringCodeGenerator) Coolant(floodCoolant, mistCoolant bool) {
 
 // Sets feedmode (G93/G94/G95)
 func (s *StringCodeGenerator) FeedMode(feedMode int) {
+	s.inverseTime.setMode(feedMode)
 	switch feedMode {
 	case vm.FeedModeInvTime:
 		s.put("G93")
@@ -85,9 +132,12 @@ func (s *StringCodeGenerator) FeedMode(feedMode int) {
 	}
 }
 
-// Sets feedrate (Fn)
+// Sets feedrate (Fn), written with every feed move in inverse time mode
 func (s *StringCodeGenerator) Feedrate(feedrate float64) {
-	s.put(fmt.Sprintf("F%s", floatToString(feedrate, s.Precision)))
+	if s.inverseTime.setFeedrate(feedrate) {
+		return
+	}
+	s.put(fmt.Sprintf("F%s", gcode.FormatFloat(feedrate, s.Precision)))
 }
 
 // Sets cutter compensation mode (G40/G41/G42)
@@ -104,8 +154,23 @@ func (s *StringCodeGenerator) CutterCompensation(cutComp int) {
 	}
 }
 
+// Enables or disables feed and speed overrides (M48/M49)
+func (s *StringCodeGenerator) Overrides(enabled bool) {
+	if enabled {
+		s.put("M48")
+	} else {
+		s.put("M49")
+	}
+}
+
 // Issues a move ([G0/G1] [Xn] [Yn] [Zn])
 func (s *StringCodeGenerator) Move(x, y, z float64, moveMode int) {
+	pos := s.GetPosition()
+	s.MoveRotary(x, y, z, pos.A, pos.B, pos.C, moveMode)
+}
+
+// Issues a move rotating the rotary axes ([G0/G1] [Xn] [Yn] [Zn] [An] [Bn] [Cn])
+func (s *StringCodeGenerator) MoveRotary(x, y, z, a, b, c float64, moveMode int) {
 	w := ""
 	pos := s.GetPosition()
 	if pos.State.MoveMode != moveMode || s.ForceModeWrite {
@@ -117,9 +182,9 @@ func (s *StringCodeGenerator) Move(x, y, z float64, moveMode int) {
 		case vm.MoveModeLinear:
 			w = "G1"
 		case vm.MoveModeCWArc:
-			panic("Cannot export arcs")
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Cannot export arcs"))
 		case vm.MoveModeCCWArc:
-			panic("Cannot export arcs")
+			panic(vm.Errorf(vm.ErrUnsupportedWord, "Cannot export arcs"))
 		default:
 			panic("Unknown move mode")
 		}
@@ -128,14 +193,108 @@ func (s *StringCodeGenerator) Move(x, y, z float64, moveMode int) {
 	s.ForceModeWrite = false
 
 	if pos.X != x {
-		w += fmt.Sprintf("X%s", floatToString(x, s.Precision))
+		w += fmt.Sprintf("X%s", gcode.FormatFloat(x, s.Precision))
 	}
 	if pos.Y != y {
-		w += fmt.Sprintf("Y%s", floatToString(y, s.Precision))
+		w += fmt.Sprintf("Y%s", gcode.FormatFloat(y, s.Precision))
 	}
 	if pos.Z != z {
-		w += fmt.Sprintf("Z%s", floatToString(z, s.Precision))
+		w += fmt.Sprintf("Z%s", gcode.FormatFloat(z, s.Precision))
+	}
+	if pos.A != a {
+		w += fmt.Sprintf("A%s", gcode.FormatFloat(a, s.Precision))
+	}
+	if pos.B != b {
+		w += fmt.Sprintf("B%s", gcode.FormatFloat(b, s.Precision))
 	}
+	if pos.C != c {
+		w += fmt.Sprintf("C%s", gcode.FormatFloat(c, s.Precision))
+	}
+	w += s.inverseTime.word(moveMode, s.Precision)
 
 	s.put(w)
 }
+
+// Issues an arc in the XY plane (G2/G3 Xn Yn [Zn] In Jn)
+func (s *StringCodeGenerator) Arc(x, y, z, i, j float64, clockwise bool) {
+	w := "G3"
+	if clockwise {
+		w = "G2"
+	}
+	w += fmt.Sprintf("X%sY%s", gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision))
+	if s.Position.Z != z {
+		w += fmt.Sprintf("Z%s", gcode.FormatFloat(z, s.Precision))
+	}
+	w += fmt.Sprintf("I%sJ%s", gcode.FormatFloat(i, s.Precision), gcode.FormatFloat(j, s.Precision))
+	w += s.inverseTime.word(vm.MoveModeLinear, s.Precision)
+	s.put(w)
+	s.ForceModeWrite = true
+}
+
+// Adds a dwell (G4 Pn)
+func (s *StringCodeGenerator) Dwell(seconds float64) {
+	s.put(fmt.Sprintf("G4 P%s", gcode.FormatFloat(seconds, s.Precision)))
+}
+
+// Pauses the program (M0), optionally (M1), or for a pallet change (M60)
+func (s *StringCodeGenerator) Pause(code int) {
+	s.put(fmt.Sprintf("M%d", code))
+}
+
+// Adds a probing move (G38.n Xn Yn Zn)
+func (s *StringCodeGenerator) Probe(x, y, z, code float64) {
+	s.put(fmt.Sprintf("G%s X%s Y%s Z%s%s", gcode.FormatFloat(code, 1),
+		gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision), gcode.FormatFloat(z, s.Precision),
+		s.inverseTime.word(vm.MoveModeLinear, s.Precision)))
+	s.ForceModeWrite = true
+}
+
+// Rotates a rotary axis ([G0/G1] An/Bn/Cn)
+func (s *StringCodeGenerator) Rotate(axis rune, angle float64, moveMode int) {
+	w := ""
+	if s.Position.State.MoveMode != moveMode || s.ForceModeWrite {
+		switch moveMode {
+		case vm.MoveModeRapid:
+			w = "G0"
+		case vm.MoveModeLinear:
+			w = "G1"
+		default:
+			panic("Unknown move mode for rotary axis")
+		}
+	}
+	s.ForceModeWrite = false
+	s.put(fmt.Sprintf("%s%c%s%s", w, axis, gcode.FormatFloat(angle, s.Precision), s.inverseTime.word(moveMode, s.Precision)))
+}
+
+// Moves in machine coordinates (G53 [G0/G1] Xn Yn Zn)
+func (s *StringCodeGenerator) MachineMove(x, y, z float64, moveMode int) {
+	mode := "G1"
+	if moveMode == vm.MoveModeRapid {
+		mode = "G0"
+	}
+	s.put(fmt.Sprintf("G53 %s X%s Y%s Z%s%s", mode,
+		gcode.FormatFloat(x, s.Precision), gcode.FormatFloat(y, s.Precision), gcode.FormatFloat(z, s.Precision),
+		s.inverseTime.word(moveMode, s.Precision)))
+	s.ForceModeWrite = false
+}
+
+// The block changing the axis offset from old to new, and the position in the
+// new coordinates. G92 sets the axes whose offset changed, giving the current
+// position in the new coordinates, and G92.1 clears the offset.
+func axisOffsetBlock(pos vm.Position, old, new vector.Vector, precision int) (string, vm.Position) {
+	pos = withAxisOffset(pos, old.Diff(new))
+	if new == (vector.Vector{}) {
+		return "G92.1", pos
+	}
+	w := "G92"
+	if old.X != new.X {
+		w += fmt.Sprintf("X%s", gcode.FormatFloat(pos.X, precision))
+	}
+	if old.Y != new.Y {
+		w += fmt.Sprintf("Y%s", gcode.FormatFloat(pos.Y, precision))
+	}
+	if old.Z != new.Z {
+		w += fmt.Sprintf("Z%s", gcode.FormatFloat(pos.Z, precision))
+	}
+	return w, pos
+}
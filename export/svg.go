@@ -0,0 +1,158 @@
+package export
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "fmt"
+import "math"
+import "strings"
+
+// Renders the XY projection of the toolpath as an SVG image, for previews.
+// Rapid moves are drawn dashed in red, and cutting moves in blue, shaded by
+// depth with DepthColors, from light at the highest cut to dark at the deepest.
+// With ToolLayers, the moves of every tool are grouped in a layer, which can
+// be toggled in editors such as Inkscape.
+type SVGGenerator struct {
+	BaseGenerator
+	Precision     int
+	MachineCoords bool // Draw in machine coordinates, for programs using several work offsets
+	DepthColors   bool // Shade cutting moves by the depth of their end
+	ToolLayers    bool // Group moves in a layer per tool
+	paths         []svgPath
+	tool          int
+	min, max      [2]float64
+}
+
+// A polyline of moves with the same move mode, tool and, with DepthColors, depth
+type svgPath struct {
+	rapid  bool
+	tool   int
+	z      float64
+	points [][2]float64
+}
+
+func (s *SVGGenerator) Init() {
+	s.BaseGenerator.Init()
+	s.paths = nil
+	s.tool = 0
+	s.min = [2]float64{math.Inf(1), math.Inf(1)}
+	s.max = [2]float64{math.Inf(-1), math.Inf(-1)}
+}
+
+func (s *SVGGenerator) MachineCoordinates() bool {
+	return s.MachineCoords
+}
+
+func (s *SVGGenerator) Toolchange(tool int) {
+	s.tool = tool
+}
+
+func (s *SVGGenerator) include(x, y float64) {
+	s.min = [2]float64{math.Min(s.min[0], x), math.Min(s.min[1], y)}
+	s.max = [2]float64{math.Max(s.max[0], x), math.Max(s.max[1], y)}
+}
+
+func (s *SVGGenerator) Move(x, y, z float64, moveMode int) {
+	if moveMode == vm.MoveModeNone {
+		return
+	}
+
+	pos := s.GetPosition()
+	if pos.X == x && pos.Y == y {
+		// Not visible from above
+		return
+	}
+
+	rapid := moveMode == vm.MoveModeRapid
+	if !s.DepthColors || rapid {
+		z = 0
+	}
+	if n := len(s.paths); n == 0 || s.paths[n-1].rapid != rapid || s.paths[n-1].tool != s.tool || s.paths[n-1].z != z {
+		s.paths = append(s.paths, svgPath{rapid, s.tool, z, [][2]float64{{pos.X, pos.Y}}})
+		s.include(pos.X, pos.Y)
+	}
+
+	p := &s.paths[len(s.paths)-1]
+	p.points = append(p.points, [2]float64{x, y})
+	s.include(x, y)
+}
+
+// Fetch the generated SVG image
+func (s *SVGGenerator) Retrieve() string {
+	f := func(v float64) string {
+		return gcode.FormatFloat(v, s.Precision)
+	}
+
+	min, max := s.min, s.max
+	if len(s.paths) == 0 {
+		min, max = [2]float64{0, 0}, [2]float64{0, 0}
+	}
+	margin := math.Max(1, math.Max(max[0]-min[0], max[1]-min[1])*0.02)
+	w, h := max[0]-min[0]+2*margin, max[1]-min[1]+2*margin
+	stroke := math.Max(w, h) / 500
+
+	var b strings.Builder
+	ns := ""
+	if s.ToolLayers {
+		ns = ` xmlns:inkscape="http://www.inkscape.org/namespaces/inkscape"`
+	}
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg"%s viewBox="%s %s %s %s">`+"\n",
+		ns, f(min[0]-margin), f(-max[1]-margin), f(w), f(h))
+
+	// Flip the Y axis, as SVG has it pointing down. Layers must be top-level
+	// groups, so each is flipped on its own.
+	group := fmt.Sprintf(`transform="scale(1,-1)" fill="none" stroke-width="%s"`, f(stroke))
+	if !s.ToolLayers {
+		fmt.Fprintf(&b, "<g %s>\n", group)
+		s.writePaths(&b, s.paths, stroke)
+		b.WriteString("</g>\n")
+	} else {
+		var (
+			tools  []int
+			byTool = make(map[int][]svgPath)
+		)
+		for _, p := range s.paths {
+			if _, ok := byTool[p.tool]; !ok {
+				tools = append(tools, p.tool)
+			}
+			byTool[p.tool] = append(byTool[p.tool], p)
+		}
+		for _, t := range tools {
+			fmt.Fprintf(&b, `<g id="tool-%d" inkscape:groupmode="layer" inkscape:label="Tool %d" %s>`+"\n", t, t, group)
+			s.writePaths(&b, byTool[t], stroke)
+			b.WriteString("</g>\n")
+		}
+	}
+	b.WriteString("</svg>\n")
+	return b.String()
+}
+
+// Writes the paths as polylines
+func (s *SVGGenerator) writePaths(b *strings.Builder, paths []svgPath, stroke float64) {
+	f := func(v float64) string {
+		return gcode.FormatFloat(v, s.Precision)
+	}
+
+	// Depths of the cuts, for shading
+	top, bottom := math.Inf(-1), math.Inf(1)
+	for _, p := range s.paths {
+		if !p.rapid {
+			top, bottom = math.Max(top, p.z), math.Min(bottom, p.z)
+		}
+	}
+
+	for _, p := range paths {
+		pts := make([]string, len(p.points))
+		for idx, pt := range p.points {
+			pts[idx] = f(pt[0]) + "," + f(pt[1])
+		}
+		style := `stroke="blue"`
+		switch {
+		case p.rapid:
+			style = fmt.Sprintf(`stroke="red" stroke-dasharray="%s"`, f(stroke*4))
+		case s.DepthColors && top > bottom:
+			lightness := 70 - 45*(top-p.z)/(top-bottom)
+			style = fmt.Sprintf(`stroke="hsl(220,90%%,%.0f%%)"`, lightness)
+		}
+		fmt.Fprintf(b, `<polyline %s points="%s"/>`+"\n", style, strings.Join(pts, " "))
+	}
+}
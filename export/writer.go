@@ -0,0 +1,72 @@
+package export
+
+import "bufio"
+import "io"
+
+//
+// Writers
+//
+// Generators write lines through a function as they handle segments, so
+// programs can be written out while they are exported, instead of collected
+// in memory. A LineWriter passes the lines to an io.Writer, buffered:
+//
+//   w := export.NewLineWriter(f)
+//   g, _ := export.NewGenerator("grbl", 4, w.WriteLine)
+//   g.Init()
+//   if err := export.HandleAllPositions(m, g); err != nil {
+//       ...
+//   }
+//   err := w.Flush()
+//
+// Write errors panic, so that they stop the export and are returned by the
+// handling functions like other generator errors.
+//
+
+// Size of the buffer of a LineWriter
+const DefaultLineWriterBuffer = 64 * 1024
+
+// Writes lines to an io.Writer
+type LineWriter struct {
+	Progress func(lines int, bytes int64) // Called after every flush of the buffer, if set
+	w        *bufio.Writer
+	lines    int
+	bytes    int64
+}
+
+// Creates a line writer with a buffer of DefaultLineWriterBuffer
+func NewLineWriter(w io.Writer) *LineWriter {
+	return &LineWriter{w: bufio.NewWriterSize(w, DefaultLineWriterBuffer)}
+}
+
+// Writes a line, flushing the buffer first if the line does not fit
+func (l *LineWriter) WriteLine(line string) {
+	if l.w.Available() < len(line)+1 && l.w.Buffered() > 0 {
+		if err := l.Flush(); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := l.w.WriteString(line); err != nil {
+		panic(err)
+	}
+	if err := l.w.WriteByte('\n'); err != nil {
+		panic(err)
+	}
+	l.lines++
+	l.bytes += int64(len(line) + 1)
+}
+
+// Writes out the buffered lines
+func (l *LineWriter) Flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.Progress != nil {
+		l.Progress(l.lines, l.bytes)
+	}
+	return nil
+}
+
+// The number of lines and bytes written
+func (l *LineWriter) Written() (lines int, bytes int64) {
+	return l.lines, l.bytes
+}
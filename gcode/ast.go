@@ -1,6 +1,6 @@
 package gcode
 
-import "strconv"
+import "github.com/joushou/gocnc/warnings"
 import "strings"
 import "errors"
 import "fmt"
@@ -40,19 +40,7 @@ func (w *Word) GetType() string {
 
 // Exports the word as-is, using the given floating point precision.
 func (w *Word) Export(precision int) string {
-	x := strconv.FormatFloat(w.Command, 'f', precision, 64)
-
-	// Hacky way to remove silly zeroes
-	if strings.IndexRune(x, '.') != -1 {
-		for x[len(x)-1] == '0' {
-			x = x[:len(x)-1]
-		}
-		if x[len(x)-1] == '.' {
-			x = x[:len(x)-1]
-		}
-	}
-
-	return string(w.Address) + x
+	return string(w.Address) + FormatFloat(w.Command, precision)
 }
 
 func (c *Comment) GetType() string {
@@ -81,10 +69,13 @@ func (f *Filemarker) Export(precision int) string {
 // Block type
 //
 
-// A block, which is a slice of Nodes.
+// A block, which is a slice of Nodes. Blocks read by a Scanner hold the
+// number and text of their line, so results can be traced back to the input.
 type Block struct {
 	Nodes       []Node
 	BlockDelete bool
+	Line        int    // Line of the block, starting at 1, 0 if not parsed
+	Source      string // Text of the line, without the line ending
 }
 
 // Append a node to the block.
@@ -187,7 +178,8 @@ func (s *Block) HasWord(address rune, command float64) (res bool) {
 
 // A document, which is a slice of Blocks.
 type Document struct {
-	Blocks []Block
+	Blocks   []Block
+	Warnings warnings.Warnings
 }
 
 // Append a block to the document.
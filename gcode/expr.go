@@ -0,0 +1,314 @@
+package gcode
+
+import "errors"
+import "fmt"
+import "strconv"
+import "strings"
+
+//
+// Expressions and parameters
+//
+// Word values and parameter assignments can be expressions (LinuxCNC/Fanuc
+// style), which are kept unevaluated in the AST, as their values depend on
+// the parameters when executing. The vm evaluates them.
+//
+//   #1 = 10                   numbered parameter
+//   #<depth> = [#1 / 4]       named parameter (case and spaces ignored)
+//   G1 X[#1 * 2] Z-#<depth>   expressions as word values
+//   G1 Y#[#1 + 1]             indirect parameter
+//   G1 X[COS[30] * #1]        functions, in degrees
+//
+// Binary operators are only allowed within brackets. By precedence:
+//
+//   **
+//   *  /  MOD
+//   +  -
+//   EQ  NE  GT  GE  LT  LE
+//   AND  OR  XOR
+//
+// Functions take a bracketed argument: ABS, ACOS, ASIN, COS, EXP, FIX, FUP,
+// ROUND, LN, SIN, SQRT and TAN, as well as ATAN[y]/[x] and EXISTS[#<name>].
+//
+
+// A numeric expression
+type Expr interface {
+	Export(precision int) string
+}
+
+// A number
+type Number float64
+
+// A parameter, either numbered (#100 or #[expression]) or named (#<name>)
+type Parameter struct {
+	Index Expr   // Nil for named parameters
+	Name  string // Lower-case, without spaces
+}
+
+// A unary operator or function, such as -, ABS or COS
+type Unary struct {
+	Op string
+	X  Expr
+}
+
+// A binary operator, or ATAN, with its arguments Y and X
+type Binary struct {
+	Op   string
+	X, Y Expr
+}
+
+// A word with an expression as value, such as X[#1 + 2]
+type ExprWord struct {
+	Address rune
+	Value   Expr
+}
+
+// A parameter assignment (Such as "#1=10")
+type Assignment struct {
+	Param Parameter
+	Value Expr
+}
+
+func (n Number) Export(precision int) string {
+	return FormatFloat(float64(n), precision)
+}
+
+func (p *Parameter) Export(precision int) string {
+	if p.Index == nil {
+		return "#<" + p.Name + ">"
+	}
+	return "#" + p.Index.Export(precision)
+}
+
+func (u *Unary) Export(precision int) string {
+	switch u.Op {
+	case "-", "+":
+		return u.Op + u.X.Export(precision)
+	case "EXISTS":
+		return "EXISTS[" + u.X.Export(precision) + "]"
+	}
+	return u.Op + bracket(u.X, precision)
+}
+
+func (b *Binary) Export(precision int) string {
+	if b.Op == "ATAN" {
+		return "ATAN" + bracket(b.X, precision) + "/" + bracket(b.Y, precision)
+	}
+	op := b.Op
+	if op[0] >= 'A' && op[0] <= 'Z' {
+		op = " " + op + " "
+	}
+	return "[" + b.X.Export(precision) + op + b.Y.Export(precision) + "]"
+}
+
+// Exports an expression within brackets, which binary expressions already have
+func bracket(e Expr, precision int) string {
+	if b, ok := e.(*Binary); ok && b.Op != "ATAN" {
+		return e.Export(precision)
+	}
+	return "[" + e.Export(precision) + "]"
+}
+
+func (w *ExprWord) GetType() string {
+	return "exprword"
+}
+
+// Exports the word with its expression, using the given floating point precision.
+func (w *ExprWord) Export(precision int) string {
+	return string(w.Address) + w.Value.Export(precision)
+}
+
+func (a *Assignment) GetType() string {
+	return "assignment"
+}
+
+// Exports the assignment, using the given floating point precision.
+func (a *Assignment) Export(precision int) string {
+	return a.Param.Export(precision) + "=" + a.Value.Export(precision)
+}
+
+//
+// Parsing
+//
+
+// Unary functions
+var functions = []string{"ABS", "ACOS", "ASIN", "ATAN", "COS", "EXISTS", "EXP", "FIX", "FUP", "ROUND", "LN", "SIN", "SQRT", "TAN"}
+
+// Binary operators by precedence, highest first
+var operators = [][]string{
+	{"**"},
+	{"*", "/", "MOD"},
+	{"+", "-"},
+	{"EQ", "NE", "GT", "GE", "LT", "LE"},
+	{"AND", "OR", "XOR"},
+}
+
+// Parses expressions from a line
+type exprParser struct {
+	text string
+	pos  int
+}
+
+type exprError string
+
+// Parses a value (a number, parameter, function or bracketed expression, with
+// an optional sign) at pos, returning it and the position after it
+func parseValue(text string, pos int) (e Expr, end int, err error) {
+	p := exprParser{text, pos}
+	defer p.recover(&end, &err)
+	return p.value(), p.pos, nil
+}
+
+// Parses an assignment at pos, returning it and the position after it
+func parseAssignment(text string, pos int) (a *Assignment, end int, err error) {
+	p := exprParser{text, pos}
+	defer p.recover(&end, &err)
+	param, ok := p.value().(*Parameter)
+	if !ok {
+		p.fail("Expected parameter")
+	}
+	p.expect("=")
+	return &Assignment{*param, p.value()}, p.pos, nil
+}
+
+// Tests if a function call starts at pos
+func functionAt(text string, pos int) bool {
+	p := exprParser{text, pos}
+	return p.function() != ""
+}
+
+// Recovers a failure as an error at the position of the failure, to be deferred
+func (p *exprParser) recover(end *int, err *error) {
+	if r := recover(); r != nil {
+		msg, ok := r.(exprError)
+		if !ok {
+			panic(r)
+		}
+		*end, *err = p.pos, errors.New(string(msg))
+	}
+}
+
+func (p *exprParser) fail(format string, args ...interface{}) {
+	panic(exprError(fmt.Sprintf(format, args...)))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// Consumes the given token, ignoring case, if it is next
+func (p *exprParser) accept(token string) bool {
+	p.skipSpace()
+	if len(p.text)-p.pos >= len(token) && strings.EqualFold(p.text[p.pos:p.pos+len(token)], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(token string) {
+	if !p.accept(token) {
+		p.fail("Expected %s", token)
+	}
+}
+
+// Consumes a function name followed by a bracket, returning the name
+func (p *exprParser) function() string {
+	start := p.pos
+	for _, f := range functions {
+		p.pos = start
+		if p.accept(f) && p.accept("[") {
+			p.pos -= 1
+			return f
+		}
+	}
+	p.pos = start
+	return ""
+}
+
+// Parses an expression with operators of the given precedence level or higher
+func (p *exprParser) expr(level int) Expr {
+	if level < 0 {
+		return p.value()
+	}
+	x := p.expr(level - 1)
+	for {
+		op := ""
+		for _, o := range operators[level] {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return x
+		}
+		x = &Binary{op, x, p.expr(level - 1)}
+	}
+}
+
+// Parses a bracketed expression
+func (p *exprParser) bracketed() Expr {
+	p.expect("[")
+	e := p.expr(len(operators) - 1)
+	p.expect("]")
+	return e
+}
+
+func (p *exprParser) value() Expr {
+	p.skipSpace()
+	switch {
+	case p.accept("-"):
+		return &Unary{"-", p.value()}
+	case p.accept("+"):
+		return &Unary{"+", p.value()}
+	case p.accept("#"):
+		if p.accept("<") {
+			end := strings.IndexByte(p.text[p.pos:], '>')
+			if end < 0 {
+				p.fail("Unterminated parameter name")
+			}
+			name := strings.ToLower(strings.Replace(p.text[p.pos:p.pos+end], " ", "", -1))
+			if name == "" {
+				p.fail("Empty parameter name")
+			}
+			p.pos += end + 1
+			return &Parameter{nil, name}
+		}
+		return &Parameter{p.value(), ""}
+	case p.pos < len(p.text) && p.text[p.pos] == '[':
+		return p.bracketed()
+	}
+
+	switch f := p.function(); f {
+	case "":
+	case "ATAN":
+		y := p.bracketed()
+		p.expect("/")
+		return &Binary{"ATAN", y, p.bracketed()}
+	case "EXISTS":
+		p.expect("[")
+		x := p.value()
+		if param, ok := x.(*Parameter); !ok || param.Index != nil {
+			p.fail("EXISTS requires a named parameter")
+		}
+		p.expect("]")
+		return &Unary{"EXISTS", x}
+	default:
+		return &Unary{f, p.bracketed()}
+	}
+
+	start := p.pos
+	for p.pos < len(p.text) && (p.text[p.pos] >= '0' && p.text[p.pos] <= '9' || p.text[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		p.fail("Expected value")
+	}
+	f, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+	if err != nil {
+		p.fail("Invalid number %q", p.text[start:p.pos])
+	}
+	return Number(f)
+}
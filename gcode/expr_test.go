@@ -0,0 +1,78 @@
+package gcode
+
+import "testing"
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected string // Exported with brackets around every operator
+	}{
+		{"[1+2*3]", "[1+[2*3]]"},
+		{"[[1+2]*3]", "[[1+2]*3]"},
+		{"[1-2-3]", "[[1-2]-3]"},
+		{"[2*3**2]", "[2*[3**2]]"},
+		{"[10 mod 3 + 1]", "[[10 MOD 3]+1]"},
+		{"[1+2 LT 4 AND 1]", "[[[1+2] LT 4] AND 1]"},
+		{"[ 1 + 2 ]", "[1+2]"},
+		{"-[1+2]", "-[1+2]"},
+		{"--1", "--1"},
+		{"1.5", "1.5"},
+		{"#1", "#1"},
+		{"#[#1+1]", "#[#1+1]"},
+		{"##2", "##2"},
+		{"#<Depth Of Cut>", "#<depthofcut>"},
+		{"cos[30]", "COS[30]"},
+		{"ABS[-2]", "ABS[-2]"},
+		{"SQRT[[1+3]]", "SQRT[1+3]"},
+		{"ATAN[1]/[2]", "ATAN[1]/[2]"},
+		{"EXISTS[#<x>]", "EXISTS[#<x>]"},
+	}
+	for _, test := range tests {
+		e, end, err := parseValue(test.text+"X1", 0)
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+			continue
+		}
+		if s := e.Export(4); s != test.expected {
+			t.Errorf("%q: parsed as %q, expected %q", test.text, s, test.expected)
+		}
+		if end != len(test.text) {
+			t.Errorf("%q: ended at %d, expected %d", test.text, end, len(test.text))
+		}
+	}
+}
+
+func TestParseValueErrors(t *testing.T) {
+	for _, text := range []string{"", "X", "[1+2", "[1+]", "[1 2]", "1+2", "#<x", "#<>", "EXISTS[#1]", "ATAN[1]", "COS 30", "1.2.3"} {
+		if e, end, err := parseValue(text, 0); err == nil && end == len(text) {
+			t.Errorf("%q: parsed as %q", text, e.Export(4))
+		}
+	}
+}
+
+func TestParseAssignment(t *testing.T) {
+	tests := []struct {
+		text, expected string
+	}{
+		{"#1=10", "#1=10"},
+		{"#1 = [#2 * 2]", "#1=[#2*2]"},
+		{"#<x>=-1", "#<x>=-1"},
+		{"#[#1+1]=#1", "#[#1+1]=#1"},
+	}
+	for _, test := range tests {
+		a, _, err := parseAssignment(test.text, 0)
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+			continue
+		}
+		if s := a.Export(4); s != test.expected {
+			t.Errorf("%q: parsed as %q, expected %q", test.text, s, test.expected)
+		}
+	}
+
+	for _, text := range []string{"1=10", "#1 10", "#1="} {
+		if _, _, err := parseAssignment(text, 0); err == nil {
+			t.Errorf("%q: parsed an invalid assignment", text)
+		}
+	}
+}
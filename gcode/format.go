@@ -0,0 +1,43 @@
+package gcode
+
+import "math"
+import "strconv"
+import "strings"
+
+//
+// Number formatting
+//
+// Numbers in exported gcode must never depend on the locale, use exponents or
+// come out as "-0". All exporters should format numbers with these helpers.
+//
+
+// Options for formatting numbers
+type FloatFormat struct {
+	Decimals int  // Digits after the decimal point, -1 for as many as needed
+	Trim     bool // Remove trailing zeroes, and the decimal point if nothing follows
+}
+
+// Formats a number. NaN and infinities have no gcode representation, and cause a panic.
+func (f FloatFormat) Format(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		panic("Cannot format " + strconv.FormatFloat(v, 'g', -1, 64))
+	}
+
+	x := strconv.FormatFloat(v, 'f', f.Decimals, 64)
+	if f.Trim && strings.IndexByte(x, '.') != -1 {
+		x = strings.TrimRight(x, "0")
+		x = strings.TrimSuffix(x, ".")
+	}
+
+	// Negative zero, or a negative number rounded to zero
+	if x[0] == '-' && strings.Trim(x[1:], "0.") == "" {
+		x = x[1:]
+	}
+	return x
+}
+
+// Formats a number with at most the given number of decimals, trimming trailing
+// zeroes. Negative decimals use as many as needed.
+func FormatFloat(v float64, decimals int) string {
+	return FloatFormat{decimals, true}.Format(v)
+}
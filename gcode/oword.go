@@ -0,0 +1,114 @@
+package gcode
+
+import "errors"
+import "strings"
+
+//
+// O-words
+//
+// Flow control (LinuxCNC style) is written with O-words, naming the construct
+// with a number or a <name>, followed by a keyword and its arguments:
+//
+//   o100 sub                  o101 if [#1 GT 0]        o102 while [#1 LT 10]
+//     ...                       ...                      ...
+//   o100 endsub               o101 elseif [#1 EQ 0]    o102 endwhile
+//   o100 call [1] [2]           ...
+//                             o101 else                o103 do
+//   o104 repeat [5]             ...                      ...
+//     ...                     o101 endif               o103 while [#1 LT 10]
+//   o104 endrepeat
+//
+// Inside loops, "break" and "continue" use the name of the loop, and inside
+// subroutines, "return" the name of the subroutine. O-words without a keyword,
+// such as Fanuc program numbers (O1000), are kept as plain words.
+//
+
+// Keywords of O-words
+var keywords = []string{"sub", "endsub", "return", "call", "if", "elseif", "else", "endif",
+	"while", "endwhile", "do", "repeat", "endrepeat", "break", "continue"}
+
+// A flow control word (Such as "o100 call [1]")
+type OWord struct {
+	Name    string // Number, or <name> in lower-case without spaces
+	Keyword string // Lower-case
+	Args    []Expr // Bracketed arguments
+}
+
+func (o *OWord) GetType() string {
+	return "oword"
+}
+
+// Exports the O-word with its arguments, using the given floating point precision.
+func (o *OWord) Export(precision int) string {
+	x := "O" + o.Name + " " + o.Keyword
+	for _, a := range o.Args {
+		x += " " + bracket(a, precision)
+	}
+	return x
+}
+
+// Parses an O-word with a keyword at pos, returning it and the position after
+// it. Returns nil if the O-word has no keyword.
+func parseOWord(text string, pos int) (o *OWord, end int, err error) {
+	p := exprParser{text, pos}
+	defer p.recover(&end, &err)
+	p.expect("O")
+
+	var name string
+	if p.accept("<") {
+		end := strings.IndexByte(p.text[p.pos:], '>')
+		if end < 0 {
+			p.fail("Unterminated O-word name")
+		}
+		name = "<" + strings.ToLower(strings.Replace(p.text[p.pos:p.pos+end], " ", "", -1)) + ">"
+		p.pos += end + 1
+	} else {
+		start := p.pos
+		for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+			p.pos++
+		}
+		if start == p.pos {
+			p.fail("Expected O-word number or name")
+		}
+		name = p.text[start:p.pos]
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.text) && (p.text[p.pos] >= 'a' && p.text[p.pos] <= 'z' || p.text[p.pos] >= 'A' && p.text[p.pos] <= 'Z') {
+		p.pos++
+	}
+	keyword := strings.ToLower(p.text[start:p.pos])
+	if len(keyword) < 2 {
+		// No keyword, or the address of the next word
+		return nil, pos, nil
+	}
+	known := false
+	for _, k := range keywords {
+		known = known || k == keyword
+	}
+	if !known {
+		p.pos = start
+		p.fail("Unknown O-word keyword %q", keyword)
+	}
+
+	o = &OWord{name, keyword, nil}
+	for p.skipSpace(); p.pos < len(p.text) && p.text[p.pos] == '['; p.skipSpace() {
+		o.Args = append(o.Args, p.bracketed())
+	}
+	return o, p.pos, nil
+}
+
+// Finds the O-word of a block, if any
+func (s *Block) GetOWord() (*OWord, error) {
+	var res *OWord
+	for _, m := range s.Nodes {
+		if o, ok := m.(*OWord); ok {
+			if res != nil {
+				return nil, errors.New("Multiple O-words in block")
+			}
+			res = o
+		}
+	}
+	return res, nil
+}
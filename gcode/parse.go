@@ -1,143 +1,340 @@
 package gcode
 
+import "github.com/joushou/gocnc/warnings"
+import "bufio"
+import "context"
 import "fmt"
 import "errors"
+import "io"
 import "strconv"
+import "strings"
+
+// Parser options for dialect differences.
+type Options struct {
+	// Terminate unclosed parenthesis comments at the end of the line (Mach3/Mach4),
+	// instead of failing.
+	UnterminatedComments bool
+
+	// Skip lines that cannot be parsed, adding a warning for each, instead of
+	// failing. Skipped lines are kept as empty blocks, so line numbers stay valid.
+	Tolerant bool
+}
 
 // Parses a string, and returns an AST.
 func Parse(input string) (doc *Document, err error) {
+	return ParseWithOptions(input, Options{})
+}
 
-	const (
-		normal     = iota
-		comment    = iota
-		eolcomment = iota
-		word       = iota
-	)
+// Parses a string with the given options, and returns an AST.
+func ParseWithOptions(input string, opts Options) (doc *Document, err error) {
+	return ParseContext(context.Background(), input, opts)
+}
 
-	var (
-		document    Document
-		curBlock    Block = Block{}
-		state       int   = normal
-		lastNewline int   = 0
-		buffer      string
-		address     rune
-	)
+// Parses a string with the given options, and returns an AST. Stops with the
+// context error if the context is cancelled.
+func ParseContext(ctx context.Context, input string, opts Options) (doc *Document, err error) {
+	return ParseReader(ctx, strings.NewReader(input), opts)
+}
 
-	input += "\n"
+// Reads and parses gcode with the given options, and returns an AST. Stops
+// with the context error if the context is cancelled.
+func ParseReader(ctx context.Context, r io.Reader, opts Options) (*Document, error) {
+	var document Document
+	s := NewScanner(r, opts)
+	for s.Scan() {
+		document.AppendBlock(s.Block())
+		document.Warnings = append(document.Warnings, s.Warnings()...)
+		if s.Line()%1024 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+//
+// Streaming
+//
+// A Scanner parses one line at a time, so documents of any size can be
+// processed without holding them in memory:
+//
+//   s := gcode.NewScanner(r, opts)
+//   for s.Scan() {
+//       process(s.Line(), s.Block())
+//   }
+//   if err := s.Err(); err != nil {
+//       ...
+//   }
+//
+// Every line is a block, including empty lines and the (possibly empty) text
+// after the last newline, so line numbers are the same as block numbers.
+//
+
+// Parser states
+const (
+	normal     = iota
+	comment    = iota
+	eolcomment = iota
+	word       = iota
+	skip       = iota
+)
+
+// Reads blocks one at a time from a reader.
+type Scanner struct {
+	r    *bufio.Reader
+	opts Options
+	done bool
+	err  error
+
+	line     int
+	block    Block
+	warnings warnings.Warnings
+
+	state   int
+	buffer  string
+	address rune
+	text    string // Line being parsed
+	next    int    // Position to continue at, after expressions
+}
+
+// Creates a scanner reading from r, parsing with the given options.
+func NewScanner(r io.Reader, opts Options) *Scanner {
+	return &Scanner{r: bufio.NewReader(r), opts: opts}
+}
 
+// Parses the next line, returning false at the end of the input or on errors.
+func (s *Scanner) Scan() bool {
+	if s.done {
+		return false
+	}
+
+	text, err := s.r.ReadString('\n')
+	switch err {
+	case nil:
+	case io.EOF:
+		s.done = true
+		text += "\n"
+	default:
+		s.done = true
+		s.err = err
+		return false
+	}
+
+	s.line++
+	s.block = Block{}
+	s.warnings = nil
+	if s.err = s.parseLine(text); s.err != nil {
+		s.done = true
+		return false
+	}
+	s.block.Line, s.block.Source = s.line, strings.TrimRight(text, "\r\n")
+	return true
+}
+
+// The block of the last scanned line.
+func (s *Scanner) Block() Block {
+	return s.block
+}
+
+// The number of the last scanned line, starting at 1.
+func (s *Scanner) Line() int {
+	return s.line
+}
+
+// The warnings for the last scanned line.
+func (s *Scanner) Warnings() warnings.Warnings {
+	return s.warnings
+}
+
+// The error that stopped scanning, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Parses a line, including the terminating newline, into the block.
+func (s *Scanner) parseLine(text string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
+			if e, ok := r.(error); ok {
+				err = e
+			} else {
+				err = errors.New(fmt.Sprintf("%s", r))
+			}
 		}
 	}()
 
-	parserPanic := func(idx int, err string) string {
-		nl := 0
-		for idy, s := range input {
-			if idy == idx {
-				break
-			} else if s == '\n' {
-				nl++
-			}
+	s.text, s.next = text, 0
+	for pos, c := range text {
+		if pos < s.next {
+			continue
+		}
+		switch s.state {
+		case normal:
+			s.parseNormal(c, pos)
+		case comment:
+			s.parseComment(c, pos)
+		case eolcomment:
+			s.parseEOLComment(c, pos)
+		case word:
+			s.parseWord(c, pos)
+		case skip:
+			s.parseSkip(c, pos)
 		}
-		panic(fmt.Sprintf("Line %d, pos %d: %s", nl, idx-lastNewline+1, err))
 	}
+	return nil
+}
 
-	parseNormal := func(c rune, idx int) {
-		switch c {
-		case '/':
-			if idx-lastNewline == 0 {
-				curBlock.BlockDelete = true
-				lastNewline--
-			} else {
-				parserPanic(idx, "Unexpected /")
-			}
-		case '%':
-			fm := Filemarker{}
-			curBlock.AppendNode(&fm)
-		case '(':
-			state = comment
-		case ';':
-			state = eolcomment
-		case '\n':
-			document.AppendBlock(curBlock)
-			curBlock = Block{}
-			lastNewline = idx + 1
-		case '\r':
-			// Ignore
-			return
-		case ' ':
-			// Ignore
+func (s *Scanner) parserPanic(pos int, err string) {
+	if s.opts.Tolerant {
+		s.warnings.Add(warnings.StageParse, s.line, warnings.SeverityWarning,
+			"Skipped unparseable line: %s", err)
+		s.state = skip
+		return
+	}
+	panic(fmt.Sprintf("Line %d, pos %d: %s", s.line, pos+1, err))
+}
+
+func (s *Scanner) parseNormal(c rune, pos int) {
+	switch c {
+	case '/':
+		if pos == 0 {
+			s.block.BlockDelete = true
+		} else {
+			s.parserPanic(pos, "Unexpected /")
+		}
+	case '%':
+		fm := Filemarker{}
+		s.block.AppendNode(&fm)
+	case '#':
+		a, end, err := parseAssignment(s.text, pos)
+		if err != nil {
+			s.parserPanic(end, err.Error())
 			return
-		default:
-			if c >= 97 && c <= 122 {
-				// Lower-case character
-				state = word
-				address = c - 32 // Make uppercase
-			} else if (c >= 65 && c <= 90) || c == 64 || c == 94 {
-				// Upper-case character, @ or ^
-				state = word
-				address = c
-			} else {
-				// No clue
-				parserPanic(idx, fmt.Sprintf("Expected word address, found [%c]", c))
-			}
+		}
+		s.block.AppendNode(a)
+		s.next = end
+	case '(':
+		s.state = comment
+	case ';':
+		s.state = eolcomment
+	case '\n':
+		// End of block
+	case '\r':
+		// Ignore
+		return
+	case ' ':
+		// Ignore
+		return
+	case 'O', 'o':
+		o, end, err := parseOWord(s.text, pos)
+		if err != nil {
+			s.parserPanic(end, err.Error())
+		} else if o != nil {
+			s.block.AppendNode(o)
+			s.next = end
+		} else {
+			s.state = word
+			s.address = 'O'
+		}
+	default:
+		if c >= 97 && c <= 122 {
+			// Lower-case character
+			s.state = word
+			s.address = c - 32 // Make uppercase
+		} else if (c >= 65 && c <= 90) || c == 64 || c == 94 {
+			// Upper-case character, @ or ^
+			s.state = word
+			s.address = c
+		} else {
+			// No clue
+			s.parserPanic(pos, fmt.Sprintf("Expected word address, found [%c]", c))
 		}
 	}
+}
 
-	parseComment := func(c rune, idx int) {
-		switch c {
-		case ')':
-			state = normal
-			cm := Comment{buffer, false}
-			curBlock.AppendNode(&cm)
-			buffer = ""
-		case '\n':
-			parserPanic(idx, "Non-terminated comment")
-		default:
-			buffer += string(c)
+func (s *Scanner) parseComment(c rune, pos int) {
+	switch c {
+	case ')':
+		s.state = normal
+		cm := Comment{s.buffer, false}
+		s.block.AppendNode(&cm)
+		s.buffer = ""
+	case '\n':
+		if !s.opts.UnterminatedComments && !s.opts.Tolerant {
+			s.parserPanic(pos, "Non-terminated comment")
 		}
+		s.warnings.Add(warnings.StageParse, s.line, warnings.SeverityInfo, "Non-terminated comment")
+		s.state = normal
+		cm := Comment{s.buffer, false}
+		s.block.AppendNode(&cm)
+		s.buffer = ""
+		s.parseNormal(c, pos)
+	default:
+		s.buffer += string(c)
 	}
+}
 
-	parseEOLComment := func(c rune, idx int) {
-		switch c {
-		case '\n':
-			state = normal
-			cm := Comment{buffer, true}
-			curBlock.AppendNode(&cm)
-			buffer = ""
-			parseNormal(c, idx)
-		default:
-			buffer += string(c)
-		}
+func (s *Scanner) parseEOLComment(c rune, pos int) {
+	switch c {
+	case '\n':
+		s.state = normal
+		cm := Comment{s.buffer, true}
+		s.block.AppendNode(&cm)
+		s.buffer = ""
+		s.parseNormal(c, pos)
+	default:
+		s.buffer += string(c)
 	}
+}
 
-	parseWord := func(c rune, idx int) {
-		if (c >= 48 && c <= 57) || c == 46 || c == 45 || c == 43 {
-			// [0-9\.\-\+]
-			buffer += string(c)
-		} else {
-			// End of command
-			state = normal
-			f, _ := strconv.ParseFloat(string(buffer), 64)
-			w := Word{address, f}
-			curBlock.AppendNode(&w)
-			buffer = ""
-			parseNormal(c, idx)
+func (s *Scanner) parseWord(c rune, pos int) {
+	if (s.buffer == "" || s.buffer == "-" || s.buffer == "+") && (c == '#' || c == '[' || functionAt(s.text, pos)) {
+		s.parseExprWord(pos)
+	} else if (c >= 48 && c <= 57) || c == 46 || c == 45 || c == 43 {
+		// [0-9\.\-\+]
+		s.buffer += string(c)
+	} else {
+		// End of command
+		s.state = normal
+		f, err := strconv.ParseFloat(s.buffer, 64)
+		if err != nil {
+			s.parserPanic(pos, fmt.Sprintf("Invalid number %q for %c", s.buffer, s.address))
+			// Tolerant, skipping the line, which may end here
+			s.parseSkip(c, pos)
+			return
 		}
+		w := Word{s.address, f}
+		s.block.AppendNode(&w)
+		s.buffer = ""
+		s.parseNormal(c, pos)
 	}
+}
 
-	for idx, c := range input {
-		switch state {
-		case normal:
-			parseNormal(c, idx)
-		case comment:
-			parseComment(c, idx)
-		case eolcomment:
-			parseEOLComment(c, idx)
-		case word:
-			parseWord(c, idx)
-		}
+// Parses a word with an expression as value
+func (s *Scanner) parseExprWord(pos int) {
+	v, end, err := parseValue(s.text, pos)
+	if err != nil {
+		s.parserPanic(end, err.Error())
+		return
+	}
+	if s.buffer == "-" {
+		v = &Unary{"-", v}
+	}
+	w := ExprWord{s.address, v}
+	s.block.AppendNode(&w)
+	s.buffer = ""
+	s.state = normal
+	s.next = end
+}
+
+// Discards the rest of an unparseable line
+func (s *Scanner) parseSkip(c rune, pos int) {
+	if c == '\n' {
+		s.state = normal
+		s.buffer = ""
+		s.block = Block{}
+		s.parseNormal(c, pos)
 	}
-	return &document, nil
 }
@@ -0,0 +1,175 @@
+package gcode
+
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "strings"
+import "testing"
+
+func TestInvalidNumbers(t *testing.T) {
+	for _, program := range []string{"G0 X1.2.3", "G0 X1.2.3 Y1", "G0 X1.2.3(comment)"} {
+		if _, err := Parse(program); err == nil {
+			t.Errorf("%q: parsed an invalid number", program)
+		}
+
+		s := NewScanner(strings.NewReader(program+"\nG1 X2\n"), Options{Tolerant: true})
+		var blocks []Block
+		for s.Scan() {
+			if n := s.Block().Line; n == 1 && len(s.Warnings()) != 1 {
+				t.Errorf("%q: %d warnings, expected 1", program, len(s.Warnings()))
+			}
+			blocks = append(blocks, s.Block())
+		}
+		if err := s.Err(); err != nil {
+			t.Errorf("%q: %s", program, err)
+			continue
+		}
+		if len(blocks) < 2 {
+			t.Errorf("%q: %d blocks, expected at least 2", program, len(blocks))
+			continue
+		}
+		if n := len(blocks[0].Nodes); n != 0 {
+			t.Errorf("%q: %d nodes on the skipped line, expected 0", program, n)
+		}
+		if x, err := blocks[1].GetWord('X'); err != nil || x != 2 {
+			t.Errorf("%q: X%g (%v) on the line after, expected X2", program, x, err)
+		}
+	}
+}
+
+// Generates count lines of moves, keeping track of how many were read
+type moveReader struct {
+	count, read int
+	buf         []byte
+}
+
+func (r *moveReader) Read(p []byte) (int, error) {
+	for len(r.buf) < len(p) && r.read < r.count {
+		r.read++
+		r.buf = append(r.buf, fmt.Sprintf("G1 X%d\n", r.read)...)
+	}
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// A reader failing after its input
+type failingReader struct {
+	r io.Reader
+}
+
+var errRead = errors.New("read failed")
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = errRead
+	}
+	return n, err
+}
+
+func TestScanner(t *testing.T) {
+	const input = "G21 G90\r\n\n/G0 X1 (move)\nG1 X2 ; cut\nM2"
+	s := NewScanner(strings.NewReader(input), Options{})
+	var (
+		lines   []int
+		sources []string
+	)
+	for s.Scan() {
+		if b := s.Block(); b.Line != s.Line() {
+			t.Errorf("Block of line %d numbered %d", s.Line(), b.Line)
+		}
+		lines = append(lines, s.Line())
+		sources = append(sources, s.Block().Source)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"G21 G90", "", "/G0 X1 (move)", "G1 X2 ; cut", "M2"}
+	if strings.Join(sources, "|") != strings.Join(expected, "|") {
+		t.Errorf("Scanned %q, expected %q", sources, expected)
+	}
+	if len(lines) != len(expected) || lines[len(lines)-1] != len(expected) {
+		t.Errorf("Scanned lines %v", lines)
+	}
+
+	// Scanning gives the blocks of Parse
+	doc, err := Parse(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = NewScanner(strings.NewReader(input), Options{})
+	for idx := 0; s.Scan(); idx++ {
+		b := s.Block()
+		if b.Export(4) != doc.Blocks[idx].Export(4) || b.BlockDelete != doc.Blocks[idx].BlockDelete {
+			t.Errorf("Line %d: scanned %q, parsed %q", idx+1, b.Export(4), doc.Blocks[idx].Export(4))
+		}
+	}
+}
+
+func TestScannerStreams(t *testing.T) {
+	const count = 100000
+	r := &moveReader{count: count}
+	s := NewScanner(r, Options{})
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if r.read >= count {
+		t.Errorf("Read all %d lines before the first block", count)
+	}
+	b := s.Block()
+	if x, err := b.GetWord('X'); err != nil || x != 1 {
+		t.Errorf("First block at X%g (%v), expected X1", x, err)
+	}
+
+	n := 1
+	for s.Scan() {
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The empty line after the last newline is a block too
+	if n != count+1 {
+		t.Errorf("Scanned %d blocks, expected %d", n, count+1)
+	}
+}
+
+func TestScannerErrors(t *testing.T) {
+	s := NewScanner(strings.NewReader("G0 X1\nG0 X(\nG0 X2\n"), Options{})
+	n := 0
+	for s.Scan() {
+		n++
+	}
+	if s.Err() == nil || !strings.Contains(s.Err().Error(), "Line 2") {
+		t.Errorf("Failed with %v, expected an error on line 2", s.Err())
+	}
+	if n != 1 || s.Scan() {
+		t.Errorf("Scanned %d blocks, or continued after the error", n)
+	}
+
+	// Warnings are those of the last line only
+	s = NewScanner(strings.NewReader("G0 X1 (open\nG0 X2\n"), Options{UnterminatedComments: true})
+	for s.Scan() {
+		if w := len(s.Warnings()); (s.Line() == 1) != (w == 1) {
+			t.Errorf("Line %d: %d warnings", s.Line(), w)
+		}
+	}
+
+	s = NewScanner(failingReader{strings.NewReader("G0 X1\n")}, Options{})
+	for s.Scan() {
+	}
+	if !errors.Is(s.Err(), errRead) {
+		t.Errorf("Failed with %v, expected %v", s.Err(), errRead)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ParseReader(ctx, &moveReader{count: 10000}, Options{}); err != context.Canceled {
+		t.Errorf("Parsed with a cancelled context, failing with %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+
+//
+// DXF import
+//
+// Supports LINE, ARC, CIRCLE, LWPOLYLINE and POLYLINE entities from the
+// ENTITIES section. Everything else is ignored.
+//
+
+// A DXF group code and value pair
+type dxfPair struct {
+	code  int
+	value string
+}
+
+// A DXF entity with its group codes
+type dxfEntity struct {
+	kind  string
+	pairs []dxfPair
+}
+
+// Returns the first float value of the group code
+func (e *dxfEntity) float(code int) float64 {
+	for _, p := range e.pairs {
+		if p.code == code {
+			f, _ := strconv.ParseFloat(p.value, 64)
+			return f
+		}
+	}
+	return 0
+}
+
+// Returns the first int value of the group code
+func (e *dxfEntity) int(code int) int {
+	return int(e.float(code))
+}
+
+// Reads all group code and value pairs
+func readDXFPairs(r io.Reader) ([]dxfPair, error) {
+	var pairs []dxfPair
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		codeStr := strings.TrimSpace(scanner.Text())
+		if !scanner.Scan() {
+			if codeStr == "" {
+				break
+			}
+			return nil, errors.New(fmt.Sprintf("Line %d: Group code without value", line))
+		}
+		line++
+		code, err := strconv.Atoi(codeStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Line %d: Invalid group code %q", line-1, codeStr))
+		}
+		pairs = append(pairs, dxfPair{code, strings.TrimSpace(scanner.Text())})
+	}
+	return pairs, scanner.Err()
+}
+
+// Extracts the entities of the ENTITIES section
+func dxfEntities(pairs []dxfPair) []dxfEntity {
+	var (
+		res       []dxfEntity
+		inSection bool
+		cur       *dxfEntity
+	)
+
+	for idx, p := range pairs {
+		if p.code != 0 {
+			if cur != nil {
+				cur.pairs = append(cur.pairs, p)
+			}
+			continue
+		}
+
+		if cur != nil {
+			res = append(res, *cur)
+			cur = nil
+		}
+
+		switch p.value {
+		case "SECTION":
+			if idx+1 < len(pairs) && pairs[idx+1].code == 2 && pairs[idx+1].value == "ENTITIES" {
+				inSection = true
+			}
+		case "ENDSEC":
+			inSection = false
+		case "EOF":
+			return res
+		default:
+			if inSection {
+				cur = &dxfEntity{kind: p.value}
+			}
+		}
+	}
+	if cur != nil {
+		res = append(res, *cur)
+	}
+	return res
+}
+
+// Converts a bulge between two points to an arc center and direction.
+// The bulge is the tangent of a quarter of the included angle, positive for counter clockwise arcs.
+func bulgeArc(from, to Point, bulge float64) (center Point, clockwise bool) {
+	chord := from.dist(to)
+	theta := 4 * math.Atan(math.Abs(bulge))
+	radius := chord / (2 * math.Sin(theta/2))
+
+	// Signed distance from the chord midpoint to the center, along the left normal
+	d := radius * math.Cos(theta/2)
+	if bulge < 0 {
+		d = -d
+	}
+	nx, ny := -(to.Y-from.Y)/chord, (to.X-from.X)/chord
+	return Point{(from.X+to.X)/2 + nx*d, (from.Y+to.Y)/2 + ny*d}, bulge < 0
+}
+
+// Builds a path from polyline vertices and bulges
+func polylinePath(vertices []Point, bulges []float64, closed bool) Path {
+	p := Path{Start: vertices[0]}
+	count := len(vertices)
+	if !closed {
+		count--
+	}
+	for i := 0; i < count; i++ {
+		from, to := vertices[i], vertices[(i+1)%len(vertices)]
+		if bulges[i] == 0 || from.dist(to) == 0 {
+			p.LineTo(to.X, to.Y)
+		} else {
+			c, cw := bulgeArc(from, to, bulges[i])
+			p.ArcTo(to.X, to.Y, c.X, c.Y, cw)
+		}
+	}
+	return p
+}
+
+// Converts the DXF entities to paths
+func dxfPaths(entities []dxfEntity, scale float64) ([]Path, error) {
+	var paths []Path
+	pt := func(x, y float64) Point {
+		return Point{x * scale, y * scale}
+	}
+
+	for idx := 0; idx < len(entities); idx++ {
+		e := &entities[idx]
+		switch e.kind {
+		case "LINE":
+			p := Path{Start: pt(e.float(10), e.float(20))}
+			end := pt(e.float(11), e.float(21))
+			p.LineTo(end.X, end.Y)
+			paths = append(paths, p)
+		case "ARC", "CIRCLE":
+			c := pt(e.float(10), e.float(20))
+			r := e.float(40) * scale
+			if r <= 0 {
+				return nil, errors.New(fmt.Sprintf("%s with invalid radius", e.kind))
+			}
+			start, end := 0.0, 360.0
+			if e.kind == "ARC" {
+				start, end = e.float(50), e.float(51)
+			}
+			sx, sy := c.X+r*math.Cos(start*math.Pi/180), c.Y+r*math.Sin(start*math.Pi/180)
+			p := Path{Start: Point{sx, sy}}
+			if e.kind == "CIRCLE" {
+				// Split in two, as full circles are ambiguous
+				p.ArcTo(c.X-r, c.Y, c.X, c.Y, false)
+				p.ArcTo(sx, sy, c.X, c.Y, false)
+			} else {
+				p.ArcTo(c.X+r*math.Cos(end*math.Pi/180), c.Y+r*math.Sin(end*math.Pi/180), c.X, c.Y, false)
+			}
+			paths = append(paths, p)
+		case "LWPOLYLINE":
+			var (
+				vertices []Point
+				bulges   []float64
+				x        float64
+			)
+			for _, pair := range e.pairs {
+				v, _ := strconv.ParseFloat(pair.value, 64)
+				switch pair.code {
+				case 10:
+					x = v
+				case 20:
+					vertices = append(vertices, pt(x, v))
+					bulges = append(bulges, 0)
+				case 42:
+					if len(bulges) > 0 {
+						bulges[len(bulges)-1] = v
+					}
+				}
+			}
+			if len(vertices) > 1 {
+				paths = append(paths, polylinePath(vertices, bulges, e.int(70)&1 == 1))
+			}
+		case "POLYLINE":
+			var (
+				vertices []Point
+				bulges   []float64
+				closed   = e.int(70)&1 == 1
+			)
+			for idx+1 < len(entities) && entities[idx+1].kind == "VERTEX" {
+				idx++
+				v := &entities[idx]
+				vertices = append(vertices, pt(v.float(10), v.float(20)))
+				bulges = append(bulges, v.float(42))
+			}
+			if idx+1 < len(entities) && entities[idx+1].kind == "SEQEND" {
+				idx++
+			}
+			if len(vertices) > 1 {
+				paths = append(paths, polylinePath(vertices, bulges, closed))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Imports a DXF file, generating profile cuts following all lines, arcs, circles and polylines.
+func DXF(r io.Reader, s Settings) (*gcode.Document, error) {
+	pairs, err := readDXFPairs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := dxfPaths(dxfEntities(pairs), s.Scale)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("No supported entities found in DXF")
+	}
+
+	return profileDocument("DXF", paths, s), nil
+}
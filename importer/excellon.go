@@ -0,0 +1,298 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "sort"
+import "strconv"
+import "strings"
+
+//
+// Excellon import
+//
+// Reads the tool definitions and hole positions of an Excellon drill file,
+// and drills every hole with a canned cycle, grouped by tool:
+//
+//   T1 M6
+//   G98 G81 X1 Y2 R1 Z-1.8 F100   - first hole, from the retract height (R)
+//   X3 Y2                        - every following hole
+//   G80
+//
+// G83 is used instead when pecking, with the peck depth as Q. The cycles
+// return to the safe height between holes (G98), and are expanded into moves
+// by the vm, so the holes go through the optimizer like any other program.
+//
+// Hole coordinates may be absolute (G90) or incremental (G91 or ICI,ON), and
+// repeated with R, as in R4X2.54, which drills 4 more holes 2.54 apart.
+// Routing commands (G00/G01 in route mode) and slots (G85) are not supported.
+//
+
+// An Excellon tool
+type excellonTool struct {
+	number   int
+	diameter float64
+	holes    []Point
+}
+
+// Number format state of an Excellon file
+type excellonFormat struct {
+	metric       bool
+	leadingZeros bool // LZ: leading zeros present, trailing zeros suppressed
+	integer      int
+	decimal      int
+}
+
+// Parses the zero suppression and number format of a unit statement, such as "METRIC,TZ,000.000"
+func (f *excellonFormat) parseUnits(l string) {
+	f.leadingZeros = strings.Contains(l, "LZ")
+	for _, part := range strings.Split(l, ",") {
+		if idx := strings.IndexRune(part, '.'); idx != -1 && strings.Trim(part, "0.") == "" {
+			f.integer, f.decimal = idx, len(part)-idx-1
+		}
+	}
+}
+
+// Parses a coordinate, honoring implied decimal points and zero suppression. Result is in mm.
+func (f excellonFormat) coord(s string) (float64, error) {
+	var v float64
+	if strings.ContainsRune(s, '.') {
+		var err error
+		if v, err = strconv.ParseFloat(s, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		sign := 1.0
+		if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+			if s[0] == '-' {
+				sign = -1
+			}
+			s = s[1:]
+		}
+		if f.leadingZeros {
+			// Trailing zeros suppressed, pad on the right
+			for len(s) < f.integer+f.decimal {
+				s += "0"
+			}
+		}
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		v = sign * float64(i) / math.Pow(10, float64(f.decimal))
+	}
+
+	if !f.metric {
+		v *= 25.4
+	}
+	return v, nil
+}
+
+// Splits "X1.2Y3.4" into its X and Y parts
+func splitExcellonCoords(s string) (x, y string) {
+	yIdx := strings.IndexRune(s, 'Y')
+	if yIdx == -1 {
+		return strings.TrimPrefix(s, "X"), ""
+	}
+	return strings.TrimPrefix(s[:yIdx], "X"), s[yIdx+1:]
+}
+
+// Parses an Excellon file into tools with their holes
+func parseExcellon(r io.Reader) ([]*excellonTool, error) {
+	var (
+		tools   = make(map[int]*excellonTool)
+		current *excellonTool
+		format  = excellonFormat{false, false, 2, 4}
+		header  bool
+		incr    bool // Incremental coordinates
+		lastX   float64
+		lastY   float64
+		line    int
+		done    bool
+		scanner = bufio.NewScanner(r)
+	)
+
+	for scanner.Scan() {
+		line++
+		l := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if idx := strings.IndexRune(l, ';'); idx != -1 {
+			l = strings.TrimSpace(l[:idx])
+		}
+		if l == "" {
+			continue
+		}
+
+		fail := func(err string) error {
+			return errors.New(fmt.Sprintf("Line %d: %s", line, err))
+		}
+
+		switch {
+		case l == "M48":
+			header = true
+		case l == "%" || l == "M95":
+			header = false
+		case strings.HasPrefix(l, "METRIC") || l == "M71":
+			format.metric, format.integer, format.decimal = true, 3, 3
+			format.parseUnits(l)
+		case strings.HasPrefix(l, "INCH") || l == "M72":
+			format.metric, format.integer, format.decimal = false, 2, 4
+			format.parseUnits(l)
+		case l[0] == 'T':
+			// Tool definition (T1C0.8) or selection (T1)
+			rest := l[1:]
+			end := strings.IndexFunc(rest, func(c rune) bool { return c < '0' || c > '9' })
+			if end == -1 {
+				end = len(rest)
+			}
+			num, err := strconv.Atoi(rest[:end])
+			if err != nil {
+				return nil, fail("Invalid tool number")
+			}
+			t, ok := tools[num]
+			if !ok {
+				t = &excellonTool{number: num}
+				tools[num] = t
+			}
+			if c := strings.IndexRune(rest, 'C'); c != -1 {
+				end := strings.IndexFunc(rest[c+1:], func(c rune) bool { return (c < '0' || c > '9') && c != '.' })
+				if end == -1 {
+					end = len(rest) - c - 1
+				}
+				d, err := strconv.ParseFloat(rest[c+1:c+1+end], 64)
+				if err != nil {
+					return nil, fail("Invalid tool diameter")
+				}
+				if !format.metric {
+					d *= 25.4
+				}
+				t.diameter = d
+			}
+			if !header && num != 0 {
+				current = t
+			}
+		case strings.HasPrefix(l, "ICI"):
+			incr = !strings.HasSuffix(l, ",OFF")
+		case l == "G90":
+			incr = false
+		case l == "G91":
+			incr = true
+		case l[0] == 'X' || l[0] == 'Y' || l[0] == 'R':
+			if current == nil {
+				return nil, fail("Hole without selected tool")
+			}
+			if strings.Contains(l, "G85") {
+				return nil, fail("Slots (G85) are not supported")
+			}
+
+			// Repeats step from the last hole, otherwise coordinates are incremental only in incremental mode
+			repeat, step := 1, incr
+			if l[0] == 'R' {
+				end := strings.IndexAny(l, "XY")
+				if end == -1 {
+					end = len(l)
+				}
+				n, err := strconv.Atoi(l[1:end])
+				if err != nil || n < 1 {
+					return nil, fail("Invalid repeat count")
+				}
+				repeat, step, l = n, true, l[end:]
+			}
+
+			xs, ys := splitExcellonCoords(l)
+			var dx, dy float64
+			var err error
+			if xs != "" {
+				if dx, err = format.coord(xs); err != nil {
+					return nil, fail("Invalid X coordinate")
+				}
+			}
+			if ys != "" {
+				if dy, err = format.coord(ys); err != nil {
+					return nil, fail("Invalid Y coordinate")
+				}
+			}
+			for n := 0; n < repeat; n++ {
+				x, y := lastX+dx, lastY+dy
+				if !step {
+					x, y = lastX, lastY
+					if xs != "" {
+						x = dx
+					}
+					if ys != "" {
+						y = dy
+					}
+				}
+				current.holes = append(current.holes, Point{x, y})
+				lastX, lastY = x, y
+			}
+		case l == "M30" || l == "M00":
+			done = true
+		}
+		if done {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make([]*excellonTool, 0, len(tools))
+	for _, t := range tools {
+		if len(t.holes) > 0 {
+			res = append(res, t)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].number < res[j].number
+	})
+	return res, nil
+}
+
+// Drills the holes with a canned cycle from the safe height, pecking if configured
+func (b *builder) drill(holes []Point) {
+	s := b.settings
+	for idx, h := range holes {
+		x, y := gcode.Word{'X', h.X}, gcode.Word{'Y', h.Y}
+		switch {
+		case idx > 0:
+			b.block(x, y)
+		case s.PeckDepth <= 0 || s.PeckDepth >= s.Depth:
+			b.block(gcode.Word{'G', 98}, gcode.Word{'G', 81}, x, y, gcode.Word{'R', s.Retract},
+				gcode.Word{'Z', -s.Depth}, gcode.Word{'F', s.PlungeFeedrate})
+		default:
+			b.block(gcode.Word{'G', 98}, gcode.Word{'G', 83}, x, y, gcode.Word{'R', s.Retract},
+				gcode.Word{'Z', -s.Depth}, gcode.Word{'Q', s.PeckDepth}, gcode.Word{'F', s.PlungeFeedrate})
+		}
+	}
+	b.block(gcode.Word{'G', 80})
+}
+
+// Imports an Excellon drill file, generating drilling cycles for all holes.
+// Excellon tools are mapped to machine tools using Settings.ToolMap, keeping the
+// Excellon tool number if no mapping exists.
+func Excellon(r io.Reader, s Settings) (*gcode.Document, error) {
+	tools, err := parseExcellon(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(tools) == 0 {
+		return nil, errors.New("No holes found in Excellon file")
+	}
+
+	b := builder{settings: s}
+	b.header("Excellon")
+	for _, t := range tools {
+		num := t.number
+		if mapped, ok := s.ToolMap[num]; ok {
+			num = mapped
+		}
+		b.comment(fmt.Sprintf("T%d: %g mm, %d holes", t.number, t.diameter, len(t.holes)))
+		b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+		b.block(gcode.Word{'T', float64(num)}, gcode.Word{'M', 6})
+		b.drill(t.holes)
+	}
+	b.footer()
+	return &b.doc, nil
+}
@@ -0,0 +1,572 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "bufio"
+import "bytes"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "math"
+import "strconv"
+import "strings"
+
+//
+// Gerber import and isolation routing
+//
+// Copper features (flashes, traces and regions) are read from an RS-274X file,
+// grown by the isolation offset and rasterized. The outlines of the resulting
+// areas are traced and simplified, and cut as isolation paths. Only dark
+// polarity is supported, clear polarity (LPC) layers are ignored.
+//
+// With several isolation passes, every pass is grown further by the tool
+// diameter less the overlap, clearing a wider channel around the copper, so
+// that stray copper between traces is less likely to short them.
+//
+
+// A shape, grown by the isolation offset
+type gerberShape interface {
+	bounds() (min, max Point)
+	contains(p Point) bool
+}
+
+// A rectangle with rounded corners, formed by growing the rectangle by r.
+// Circles are rounded rectangles with a size of zero.
+type roundRect struct {
+	center Point
+	hw, hh float64 // Half width and height
+	r      float64
+}
+
+func (s roundRect) bounds() (Point, Point) {
+	return Point{s.center.X - s.hw - s.r, s.center.Y - s.hh - s.r},
+		Point{s.center.X + s.hw + s.r, s.center.Y + s.hh + s.r}
+}
+
+func (s roundRect) contains(p Point) bool {
+	dx := math.Max(math.Abs(p.X-s.center.X)-s.hw, 0)
+	dy := math.Max(math.Abs(p.Y-s.center.Y)-s.hh, 0)
+	return dx*dx+dy*dy <= s.r*s.r
+}
+
+// A line segment grown by r
+type capsule struct {
+	a, b Point
+	r    float64
+}
+
+func (s capsule) bounds() (Point, Point) {
+	return Point{math.Min(s.a.X, s.b.X) - s.r, math.Min(s.a.Y, s.b.Y) - s.r},
+		Point{math.Max(s.a.X, s.b.X) + s.r, math.Max(s.a.Y, s.b.Y) + s.r}
+}
+
+func (s capsule) contains(p Point) bool {
+	dx, dy := s.b.X-s.a.X, s.b.Y-s.a.Y
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p.X-s.a.X)*dx+(p.Y-s.a.Y)*dy)/l))
+	}
+	return math.Hypot(s.a.X+t*dx-p.X, s.a.Y+t*dy-p.Y) <= s.r
+}
+
+// A filled polygon
+type polygon []Point
+
+func (s polygon) bounds() (Point, Point) {
+	min, max := s[0], s[0]
+	for _, p := range s {
+		min.X, min.Y = math.Min(min.X, p.X), math.Min(min.Y, p.Y)
+		max.X, max.Y = math.Max(max.X, p.X), math.Max(max.Y, p.Y)
+	}
+	return min, max
+}
+
+func (s polygon) contains(p Point) bool {
+	in := false
+	for i, j := 0, len(s)-1; i < len(s); j, i = i, i+1 {
+		a, b := s[i], s[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			in = !in
+		}
+	}
+	return in
+}
+
+// A Gerber aperture
+type gerberAperture struct {
+	kind byte    // 'C', 'R', 'O' or 'P'
+	w, h float64 // Diameter for circles and polygons
+}
+
+// Returns the shape of a flash of the aperture, grown by offset
+func (a gerberAperture) flash(p Point, offset float64) gerberShape {
+	switch a.kind {
+	case 'R':
+		return roundRect{p, a.w / 2, a.h / 2, offset}
+	case 'O':
+		r := math.Min(a.w, a.h) / 2
+		dx, dy := a.w/2-r, a.h/2-r
+		return capsule{Point{p.X - dx, p.Y - dy}, Point{p.X + dx, p.Y + dy}, r + offset}
+	default:
+		return roundRect{p, 0, 0, a.w/2 + offset}
+	}
+}
+
+// Returns the shape of a trace from a to b drawn with the aperture, grown by offset
+func (a gerberAperture) trace(from, to Point, offset float64) gerberShape {
+	return capsule{from, to, math.Max(a.w, a.h)/2 + offset}
+}
+
+// Gerber parser state
+type gerberParser struct {
+	shapes    []gerberShape
+	apertures map[int]gerberAperture
+	aperture  gerberAperture
+	format    excellonFormat
+	offset    float64
+	tolerance float64
+	cur       Point
+	mode      int // 1 linear, 2 cw arc, 3 ccw arc
+	region    bool
+	regionPts polygon
+	clear     bool
+	inchScale float64
+	trailingZ bool
+}
+
+// Parses a coordinate value in the current format
+func (g *gerberParser) coord(s string) (float64, error) {
+	f := g.format
+	f.leadingZeros = g.trailingZ
+	return f.coord(s)
+}
+
+// Approximates an arc from the current point with the given center
+func (g *gerberParser) arcPoints(to, center Point, clockwise bool) []Point {
+	r := g.cur.dist(center)
+	a1 := math.Atan2(g.cur.Y-center.Y, g.cur.X-center.X)
+	a2 := math.Atan2(to.Y-center.Y, to.X-center.X)
+	diff := a2 - a1
+	if clockwise && diff >= 0 {
+		diff -= 2 * math.Pi
+	} else if !clockwise && diff <= 0 {
+		diff += 2 * math.Pi
+	}
+
+	steps := 1
+	if r > g.tolerance {
+		steps = int(math.Ceil(math.Abs(diff) / (2 * math.Acos(1-g.tolerance/r))))
+	}
+	var res []Point
+	for i := 1; i < steps; i++ {
+		a := a1 + diff*float64(i)/float64(steps)
+		res = append(res, Point{center.X + r*math.Cos(a), center.Y + r*math.Sin(a)})
+	}
+	return append(res, to)
+}
+
+// Finishes a region, adding its outline grown by the offset
+func (g *gerberParser) closeRegion() {
+	if len(g.regionPts) > 2 && !g.clear {
+		g.shapes = append(g.shapes, g.regionPts)
+		for i := range g.regionPts {
+			a, b := g.regionPts[i], g.regionPts[(i+1)%len(g.regionPts)]
+			g.shapes = append(g.shapes, capsule{a, b, g.offset})
+		}
+	}
+	g.regionPts = nil
+}
+
+// Handles an extended (%...%) command
+func (g *gerberParser) extended(cmd string) error {
+	switch {
+	case strings.HasPrefix(cmd, "FS"):
+		// %FSLAX24Y24*%
+		g.trailingZ = len(cmd) > 2 && cmd[2] == 'T'
+		if idx := strings.IndexRune(cmd, 'X'); idx != -1 && idx+2 < len(cmd) {
+			g.format.integer = int(cmd[idx+1] - '0')
+			g.format.decimal = int(cmd[idx+2] - '0')
+		}
+	case cmd == "MOMM":
+		g.format.metric = true
+	case cmd == "MOIN":
+		g.format.metric = false
+	case strings.HasPrefix(cmd, "LP"):
+		g.clear = cmd == "LPC"
+	case strings.HasPrefix(cmd, "AD"):
+		// %ADD10C,0.5*% or %ADD11R,1.0X0.5*%
+		rest := cmd[3:]
+		end := strings.IndexFunc(rest, func(c rune) bool { return c < '0' || c > '9' })
+		if end <= 0 {
+			return errors.New("Invalid aperture definition")
+		}
+		num, _ := strconv.Atoi(rest[:end])
+		rest = rest[end:]
+		comma := strings.IndexRune(rest, ',')
+		if comma == -1 {
+			return errors.New(fmt.Sprintf("Unsupported aperture macro %s", rest))
+		}
+		kind := rest[:comma]
+		if kind != "C" && kind != "R" && kind != "O" && kind != "P" {
+			return errors.New(fmt.Sprintf("Unsupported aperture macro %s", kind))
+		}
+		var params []float64
+		for _, v := range strings.Split(rest[comma+1:], "X") {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return errors.New("Invalid aperture parameter")
+			}
+			if !g.format.metric {
+				f *= 25.4
+			}
+			params = append(params, f)
+		}
+		a := gerberAperture{kind: kind[0], w: params[0], h: params[0]}
+		if (kind == "R" || kind == "O") && len(params) > 1 {
+			a.h = params[1]
+		}
+		g.apertures[num] = a
+	}
+	return nil
+}
+
+// Handles a data block, such as "X100Y200D01"
+func (g *gerberParser) data(cmd string) error {
+	// Strip and handle G codes
+	for strings.HasPrefix(cmd, "G") {
+		end := strings.IndexFunc(cmd[1:], func(c rune) bool { return c < '0' || c > '9' }) + 1
+		if end == 0 {
+			end = len(cmd)
+		}
+		code, _ := strconv.Atoi(cmd[1:end])
+		cmd = cmd[end:]
+		switch code {
+		case 1, 2, 3:
+			g.mode = code
+		case 4:
+			// Comment
+			return nil
+		case 36:
+			g.region = true
+		case 37:
+			g.closeRegion()
+			g.region = false
+		}
+	}
+
+	if cmd == "" || strings.HasPrefix(cmd, "M") {
+		return nil
+	}
+
+	// Split into address/value pairs
+	values := make(map[byte]string)
+	for len(cmd) > 0 {
+		addr := cmd[0]
+		end := strings.IndexFunc(cmd[1:], func(c rune) bool { return (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' }) + 1
+		if end == 0 {
+			end = len(cmd)
+		}
+		values[addr] = cmd[1:end]
+		cmd = cmd[end:]
+	}
+
+	d, hasD := values['D']
+	op := 0
+	if hasD {
+		op, _ = strconv.Atoi(d)
+		if op >= 10 {
+			a, ok := g.apertures[op]
+			if !ok {
+				return errors.New(fmt.Sprintf("Undefined aperture D%d", op))
+			}
+			g.aperture = a
+			return nil
+		}
+	}
+
+	to := g.cur
+	var err error
+	if v, ok := values['X']; ok {
+		if to.X, err = g.coord(v); err != nil {
+			return err
+		}
+	}
+	if v, ok := values['Y']; ok {
+		if to.Y, err = g.coord(v); err != nil {
+			return err
+		}
+	}
+	var center Point
+	i, _ := g.coord(values['I'])
+	j, _ := g.coord(values['J'])
+	center = Point{g.cur.X + i, g.cur.Y + j}
+
+	switch op {
+	case 1:
+		pts := []Point{to}
+		if g.mode == 2 || g.mode == 3 {
+			pts = g.arcPoints(to, center, g.mode == 2)
+		}
+		if g.region {
+			if len(g.regionPts) == 0 {
+				g.regionPts = append(g.regionPts, g.cur)
+			}
+			g.regionPts = append(g.regionPts, pts...)
+		} else if !g.clear {
+			from := g.cur
+			for _, p := range pts {
+				g.shapes = append(g.shapes, g.aperture.trace(from, p, g.offset))
+				from = p
+			}
+		}
+	case 2:
+		if g.region {
+			g.closeRegion()
+		}
+	case 3:
+		if !g.clear {
+			g.shapes = append(g.shapes, g.aperture.flash(to, g.offset))
+		}
+	}
+	g.cur = to
+	return nil
+}
+
+// Parses a Gerber file, returning all copper shapes grown by the offset
+func parseGerber(r io.Reader, offset, tolerance float64) ([]gerberShape, error) {
+	g := gerberParser{
+		apertures: make(map[int]gerberAperture),
+		format:    excellonFormat{false, false, 2, 4},
+		offset:    offset,
+		tolerance: tolerance,
+		mode:      1,
+	}
+
+	reader := bufio.NewReader(r)
+	var (
+		buf      strings.Builder
+		extended bool
+	)
+	for {
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch c {
+		case '\r', '\n', ' ', '\t':
+		case '%':
+			extended = !extended
+		case '*':
+			cmd := buf.String()
+			buf.Reset()
+			if extended {
+				err = g.extended(cmd)
+			} else {
+				err = g.data(cmd)
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return g.shapes, nil
+}
+
+// A raster of grown copper
+type raster struct {
+	origin Point
+	res    float64
+	w, h   int
+	cells  []bool
+}
+
+func (r *raster) get(i, j int) bool {
+	if i < 0 || j < 0 || i >= r.w || j >= r.h {
+		return false
+	}
+	return r.cells[j*r.w+i]
+}
+
+// Rasterizes the shapes, with a margin of empty cells around them
+func rasterize(shapes []gerberShape, res float64) *raster {
+	min, max := shapes[0].bounds()
+	for _, s := range shapes {
+		a, b := s.bounds()
+		min.X, min.Y = math.Min(min.X, a.X), math.Min(min.Y, a.Y)
+		max.X, max.Y = math.Max(max.X, b.X), math.Max(max.Y, b.Y)
+	}
+
+	r := &raster{origin: Point{min.X - 2*res, min.Y - 2*res}, res: res}
+	r.w = int(math.Ceil((max.X-min.X)/res)) + 4
+	r.h = int(math.Ceil((max.Y-min.Y)/res)) + 4
+	r.cells = make([]bool, r.w*r.h)
+
+	for _, s := range shapes {
+		a, b := s.bounds()
+		i0, j0 := int((a.X-r.origin.X)/res), int((a.Y-r.origin.Y)/res)
+		i1, j1 := int((b.X-r.origin.X)/res), int((b.Y-r.origin.Y)/res)
+		for j := j0; j <= j1 && j < r.h; j++ {
+			for i := i0; i <= i1 && i < r.w; i++ {
+				if r.cells[j*r.w+i] {
+					continue
+				}
+				p := Point{r.origin.X + (float64(i)+0.5)*res, r.origin.Y + (float64(j)+0.5)*res}
+				if s.contains(p) {
+					r.cells[j*r.w+i] = true
+				}
+			}
+		}
+	}
+	return r
+}
+
+// Traces the outlines of all filled areas of the raster, with the filled area on the left
+func (r *raster) outlines() [][]Point {
+	type vertex struct{ i, j int }
+	edges := make(map[vertex][]vertex)
+	add := func(a, b vertex) {
+		edges[a] = append(edges[a], b)
+	}
+
+	for j := 0; j < r.h; j++ {
+		for i := 0; i < r.w; i++ {
+			if !r.get(i, j) {
+				continue
+			}
+			if !r.get(i, j-1) {
+				add(vertex{i, j}, vertex{i + 1, j})
+			}
+			if !r.get(i+1, j) {
+				add(vertex{i + 1, j}, vertex{i + 1, j + 1})
+			}
+			if !r.get(i, j+1) {
+				add(vertex{i + 1, j + 1}, vertex{i, j + 1})
+			}
+			if !r.get(i-1, j) {
+				add(vertex{i, j + 1}, vertex{i, j})
+			}
+		}
+	}
+
+	var loops [][]Point
+	for j := 0; j <= r.h; j++ {
+		for i := 0; i <= r.w; i++ {
+			start := vertex{i, j}
+			for len(edges[start]) > 0 {
+				var loop []Point
+				v := start
+				for {
+					next := edges[v]
+					if len(next) == 0 {
+						break
+					}
+					edges[v] = next[1:]
+					loop = append(loop, Point{r.origin.X + float64(v.i)*r.res, r.origin.Y + float64(v.j)*r.res})
+					v = next[0]
+					if v == start {
+						break
+					}
+				}
+				loops = append(loops, loop)
+			}
+		}
+	}
+	return loops
+}
+
+// Simplifies a polyline using the Douglas-Peucker algorithm
+func simplify(pts []Point, tolerance float64) []Point {
+	if len(pts) < 3 {
+		return pts
+	}
+	a, b := pts[0], pts[len(pts)-1]
+	dx, dy := b.X-a.X, b.Y-a.Y
+	l := math.Hypot(dx, dy)
+
+	idx, dist := 0, 0.0
+	for i := 1; i < len(pts)-1; i++ {
+		var d float64
+		if l == 0 {
+			d = pts[i].dist(a)
+		} else {
+			d = math.Abs(dy*pts[i].X-dx*pts[i].Y+b.X*a.Y-b.Y*a.X) / l
+		}
+		if d > dist {
+			idx, dist = i, d
+		}
+	}
+
+	if dist <= tolerance {
+		return []Point{a, b}
+	}
+	left := simplify(pts[:idx+1], tolerance)
+	right := simplify(pts[idx:], tolerance)
+	return append(left[:len(left)-1], right...)
+}
+
+// Traces the outlines of the raster as closed paths
+func (r *raster) paths() []Path {
+	var paths []Path
+	for _, loop := range r.outlines() {
+		pts := simplify(append(loop, loop[0]), r.res)
+		if len(pts) < 3 {
+			continue
+		}
+		p := Path{Start: pts[0]}
+		for _, pt := range pts[1:] {
+			p.LineTo(pt.X, pt.Y)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// Computes isolation paths around the copper shapes
+func isolationPaths(shapes []gerberShape, res float64) []Path {
+	return rasterize(shapes, res).paths()
+}
+
+// Imports a Gerber copper layer, generating isolation routing paths around all copper.
+// The tool center follows the copper outline at half the tool diameter plus the isolation
+// offset, and, for every further pass, the tool diameter less the overlap.
+func Gerber(r io.Reader, s Settings) (*gcode.Document, error) {
+	if s.ToolDiameter <= 0 {
+		return nil, errors.New("Isolation routing requires a tool diameter")
+	}
+	if s.IsolationOverlap < 0 || s.IsolationOverlap >= 1 {
+		return nil, errors.New("Isolation pass overlap must be at least 0 and less than 1")
+	}
+	res := s.Resolution
+	if res <= 0 {
+		res = s.ToolDiameter / 10
+	}
+	passes := s.IsolationPasses
+	if passes < 1 {
+		passes = 1
+	}
+
+	// The shapes are grown as they are read, so the file is read for every pass
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var paths []Path
+	for n := 0; n < passes; n++ {
+		offset := s.ToolDiameter/2 + s.IsolationOffset + float64(n)*s.ToolDiameter*(1-s.IsolationOverlap)
+		shapes, err := parseGerber(bytes.NewReader(data), offset, s.Tolerance)
+		if err != nil {
+			return nil, err
+		}
+		if len(shapes) == 0 {
+			return nil, errors.New("No copper found in Gerber file")
+		}
+		paths = append(paths, isolationPaths(shapes, res)...)
+	}
+
+	return profileDocument("Gerber", paths, s), nil
+}
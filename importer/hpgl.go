@@ -0,0 +1,186 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+import "unicode"
+
+//
+// HPGL import
+//
+// Supports PU, PD, PA, PR, AA, AR and CI. Pen down moves are cut at the
+// configured depth, pen up moves travel at the safe height. Other
+// instructions, such as pen selection, are ignored.
+//
+
+// HPGL plotter units per mm
+const hpglUnitsPerMM = 40
+
+// Reads HPGL instructions as mnemonic and parameter pairs
+func readHPGL(r io.Reader) ([]string, [][]float64, error) {
+	var (
+		mnemonics []string
+		params    [][]float64
+		reader    = bufio.NewReader(r)
+		buf       []rune
+	)
+
+	flush := func() error {
+		s := strings.TrimSpace(string(buf))
+		buf = buf[:0]
+		if len(s) < 2 {
+			return nil
+		}
+		var p []float64
+		for _, f := range strings.FieldsFunc(s[2:], func(c rune) bool { return c == ',' || unicode.IsSpace(c) }) {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Invalid parameter %q for %s", f, s[:2]))
+			}
+			p = append(p, v)
+		}
+		mnemonics = append(mnemonics, strings.ToUpper(s[:2]))
+		params = append(params, p)
+		return nil
+	}
+
+	for {
+		c, _, err := reader.ReadRune()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case c == ';' || c == '\n' || c == '\r':
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		case unicode.IsLetter(c) && len(buf) >= 2 && strings.TrimSpace(string(buf)) != "" && !unicode.IsLetter(buf[len(buf)-1]):
+			// A new instruction without a terminator
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return mnemonics, params, flush()
+}
+
+// Imports an HPGL file, cutting all pen down moves at the configured depth.
+func HPGL(r io.Reader, s Settings) (*gcode.Document, error) {
+	mnemonics, params, err := readHPGL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		paths    []Path
+		cur      *Path
+		pos      Point
+		relative bool
+		penDown  bool
+		scale    = s.Scale / hpglUnitsPerMM
+	)
+
+	finish := func() {
+		if cur != nil && len(cur.Segments) > 0 {
+			paths = append(paths, *cur)
+		}
+		cur = nil
+	}
+
+	moveTo := func(p Point) {
+		if penDown {
+			if cur == nil {
+				cur = &Path{Start: pos}
+			}
+			cur.LineTo(p.X, p.Y)
+		} else {
+			finish()
+		}
+		pos = p
+	}
+
+	arc := func(center Point, sweep float64) {
+		if cur == nil {
+			cur = &Path{Start: pos}
+		}
+		r := pos.dist(center)
+		a := math.Atan2(pos.Y-center.Y, pos.X-center.X) + sweep*math.Pi/180
+		end := Point{center.X + r*math.Cos(a), center.Y + r*math.Sin(a)}
+
+		// Split arcs of more than 180 degrees, as they are ambiguous as full circles
+		if math.Abs(sweep) > 180 {
+			mid := math.Atan2(pos.Y-center.Y, pos.X-center.X) + sweep/2*math.Pi/180
+			cur.ArcTo(center.X+r*math.Cos(mid), center.Y+r*math.Sin(mid), center.X, center.Y, sweep < 0)
+		}
+		cur.ArcTo(end.X, end.Y, center.X, center.Y, sweep < 0)
+		pos = end
+	}
+
+	for idx, m := range mnemonics {
+		p := params[idx]
+		switch m {
+		case "PU", "PD", "PA", "PR":
+			switch m {
+			case "PU":
+				penDown = false
+				finish()
+			case "PD":
+				penDown = true
+			case "PA":
+				relative = false
+			case "PR":
+				relative = true
+			}
+			for i := 0; i+1 < len(p); i += 2 {
+				pt := Point{p[i] * scale, p[i+1] * scale}
+				if relative {
+					pt = Point{pos.X + pt.X, pos.Y + pt.Y}
+				}
+				moveTo(pt)
+			}
+		case "AA", "AR":
+			if len(p) < 3 {
+				return nil, errors.New(fmt.Sprintf("%s requires center and sweep angle", m))
+			}
+			c := Point{p[0] * scale, p[1] * scale}
+			if m == "AR" {
+				c = Point{pos.X + c.X, pos.Y + c.Y}
+			}
+			if penDown {
+				arc(c, p[2])
+			} else {
+				// Pen up arcs only move the pen
+				r := pos.dist(c)
+				a := math.Atan2(pos.Y-c.Y, pos.X-c.X) + p[2]*math.Pi/180
+				pos = Point{c.X + r*math.Cos(a), c.Y + r*math.Sin(a)}
+			}
+		case "CI":
+			if len(p) < 1 {
+				return nil, errors.New("CI requires a radius")
+			}
+			center, r := pos, p[0]*scale
+			finish()
+			cur = &Path{Start: Point{center.X + r, center.Y}}
+			cur.ArcTo(center.X-r, center.Y, center.X, center.Y, false)
+			cur.ArcTo(center.X+r, center.Y, center.X, center.Y, false)
+			finish()
+		}
+	}
+	finish()
+
+	if len(paths) == 0 {
+		return nil, errors.New("No pen down moves found in HPGL file")
+	}
+	return profileDocument("HPGL", paths, s), nil
+}
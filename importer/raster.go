@@ -0,0 +1,124 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "errors"
+import "image"
+import "image/color"
+import _ "image/jpeg"
+import _ "image/png"
+import "io"
+import "math"
+
+//
+// Raster laser engraving
+//
+// Images are engraved line by line, with the laser power (S) of every run of
+// pixels modulated by the pixel intensity: black engraves at full power and
+// white at minimum power. The laser is run in dynamic power mode (M4), and
+// every line is extended by the overscan distance, so that acceleration
+// happens outside of the image.
+//
+
+// Converts a pixel to a power level between MinPower and SpindleSpeed
+func pixelPower(c color.Color, s Settings) float64 {
+	gray := color.GrayModel.Convert(c).(color.Gray)
+	_, _, _, a := c.RGBA()
+	darkness := (1 - float64(gray.Y)/255) * float64(a) / 0xffff
+	if darkness == 0 {
+		return 0
+	}
+	return math.Round(s.MinPower + (s.SpindleSpeed-s.MinPower)*darkness)
+}
+
+// Generates laser raster engraving code from a PNG or JPEG image. One pixel equals one
+// line at the configured DPI. Lines are scanned bidirectionally if configured.
+func Raster(r io.Reader, s Settings) (*gcode.Document, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	if s.DPI <= 0 {
+		return nil, errors.New("Raster engraving requires a DPI greater than zero")
+	}
+
+	var (
+		b       = builder{settings: s}
+		bounds  = img.Bounds()
+		pixel   = 25.4 / s.DPI * s.Scale
+		reverse bool
+	)
+
+	b.comment("Generated by gocnc from image")
+	b.block(gcode.Word{'G', 21}, gcode.Word{'G', 90}, gcode.Word{'G', 17})
+	b.block(gcode.Word{'M', 4}, gcode.Word{'S', 0}, gcode.Word{'F', s.Feedrate})
+
+	for row := bounds.Max.Y - 1; row >= bounds.Min.Y; row-- {
+		y := float64(bounds.Max.Y-1-row) * pixel
+
+		// Collect runs of equal power
+		type run struct {
+			end   int
+			power float64
+		}
+		var runs []run
+		first, last := -1, -1
+		for col := bounds.Min.X; col < bounds.Max.X; col++ {
+			p := pixelPower(img.At(col, row), s)
+			if p > 0 {
+				if first == -1 {
+					first = col
+				}
+				last = col
+			}
+			if len(runs) > 0 && runs[len(runs)-1].power == p {
+				runs[len(runs)-1].end = col + 1
+			} else {
+				runs = append(runs, run{col + 1, p})
+			}
+		}
+		if first == -1 {
+			// Blank line
+			continue
+		}
+
+		x := func(col int) float64 {
+			return float64(col-bounds.Min.X) * pixel
+		}
+		start, end := x(first)-s.Overscan, x(last+1)+s.Overscan
+
+		if !reverse {
+			b.block(gcode.Word{'G', 0}, gcode.Word{'X', start}, gcode.Word{'Y', y}, gcode.Word{'S', 0})
+			b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(first)})
+			for idx, r := range runs {
+				if r.end <= first || (idx > 0 && runs[idx-1].end > last) {
+					continue
+				}
+				b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(r.end)}, gcode.Word{'S', r.power})
+			}
+			b.block(gcode.Word{'G', 1}, gcode.Word{'X', end}, gcode.Word{'S', 0})
+		} else {
+			b.block(gcode.Word{'G', 0}, gcode.Word{'X', end}, gcode.Word{'Y', y}, gcode.Word{'S', 0})
+			b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(last + 1)})
+			for idx := len(runs) - 1; idx >= 0; idx-- {
+				r := runs[idx]
+				begin := bounds.Min.X
+				if idx > 0 {
+					begin = runs[idx-1].end
+				}
+				if begin > last || r.end <= first {
+					continue
+				}
+				b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(begin)}, gcode.Word{'S', r.power})
+			}
+			b.block(gcode.Word{'G', 1}, gcode.Word{'X', start}, gcode.Word{'S', 0})
+		}
+
+		if s.Bidirectional {
+			reverse = !reverse
+		}
+	}
+
+	b.block(gcode.Word{'M', 5})
+	b.block(gcode.Word{'M', 2})
+	return &b.doc, nil
+}
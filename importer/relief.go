@@ -0,0 +1,213 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "errors"
+import "image"
+import "image/color"
+import "io"
+import "math"
+
+//
+// Relief carving from height fields
+//
+// A height field is a regular grid of surface heights. Toolpaths are
+// generated for a ball-nose tool using the drop cutter method: for every
+// position, the tool is lowered until it touches the surface. Roughing clears
+// the stock in layers of PassDepth, leaving StockAllowance on the surface, and
+// finishing follows the surface in parallel passes along the X axis.
+//
+
+// A regular grid of surface heights
+type heightfield struct {
+	w, h   int
+	origin Point     // Position of the first grid point
+	pixel  float64   // Grid spacing (mm)
+	z      []float64 // Surface height, row by row from Y0
+	min    float64   // Lowest surface height
+	rows   map[int][]float64
+}
+
+func newHeightfield(w, h int, pixel float64) *heightfield {
+	return &heightfield{w: w, h: h, pixel: pixel, z: make([]float64, w*h), rows: make(map[int][]float64)}
+}
+
+// Calculates the lowest tool tip height for a ball-nose tool of the given radius along
+// a row, such that the tool does not gouge the surface. Results are cached.
+func (hf *heightfield) toolRow(row int, radius float64) []float64 {
+	if res, ok := hf.rows[row]; ok {
+		return res
+	}
+
+	r := int(math.Ceil(radius / hf.pixel))
+	res := make([]float64, hf.w)
+	for col := 0; col < hf.w; col++ {
+		z := math.Inf(-1)
+		for dy := -r; dy <= r; dy++ {
+			y := row + dy
+			if y < 0 || y >= hf.h {
+				continue
+			}
+			for dx := -r; dx <= r; dx++ {
+				x := col + dx
+				if x < 0 || x >= hf.w {
+					continue
+				}
+				d := math.Hypot(float64(dx), float64(dy)) * hf.pixel
+				if d > radius {
+					continue
+				}
+				// Height of the tool tip when the ball touches this point
+				tip := hf.z[y*hf.w+x] + math.Sqrt(radius*radius-d*d) - radius
+				z = math.Max(z, tip)
+			}
+		}
+		res[col] = z
+	}
+	hf.rows[row] = res
+	return res
+}
+
+// Row indexes spaced by the given distance, always including the last row
+func (hf *heightfield) rowIndexes(spacing float64) []int {
+	step := int(math.Max(1, math.Round(spacing/hf.pixel)))
+	var res []int
+	for row := 0; row < hf.h; row += step {
+		res = append(res, row)
+	}
+	if res[len(res)-1] != hf.h-1 {
+		res = append(res, hf.h-1)
+	}
+	return res
+}
+
+// Traces the contours where the tool, leaving the allowance on the surface, can
+// descend to the level. The contours lie between the grid points.
+func (hf *heightfield) waterline(level, radius, allowance float64) []Path {
+	r := &raster{
+		origin: Point{hf.origin.X - hf.pixel/2, hf.origin.Y - hf.pixel/2},
+		res:    hf.pixel,
+		w:      hf.w,
+		h:      hf.h,
+		cells:  make([]bool, hf.w*hf.h),
+	}
+	for row := 0; row < hf.h; row++ {
+		for col, z := range hf.toolRow(row, radius) {
+			r.cells[row*hf.w+col] = z+allowance > level
+		}
+	}
+	return r.paths()
+}
+
+// Generates roughing and finishing toolpaths for the height field
+func reliefDocument(name string, hf *heightfield, s Settings) *gcode.Document {
+	var (
+		b      = builder{settings: s}
+		radius = s.ToolDiameter / 2
+		x      = func(col int) float64 { return hf.origin.X + float64(col)*hf.pixel }
+		y      = func(row int) float64 { return hf.origin.Y + float64(row)*hf.pixel }
+	)
+
+	b.header(name)
+
+	// Roughing, in layers, each cleared in rows and finished with waterline contours
+	if s.PassDepth > 0 {
+		b.comment("Roughing")
+		for level := -s.PassDepth; level > hf.min+s.StockAllowance-s.PassDepth; level -= s.PassDepth {
+			for _, row := range hf.rowIndexes(s.ToolDiameter / 2) {
+				tool := hf.toolRow(row, radius)
+				cutting := false
+				for col := 0; col <= hf.w; col++ {
+					inside := col < hf.w && tool[col]+s.StockAllowance < level+s.PassDepth
+					if inside {
+						z := math.Max(level, tool[col]+s.StockAllowance)
+						if !cutting {
+							b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+							b.block(gcode.Word{'G', 0}, gcode.Word{'X', x(col)}, gcode.Word{'Y', y(row)})
+							b.block(gcode.Word{'G', 1}, gcode.Word{'Z', z}, gcode.Word{'F', s.PlungeFeedrate})
+							b.block(gcode.Word{'F', s.Feedrate})
+							cutting = true
+						} else {
+							b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(col)}, gcode.Word{'Z', z})
+						}
+					} else if cutting {
+						b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+						cutting = false
+					}
+				}
+			}
+
+			for _, p := range hf.waterline(level, radius, s.StockAllowance) {
+				b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+				b.block(gcode.Word{'G', 0}, gcode.Word{'X', p.Start.X}, gcode.Word{'Y', p.Start.Y})
+				b.block(gcode.Word{'G', 1}, gcode.Word{'Z', level}, gcode.Word{'F', s.PlungeFeedrate})
+				b.path(p, s.Feedrate)
+			}
+		}
+	}
+
+	// Finishing, in alternating directions
+	b.comment("Finishing")
+	reverse := false
+	for _, row := range hf.rowIndexes(s.Stepover) {
+		tool := hf.toolRow(row, radius)
+		start, end, step := 0, hf.w, 1
+		if reverse {
+			start, end, step = hf.w-1, -1, -1
+		}
+
+		b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+		b.block(gcode.Word{'G', 0}, gcode.Word{'X', x(start)}, gcode.Word{'Y', y(row)})
+		b.block(gcode.Word{'G', 1}, gcode.Word{'Z', tool[start]}, gcode.Word{'F', s.PlungeFeedrate})
+		b.block(gcode.Word{'F', s.Feedrate})
+		for col := start + step; col != end; col += step {
+			b.block(gcode.Word{'G', 1}, gcode.Word{'X', x(col)}, gcode.Word{'Z', tool[col]})
+		}
+		reverse = !reverse
+	}
+
+	b.footer()
+	return &b.doc
+}
+
+// Checks the settings required for relief carving
+func checkReliefSettings(s Settings) error {
+	if s.ToolDiameter <= 0 {
+		return errors.New("Relief carving requires a tool diameter")
+	}
+	if s.Stepover <= 0 {
+		return errors.New("Relief carving requires a stepover")
+	}
+	return nil
+}
+
+// Generates relief carving toolpaths from a grayscale heightmap image. White is the
+// top of the stock at Z0, and black is at the configured depth. One pixel
+// equals one grid point at the configured DPI.
+func Heightmap(r io.Reader, s Settings) (*gcode.Document, error) {
+	if err := checkReliefSettings(s); err != nil {
+		return nil, err
+	}
+	if s.DPI <= 0 {
+		return nil, errors.New("Relief carving requires a DPI greater than zero")
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	hf := newHeightfield(bounds.Dx(), bounds.Dy(), 25.4/s.DPI*s.Scale)
+	for row := 0; row < hf.h; row++ {
+		for col := 0; col < hf.w; col++ {
+			// Image rows go downwards, height field rows upwards
+			c := img.At(bounds.Min.X+col, bounds.Max.Y-1-row)
+			gray := color.GrayModel.Convert(c).(color.Gray)
+			z := -s.Depth * (1 - float64(gray.Y)/255)
+			hf.z[row*hf.w+col] = z
+			hf.min = math.Min(hf.min, z)
+		}
+	}
+
+	return reliefDocument("heightmap", hf, s), nil
+}
@@ -0,0 +1,197 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "math"
+import "strconv"
+import "strings"
+
+//
+// STL import
+//
+// The mesh is sampled as a 2.5D height field seen from above, so undercuts are
+// ignored. The top of the model is placed at Z0, and X and Y are kept.
+//
+
+type triangle [3]vector.Vector
+
+// Parses an ASCII STL file
+func parseASCIISTL(data []byte) ([]triangle, error) {
+	var (
+		res     []triangle
+		cur     triangle
+		n       int
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToLower(fields[0]) {
+		case "vertex":
+			if len(fields) != 4 || n > 2 {
+				return nil, errors.New(fmt.Sprintf("Invalid STL vertex: %s", scanner.Text()))
+			}
+			var v [3]float64
+			for i := range v {
+				x, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("Invalid STL vertex: %s", scanner.Text()))
+				}
+				v[i] = x
+			}
+			cur[n] = vector.Vector{v[0], v[1], v[2]}
+			n++
+		case "endfacet":
+			if n != 3 {
+				return nil, errors.New("STL facet without three vertices")
+			}
+			res = append(res, cur)
+			n = 0
+		}
+	}
+	return res, scanner.Err()
+}
+
+// Parses a binary STL file
+func parseBinarySTL(data []byte) ([]triangle, error) {
+	if len(data) < 84 {
+		return nil, errors.New("STL file too short")
+	}
+	count := int(binary.LittleEndian.Uint32(data[80:84]))
+	if len(data) < 84+count*50 {
+		return nil, errors.New(fmt.Sprintf("STL file truncated, expected %d triangles", count))
+	}
+
+	f := func(off int) float64 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(data[off:])))
+	}
+
+	res := make([]triangle, count)
+	for i := range res {
+		// Skip the normal, followed by three vertices and an attribute count
+		off := 84 + i*50 + 12
+		for v := 0; v < 3; v++ {
+			res[i][v] = vector.Vector{f(off), f(off + 4), f(off + 8)}
+			off += 12
+		}
+	}
+	return res, nil
+}
+
+// Parses an ASCII or binary STL file. Binary files may also start with "solid",
+// so the file is only treated as ASCII if it contains facets in text.
+func parseSTL(r io.Reader) ([]triangle, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	head := data
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(head), []byte("solid")) && bytes.Contains(head, []byte("facet")) {
+		return parseASCIISTL(data)
+	}
+	return parseBinarySTL(data)
+}
+
+// Samples the highest surface of the triangles at every grid point. Points not covered
+// by any triangle are at the bottom of the model.
+func sampleTriangles(tris []triangle, res float64) *heightfield {
+	min, max := tris[0][0], tris[0][0]
+	for _, t := range tris {
+		for _, v := range t {
+			min = vector.Vector{math.Min(min.X, v.X), math.Min(min.Y, v.Y), math.Min(min.Z, v.Z)}
+			max = vector.Vector{math.Max(max.X, v.X), math.Max(max.Y, v.Y), math.Max(max.Z, v.Z)}
+		}
+	}
+
+	w := int(math.Ceil((max.X-min.X)/res)) + 1
+	h := int(math.Ceil((max.Y-min.Y)/res)) + 1
+	hf := newHeightfield(w, h, res)
+	hf.origin = Point{min.X, min.Y}
+	for i := range hf.z {
+		hf.z[i] = min.Z
+	}
+
+	for _, t := range tris {
+		a, b, c := t[0], t[1], t[2]
+		det := (b.Y-c.Y)*(a.X-c.X) + (c.X-b.X)*(a.Y-c.Y)
+		if det == 0 {
+			// Vertical or degenerate
+			continue
+		}
+
+		col0 := int(math.Ceil((math.Min(a.X, math.Min(b.X, c.X)) - min.X) / res))
+		col1 := int(math.Floor((math.Max(a.X, math.Max(b.X, c.X)) - min.X) / res))
+		row0 := int(math.Ceil((math.Min(a.Y, math.Min(b.Y, c.Y)) - min.Y) / res))
+		row1 := int(math.Floor((math.Max(a.Y, math.Max(b.Y, c.Y)) - min.Y) / res))
+		for row := row0; row <= row1 && row < h; row++ {
+			for col := col0; col <= col1 && col < w; col++ {
+				x, y := min.X+float64(col)*res, min.Y+float64(row)*res
+
+				// Barycentric coordinates
+				l1 := ((b.Y-c.Y)*(x-c.X) + (c.X-b.X)*(y-c.Y)) / det
+				l2 := ((c.Y-a.Y)*(x-c.X) + (a.X-c.X)*(y-c.Y)) / det
+				l3 := 1 - l1 - l2
+				if l1 < -1e-9 || l2 < -1e-9 || l3 < -1e-9 {
+					continue
+				}
+
+				z := l1*a.Z + l2*b.Z + l3*c.Z
+				hf.z[row*w+col] = math.Max(hf.z[row*w+col], z)
+			}
+		}
+	}
+
+	return hf
+}
+
+// Imports an STL model, generating waterline roughing and parallel finishing passes
+// for a ball-nose tool. The model is scaled by Scale and placed with its top at Z0.
+// Surfaces deeper than Depth are not cut.
+func STL(r io.Reader, s Settings) (*gcode.Document, error) {
+	if err := checkReliefSettings(s); err != nil {
+		return nil, err
+	}
+	res := s.Resolution
+	if res <= 0 {
+		res = s.ToolDiameter / 10
+	}
+
+	tris, err := parseSTL(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(tris) == 0 {
+		return nil, errors.New("No triangles found in STL file")
+	}
+
+	top := math.Inf(-1)
+	for i := range tris {
+		for v := range tris[i] {
+			p := tris[i][v]
+			tris[i][v] = vector.Vector{p.X * s.Scale, p.Y * s.Scale, p.Z * s.Scale}
+			top = math.Max(top, tris[i][v].Z)
+		}
+	}
+
+	hf := sampleTriangles(tris, res)
+	for i, z := range hf.z {
+		hf.z[i] = math.Max(z-top, -s.Depth)
+		hf.min = math.Min(hf.min, hf.z[i])
+	}
+
+	return reliefDocument("STL", hf, s), nil
+}
@@ -0,0 +1,499 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "encoding/xml"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "strconv"
+import "strings"
+import "unicode"
+
+//
+// SVG import
+//
+// Supports path, line, polyline, polygon, rect, circle and ellipse elements.
+// Bezier curves and elliptical arcs are flattened to line segments within the
+// configured tolerance, while circular arcs are kept as arcs. Transforms are
+// not supported. The Y axis is flipped, so that the drawing
+// keeps its orientation with Y pointing up.
+//
+
+// SVG user units per mm
+const svgUnitsPerMM = 96 / 25.4
+
+// Converts SVG user units to mm, flipping the Y axis
+type svgTransform struct {
+	scale, height float64
+}
+
+func (t svgTransform) point(x, y float64) Point {
+	return Point{x * t.scale, (t.height - y) * t.scale}
+}
+
+// Parses a length with an optional unit, returning it in mm
+func svgLength(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	units := map[string]float64{"mm": 1, "cm": 10, "in": 25.4, "pt": 25.4 / 72, "pc": 25.4 / 6, "px": 1 / svgUnitsPerMM}
+	for u, f := range units {
+		if strings.HasSuffix(s, u) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u), 64)
+			return v * f, err == nil
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v / svgUnitsPerMM, err == nil
+}
+
+// Splits an attribute into numbers
+func svgNumbers(s string) []float64 {
+	var res []float64
+	for _, f := range tokenizeSVGPath(s) {
+		if v, err := strconv.ParseFloat(f, 64); err == nil {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Splits path data into commands and numbers
+func tokenizeSVGPath(d string) []string {
+	var (
+		res []string
+		cur []rune
+	)
+	flush := func() {
+		if len(cur) > 0 {
+			res = append(res, string(cur))
+			cur = cur[:0]
+		}
+	}
+	for _, c := range d {
+		switch {
+		case unicode.IsLetter(c) && c != 'e' && c != 'E':
+			flush()
+			res = append(res, string(c))
+		case c == ',' || unicode.IsSpace(c):
+			flush()
+		case c == '-' || c == '+':
+			if len(cur) > 0 && cur[len(cur)-1] != 'e' && cur[len(cur)-1] != 'E' {
+				flush()
+			}
+			cur = append(cur, c)
+		case c == '.':
+			if strings.ContainsRune(string(cur), '.') {
+				flush()
+			}
+			cur = append(cur, c)
+		default:
+			cur = append(cur, c)
+		}
+	}
+	flush()
+	return res
+}
+
+// Flattens a bezier curve with the given control points (in mm) into the path
+func flattenBezier(p *Path, pts []Point, tolerance float64) {
+	// Wang's formula for the number of segments
+	var l float64
+	for i := 0; i+2 < len(pts); i++ {
+		dx := pts[i].X - 2*pts[i+1].X + pts[i+2].X
+		dy := pts[i].Y - 2*pts[i+1].Y + pts[i+2].Y
+		l = math.Max(l, math.Hypot(dx, dy))
+	}
+	deg := float64(len(pts) - 1)
+	n := int(math.Ceil(math.Sqrt(deg * (deg - 1) / 8 * l / tolerance)))
+	if n < 1 {
+		n = 1
+	}
+
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		// De Casteljau
+		tmp := append([]Point{}, pts...)
+		for k := len(tmp) - 1; k > 0; k-- {
+			for j := 0; j < k; j++ {
+				tmp[j] = Point{tmp[j].X + (tmp[j+1].X-tmp[j].X)*t, tmp[j].Y + (tmp[j+1].Y-tmp[j].Y)*t}
+			}
+		}
+		p.LineTo(tmp[0].X, tmp[0].Y)
+	}
+}
+
+// Converts an elliptical arc from its endpoints to its center, radii, start
+// angle and sweep, all in SVG units (see the implementation notes of the SVG
+// specification). Radii too small to reach the end are scaled up.
+func svgArcCenter(x1, y1, x2, y2, rx, ry, phi float64, large, sweep bool) (cx, cy, outRx, outRy, theta, delta float64) {
+	sin, cos := math.Sincos(phi)
+	dx, dy := (x1-x2)/2, (y1-y2)/2
+	x1p, y1p := cos*dx+sin*dy, -sin*dx+cos*dy
+
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if l := x1p*x1p/(rx*rx) + y1p*y1p/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1p*y1p - ry*ry*x1p*x1p
+	den := rx*rx*y1p*y1p + ry*ry*x1p*x1p
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cxp, cyp := coef*rx*y1p/ry, -coef*ry*x1p/rx
+
+	cx = cos*cxp - sin*cyp + (x1+x2)/2
+	cy = sin*cxp + cos*cyp + (y1+y2)/2
+	theta = math.Atan2((y1p-cyp)/ry, (x1p-cxp)/rx)
+	delta = math.Atan2((-y1p-cyp)/ry, (-x1p-cxp)/rx) - theta
+	if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	} else if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	}
+	return cx, cy, rx, ry, theta, delta
+}
+
+// Flattens an elliptical arc in SVG units into the path, from the start angle
+// through the sweep, with the X axis of the ellipse rotated by phi
+func flattenEllipse(p *Path, t svgTransform, cx, cy, rx, ry, phi, theta, delta, tolerance float64) {
+	// Angle of a chord deviating by the tolerance at the larger radius
+	r := math.Max(rx, ry) * t.scale
+	step := math.Pi / 2
+	if r > tolerance {
+		step = math.Min(step, 2*math.Acos(1-tolerance/r))
+	}
+	n := int(math.Ceil(math.Abs(delta) / step))
+	if n < 1 {
+		n = 1
+	}
+
+	sin, cos := math.Sincos(phi)
+	for i := 1; i <= n; i++ {
+		s, c := math.Sincos(theta + delta*float64(i)/float64(n))
+		pt := t.point(cx+cos*rx*c-sin*ry*s, cy+sin*rx*c+cos*ry*s)
+		p.LineTo(pt.X, pt.Y)
+	}
+}
+
+// Parses SVG path data into paths
+func svgPathData(d string, t svgTransform, tolerance float64) ([]Path, error) {
+	var (
+		paths        []Path
+		cur          *Path
+		x, y         float64 // Current point, in SVG units
+		sx, sy       float64 // Subpath start
+		cx, cy       float64 // Last control point, for smooth curves
+		cmd, lastCmd rune
+		tokens       = tokenizeSVGPath(d)
+		idx          = 0
+	)
+
+	num := func() (float64, error) {
+		if idx >= len(tokens) {
+			return 0, errors.New("Unexpected end of path data")
+		}
+		v, err := strconv.ParseFloat(tokens[idx], 64)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Expected number in path data, found %q", tokens[idx]))
+		}
+		idx++
+		return v, nil
+	}
+
+	nums := func(n int) ([]float64, error) {
+		res := make([]float64, n)
+		for i := range res {
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v
+		}
+		return res, nil
+	}
+
+	finish := func() {
+		if cur != nil && len(cur.Segments) > 0 {
+			paths = append(paths, *cur)
+		}
+		cur = nil
+	}
+
+	lineTo := func(nx, ny float64) {
+		if cur == nil {
+			cur = &Path{Start: t.point(x, y)}
+		}
+		p := t.point(nx, ny)
+		cur.LineTo(p.X, p.Y)
+		x, y = nx, ny
+	}
+
+	curveTo := func(ctrl ...float64) {
+		if cur == nil {
+			cur = &Path{Start: t.point(x, y)}
+		}
+		pts := []Point{t.point(x, y)}
+		for i := 0; i+1 < len(ctrl); i += 2 {
+			pts = append(pts, t.point(ctrl[i], ctrl[i+1]))
+		}
+		flattenBezier(cur, pts, tolerance)
+		cx, cy = ctrl[len(ctrl)-4], ctrl[len(ctrl)-3]
+		x, y = ctrl[len(ctrl)-2], ctrl[len(ctrl)-1]
+	}
+
+	arcTo := func(rx, ry, rot float64, large, sweep bool, nx, ny float64) {
+		if nx == x && ny == y {
+			return
+		}
+		if rx == 0 || ry == 0 {
+			lineTo(nx, ny)
+			return
+		}
+		if cur == nil {
+			cur = &Path{Start: t.point(x, y)}
+		}
+		acx, acy, rx, ry, theta, delta := svgArcCenter(x, y, nx, ny, rx, ry, rot*math.Pi/180, large, sweep)
+		if math.Abs(rx-ry) > 1e-9*math.Max(rx, ry) {
+			flattenEllipse(cur, t, acx, acy, rx, ry, rot*math.Pi/180, theta, delta, tolerance)
+			x, y = nx, ny
+			return
+		}
+
+		// Circular arcs are kept. The Y axis is flipped, so a positive sweep
+		// in SVG units is clockwise. Arcs of more than 180 degrees are split,
+		// as they are ambiguous as full circles.
+		c := t.point(acx, acy)
+		if math.Abs(delta) > math.Pi {
+			s, co := math.Sincos(theta + delta/2)
+			mid := t.point(acx+rx*co, acy+rx*s)
+			cur.ArcTo(mid.X, mid.Y, c.X, c.Y, sweep)
+		}
+		end := t.point(nx, ny)
+		cur.ArcTo(end.X, end.Y, c.X, c.Y, sweep)
+		x, y = nx, ny
+	}
+
+	for idx < len(tokens) {
+		if r := rune(tokens[idx][0]); unicode.IsLetter(r) {
+			cmd = r
+			idx++
+		} else if cmd == 'M' {
+			// Implicit lineto after moveto
+			cmd = 'L'
+		} else if cmd == 'm' {
+			cmd = 'l'
+		} else if cmd == 0 {
+			return nil, errors.New("Path data must start with a command")
+		}
+
+		rel := unicode.IsLower(cmd)
+		ox, oy := 0.0, 0.0
+		if rel {
+			ox, oy = x, y
+		}
+
+		switch unicode.ToUpper(cmd) {
+		case 'M':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			finish()
+			x, y = v[0]+ox, v[1]+oy
+			sx, sy = x, y
+		case 'L':
+			v, err := nums(2)
+			if err != nil {
+				return nil, err
+			}
+			lineTo(v[0]+ox, v[1]+oy)
+		case 'H':
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			lineTo(v+ox, y)
+		case 'V':
+			v, err := num()
+			if err != nil {
+				return nil, err
+			}
+			lineTo(x, v+oy)
+		case 'C':
+			v, err := nums(6)
+			if err != nil {
+				return nil, err
+			}
+			curveTo(v[0]+ox, v[1]+oy, v[2]+ox, v[3]+oy, v[4]+ox, v[5]+oy)
+		case 'S', 'T':
+			n := 4
+			if unicode.ToUpper(cmd) == 'T' {
+				n = 2
+			}
+			v, err := nums(n)
+			if err != nil {
+				return nil, err
+			}
+			// Reflect the previous control point, if the previous command was a curve of the same kind
+			rx, ry := x, y
+			prev := unicode.ToUpper(lastCmd)
+			if (n == 4 && (prev == 'C' || prev == 'S')) || (n == 2 && (prev == 'Q' || prev == 'T')) {
+				rx, ry = 2*x-cx, 2*y-cy
+			}
+			if n == 4 {
+				curveTo(rx, ry, v[0]+ox, v[1]+oy, v[2]+ox, v[3]+oy)
+			} else {
+				curveTo(rx, ry, v[0]+ox, v[1]+oy)
+			}
+		case 'Q':
+			v, err := nums(4)
+			if err != nil {
+				return nil, err
+			}
+			curveTo(v[0]+ox, v[1]+oy, v[2]+ox, v[3]+oy)
+		case 'A':
+			v, err := nums(7)
+			if err != nil {
+				return nil, err
+			}
+			arcTo(v[0], v[1], v[2], v[3] != 0, v[4] != 0, v[5]+ox, v[6]+oy)
+		case 'Z':
+			if x != sx || y != sy {
+				lineTo(sx, sy)
+			}
+			finish()
+			x, y = sx, sy
+		default:
+			return nil, errors.New(fmt.Sprintf("Unsupported path command '%c'", cmd))
+		}
+		lastCmd = cmd
+	}
+	finish()
+	return paths, nil
+}
+
+// The SVG elements we care about
+type svgElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+}
+
+func (e svgElement) attr(name string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e svgElement) float(name string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(e.attr(name)), 64)
+	return v
+}
+
+// Converts a single element to paths
+func svgElementPaths(e svgElement, t svgTransform, tolerance float64) ([]Path, error) {
+	switch e.XMLName.Local {
+	case "path":
+		return svgPathData(e.attr("d"), t, tolerance)
+	case "line":
+		p := Path{Start: t.point(e.float("x1"), e.float("y1"))}
+		end := t.point(e.float("x2"), e.float("y2"))
+		p.LineTo(end.X, end.Y)
+		return []Path{p}, nil
+	case "polyline", "polygon":
+		v := svgNumbers(e.attr("points"))
+		if len(v) < 4 {
+			return nil, nil
+		}
+		p := Path{Start: t.point(v[0], v[1])}
+		for i := 2; i+1 < len(v); i += 2 {
+			pt := t.point(v[i], v[i+1])
+			p.LineTo(pt.X, pt.Y)
+		}
+		if e.XMLName.Local == "polygon" {
+			p.LineTo(p.Start.X, p.Start.Y)
+		}
+		return []Path{p}, nil
+	case "rect":
+		x, y, w, h := e.float("x"), e.float("y"), e.float("width"), e.float("height")
+		p := Path{Start: t.point(x, y)}
+		for _, c := range [][2]float64{{x + w, y}, {x + w, y + h}, {x, y + h}, {x, y}} {
+			pt := t.point(c[0], c[1])
+			p.LineTo(pt.X, pt.Y)
+		}
+		return []Path{p}, nil
+	case "circle":
+		cx, cy, r := e.float("cx"), e.float("cy"), e.float("r")
+		if r <= 0 {
+			return nil, nil
+		}
+		c := t.point(cx, cy)
+		r *= t.scale
+		p := Path{Start: Point{c.X + r, c.Y}}
+		p.ArcTo(c.X-r, c.Y, c.X, c.Y, false)
+		p.ArcTo(c.X+r, c.Y, c.X, c.Y, false)
+		return []Path{p}, nil
+	case "ellipse":
+		cx, cy, rx, ry := e.float("cx"), e.float("cy"), e.float("rx"), e.float("ry")
+		if rx <= 0 || ry <= 0 {
+			return nil, nil
+		}
+		p := Path{Start: t.point(cx+rx, cy)}
+		flattenEllipse(&p, t, cx, cy, rx, ry, 0, 0, 2*math.Pi, tolerance)
+		return []Path{p}, nil
+	}
+	return nil, nil
+}
+
+// Imports an SVG file, generating engraving toolpaths following all supported shapes.
+func SVG(r io.Reader, s Settings) (*gcode.Document, error) {
+	var (
+		paths   []Path
+		t       = svgTransform{scale: s.Scale / svgUnitsPerMM}
+		decoder = xml.NewDecoder(r)
+	)
+
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		e := svgElement{start.Name, start.Attr}
+
+		if e.XMLName.Local == "svg" {
+			// Document size determines the Y flip and the scale of user units
+			height, _ := svgLength(e.attr("height"))
+			width, _ := svgLength(e.attr("width"))
+			t.height = height * svgUnitsPerMM
+			if vb := svgNumbers(e.attr("viewBox")); len(vb) == 4 && vb[2] > 0 && vb[3] > 0 {
+				t.height = vb[1]*2 + vb[3]
+				if width > 0 {
+					t.scale = s.Scale * width / vb[2]
+				}
+			}
+			continue
+		}
+
+		p, err := svgElementPaths(e, t, s.Tolerance)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("<%s>: %s", e.XMLName.Local, err))
+		}
+		paths = append(paths, p...)
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("No supported elements found in SVG")
+	}
+	return profileDocument("SVG", paths, s), nil
+}
@@ -0,0 +1,266 @@
+package importer
+
+import "github.com/joushou/gocnc/gcode"
+import "math"
+
+//
+// Toolpath generation shared by the importers.
+//
+// Importers convert their input to 2D paths, which are then cut as profiles
+// at the configured depth, in one or more passes. The result is a regular
+// gcode document, ready to be run through the vm.
+//
+
+// Constants for path ordering
+const (
+	OrderNearest  = iota
+	OrderDocument = iota
+)
+
+// Settings for generated toolpaths
+type Settings struct {
+	Depth            float64 // Final cutting depth below Z0 (mm)
+	PassDepth        float64 // Maximum depth per pass (mm, <= 0 for a single pass)
+	SafeHeight       float64 // Height for moves between paths (mm)
+	Feedrate         float64 // Cutting feedrate (mm/min)
+	PlungeFeedrate   float64 // Plunge feedrate (mm/min)
+	SpindleSpeed     float64 // RPM, 0 to leave the spindle off
+	Tolerance        float64 // Maximum deviation when flattening curves (mm)
+	Scale            float64 // Scale factor from input units to mm
+	Order            int     // Path ordering
+	PeckDepth        float64 // Depth per peck when drilling (mm, <= 0 to disable)
+	Retract          float64 // Retract height between pecks (mm)
+	ToolMap          map[int]int
+	ToolDiameter     float64 // Diameter of the cutting tool (mm)
+	Resolution       float64 // Raster resolution used for isolation routing and STL sampling (mm, 0 for automatic)
+	IsolationOffset  float64 // Extra distance between copper and isolation path (mm)
+	IsolationPasses  int     // Isolation paths around the copper, each further out (<= 1 for one)
+	IsolationOverlap float64 // Overlap of neighbouring isolation passes (fraction of the tool diameter)
+	DPI              float64 // Raster engraving resolution (dots per inch)
+	Overscan         float64 // Distance to extend raster lines by (mm)
+	Bidirectional    bool    // Scan raster lines in both directions
+	MinPower         float64 // Laser power for white pixels (SpindleSpeed is used for black)
+	Stepover         float64 // Distance between finishing passes (mm)
+	StockAllowance   float64 // Stock left on the surface by roughing (mm)
+}
+
+// Returns reasonable default settings
+func DefaultSettings() Settings {
+	return Settings{
+		Depth:            1,
+		PassDepth:        0,
+		SafeHeight:       5,
+		Feedrate:         500,
+		PlungeFeedrate:   100,
+		SpindleSpeed:     10000,
+		Tolerance:        0.01,
+		Scale:            1,
+		Retract:          1,
+		DPI:              254,
+		Overscan:         2,
+		IsolationOverlap: 0.5,
+	}
+}
+
+// A point in the XY plane
+type Point struct {
+	X, Y float64
+}
+
+func (p Point) dist(o Point) float64 {
+	return math.Hypot(p.X-o.X, p.Y-o.Y)
+}
+
+// A path segment, either a line or an arc ending at End
+type PathSegment struct {
+	End       Point
+	Arc       bool
+	Center    Point
+	Clockwise bool
+}
+
+// A path of connected segments
+type Path struct {
+	Start    Point
+	Segments []PathSegment
+}
+
+// Returns the end point of the path
+func (p Path) End() Point {
+	if len(p.Segments) == 0 {
+		return p.Start
+	}
+	return p.Segments[len(p.Segments)-1].End
+}
+
+// Tests if the path ends where it starts
+func (p Path) Closed() bool {
+	return len(p.Segments) > 0 && p.End().dist(p.Start) < 1e-6
+}
+
+// Returns the path in the opposite direction
+func (p Path) Reverse() Path {
+	res := Path{Start: p.End()}
+	for i := len(p.Segments) - 1; i >= 0; i-- {
+		s := p.Segments[i]
+		end := p.Start
+		if i > 0 {
+			end = p.Segments[i-1].End
+		}
+		res.Segments = append(res.Segments, PathSegment{end, s.Arc, s.Center, !s.Clockwise})
+	}
+	return res
+}
+
+// Appends a line to the path
+func (p *Path) LineTo(x, y float64) {
+	p.Segments = append(p.Segments, PathSegment{End: Point{x, y}})
+}
+
+// Appends an arc around the center to the path
+func (p *Path) ArcTo(x, y, cx, cy float64, clockwise bool) {
+	p.Segments = append(p.Segments, PathSegment{Point{x, y}, true, Point{cx, cy}, clockwise})
+}
+
+// Orders the paths to reduce travel, starting at the origin. Paths may be reversed,
+// and paths that connect are joined.
+func orderPaths(paths []Path) []Path {
+	var (
+		res []Path
+		cur Point
+	)
+
+	for len(paths) > 0 {
+		best, reverse, bestDist := 0, false, math.Inf(1)
+		for idx, p := range paths {
+			if d := p.Start.dist(cur); d < bestDist {
+				best, reverse, bestDist = idx, false, d
+			}
+			if d := p.End().dist(cur); d < bestDist && !p.Closed() {
+				best, reverse, bestDist = idx, true, d
+			}
+		}
+
+		p := paths[best]
+		paths = append(paths[:best], paths[best+1:]...)
+		if reverse {
+			p = p.Reverse()
+		}
+
+		if len(res) > 0 && bestDist < 1e-6 && !res[len(res)-1].Closed() {
+			last := &res[len(res)-1]
+			last.Segments = append(last.Segments, p.Segments...)
+		} else {
+			res = append(res, p)
+		}
+		cur = p.End()
+	}
+	return res
+}
+
+// Builds a gcode document
+type builder struct {
+	doc      gcode.Document
+	settings Settings
+}
+
+func (b *builder) block(words ...gcode.Word) {
+	var blk gcode.Block
+	for idx := range words {
+		blk.AppendNode(&words[idx])
+	}
+	b.doc.AppendBlock(blk)
+}
+
+func (b *builder) comment(c string) {
+	var blk gcode.Block
+	blk.AppendNode(&gcode.Comment{Content: c})
+	b.doc.AppendBlock(blk)
+}
+
+// Adds the program header, selecting units, positioning mode and spindle
+func (b *builder) header(name string) {
+	b.comment("Generated by gocnc from " + name)
+	b.block(gcode.Word{'G', 21}, gcode.Word{'G', 90}, gcode.Word{'G', 17})
+	b.block(gcode.Word{'G', 0}, gcode.Word{'Z', b.settings.SafeHeight})
+	if b.settings.SpindleSpeed > 0 {
+		b.block(gcode.Word{'M', 3}, gcode.Word{'S', b.settings.SpindleSpeed})
+	}
+}
+
+// Adds the program footer, retracting and stopping the spindle
+func (b *builder) footer() {
+	b.block(gcode.Word{'G', 0}, gcode.Word{'Z', b.settings.SafeHeight})
+	if b.settings.SpindleSpeed > 0 {
+		b.block(gcode.Word{'M', 5})
+	}
+	b.block(gcode.Word{'M', 2})
+}
+
+// Depths of each pass, the fewest passes of equal depth no deeper than the pass depth
+func (b *builder) passes() []float64 {
+	depth := b.settings.Depth
+	step := b.settings.PassDepth
+	if step <= 0 || step >= depth {
+		return []float64{-depth}
+	}
+	var (
+		n   = int(math.Ceil(depth/step - 1e-9))
+		res = make([]float64, n)
+	)
+	for i := range res {
+		res[i] = -depth * float64(i+1) / float64(n)
+	}
+	return res
+}
+
+// Cuts the path as a profile, in passes
+func (b *builder) profile(p Path) {
+	s := b.settings
+	for _, z := range b.passes() {
+		b.block(gcode.Word{'G', 0}, gcode.Word{'Z', s.SafeHeight})
+		b.block(gcode.Word{'G', 0}, gcode.Word{'X', p.Start.X}, gcode.Word{'Y', p.Start.Y})
+		b.block(gcode.Word{'G', 1}, gcode.Word{'Z', z}, gcode.Word{'F', s.PlungeFeedrate})
+		b.path(p, s.Feedrate)
+	}
+}
+
+// Follows the path at the current height
+func (b *builder) path(p Path, feed float64) {
+	cur := p.Start
+	for idx, seg := range p.Segments {
+		x, y := gcode.Word{'X', seg.End.X}, gcode.Word{'Y', seg.End.Y}
+		f := gcode.Word{'F', feed}
+		if seg.Arc {
+			g := gcode.Word{'G', 3}
+			if seg.Clockwise {
+				g.Command = 2
+			}
+			i, j := gcode.Word{'I', seg.Center.X - cur.X}, gcode.Word{'J', seg.Center.Y - cur.Y}
+			if idx == 0 {
+				b.block(g, x, y, i, j, f)
+			} else {
+				b.block(g, x, y, i, j)
+			}
+		} else if idx == 0 {
+			b.block(gcode.Word{'G', 1}, x, y, f)
+		} else {
+			b.block(gcode.Word{'G', 1}, x, y)
+		}
+		cur = seg.End
+	}
+}
+
+// Generates a document cutting all paths as profiles
+func profileDocument(name string, paths []Path, s Settings) *gcode.Document {
+	b := builder{settings: s}
+	b.header(name)
+	if s.Order == OrderNearest {
+		paths = orderPaths(paths)
+	}
+	for _, p := range paths {
+		b.profile(p)
+	}
+	b.footer()
+	return &b.doc
+}
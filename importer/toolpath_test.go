@@ -0,0 +1,36 @@
+package importer
+
+import "math"
+import "testing"
+
+func TestPasses(t *testing.T) {
+	tests := []struct {
+		depth, step float64
+		passes      []float64
+	}{
+		{1, 0, []float64{-1}},
+		{1, 2, []float64{-1}},
+		{1, 0.5, []float64{-0.5, -1}},
+		{0.3, 0.1, []float64{-0.1, -0.2, -0.3}},
+		{0.7, 0.1, []float64{-0.1, -0.2, -0.3, -0.4, -0.5, -0.6, -0.7}},
+		{1, 0.1, []float64{-0.1, -0.2, -0.3, -0.4, -0.5, -0.6, -0.7, -0.8, -0.9, -1}},
+		{1, 0.4, []float64{-1.0 / 3, -2.0 / 3, -1}},
+	}
+	for _, test := range tests {
+		b := builder{settings: Settings{Depth: test.depth, PassDepth: test.step}}
+		passes := b.passes()
+		if len(passes) != len(test.passes) {
+			t.Errorf("depth %g in steps of %g: got passes %v, expected %v", test.depth, test.step, passes, test.passes)
+			continue
+		}
+		for idx, z := range passes {
+			if math.Abs(z-test.passes[idx]) > 1e-12 {
+				t.Errorf("depth %g in steps of %g: got passes %v, expected %v", test.depth, test.step, passes, test.passes)
+				break
+			}
+		}
+		if passes[len(passes)-1] != -test.depth {
+			t.Errorf("depth %g in steps of %g: last pass at %g", test.depth, test.step, passes[len(passes)-1])
+		}
+	}
+}
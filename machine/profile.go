@@ -0,0 +1,125 @@
+package machine
+
+import "github.com/joushou/gocnc/vector"
+import "encoding/json"
+import "io/ioutil"
+import "errors"
+import "fmt"
+
+//
+// Machine profiles
+//
+// A profile describes the physical machine: axis travels, feedrates,
+// accelerations, spindle range and tool change behaviour. It is shared by
+// the vm limit checker, time estimation, optimization passes, exporters
+// and streamers, so that they all agree on what the machine can do.
+//
+
+// Constants for tool change behaviour
+const (
+	ToolchangeIgnore    = iota
+	ToolchangeManual    = iota
+	ToolchangeAutomatic = iota
+)
+
+// Axis configuration
+type Axis struct {
+	Min, Max     float64 // Travel (mm)
+	MaxFeedrate  float64 // Maximum feedrate (mm/min)
+	Acceleration float64 // Acceleration (mm/s^2)
+}
+
+// Spindle configuration
+type Spindle struct {
+	MinSpeed, MaxSpeed float64 // RPM
+	Reversible         bool
+}
+
+// Tool change configuration
+type Toolchange struct {
+	Mode   int
+	Height float64 // Height to go to for tool changes (mm, 0 to use safety height)
+	Time   float64 // Time spent per tool change (seconds)
+}
+
+// Machine profile
+type Profile struct {
+	Name              string
+	X, Y, Z           Axis
+	JunctionDeviation float64 // mm
+	Spindle           Spindle
+	Toolchange        Toolchange
+}
+
+// Returns a profile matching Grbl's default settings
+func Default() Profile {
+	axis := Axis{Min: -200, Max: 200, MaxFeedrate: 500, Acceleration: 10}
+	return Profile{
+		Name:              "grbl",
+		X:                 axis,
+		Y:                 axis,
+		Z:                 axis,
+		JunctionDeviation: 0.01,
+		Spindle:           Spindle{MinSpeed: 0, MaxSpeed: 10000, Reversible: true},
+		Toolchange:        Toolchange{Mode: ToolchangeIgnore},
+	}
+}
+
+// Loads a JSON encoded profile. Fields missing from the file keep their default values.
+func Load(path string) (Profile, error) {
+	p := Default()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, errors.New(fmt.Sprintf("Invalid profile %s: %s", path, err))
+	}
+	return p, p.Validate()
+}
+
+// Checks the profile for inconsistent values
+func (p Profile) Validate() error {
+	for _, a := range []struct {
+		name string
+		axis Axis
+	}{{"X", p.X}, {"Y", p.Y}, {"Z", p.Z}} {
+		if a.axis.Min > a.axis.Max {
+			return errors.New(fmt.Sprintf("%s axis minimum travel exceeds maximum", a.name))
+		}
+		if a.axis.MaxFeedrate <= 0 || a.axis.Acceleration <= 0 {
+			return errors.New(fmt.Sprintf("%s axis feedrate and acceleration must be greater than zero", a.name))
+		}
+	}
+	if p.Spindle.MinSpeed > p.Spindle.MaxSpeed {
+		return errors.New("Spindle minimum speed exceeds maximum")
+	}
+	return nil
+}
+
+// Per-axis maximum feedrate
+func (p Profile) MaxFeedrate() vector.Vector {
+	return vector.Vector{p.X.MaxFeedrate, p.Y.MaxFeedrate, p.Z.MaxFeedrate}
+}
+
+// Per-axis acceleration
+func (p Profile) Acceleration() vector.Vector {
+	return vector.Vector{p.X.Acceleration, p.Y.Acceleration, p.Z.Acceleration}
+}
+
+// Minimum travel of all axes
+func (p Profile) MinTravel() vector.Vector {
+	return vector.Vector{p.X.Min, p.Y.Min, p.Z.Min}
+}
+
+// Maximum travel of all axes
+func (p Profile) MaxTravel() vector.Vector {
+	return vector.Vector{p.X.Max, p.Y.Max, p.Z.Max}
+}
+
+// Tests if a point is within the travel of the machine
+func (p Profile) Contains(v vector.Vector) bool {
+	return v.X >= p.X.Min && v.X <= p.X.Max &&
+		v.Y >= p.Y.Min && v.Y <= p.Y.Max &&
+		v.Z >= p.Z.Min && v.Z <= p.Z.Max
+}
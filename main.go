@@ -5,11 +5,20 @@ import "github.com/joushou/gocnc/vm"
 import "github.com/joushou/gocnc/optimize"
 import "github.com/joushou/gocnc/export"
 import "github.com/joushou/gocnc/streaming"
+import "github.com/joushou/gocnc/importer"
+import "github.com/joushou/gocnc/server"
+import "github.com/joushou/gocnc/plugins"
+import "github.com/joushou/gocnc/warnings"
+import "github.com/joushou/gocnc/transform"
+import mach "github.com/joushou/gocnc/machine"
 import "github.com/cheggaaa/pb"
 import "gopkg.in/alecthomas/kingpin.v1"
 
 import "io/ioutil"
 import "bufio"
+import "context"
+import "errors"
+import "io"
 
 import "fmt"
 import "os"
@@ -17,34 +26,106 @@ import "os/signal"
 import "syscall"
 import "time"
 import "strconv"
+import "strings"
+import "path/filepath"
+import "sort"
 
 var (
-	inputFile  = kingpin.Arg("input", "Input file").Required().ExistingFile()
+	inputFile  = kingpin.Arg("input", "Input file").ExistingFile()
 	device     = kingpin.Flag("device", "Serial device for gcode").Short('d').ExistingFile()
 	baudrate   = kingpin.Flag("baudrate", "Baudrate for serial device").Short('b').Default("115200").Int()
+	controller = kingpin.Flag("controller", "Controller on the serial device (grbl, g2core)").Default("grbl").Enum("grbl", "g2core")
 	outputFile = kingpin.Flag("output", "Output file for gcode").Short('o').String()
+	split      = kingpin.Flag("split", "Split the output file into numbered parts at tool changes, Z levels or retracts to the safety height between operations (tool, level, operation)").Enum("tool", "level", "operation")
+	sections   = kingpin.Flag("splitsections", "Write the parts of --split as named sections of the output file, each starting with a safe-start prologue, instead of files of their own").Bool()
+	preview    = kingpin.Flag("preview", "Output file for an SVG preview of the toolpath, shaded by depth with a layer per tool").String()
+	dxfFile    = kingpin.Flag("dxf", "Output file for a DXF drawing of the toolpath, with layers for rapids and for the cuts of every tool and depth").String()
+	serve      = kingpin.Flag("serve", "Run as a processing server on the address (e.g. :8080) instead of processing a file").String()
 
 	dumpStdout = kingpin.Flag("stdout", "Dump gcode to stdout").Bool()
 	debugDump  = kingpin.Flag("debugdump", "Dump VM state to stdout").Hidden().Bool()
 
 	stats     = kingpin.Flag("stats", "Print gcode metrics").Default("true").Bool()
 	autoStart = kingpin.Flag("autostart", "Start sending code without asking questions").Bool()
+	resume    = kingpin.Flag("resume", "Start exported or streamed code at the given line of the input, with a safe-start prologue. Not possible after path grouping, travel or drill ordering").Int()
+	resumeIdx = kingpin.Flag("resumeindex", "Start exported or streamed code at the given segment index, as reported when streaming stops, with a safe-start prologue").Int()
 
 	opt             = kingpin.Flag("opt", "Allow optimizations").Default("true").Bool()
 	optBogusMove    = kingpin.Flag("optbogus", "Remove all moves that would be an implicit part of another move (Deprecated for optvector)").Default("false").Bool()
 	optVector       = kingpin.Flag("optvector", "Remove all B moves that deviate from the line AC more than tolerance").Default("true").Bool()
+	optCollinear    = kingpin.Flag("optcollinear", "Merge consecutive feed moves at the same state along a straight line, within the angle and deviation tolerances").Bool()
+	optPrune        = kingpin.Flag("optprune", "Remove moves to the current position that change no state, and collapse repeated mode changes").Default("true").Bool()
+	optRetracts     = kingpin.Flag("optretracts", "Replace retracts between nearby cuts with hops at the clearance height").Bool()
+	optDrillOrder   = kingpin.Flag("optdrillorder", "Reorder runs of drilled holes of the same tool and depth to minimize travel").Bool()
+	optAxisFeed     = kingpin.Flag("optaxisfeed", "Lower feedrates so that no axis exceeds its maximum feedrate in the machine profile").Bool()
 	optLiftSpeed    = kingpin.Flag("optlifts", "Use rapid positioning for Z-only upwards moves").Default("true").Bool()
 	optDrillSpeed   = kingpin.Flag("optdrill", "Use rapid positioning for drills to last drilled depth").Default("true").Bool()
 	optFloatingZ    = kingpin.Flag("optfloat", "Remove bogus moves above Z0 (floating Z)").Default("true").Bool()
 	optPathGrouping = kingpin.Flag("optpath", "Optimize path to minimize moves between individual operations").Default("true").Bool()
+	optTravel       = kingpin.Flag("opttravel", "Reorder operations separated by retracts to the safety height to minimize rapid travel").Bool()
+	optExtra        = kingpin.Flag("optimizer", "Run a registered optimizer, such as one loaded from a plugin (repeatable)").Strings()
+
+	pluginFiles = kingpin.Flag("plugin", "Load code generators and optimizers from a Go plugin (repeatable)").Strings()
+	generator   = kingpin.Flag("generator", "Registered code generator to use for exported gcode (g2core, grbl, grbl-laser, linuxcnc, mach, marlin, marlin-serial, plasma, string or from a plugin)").String()
 
 	precision        = kingpin.Flag("precision", "Precision to use for exported gcode (max mantissa digits)").Default("4").Int()
+	sourceComments   = kingpin.Flag("sourcecomments", "Comment exported gcode with the input line of the moves that follow").Bool()
+	arcFit           = kingpin.Flag("arcfit", "Export lines fitting arcs within the tolerance as G2/G3, except with --resume (mm, 0 to disable)").Default("0").Float()
 	maxArcDeviation  = kingpin.Flag("maxarcdeviation", "Maximum deviation from an ideal arc (mm)").Default("0.002").Float()
 	minArcLineLength = kingpin.Flag("minarclinelength", "Minimum arc segment line length (mm)").Default("0.01").Float()
 	rtolerance       = kingpin.Flag("rtolerance", "Tolerance used by route grouping (mm)").Default("0.001").Float()
 	vtolerance       = kingpin.Flag("vtolerance", "Tolerance used by vector optimization (mm)").Default("0.0003").Float()
+	ctolerance       = kingpin.Flag("ctolerance", "Deviation tolerance used by collinear merging (mm)").Default("0.001").Float()
+	cangle           = kingpin.Flag("cangle", "Angle tolerance used by collinear merging (degrees)").Default("1").Float()
+	hopClearance     = kingpin.Flag("hopclearance", "Height above Z0 of hops replacing retracts (mm)").Default("0.5").Float()
+	hopDistance      = kingpin.Flag("hopdistance", "Maximum XY distance of hops replacing retracts (mm)").Default("5").Float()
+	verifyTolerance  = kingpin.Flag("verify", "Fail if optimizations change the toolpath by more than the given distance (mm, 0 to disable)").Default("0").Float()
+
+	dialect    = kingpin.Flag("dialect", "Input gcode dialect (rs274ngc, mach, marlin)").Default("rs274ngc").Enum("rs274ngc", "mach", "marlin")
+	tolerant   = kingpin.Flag("tolerant", "Skip lines that cannot be parsed instead of failing").Bool()
+	revDwell   = kingpin.Flag("reversaldwell", "Stop the spindle and dwell for the given seconds before reversing it (negative to disable)").Default("-1").Float()
+	explain    = kingpin.Flag("explain", "Print the program annotated with the interpretation of every line, and exit").Bool()
+	strictFeed = kingpin.Flag("strictfeed", "Fail on feed moves without a previously set feedrate instead of warning").Bool()
+	cutComp    = kingpin.Flag("cutcomp", "Offset the path for cutter compensation (G41/G42) instead of passing it on").Bool()
+	bakeScale  = kingpin.Flag("bakescaling", "Scale the exported coordinates for G51 instead of passing it on to generators that can scale (mach)").Bool()
+
+	plasma       = kingpin.Flag("plasma", "Treat the spindle as a plasma torch, piercing when it is fired").Bool()
+	pierceHeight = kingpin.Flag("pierceheight", "Height to fire the plasma torch at (mm, 0 to fire at the current height)").Default("0").Float()
+	pierceDelay  = kingpin.Flag("piercedelay", "Seconds to wait after firing the plasma torch").Default("0").Float()
+	cutHeight    = kingpin.Flag("cutheight", "Height to cut at after piercing (mm)").Default("0").Float()
+	thcOutput    = kingpin.Flag("thcoutput", "Digital output disabling torch height control (M62-M65 P), -1 for none").Default("2").Int()
+
+	profileFile = kingpin.Flag("profile", "Machine profile (JSON) describing travels, feedrates and accelerations").ExistingFile()
+	limitMode   = kingpin.Flag("limits", "Handling of moves exceeding the machine profile: report them as warnings, clip them to the machine envelope, or abort").Default("report").Enum("report", "clip", "abort")
+	toolFile    = kingpin.Flag("tooltable", "Tool table (JSON, or CSV with a .csv extension) with diameters and length offsets").ExistingFile()
+
+	scallopRadius = kingpin.Flag("scallopradius", "Ball-nose radius for scallop height estimation (mm, 0 to disable)").Float()
+	scallopTarget = kingpin.Flag("scalloptarget", "Maximum acceptable scallop height (mm)").Default("0.01").Float()
+
+	importDepth     = kingpin.Flag("depth", "Cutting depth for imported drawings (mm)").Default("1").Float()
+	importPassDepth = kingpin.Flag("passdepth", "Maximum depth per pass for imported drawings (mm, 0 for a single pass)").Default("0").Float()
+	importFeed      = kingpin.Flag("cutfeed", "Cutting feedrate for imported drawings (mm/min)").Default("500").Float()
+	importPlunge    = kingpin.Flag("plungefeed", "Plunge feedrate for imported drawings (mm/min)").Default("100").Float()
+	importSafe      = kingpin.Flag("safez", "Safe height for imported drawings (mm)").Default("5").Float()
+	importSpindle   = kingpin.Flag("rpm", "Spindle speed for imported drawings (RPM, 0 to disable)").Default("10000").Float()
+	importScale     = kingpin.Flag("importscale", "Scale factor from drawing units to mm").Default("1").Float()
+	importPeck      = kingpin.Flag("peckdepth", "Peck depth for imported drill files (mm, 0 to disable)").Default("0").Float()
+	importToolMap   = kingpin.Flag("toolmap", "Map a drill file tool to a machine tool (from=to, repeatable)").Strings()
+	importTool      = kingpin.Flag("tooldiameter", "Tool diameter for Gerber isolation routing, relief carving and STL import (mm)").Default("0.2").Float()
+	importIsolation = kingpin.Flag("isolation", "Extra clearance between copper and isolation path (mm)").Default("0").Float()
+	importIsoPasses = kingpin.Flag("isolationpasses", "Number of Gerber isolation passes, each further from the copper").Default("1").Int()
+	importIsoLap    = kingpin.Flag("isolationoverlap", "Overlap of neighbouring Gerber isolation passes (fraction of the tool diameter)").Default("0.5").Float()
+	importDPI       = kingpin.Flag("dpi", "Resolution for raster engraving of imported images (dots per inch)").Default("254").Float()
+	importOverscan  = kingpin.Flag("overscan", "Distance to extend raster engraving lines by (mm)").Default("2").Float()
+	importBidir     = kingpin.Flag("bidirectional", "Scan raster engraving lines in both directions").Bool()
+	importMinPower  = kingpin.Flag("minpower", "Laser power for white pixels when raster engraving (--rpm is used for black)").Default("0").Float()
+	importRelief    = kingpin.Flag("relief", "Carve images as heightmaps with a ball-nose tool instead of raster engraving").Bool()
+	importStepover  = kingpin.Flag("stepover", "Distance between relief and STL finishing passes (mm)").Default("0.2").Float()
+	importAllowance = kingpin.Flag("allowance", "Stock left by relief and STL roughing (mm)").Default("0.2").Float()
+	importKeepOrder = kingpin.Flag("keeporder", "Cut imported paths in drawing order instead of nearest first").Bool()
 
 	feedLimit    = kingpin.Flag("feedlimit", "Maximum feedrate (mm/min, <= 0 to disable)").Float()
+	unitsPerMin  = kingpin.Flag("unitspermin", "Convert inverse time (G93) and units per revolution (G95) feedrates to units per minute (G94)").Bool()
 	safetyHeight = kingpin.Flag("safetyheight", "Enforce safety height (mm, <= 0 to disable)").Float()
 	multiplyFeed = kingpin.Flag("multiplyfeed", "Feedrate multiplier (0 to disable)").Float()
 	multiplyMove = kingpin.Flag("multiplymove", "Move distance multiplier (0 to disable)").Float()
@@ -52,11 +133,29 @@ var (
 	spindleCW  = kingpin.Flag("spindlecw", "Force clockwise spindle speed (RPM, <= 0 to disable)").Float()
 	spindleCCW = kingpin.Flag("spindleccw", "Force counter clockwise spindle speed (RPM, <= 0 to disable)").Float()
 
+	dryRun           = kingpin.Flag("dryrun", "Raise all moves to at least the given height with the spindle and coolant off, to run the program in the air (mm, 0 to disable)").Float()
 	enforceReturn    = kingpin.Flag("enforcereturn", "Enforce rapid return to X0 Y0 Z0").Default("true").Bool()
 	flipXY           = kingpin.Flag("flipxy", "Flips the X and Y axes for all moves").Bool()
+	mirror           = kingpin.Flag("mirror", "Mirror the toolpath along an axis (X, Y or Z), about the origin").Enum("X", "Y", "Z", "x", "y", "z")
+	rotate           = kingpin.Flag("rotate", "Rotate the toolpath counterclockwise about the Z axis (degrees)").Default("0").Float()
+	scale            = kingpin.Flag("scale", "Scale the toolpath about the origin (0 to disable)").Default("0").Float()
+	translate        = kingpin.Flag("translate", "Move the toolpath by X,Y[,Z] (mm)").String()
+	heightMap        = kingpin.Flag("heightmap", "Level the toolpath to the probed surface in the height map (X,Y,Z points from a CSV file or Grbl probe log)").ExistingFile()
+	levelSegment     = kingpin.Flag("levelsegment", "Longest move when leveling to a height map (mm)").Default("1").Float()
+	rampAngle        = kingpin.Flag("ramp", "Replace straight plunges into the work with ramps at the given angle (degrees, 0 to disable)").Default("0").Float()
+	rampRadius       = kingpin.Flag("rampradius", "Radius of helical ramps, zigzag along the next move if 0 (mm)").Default("0").Float()
+	tabs             = kingpin.Flag("tabs", "Leave the given number of holding tabs in closed profiles at the bottom of the program").Default("0").Int()
+	tabWidth         = kingpin.Flag("tabwidth", "Width of holding tabs along the toolpath (mm)").Default("5").Float()
+	tabHeight        = kingpin.Flag("tabheight", "Height of holding tabs above the deepest cut (mm)").Default("1").Float()
+	leads            = kingpin.Flag("leads", "Add lead-in and lead-out moves to closed profiles below Z0").Bool()
+	leadLength       = kingpin.Flag("leadlength", "Length of linear leads (mm)").Default("2").Float()
+	leadRadius       = kingpin.Flag("leadradius", "Radius of arc leads, linear leads if 0 (mm)").Default("0").Float()
+	leadAngle        = kingpin.Flag("leadangle", "Angle of linear leads to the profile, or sweep of arc leads (degrees)").Default("90").Float()
+	corner           = kingpin.Flag("corner", "Move the lower left corner of the cutting moves to X,Y (mm), after the other transforms").String()
 	manualToolchange = kingpin.Flag("manualtool", "Wait for manual toolchange operation").Bool()
 	manualSpindle    = kingpin.Flag("manualspindle", "Wait for manual spindle operation").Bool()
 	manualCoolant    = kingpin.Flag("manualcoolant", "Wait for manual coolant operation").Bool()
+	optionalStop     = kingpin.Flag("optionalstop", "Stop at optional program pauses (M1) when streaming").Bool()
 	spindleWait      = kingpin.Flag("spindlewait", "Seconds to dwell after spindle changes").Int()
 	coolantWait      = kingpin.Flag("coolantwait", "Seconds to dwell after coolant changes").Int()
 	toolchangeHeight = kingpin.Flag("tcheight", "Height to go to for toolchange (0 to use safety height)").Default("0").Float()
@@ -65,6 +164,9 @@ var (
 var (
 	generators []export.CodeGenerator
 	machine    vm.Machine
+	tools      vm.ToolTable
+	profile    mach.Profile = mach.Default()
+	start      int          // Segment index to start output at
 )
 
 //
@@ -148,6 +250,24 @@ func (m *ManualGenerator) Coolant(floodCoolant, mistCoolant bool) {
 	_, _ = reader.ReadString('\n')
 }
 
+// Prompts the user to continue a paused program, waits for <ENTER>. Called by
+// the streamer once the machine has stopped.
+func (m *ManualGenerator) ProgramPause(code int) {
+	switch code {
+	case 1:
+		if !*optionalStop {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\nOptional stop (M1). Continue with <ENTER>")
+	case 60:
+		fmt.Fprintf(os.Stderr, "\nChange pallet (M60). Continue with <ENTER>")
+	default:
+		fmt.Fprintf(os.Stderr, "\nProgram paused (M%d). Continue with <ENTER>", code)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	_, _ = reader.ReadString('\n')
+}
+
 // Moves spindle to easily accessible spot, and prompts for toolchange
 func (m *ManualGenerator) Toolchange(i int) {
 	// Multiple entry guard!
@@ -159,16 +279,17 @@ func (m *ManualGenerator) Toolchange(i int) {
 		m.tguard--
 	}()
 
-	if !*manualToolchange {
+	if !*manualToolchange && profile.Toolchange.Mode != mach.ToolchangeManual {
 		return
 	}
 
 	// Go to X0Y0 and Z as requested
-	newHeight := 0.0
-	if *toolchangeHeight == 0 {
+	newHeight := *toolchangeHeight
+	if newHeight == 0 {
+		newHeight = profile.Toolchange.Height
+	}
+	if newHeight == 0 {
 		newHeight = machine.FindSafetyHeight()
-	} else {
-		newHeight = *toolchangeHeight
 	}
 
 	curPos := m.GetPosition()
@@ -210,8 +331,8 @@ func (m *ManualGenerator) Toolchange(i int) {
 	if m.hasChanged {
 		change := toolLength - m.toolLength
 
-		for idx, _ := range machine.Positions {
-			machine.Positions[idx].Z += change
+		for idx, _ := range machine.Segments {
+			machine.Segments[idx].Z += change
 		}
 
 		newPos := curPos
@@ -230,7 +351,25 @@ func printStats(m *vm.Machine) {
 	minx, miny, minz, maxx, maxy, maxz, feedrates := machine.Info()
 	fmt.Fprintf(os.Stderr, "Metrics\n")
 	fmt.Fprintf(os.Stderr, "-------------------------\n")
-	fmt.Fprintf(os.Stderr, "   Moves: %d\n", len(machine.Positions))
+	fmt.Fprintf(os.Stderr, "   Moves: %d\n", len(machine.Segments))
+	fmt.Fprintf(os.Stderr, "   Operations: %d\n", len(machine.Operations()))
+	if reps := machine.Repetitions(3, 0.0001); len(reps) > 0 {
+		covered := 0
+		for _, r := range reps {
+			covered += r.Length * r.Count
+		}
+		fmt.Fprintf(os.Stderr, "   Repetitions: %d patterns covering %d moves\n", len(reps), covered)
+	}
+	if n := len(machine.Warnings); n > 0 {
+		fmt.Fprintf(os.Stderr, "   Warnings: %d (%d affecting the result)\n", n, machine.Warnings.Count(warnings.SeverityWarning))
+	}
+	if len(machine.Arcs) > 0 {
+		fmt.Fprintf(os.Stderr, "   Arcs: %d, max deviation %g mm", len(machine.Arcs), machine.MaxArcChordDeviation())
+		if bad := machine.ArcsOutOfTolerance(); len(bad) > 0 {
+			fmt.Fprintf(os.Stderr, " (%d out of tolerance)", len(bad))
+		}
+		fmt.Fprintf(os.Stderr, "\n")
+	}
 	fmt.Fprintf(os.Stderr, "   Feedrates (mm/min): ")
 
 	for idx, feed := range feedrates {
@@ -243,16 +382,329 @@ func printStats(m *vm.Machine) {
 		}
 	}
 	fmt.Fprintf(os.Stderr, "\n")
-	eta := machine.ETA()
-	meta := (eta / time.Second) * time.Second
-	fmt.Fprintf(os.Stderr, "   ETA: %s\n", meta.String())
+	summary := machine.Stats(profile)
+	if summary.MaxFeedrate > 0 {
+		fmt.Fprintf(os.Stderr, "   Feedrate range (mm/min): %g <-> %g\n", summary.MinFeedrate, summary.MaxFeedrate)
+	}
+	report := machine.TimeBreakdown(profile)
+	round := func(d time.Duration) string {
+		return ((d / time.Second) * time.Second).String()
+	}
+	// Estimates are only as good as the profile
+	basis := fmt.Sprintf("machine profile %s", *profileFile)
+	if *profileFile == "" {
+		basis = "default Grbl profile, set the machine with --profile"
+	}
+	fmt.Fprintf(os.Stderr, "   ETA: %s (%s)\n", round(report.Total()), basis)
+	fmt.Fprintf(os.Stderr, "      Cutting: %s\n", round(report.Cutting.Time))
+	fmt.Fprintf(os.Stderr, "      Rapid: %s\n", round(report.Rapid.Time))
+	if report.Toolchange.Time > 0 {
+		fmt.Fprintf(os.Stderr, "      Toolchange: %s\n", round(report.Toolchange.Time))
+	}
 	fmt.Fprintf(os.Stderr, "   X (mm): %g <-> %g\n", minx, maxx)
 	fmt.Fprintf(os.Stderr, "   Y (mm): %g <-> %g\n", miny, maxy)
 	fmt.Fprintf(os.Stderr, "   Z (mm): %g <-> %g\n", minz, maxz)
+	if c := machine.Extents().Cutting; c != nil {
+		fmt.Fprintf(os.Stderr, "   Cutting (mm): X %g <-> %g, Y %g <-> %g, Z %g <-> %g\n",
+			c.Min.X, c.Max.X, c.Min.Y, c.Max.Y, c.Min.Z, c.Max.Z)
+	}
+	fmt.Fprintf(os.Stderr, "   Deepest cut (mm): Z%g\n", summary.MinZ)
+	fmt.Fprintf(os.Stderr, "   Cutting distance (mm): %.2f\n", summary.CutDistance)
+	fmt.Fprintf(os.Stderr, "   Rapid distance (mm): %.2f\n", summary.RapidDistance)
+	fmt.Fprintf(os.Stderr, "   Toolchanges: %d\n", summary.Toolchanges)
+	spindle := machine.SpindleUsage(profile)
+	fmt.Fprintf(os.Stderr, "   Spindle on-time: %s (%d starts)\n", round(summary.SpindleOn), spindle.Cycles)
+	if *scallopRadius > 0 {
+		scallop := machine.ScallopReport(*scallopRadius, *scallopTarget)
+		fmt.Fprintf(os.Stderr, "   Scallop height (mm): %g max, %d of %d passes above %g\n",
+			scallop.MaxHeight, len(scallop.Regions), scallop.Passes, *scallopTarget)
+	}
+	if len(report.Tools) > 1 {
+		tools := make([]int, 0, len(report.Tools))
+		for t, _ := range report.Tools {
+			tools = append(tools, t)
+		}
+		sort.Ints(tools)
+		for _, t := range tools {
+			b := report.Tools[t]
+			name := fmt.Sprintf("Tool %d", t)
+			if tool, ok := m.Tools.Get(t); ok {
+				name += fmt.Sprintf(" (%g mm)", tool.Diameter)
+			}
+			fmt.Fprintf(os.Stderr, "   %s: %s, %.2f mm cut\n", name, round(b.Total()), b.Cutting.Distance)
+		}
+	}
 	fmt.Fprintf(os.Stderr, "-------------------------\n")
 
 }
 
+// Returns the settings used for generating toolpaths from imported drawings
+func importSettings() importer.Settings {
+	s := importer.DefaultSettings()
+	s.Depth = *importDepth
+	s.PassDepth = *importPassDepth
+	s.Feedrate = *importFeed
+	s.PlungeFeedrate = *importPlunge
+	s.SafeHeight = *importSafe
+	s.SpindleSpeed = *importSpindle
+	s.Scale = *importScale
+	if *importKeepOrder {
+		s.Order = importer.OrderDocument
+	}
+	s.PeckDepth = *importPeck
+	s.ToolDiameter = *importTool
+	s.IsolationOffset = *importIsolation
+	s.IsolationPasses = *importIsoPasses
+	s.IsolationOverlap = *importIsoLap
+	s.DPI = *importDPI
+	s.Overscan = *importOverscan
+	s.Bidirectional = *importBidir
+	s.MinPower = *importMinPower
+	s.Stepover = *importStepover
+	s.StockAllowance = *importAllowance
+	s.ToolMap = make(map[int]int)
+	for _, m := range *importToolMap {
+		var from, to int
+		if _, err := fmt.Sscanf(m, "%d=%d", &from, &to); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Ignoring invalid tool mapping %q\n", m)
+			continue
+		}
+		s.ToolMap[from] = to
+	}
+	return s
+}
+
+// Exports from the start index to the generators
+func exportFrom(gens ...export.CodeGenerator) error {
+	if start > 0 {
+		return export.HandleAllPositionsFrom(context.Background(), &machine, start, gens...)
+	}
+	if *arcFit > 0 {
+		return export.HandleAllPositionsWithArcs(context.Background(), &machine, *arcFit, gens...)
+	}
+	return export.HandleAllPositions(&machine, gens...)
+}
+
+// Exports the machine as gcode, using the requested code generator, writing
+// lines to w as they are generated
+func exportCode(w io.Writer) error {
+	return exportCodeWith(w, exportFrom)
+}
+
+// Like exportCode, exporting to the generator with fn
+func exportCodeWith(w io.Writer, fn func(...export.CodeGenerator) error) error {
+	lw := export.NewLineWriter(w)
+	var g export.CodeGenerator = &export.StringCodeGenerator{Precision: *precision, Write: lw.WriteLine}
+	if *generator != "" {
+		var err error
+		if g, err = export.NewGenerator(*generator, *precision, lw.WriteLine); err != nil {
+			return err
+		}
+	}
+	if h, ok := g.(export.SourceCommenter); ok {
+		h.SetSourceComments(*sourceComments)
+	}
+	g.Init()
+	if err := fn(g); err != nil {
+		return err
+	}
+	if err := export.EndProgram(g); err != nil {
+		return err
+	}
+	return lw.Flush()
+}
+
+// Exports the machine as gcode to a file, removing the file if the export fails
+func exportFile(path string) error {
+	return exportFileWith(path, exportFrom)
+}
+
+// Like exportFile, exporting to the generator with fn
+func exportFileWith(path string, fn func(...export.CodeGenerator) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = exportCodeWith(f, fn)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Exports the machine as gcode to a file per part, as requested with --split.
+// Parts are numbered, and named after their tool: part.nc is split into
+// part-1-T1.nc, part-2-T2.nc and so on. With --splitsections, the parts are
+// sections of the one file instead.
+func exportParts(path string) error {
+	var splits []int
+	switch *split {
+	case "tool":
+		splits = export.ToolSplits(&machine)
+	case "level":
+		splits = export.LevelSplits(&machine)
+	case "operation":
+		splits = export.OperationSplits(&machine)
+	}
+
+	bounds := []int{start}
+	for _, idx := range splits {
+		if idx > start {
+			bounds = append(bounds, idx)
+		}
+	}
+	bounds = append(bounds, len(machine.Segments))
+
+	if *sections {
+		return exportFileWith(path, func(gens ...export.CodeGenerator) error {
+			return export.HandleSections(context.Background(), &machine, bounds, gens...)
+		})
+	}
+
+	ext := filepath.Ext(path)
+	for n := 0; n+1 < len(bounds); n++ {
+		from, to := bounds[n], bounds[n+1]
+		name := fmt.Sprintf("%s-%d-T%d%s", strings.TrimSuffix(path, ext), n+1, export.PartTool(&machine, from, to), ext)
+		err := exportFileWith(name, func(gens ...export.CodeGenerator) error {
+			return export.HandlePart(context.Background(), &machine, from, to, gens...)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote part %d to %s\n", n+1, name)
+	}
+	return nil
+}
+
+// Checks the program against the machine profile as requested with --limits,
+// adding the violations to the warnings, or exiting on them
+func checkLimits() {
+	if *limitMode == "clip" {
+		for _, v := range machine.ClipLimits(profile) {
+			machine.Warnings.Add(warnings.StageVM, v.Line, warnings.SeverityWarning, "%s, clipped", v.Err)
+		}
+	}
+	violations := machine.LimitViolations(profile)
+	for _, v := range violations {
+		machine.Warnings.Add(warnings.StageVM, v.Line, warnings.SeverityWarning, "%s", v.Err)
+	}
+	if len(violations) > 0 && *limitMode == "abort" {
+		for _, v := range violations {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", v)
+		}
+		os.Exit(3)
+	}
+}
+
+// Parses a comma separated list of at least min and at most max numbers
+func parseNumbers(s string, min, max int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) < min || len(parts) > max {
+		return nil, errors.New(fmt.Sprintf("Expected %d to %d comma separated numbers, got %q", min, max, s))
+	}
+	res := make([]float64, len(parts))
+	for idx, p := range parts {
+		var err error
+		if res[idx], err = strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid number %q", p))
+		}
+	}
+	return res, nil
+}
+
+// Applies the transforms requested on the command line, in the order mirror,
+// rotate, scale, translate and corner
+func transformToolpath() error {
+	t := transform.Identity()
+	if *mirror != "" {
+		t = t.Then(transform.Mirror(rune((*mirror)[0])))
+	}
+	if *rotate != 0 {
+		t = t.Then(transform.RotateZ(*rotate))
+	}
+	if *scale != 0 {
+		t = t.Then(transform.Scale(*scale, *scale, *scale))
+	}
+	if *translate != "" {
+		v, err := parseNumbers(*translate, 2, 3)
+		if err != nil {
+			return err
+		}
+		v = append(v, 0)
+		t = t.Then(transform.Translate(v[0], v[1], v[2]))
+	}
+	if t != transform.Identity() {
+		if err := transform.Apply(&machine, t); err != nil {
+			return err
+		}
+	}
+
+	if *corner != "" {
+		v, err := parseNumbers(*corner, 2, 2)
+		if err != nil {
+			return err
+		}
+		c, err := transform.Corner(&machine, v[0], v[1])
+		if err != nil {
+			return err
+		}
+		return transform.Apply(&machine, c)
+	}
+	return nil
+}
+
+// Returns the vm dialect selected on the command line
+func dialectValue() int {
+	switch *dialect {
+	case "mach":
+		return vm.DialectMach
+	case "marlin":
+		return vm.DialectMarlin
+	default:
+		return vm.DialectRS274NGC
+	}
+}
+
+// Loads the input file, importing drawings based on the file extension
+func loadDocument(path string) (*gcode.Document, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".dxf":
+		return importer.DXF(f, importSettings())
+	case ".svg":
+		return importer.SVG(f, importSettings())
+	case ".drl", ".xln", ".exc":
+		return importer.Excellon(f, importSettings())
+	case ".gbr", ".ger", ".gtl", ".gbl", ".cmp", ".sol":
+		return importer.Gerber(f, importSettings())
+	case ".plt", ".hpgl", ".hpg":
+		return importer.HPGL(f, importSettings())
+	case ".stl":
+		return importer.STL(f, importSettings())
+	case ".png", ".jpg", ".jpeg":
+		if *importRelief {
+			return importer.Heightmap(f, importSettings())
+		}
+		return importer.Raster(f, importSettings())
+	default:
+		code, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		opts := vm.DialectOptions(dialectValue())
+		opts.Tolerant = *tolerant
+		return gcode.ParseWithOptions(string(code), opts)
+	}
+}
+
 //
 // Application flow
 //
@@ -266,32 +718,99 @@ func main() {
 		os.Exit(1)
 	}
 
-	fhandle, err := ioutil.ReadFile(*inputFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Could not open file: %s\n", err)
+	if *profileFile != "" {
+		var err error
+		if profile, err = mach.Load(*profileFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not load machine profile: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *toolFile != "" {
+		var err error
+		if tools, err = vm.LoadToolTable(*toolFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not load tool table: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if err := plugins.LoadAll(*pluginFiles); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		os.Exit(2)
 	}
 
+	if *serve != "" {
+		fmt.Fprintf(os.Stderr, "Serving on %s\n", *serve)
+		if err := server.New(profile).ListenAndServe(*serve); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if *inputFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: No input file given\n")
+		os.Exit(1)
+	}
+
 	// Parse
-	code := string(fhandle)
-	document, err := gcode.Parse(code)
+	document, err := loadDocument(*inputFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Parse error: %s\n", err)
 		os.Exit(3)
 	}
 
 	// Run through the VM
-	machine.Init()
-	machine.MaxArcDeviation = *maxArcDeviation
-	machine.MinArcLineLength = *minArcLineLength
+	vmOpts := []vm.Option{
+		vm.WithArcTolerance(*maxArcDeviation, *minArcLineLength),
+		vm.WithDialect(dialectValue()),
+		vm.WithToolTable(tools),
+	}
+	if *strictFeed {
+		vmOpts = append(vmOpts, vm.WithStrictFeedrate())
+	}
+	if *cutComp {
+		vmOpts = append(vmOpts, vm.WithCutterCompensation())
+	}
+	if *bakeScale {
+		vmOpts = append(vmOpts, vm.WithBakedScaling())
+	}
+	if *revDwell >= 0 {
+		vmOpts = append(vmOpts, vm.WithSafeReversal(*revDwell))
+	}
+	if *plasma {
+		vmOpts = append(vmOpts, vm.WithPlasma(vm.Plasma{PierceHeight: *pierceHeight, PierceDelay: *pierceDelay, CutHeight: *cutHeight, THCOutput: *thcOutput}))
+
+		// Plasma cuts above the sheet, which these take for moves between operations
+		*optFloatingZ = false
+		*optPathGrouping = false
+	}
+	machine = *vm.New(vmOpts...)
 
 	if err := machine.Process(document); err != nil {
 		fmt.Fprintf(os.Stderr, "VM failed: %s\n", err)
 		os.Exit(3)
 	}
 
+	if *explain {
+		if err := machine.Explain(document, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+		return
+	}
+
 	// Optimize as requested
 	if *opt {
+		var orig []vm.Segment
+		if *verifyTolerance > 0 {
+			orig = append(orig, machine.Segments...)
+		}
+
+		if *optPrune {
+			optimize.OptPrune(&machine)
+		}
+
 		if *optDrillSpeed {
 			optimize.OptDrillSpeed(&machine)
 		}
@@ -302,10 +821,24 @@ func main() {
 
 		if *optPathGrouping {
 			if err := optimize.OptPathGrouping(&machine, *rtolerance); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: Could not execute path grouping: %s\n", err)
+				machine.Warnings.Add(warnings.StageOptimize, 0, warnings.SeverityWarning, "Could not execute path grouping: %s", err)
 			}
 		}
 
+		if *optTravel {
+			if err := optimize.OptTravel(&machine); err != nil {
+				machine.Warnings.Add(warnings.StageOptimize, 0, warnings.SeverityWarning, "Could not execute travel ordering: %s", err)
+			}
+		}
+
+		if *optRetracts {
+			optimize.OptRetracts(&machine, *hopClearance, *hopDistance)
+		}
+
+		if *optDrillOrder {
+			optimize.OptDrillOrder(&machine)
+		}
+
 		if *optBogusMove {
 			optimize.OptBogusMoves(&machine)
 		}
@@ -314,9 +847,35 @@ func main() {
 			optimize.OptVector(&machine, *vtolerance)
 		}
 
+		if *optCollinear {
+			optimize.OptCollinear(&machine, *cangle, *ctolerance)
+		}
+
 		if *optLiftSpeed {
 			optimize.OptLiftSpeed(&machine)
 		}
+
+		if *optAxisFeed {
+			optimize.OptAxisFeedrate(&machine, profile)
+		}
+
+		for _, name := range *optExtra {
+			o, err := optimize.Lookup(name)
+			if err == nil {
+				err = o.Optimize(&machine)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Could not run optimizer: %s\n", err)
+				os.Exit(3)
+			}
+		}
+
+		if *verifyTolerance > 0 {
+			if err := optimize.Verify(orig, machine.Segments, *verifyTolerance); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Optimizer verification failed: %s\n", err)
+				os.Exit(3)
+			}
+		}
 	}
 
 	// Apply requested modifications
@@ -324,12 +883,54 @@ func main() {
 		machine.FlipXY()
 	}
 
+	if err := transformToolpath(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Could not transform toolpath: %s\n", err)
+		os.Exit(3)
+	}
+
+	if *tabs > 0 {
+		if err := transform.Tabs(&machine, *tabs, *tabWidth, *tabHeight); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not add holding tabs: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	// After the tabs, which would not find the loops opened by the leads
+	if *leads {
+		if err := transform.Leads(&machine, *leadLength, *leadRadius, *leadAngle); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not add leads: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *rampAngle > 0 {
+		if err := transform.Ramp(&machine, *rampAngle, *rampRadius); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not ramp plunges: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *heightMap != "" {
+		h, err := transform.LoadHeightMap(*heightMap)
+		if err == nil {
+			err = transform.Level(&machine, h, *levelSegment)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not level toolpath: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
 	if *safetyHeight > 0 {
 		if err := machine.SetSafetyHeight(*safetyHeight); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: Could not set safety height%s\n", err)
 		}
 	}
 
+	if *unitsPerMin {
+		machine.UnitsPerMinute()
+	}
+
 	if *feedLimit > 0 {
 		machine.LimitFeedrate(*feedLimit)
 	}
@@ -352,10 +953,46 @@ func main() {
 		machine.EnforceSpindle(true, false, *spindleCCW)
 	}
 
+	if *dryRun != 0 {
+		machine.DryRun(*dryRun)
+	}
+
+	if *profileFile != "" && (*device == "" || *limitMode == "clip") {
+		// The streamer checks the limits itself, after clipping
+		checkLimits()
+	}
+
+	machine.UpdateElapsed(profile)
+
 	if *stats {
 		printStats(&machine)
 	}
 
+	if *resume > 0 && *resumeIdx > 0 {
+		fmt.Fprintf(os.Stderr, "Error: Cannot resume at both a line and a segment index\n")
+		os.Exit(1)
+	}
+	if *resumeIdx > 0 {
+		if *resumeIdx >= len(machine.Segments) {
+			fmt.Fprintf(os.Stderr, "Error: No segment at index %d\n", *resumeIdx)
+			os.Exit(3)
+		}
+		start = *resumeIdx
+	}
+	if *resume > 0 {
+		idx, err := machine.IndexOfLine(*resume)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(3)
+		}
+		start = idx
+	}
+	if start > 0 {
+		idx := start
+		fmt.Fprintf(os.Stderr, "Starting at line %d, skipping %s of %s\n", machine.Segments[idx].Line,
+			machine.Segments[idx-1].Elapsed.Round(time.Second), machine.Segments[len(machine.Segments)-1].Elapsed.Round(time.Second))
+	}
+
 	// Handle VM output
 	if *debugDump {
 		machine.Dump()
@@ -366,34 +1003,82 @@ func main() {
 	}
 
 	if *dumpStdout {
-		g := export.StringCodeGenerator{Precision: *precision}
-		g.Init()
-		export.HandleAllPositions(&machine, &g)
-		fmt.Printf(g.Retrieve())
+		if err := exportCode(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
 	}
 
-	if *outputFile != "" {
-		g := export.StringCodeGenerator{Precision: *precision}
+	if *outputFile != "" && *split != "" {
+		if err := exportParts(*outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
+	} else if *outputFile != "" {
+		if err := exportFile(*outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export gcode: %s\n", err)
+			os.Exit(3)
+		}
+	}
+
+	if *preview != "" {
+		g := export.SVGGenerator{Precision: *precision, DepthColors: true, ToolLayers: true}
 		g.Init()
-		export.HandleAllPositions(&machine, &g)
+		if err := exportFrom(&g); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export preview: %s\n", err)
+			os.Exit(3)
+		}
+		if err := ioutil.WriteFile(*preview, []byte(g.Retrieve()), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
+			os.Exit(2)
+		}
+	}
 
-		if err := ioutil.WriteFile(*outputFile, []byte(g.Retrieve()), 0644); err != nil {
+	if *dxfFile != "" {
+		g := export.DXFGenerator{Precision: *precision}
+		g.Init()
+		if err := exportFrom(&g); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Could not export DXF: %s\n", err)
+			os.Exit(3)
+		}
+		if err := ioutil.WriteFile(*dxfFile, []byte(g.Retrieve()), 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: Could not write to file: %s\n", err)
 			os.Exit(2)
 		}
 	}
 
+	for _, w := range machine.Warnings {
+		fmt.Fprintf(os.Stderr, "%s\n", w)
+	}
+
 	if *device != "" {
 		mt := &ManualGenerator{}
 		wt := &WaitGenerator{}
-		s := &streaming.GrblStreamer{}
-		s.Precision = *precision
+		var s streaming.Streamer
+		switch *controller {
+		case "g2core":
+			g := &streaming.G2CoreStreamer{OnPause: mt.ProgramPause}
+			g.Precision = *precision
+			if *profileFile != "" {
+				g.Profile = &profile
+			}
+			g.Init()
+			s = g
+		default:
+			g := &streaming.GrblStreamer{OnPause: mt.ProgramPause}
+			g.Precision = *precision
+			g.Settings = export.DefaultGrblSettings()
+			if *profileFile != "" {
+				g.Profile = &profile
+			}
+			g.Init()
+			s = g
+		}
 
 		generators = append(generators, mt)
 		generators = append(generators, wt)
-		generators = append(generators, s)
+		generators = append(generators, s.(export.CodeGenerator))
 
-		s.Init()
 		mt.Init()
 
 		if err := s.Check(&machine); err != nil {
@@ -415,11 +1100,12 @@ func main() {
 			os.Exit(2)
 		}
 
-		pBar := pb.New(len(machine.Positions))
+		pBar := pb.New(len(machine.Segments) - start)
 		pBar.ManualUpdate = true
 		pBar.Format("[=> ]")
 		pBar.Start()
 
+		ctx, cancel := context.WithCancel(context.Background())
 		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, os.Interrupt)
 		signal.Notify(sigchan, syscall.SIGTSTP)
@@ -427,27 +1113,37 @@ func main() {
 		go func() {
 			for sig := range sigchan {
 				if sig == os.Interrupt {
+					// Stop immediately, rather than waiting for the current block
 					fmt.Fprintf(os.Stderr, "\nStopping...\n")
+					cancel()
 					s.Stop()
-					os.Exit(5)
 				} else if sig == syscall.SIGTSTP {
-					s.Pause()
+					s.Hold()
 					fmt.Fprintf(os.Stderr, "\nPaused. Press <ENTER> to continue")
 					reader := bufio.NewReader(os.Stdin)
 					_, _ = reader.ReadString('\n')
-					s.Start()
+					s.Resume()
 					pBar.Update()
 				}
 			}
 		}()
 
-		for idx, _ := range machine.Positions {
-			if err := export.HandlePositionAtIndex(&machine, idx, generators...); err != nil {
-				s.Stop()
-				panic(err)
-			}
+		sent := -1
+		err := streaming.RunFrom(ctx, s, &machine, start, func(idx int) {
+			sent = idx
 			pBar.Increment()
 			pBar.Update()
+		}, generators...)
+		if (ctx.Err() != nil || err != nil) && sent >= 0 {
+			// Segments sent are buffered by the controller, so those before the
+			// last may not have been executed either
+			fmt.Fprintf(os.Stderr, "\nLast sent segment %d, from line %d. Resume before it, at the last segment executed, with --resumeindex or --resume.\n",
+				sent, machine.Segments[sent].Line)
+		}
+		if ctx.Err() != nil {
+			os.Exit(5)
+		} else if err != nil {
+			panic(err)
 		}
 		pBar.Finish()
 		pBar.Update()
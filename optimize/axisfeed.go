@@ -0,0 +1,57 @@
+package optimize
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "math"
+
+// Limits feedrates to what every axis can do.
+// The feedrate of a move is along its direction, so a steep ramp at a
+// feedrate meant for XY can drive a slow Z axis past its maximum feedrate,
+// stalling the machine. Feedrates of feed moves are lowered until no axis
+// moves faster than its maximum feedrate in the profile. Inverse time and
+// per revolution feeds are left as they are.
+func OptAxisFeedrate(m *vm.Machine, profile machine.Profile) {
+	refuseSpilled(m)
+	var (
+		limits = profile.MaxFeedrate()
+		last   vm.Segment
+	)
+
+	for idx, seg := range m.Segments {
+		from := last
+		last = seg
+		if idx == 0 || seg.Kind != vm.SegmentMove || seg.State.MoveMode != vm.MoveModeLinear || seg.State.FeedMode != vm.FeedModeUnitsMin {
+			continue
+		}
+
+		d := seg.MachineVector().Diff(from.MachineVector())
+		length := d.Norm()
+		if length == 0 {
+			continue
+		}
+		limit := axisFeedrate(d.Divide(length), limits)
+		if seg.State.Feedrate <= limit {
+			continue
+		}
+
+		seg = seg.Modify(func(st *vm.State) {
+			st.Feedrate = limit
+		})
+		if prev := m.Segments[idx-1].State; *prev == *seg.State {
+			seg.State = prev
+		}
+		m.Segments[idx] = seg
+	}
+}
+
+// The highest feedrate in a direction keeping every axis within its limit
+func axisFeedrate(u, limits vector.Vector) float64 {
+	res := math.Inf(1)
+	for _, x := range [][2]float64{{u.X, limits.X}, {u.Y, limits.Y}, {u.Z, limits.Z}} {
+		if x[0] != 0 {
+			res = math.Min(res, x[1]/math.Abs(x[0]))
+		}
+	}
+	return res
+}
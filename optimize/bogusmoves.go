@@ -7,15 +7,25 @@ import "github.com/joushou/gocnc/vector"
 // Calculates the unit-vector, and kills all incremental moves between A and B.
 // Deprecated by OptVector.
 func OptBogusMoves(machine *vm.Machine) {
+	refuseSpilled(machine)
 	var (
 		lastvec vector.Vector
 		state   vector.Vector
-		npos    []vm.Position = make([]vm.Position, 0)
+		angles  [3]float64
+		npos    []vm.Segment = make([]vm.Segment, 0)
 	)
 
-	for _, m := range machine.Positions {
+	for _, m := range machine.Segments {
 		d := m.Vector().Diff(state)
 		state = m.Vector()
+		rotates := m.Angles() != angles
+		angles = m.Angles()
+
+		if m.Kind != vm.SegmentMove || rotates {
+			lastvec = vector.Vector{}
+			npos = append(npos, m)
+			continue
+		}
 
 		if m.State.MoveMode != vm.MoveModeRapid && m.State.MoveMode != vm.MoveModeLinear {
 			lastvec = vector.Vector{}
@@ -37,5 +47,5 @@ func OptBogusMoves(machine *vm.Machine) {
 			lastvec = vec
 		}
 	}
-	machine.Positions = npos
+	machine.Segments = npos
 }
@@ -0,0 +1,80 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/vector"
+import "math"
+
+//
+// Collinear merging
+//
+// Flattened arcs and tessellating CAM tools split straight cuts into
+// thousands of tiny moves, which fill the planner of controllers like Grbl
+// faster than it can execute them. Consecutive linear feed moves are merged
+// into one while every point of the run stays within the deviation (mm) of
+// the merged move, and no move of the run turns more than the angle (degrees)
+// away from it.
+//
+// Unlike OptVector, only moves with identical states, rotary angles and
+// offsets are merged, so feedrate, spindle and coolant changes are kept where
+// they are. Moves in inverse time mode (G93) are never merged, as their
+// feedrate gives the time of the move alone.
+//
+
+// Merges runs of collinear feed moves at the same state
+func OptCollinear(machine *vm.Machine, angle, deviation float64) {
+	refuseSpilled(machine)
+	var (
+		run  []vector.Vector // Start and end points of the moves merged into the last segment
+		npos = make([]vm.Segment, 0, len(machine.Segments))
+		cos  = math.Cos(angle * math.Pi / 180)
+	)
+
+	for _, m := range machine.Segments {
+		if len(run) > 0 && mergeable(npos[len(npos)-1], m) {
+			if pts := append(run, m.Vector()); collinear(pts, cos, deviation) {
+				run = pts
+				npos[len(npos)-1] = m
+				continue
+			}
+		}
+
+		run = nil
+		if len(npos) > 0 && m.Kind == vm.SegmentMove && m.State.MoveMode == vm.MoveModeLinear {
+			run = []vector.Vector{npos[len(npos)-1].Vector(), m.Vector()}
+		}
+		npos = append(npos, m)
+	}
+	machine.Segments = npos
+}
+
+// Tests if a move may be merged into the previous one
+func mergeable(prev, m vm.Segment) bool {
+	return m.Kind == vm.SegmentMove && m.State.MoveMode == vm.MoveModeLinear &&
+		m.State.FeedMode != vm.FeedModeInvTime &&
+		*m.State == *prev.State && m.Angles() == prev.Angles() &&
+		m.Offset == prev.Offset && m.AxisOffset == prev.AxisOffset && m.Machine == prev.Machine
+}
+
+// Tests if a run of points can be replaced by a line from the first to the
+// last, with every move pointing within the angle (as its cosine) of the line
+func collinear(pts []vector.Vector, cos, deviation float64) bool {
+	start := pts[0]
+	chord := pts[len(pts)-1].Diff(start)
+	l := chord.Norm()
+	if l == 0 {
+		return false
+	}
+	dir := chord.Divide(l)
+
+	for idx := 1; idx < len(pts); idx++ {
+		d := pts[idx].Diff(pts[idx-1])
+		if n := d.Norm(); n > 0 && d.Dot(dir) < cos*n {
+			return false
+		}
+		// As no move turns back, the distance to the line is that to the move
+		if pts[idx].Diff(start).Cross(dir).Norm() > deviation {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package optimize
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "testing"
+
+// Runs the program through a vm
+func processProgram(t *testing.T, program string) *vm.Machine {
+	doc, err := gcode.Parse(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vm.New()
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Counts the linear feed moves
+func feedMoves(m *vm.Machine) int {
+	n := 0
+	for _, seg := range m.Segments {
+		if seg.Kind == vm.SegmentMove && seg.State.MoveMode == vm.MoveModeLinear {
+			n++
+		}
+	}
+	return n
+}
+
+func TestOptCollinear(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		moves   int
+	}{
+		{"collinear", "G21 G90 G0 X0 Y0 Z0\nG1 X1 F100\nX2\nX3\nX4\n", 1},
+		{"within deviation", "G21 G90 G0 X0 Y0 Z0\nG1 X1 Y0.0005 F100\nX2 Y0\nX3\n", 1},
+		{"corner", "G21 G90 G0 X0 Y0 Z0\nG1 X1 F100\nX2\nY1\nY2\n", 2},
+		{"feedrate change", "G21 G90 G0 X0 Y0 Z0\nG1 X1 F100\nX2 F200\nX3\n", 2},
+		{"inverse time", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X1 F60\nX2 F60\nX3 F60\n", 3},
+	}
+	for _, test := range tests {
+		m := processProgram(t, test.program)
+		original := append([]vm.Segment(nil), m.Segments...)
+		OptCollinear(m, 1, 0.001)
+		if n := feedMoves(m); n != test.moves {
+			t.Errorf("%s: got %d feed moves, expected %d", test.name, n, test.moves)
+		}
+		if err := Verify(original, m.Segments, 0.002); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "math"
+
+//
+// Drill ordering
+//
+// Drilling programs, such as those of PCB tools, often list holes in the
+// order of their nets instead of where they are. A drill is a run of moves
+// and dwells at the same XY position, starting at a height, going below it
+// and ending back at it, as canned cycles and plain plunges and retracts do.
+// Consecutive drills with the same height and depth are ordered like the
+// operations of travel ordering (see travel.go), if only moves at that height
+// separate them, and they run with the same tool and states. Drills of other
+// tools or depths are never mixed, so the groups of the program are kept.
+//
+
+// A drill, from the segment above the hole to the segment back above it
+type drill struct {
+	operation
+	depth float64
+}
+
+// Orders runs of drills to shorten the travel between them
+func OptDrillOrder(machine *vm.Machine) {
+	refuseSpilled(machine)
+	segs := machine.Segments
+
+	var drills []drill
+	for idx := 0; idx < len(segs); idx++ {
+		if d, ok := findDrill(segs, idx); ok {
+			drills = append(drills, d)
+			idx = d.end
+		}
+	}
+
+	var (
+		res  = []vm.Segment{}
+		next = 0 // First segment not yet added
+	)
+	for first := 0; first < len(drills); {
+		last := first
+		for last+1 < len(drills) && drills[last+1].depth == drills[first].depth &&
+			independent(segs, drills[last].operation, drills[last+1].operation) {
+			last++
+		}
+
+		if last-first >= 2 {
+			ops := make([]operation, 0, last-first+1)
+			for _, d := range drills[first : last+1] {
+				ops = append(ops, d.operation)
+			}
+			res = append(res, segs[next:ops[0].start+1]...)
+			res = appendOperations(res, segs, orderOperations(context.Background(), segs, ops))
+			next = ops[len(ops)-1].end + 1
+		}
+		first = last + 1
+	}
+	machine.Segments, machine.Reordered = append(res, segs[next:]...), true
+}
+
+// Finds the drill starting at a segment, if any. Pecks returning to the
+// height belong to the same drill.
+func findDrill(segs []vm.Segment, start int) (drill, bool) {
+	s := segs[start]
+	d := drill{operation{start, 0}, s.Z}
+	if s.Kind != vm.SegmentMove {
+		return d, false
+	}
+	for idx := start + 1; idx < len(segs); idx++ {
+		m := segs[idx]
+		if m.X != s.X || m.Y != s.Y || m.Z > s.Z || (m.Kind != vm.SegmentMove && m.Kind != vm.SegmentDwell) {
+			break
+		}
+		d.depth = math.Min(d.depth, m.Z)
+		if m.Z == s.Z {
+			d.end = idx
+		}
+	}
+	return d, d.end != 0 && d.depth < s.Z
+}
@@ -15,13 +15,14 @@ import "github.com/joushou/gocnc/vector"
 // Scans through all Z-descent moves, logs its height, and ensures that any future move
 // at that location will use vm.MoveModeRapid to go to the deepest previous known Z-height.
 func OptDrillSpeed(machine *vm.Machine) {
+	refuseSpilled(machine)
 	var (
 		last       vector.Vector
-		npos       []vm.Position = make([]vm.Position, 0)
-		drillStack []vm.Position = make([]vm.Position, 0)
+		npos       []vm.Segment = make([]vm.Segment, 0)
+		drillStack []vm.Segment = make([]vm.Segment, 0)
 	)
 
-	fastDrill := func(pos vm.Position) (vm.Position, vm.Position, bool) {
+	fastDrill := func(pos vm.Segment) (vm.Segment, vm.Segment, bool) {
 		var depth float64
 		var found bool
 		for _, m := range drillStack {
@@ -36,13 +37,13 @@ func OptDrillSpeed(machine *vm.Machine) {
 		drillStack = append(drillStack, pos)
 
 		if found {
+			rapid := func(st *vm.State) { st.MoveMode = vm.MoveModeRapid }
 			if pos.Z >= depth { // We have drilled all of it, so just rapid all the way
-				pos.State.MoveMode = vm.MoveModeRapid
+				pos = pos.Modify(rapid)
 				return pos, pos, false
 			} else { // Can only rapid some of the way
-				p := pos
+				p := pos.Modify(rapid)
 				p.Z = depth
-				p.State.MoveMode = vm.MoveModeRapid
 				return p, pos, true
 			}
 		} else {
@@ -50,8 +51,8 @@ func OptDrillSpeed(machine *vm.Machine) {
 		}
 	}
 
-	for _, m := range machine.Positions {
-		if m.X == last.X && m.Y == last.Y && m.Z < last.Z && m.State.MoveMode == vm.MoveModeLinear {
+	for _, m := range machine.Segments {
+		if m.Kind == vm.SegmentMove && m.X == last.X && m.Y == last.Y && m.Z < last.Z && m.State.MoveMode == vm.MoveModeLinear {
 			posn, poso, shouldinsert := fastDrill(m)
 			if shouldinsert {
 				npos = append(npos, posn)
@@ -62,5 +63,5 @@ func OptDrillSpeed(machine *vm.Machine) {
 		}
 		last = m.Vector()
 	}
-	machine.Positions = npos
+	machine.Segments = npos
 }
@@ -4,11 +4,22 @@ import "github.com/joushou/gocnc/vm"
 
 // Eliminates any bogus moves above Z0
 func OptFloatingZ(machine *vm.Machine) {
-	var last vm.Position
-	npos := make([]vm.Position, 0)
+	refuseSpilled(machine)
+	var last vm.Segment
+	npos := make([]vm.Segment, 0)
 
-	for _, m := range machine.Positions {
-		if last.Z > 0 && m.Z > 0 {
+	for _, m := range machine.Segments {
+		if m.Kind != vm.SegmentMove {
+			// Keep dwells, probes and rotations where they happen
+			if last.Z > 0 && npos[len(npos)-1] != last {
+				npos = append(npos, last)
+			}
+			npos = append(npos, m)
+			last = vm.Segment{}
+			continue
+		}
+
+		if last.Z > 0 && m.Z > 0 && m.Angles() == last.Angles() {
 			if m.Z > npos[len(npos)-1].Z {
 				npos[len(npos)-1].Z = m.Z
 			}
@@ -19,5 +30,5 @@ func OptFloatingZ(machine *vm.Machine) {
 		}
 		last = m
 	}
-	machine.Positions = npos
+	machine.Segments = npos
 }
@@ -3,8 +3,7 @@ package optimize
 import "github.com/joushou/gocnc/vm"
 import "github.com/joushou/gocnc/vector"
 
-import "errors"
-import "fmt"
+import "context"
 
 // Reduces moves between paths.
 // It does this by scanning through position stack, grouping moves that move from >= Z0 to < Z0.
@@ -14,13 +13,15 @@ import "fmt"
 // or the input ends with the drill below Z0, in order to play it safe.
 // This pass is new, and therefore slightly experimental.
 func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
-		}
-	}()
+	return OptPathGroupingContext(context.Background(), machine, tolerance)
+}
 
-	type Set []vm.Position
+// Like OptPathGrouping, but stops with the context error if the context is cancelled.
+func OptPathGroupingContext(ctx context.Context, machine *vm.Machine, tolerance float64) (err error) {
+	defer vm.Recover(&err)
+	refuseSpilled(machine)
+
+	type Set []vm.Segment
 	var (
 		lastx, lasty, lastz float64
 		sets                []Set = make([]Set, 0)
@@ -31,7 +32,15 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	)
 
 	// Find grouped drills
-	for _, m := range machine.Positions {
+	for _, m := range machine.Segments {
+		if m.Kind != vm.SegmentMove {
+			panic("Dwell, probing or rotary move detected")
+		}
+
+		if m.Angles() != machine.Segments[0].Angles() {
+			panic("Rotary move detected")
+		}
+
 		if m.Z != lastz && (m.X != lastx || m.Y != lasty) {
 			panic("Complex z-motion detected")
 		}
@@ -111,6 +120,9 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 
 	// Sort the sets after distance from current position
 	for len(sets) > 0 {
+		if len(sets)%64 == 0 && ctx.Err() != nil {
+			panic(ctx.Err())
+		}
 		for idx, _ := range sets {
 			if selectedSet == -1 {
 				selectedSet = idx
@@ -133,36 +145,39 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 	}
 
 	// Reconstruct new position stack from sorted sections
-	newPos := []vm.Position{machine.Positions[0]} // Origin
+	newPos := []vm.Segment{machine.Segments[0]} // Origin
 
-	addPos := func(pos vm.Position) {
+	addPos := func(pos vm.Segment) {
 		newPos = append(newPos, pos)
 	}
 
-	moveTo := func(pos vm.Position) {
+	moveTo := func(pos vm.Segment) {
 		curPos := newPos[len(newPos)-1]
 
 		// Check if we should go to safety-height before moving
 		if xyDiff(curPos.Vector(), pos.Vector()) < tolerance {
 			if curPos.X != pos.X || curPos.Y != pos.Y {
 				// If we're not 100% precise...
-				step1 := curPos
-				step1.State.MoveMode = vm.MoveModeLinear
+				step1 := curPos.Modify(func(st *vm.State) {
+					st.MoveMode = vm.MoveModeLinear
+				})
 				step1.X = pos.X
 				step1.Y = pos.Y
 				addPos(step1)
 			}
 			addPos(pos)
 		} else {
-			step1 := curPos
+			step1 := curPos.Modify(func(st *vm.State) {
+				st.MoveMode = vm.MoveModeRapid
+			})
 			step1.Z = safetyHeight
-			step1.State.MoveMode = vm.MoveModeRapid
 			step2 := step1
 			step2.X, step2.Y = pos.X, pos.Y
-			step3 := step2
+			step3 := step2.Modify(func(st *vm.State) {
+				st.MoveMode = vm.MoveModeLinear
+				st.Feedrate = drillSpeed
+			})
 			step3.Z = pos.Z
-			step3.State.MoveMode = vm.MoveModeLinear
-			step3.State.Feedrate = drillSpeed
 
 			addPos(step1)
 			addPos(step2)
@@ -181,7 +196,7 @@ func OptPathGrouping(machine *vm.Machine, tolerance float64) (err error) {
 		}
 	}
 
-	machine.Positions = newPos
+	machine.Segments, machine.Reordered = newPos, true
 
 	return nil
 }
@@ -0,0 +1,33 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+
+// Removes moves that change nothing.
+// Scans for moves to where the machine already is, such as repeated retracts
+// or positioning from CAM output, and removes them unless they change the
+// spindle, coolant, tool or other states taking effect where they happen. Feed
+// and move modes only take effect with the next move, which carries them in
+// its own state, so repeated mode changes between moves are collapsed as well.
+func OptPrune(machine *vm.Machine) {
+	refuseSpilled(machine)
+	npos := make([]vm.Segment, 0, len(machine.Segments))
+
+	for idx, m := range machine.Segments {
+		if idx > 0 && m.Kind == vm.SegmentMove {
+			last := npos[len(npos)-1]
+			if m.Vector() == last.Vector() && m.Angles() == last.Angles() &&
+				m.Offset == last.Offset && m.AxisOffset == last.AxisOffset && m.Machine == last.Machine &&
+				withoutModes(*m.State) == withoutModes(*last.State) {
+				continue
+			}
+		}
+		npos = append(npos, m)
+	}
+	machine.Segments = npos
+}
+
+// The state without the feed and move modes
+func withoutModes(st vm.State) vm.State {
+	st.MoveMode, st.FeedMode, st.Feedrate = 0, 0, 0
+	return st
+}
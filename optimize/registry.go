@@ -0,0 +1,111 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "errors"
+import "fmt"
+import "sort"
+import "sync"
+
+//
+// Optimizer registry
+//
+// Optimizers register themselves by name, so that custom optimizations can
+// live in separate packages or plugins, and be selected at runtime.
+//
+
+// An optimization pass over the position stack. Fails with ErrSpilled for
+// spilled machines.
+type Optimizer interface {
+	Optimize(machine *vm.Machine) error
+}
+
+// Adapts a function to the Optimizer interface
+type OptimizerFunc func(machine *vm.Machine) error
+
+func (f OptimizerFunc) Optimize(machine *vm.Machine) error {
+	return f(machine)
+}
+
+var (
+	optimizersLock sync.RWMutex
+	optimizers     = make(map[string]Optimizer)
+)
+
+// Wraps optimizations without an error result, recovering their panics, such
+// as ErrSpilled, as errors
+func simple(fn func(*vm.Machine)) Optimizer {
+	return OptimizerFunc(func(machine *vm.Machine) (err error) {
+		defer vm.Recover(&err)
+		fn(machine)
+		return nil
+	})
+}
+
+func init() {
+	Register("collinear", simple(func(machine *vm.Machine) {
+		OptCollinear(machine, 1, 0.001)
+	}))
+	Register("drill", simple(OptDrillSpeed))
+	Register("drillorder", simple(OptDrillOrder))
+	Register("float", simple(OptFloatingZ))
+	Register("bogus", simple(OptBogusMoves))
+	Register("lifts", simple(OptLiftSpeed))
+	Register("prune", simple(OptPrune))
+	Register("path", OptimizerFunc(func(machine *vm.Machine) error {
+		return OptPathGrouping(machine, 0.001)
+	}))
+	Register("retracts", simple(func(machine *vm.Machine) {
+		OptRetracts(machine, 0.5, 5)
+	}))
+	Register("travel", OptimizerFunc(OptTravel))
+	Register("vector", simple(func(machine *vm.Machine) {
+		OptVector(machine, 0.0003)
+	}))
+}
+
+// Registers an optimizer. Panics if the name is already taken.
+func Register(name string, opt Optimizer) {
+	optimizersLock.Lock()
+	defer optimizersLock.Unlock()
+	if _, ok := optimizers[name]; ok {
+		panic(fmt.Sprintf("Optimizer %s registered twice", name))
+	}
+	optimizers[name] = opt
+}
+
+// Looks up a registered optimizer
+func Lookup(name string) (Optimizer, error) {
+	optimizersLock.RLock()
+	defer optimizersLock.RUnlock()
+	opt, ok := optimizers[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown optimizer: %s", name))
+	}
+	return opt, nil
+}
+
+// Lists the names of all registered optimizers
+func Optimizers() []string {
+	optimizersLock.RLock()
+	defer optimizersLock.RUnlock()
+	res := make([]string, 0, len(optimizers))
+	for name, _ := range optimizers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Runs the optimizers in order, checking the context before each of them
+func RunContext(ctx context.Context, machine *vm.Machine, opts ...Optimizer) error {
+	for _, opt := range opts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := opt.Optimize(machine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
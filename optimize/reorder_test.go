@@ -0,0 +1,33 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "testing"
+
+func TestReordered(t *testing.T) {
+	// Drills far apart, in an order the travel and drill order optimizers change
+	const program = "G21 G90 G0 Z5 F100\nG0 X0 Y0\nG1 Z-1\nG0 Z5\nX100\nG1 Z-1\nG0 Z5\nX1\nG1 Z-1\nG0 Z5\nX101\nG1 Z-1\nG0 Z5\n"
+
+	tests := []struct {
+		name      string
+		opt       func(m *vm.Machine) error
+		reordered bool
+	}{
+		{"travel", OptTravel, true},
+		{"path", func(m *vm.Machine) error { return OptPathGrouping(m, 0.001) }, true},
+		{"drillorder", func(m *vm.Machine) error { OptDrillOrder(m); return nil }, true},
+		{"prune", func(m *vm.Machine) error { OptPrune(m); return nil }, false},
+		{"vector", func(m *vm.Machine) error { OptVector(m, 0.0003); return nil }, false},
+	}
+	for _, test := range tests {
+		m := processProgram(t, program)
+		if err := test.opt(m); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if m.Reordered != test.reordered {
+			t.Errorf("%s: got reordered %t, expected %t", test.name, m.Reordered, test.reordered)
+		}
+		if _, err := m.IndexOfLine(8); (err != nil) != test.reordered {
+			t.Errorf("%s: got %v resuming at a line", test.name, err)
+		}
+	}
+}
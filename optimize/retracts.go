@@ -0,0 +1,87 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "math"
+
+//
+// Retract minimization
+//
+// CAM output for engraving retracts to the safety height between every
+// stroke, even when the next stroke starts right next to where the last one
+// ended. Retracts from below the clearance height (above Z0, the top of the
+// work like for the other optimizations), followed by moves at the retract
+// height and a plunge back below the clearance height, all at most distance
+// away in XY, are replaced by a hop at the clearance height. Moves at the
+// retract height going further, such as to clear a clamp or change the tool
+// and back, keep the retract. Descents of the
+// plunge above the clearance height are dropped.
+//
+// Only moves with the same tool, spindle, coolant and other states taking
+// effect where they happen are changed, and never moves in machine
+// coordinates, as these are often used to clear fixtures.
+//
+
+// Replaces retracts between nearby cuts with hops at the clearance height
+func OptRetracts(machine *vm.Machine, clearance, distance float64) {
+	refuseSpilled(machine)
+	segs := machine.Segments
+	npos := make([]vm.Segment, 0, len(segs))
+
+	for idx := 0; idx < len(segs); idx++ {
+		last, plunge, ok := findHop(segs, idx, clearance, distance)
+		if !ok {
+			npos = append(npos, segs[idx])
+			continue
+		}
+		for _, m := range segs[idx : last+1] {
+			m.Z = clearance
+			npos = append(npos, m)
+		}
+		npos = append(npos, segs[plunge])
+		idx = plunge
+	}
+	machine.Segments = npos
+}
+
+// Tests if the segment at idx retracts for a hop, returning the last move
+// at the retract height and the move plunging below the clearance height
+func findHop(segs []vm.Segment, idx int, clearance, distance float64) (last, plunge int, ok bool) {
+	if idx == 0 {
+		return 0, 0, false
+	}
+	from, retract := segs[idx-1], segs[idx]
+	if from.Z >= clearance || retract.Z <= clearance || retract.X != from.X || retract.Y != from.Y {
+		return 0, 0, false
+	}
+
+	last = idx
+	for last+1 < len(segs) && segs[last+1].Z == retract.Z {
+		last++
+	}
+	plunge = last + 1
+	for plunge < len(segs) && segs[plunge].Z >= clearance {
+		plunge++
+	}
+	if plunge == len(segs) {
+		return 0, 0, false
+	}
+	for i := idx; i <= last; i++ {
+		if math.Hypot(segs[i].X-from.X, segs[i].Y-from.Y) > distance {
+			return 0, 0, false
+		}
+	}
+
+	k := withoutModes(*from.State)
+	for i := idx; i <= plunge; i++ {
+		m := segs[i]
+		if m.Kind != vm.SegmentMove || m.State.MoveMode == vm.MoveModeNone || m.Machine ||
+			withoutModes(*m.State) != k || m.Offset != from.Offset || m.AxisOffset != from.AxisOffset || m.Angles() != from.Angles() {
+			return 0, 0, false
+		}
+		if i > last && (m.X != segs[last].X || m.Y != segs[last].Y || m.Z >= segs[i-1].Z) {
+			// The plunge must go straight down
+			return 0, 0, false
+		}
+	}
+	return last, plunge, true
+}
@@ -0,0 +1,47 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "math"
+import "testing"
+
+// The highest Z of the moves between the first and last cut
+func hopHeight(m *vm.Machine) float64 {
+	var first, last int
+	for idx, seg := range m.Segments {
+		if seg.Z < 0 {
+			if first == 0 {
+				first = idx
+			}
+			last = idx
+		}
+	}
+	var height float64
+	for _, seg := range m.Segments[first:last] {
+		height = math.Max(height, seg.Z)
+	}
+	return height
+}
+
+func TestOptRetracts(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		height  float64
+	}{
+		{"nearby", "G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F100\nX1\nG0 Z5\nX2\nG1 Z-1\nX3\nG0 Z5\n", 0.5},
+		{"far", "G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F100\nX1\nG0 Z5\nX20\nG1 Z-1\nX21\nG0 Z5\n", 5},
+		{"away and back", "G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F100\nX1\nG0 Z5\nX50 Y50\nX2 Y0\nG1 Z-1\nX3\nG0 Z5\n", 5},
+		{"machine coordinates", "G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F100\nX1\nG53 G0 Z5\nG0 X2\nG1 Z-1\nX3\nG0 Z5\n", 5},
+	}
+	for _, test := range tests {
+		m := processProgram(t, test.program)
+		original := append([]vm.Segment(nil), m.Segments...)
+		OptRetracts(m, 0.5, 5)
+		if h := hopHeight(m); h != test.height {
+			t.Errorf("%s: hop at %g, expected %g", test.name, h, test.height)
+		}
+		if err := Verify(original, m.Segments, 0.002); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "errors"
+
+// The error of optimizers given a spilled machine (see vm/spill.go), as they
+// rewrite the segments in memory and would leave the spilled segments as
+// they were
+var ErrSpilled = errors.New("Cannot optimize a spilled program")
+
+// Panics with ErrSpilled if the machine is spilled. Optimizers without an
+// error result panic, and those registered or used by the pipeline recover
+// the panic as their error.
+func refuseSpilled(machine *vm.Machine) {
+	if machine.Spilled() {
+		panic(ErrSpilled)
+	}
+}
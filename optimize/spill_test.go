@@ -0,0 +1,30 @@
+package optimize
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "testing"
+
+func TestSpilled(t *testing.T) {
+	doc, err := gcode.Parse("G21 G90\nG0 X0 Y0 Z5\nG1 Z-1 F100\nX10\nX10\nX20\nY10\nG0 Z5\nX0 Y0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range Optimizers() {
+		m := vm.New(vm.WithSpill(t.TempDir(), 2))
+		if err := m.Process(doc); err != nil {
+			t.Fatal(err)
+		}
+		if !m.Spilled() {
+			t.Fatal("Program not spilled")
+		}
+		opt, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := opt.Optimize(m); !errors.Is(err, ErrSpilled) {
+			t.Errorf("%s: got %v for a spilled program, expected %v", name, err, ErrSpilled)
+		}
+		m.Close()
+	}
+}
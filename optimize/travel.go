@@ -0,0 +1,201 @@
+package optimize
+
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "math"
+
+//
+// Travel ordering
+//
+// Reorders operations to shorten the rapid moves between them. An operation
+// is a run of moves below the safety height, which is the highest Z of the
+// program, starting and ending at it. Operations are independent if nothing
+// but moves at the safety height separate them, and they run with the same
+// tool, spindle, coolant, work offset and rotary angles, and do not pause
+// the program, as the operator expects pauses in order. Every run of
+// independent operations is ordered separately, starting where the first of them started:
+//
+//   - by nearest neighbour, going to the closest start from where the last
+//     operation ended
+//   - improved by 2-opt, reversing the order of runs of operations while
+//     that shortens the travel
+//
+// The moves of the operations are kept as they are, so operations are never
+// reversed. The moves between them are replaced by a single rapid at the
+// safety height. Unlike path grouping, operations may move in Z and XY at
+// once, such as when ramping.
+//
+
+// Maximum number of 2-opt passes over a run of operations
+const maxTravelPasses = 64
+
+// An operation, from the segment at the safety height before it, to the
+// first segment back at the safety height
+type operation struct {
+	start, end int
+}
+
+// Orders independent operations to shorten the travel between them
+func OptTravel(machine *vm.Machine) error {
+	return OptTravelContext(context.Background(), machine)
+}
+
+// Like OptTravel, but stops with the context error if the context is cancelled.
+func OptTravelContext(ctx context.Context, machine *vm.Machine) (err error) {
+	defer vm.Recover(&err)
+	refuseSpilled(machine)
+
+	segs := machine.Segments
+	if len(segs) < 2 {
+		return nil
+	}
+
+	safety := math.Inf(-1)
+	for _, seg := range segs[1:] {
+		if seg.Kind == vm.SegmentMove && seg.State.MoveMode != vm.MoveModeNone {
+			safety = math.Max(safety, seg.Z)
+		}
+	}
+	safe := func(seg vm.Segment) bool {
+		return seg.Z >= safety-1e-6
+	}
+
+	// Find the operations
+	var ops []operation
+	for idx := 1; idx < len(segs); idx++ {
+		if safe(segs[idx]) {
+			continue
+		}
+		start := idx - 1
+		for idx < len(segs) && !safe(segs[idx]) {
+			idx++
+		}
+		if idx == len(segs) {
+			// Ends below the safety height
+			break
+		}
+		ops = append(ops, operation{start, idx})
+	}
+
+	// Split into runs of independent operations, and order them
+	var (
+		res  = []vm.Segment{}
+		next = 0 // First segment not yet added
+	)
+	for first := 0; first < len(ops); {
+		last := first
+		for last+1 < len(ops) && independent(segs, ops[last], ops[last+1]) {
+			last++
+		}
+		if ctx.Err() != nil {
+			panic(ctx.Err())
+		}
+
+		run := ops[first : last+1]
+		if len(run) > 2 {
+			res = append(res, segs[next:run[0].start+1]...)
+			res = appendOperations(res, segs, orderOperations(ctx, segs, run))
+			next = run[len(run)-1].end + 1
+		}
+		first = last + 1
+	}
+	res = append(res, segs[next:]...)
+
+	machine.Segments, machine.Reordered = res, true
+	return nil
+}
+
+// Tests if two consecutive operations can be reordered
+func independent(segs []vm.Segment, a, b operation) bool {
+	key := func(seg vm.Segment) vm.State {
+		st := *seg.State
+		st.MoveMode, st.Feedrate, st.FeedMode = 0, 0, 0
+		return st
+	}
+
+	k := key(segs[a.start])
+	for idx := a.start; idx <= b.end; idx++ {
+		seg := segs[idx]
+		if key(seg) != k || seg.Offset != segs[a.start].Offset || seg.Angles() != segs[a.start].Angles() || seg.Machine || seg.Kind == vm.SegmentPause {
+			return false
+		}
+		if idx > a.end && idx <= b.start && (seg.Kind != vm.SegmentMove || seg.Z != segs[a.end].Z) {
+			// Travel between them must be plain moves at the safety height
+			return false
+		}
+	}
+	return true
+}
+
+// Orders operations by nearest neighbour, improved by 2-opt
+func orderOperations(ctx context.Context, segs []vm.Segment, ops []operation) []operation {
+	dist := func(from, to operation) float64 {
+		a, b := segs[from.end], segs[to.start]
+		return math.Hypot(b.X-a.X, b.Y-a.Y)
+	}
+
+	// Nearest neighbour, from the start of the first
+	var (
+		res  = []operation{ops[0]}
+		left = append([]operation{}, ops[1:]...)
+	)
+	for len(left) > 0 {
+		best := 0
+		for idx := range left {
+			if dist(res[len(res)-1], left[idx]) < dist(res[len(res)-1], left[best]) {
+				best = idx
+			}
+		}
+		res = append(res, left[best])
+		left = append(left[:best], left[best+1:]...)
+	}
+
+	// 2-opt, keeping the first operation in place. As operations are not
+	// symmetric, the travel within a reversed run changes too.
+	for pass, improved := 0, true; pass < maxTravelPasses && improved; pass++ {
+		if ctx.Err() != nil {
+			panic(ctx.Err())
+		}
+		improved = false
+		for i := 1; i < len(res)-1; i++ {
+			var forward, backward float64
+			for j := i + 1; j < len(res); j++ {
+				forward += dist(res[j-1], res[j])
+				backward += dist(res[j], res[j-1])
+
+				before := dist(res[i-1], res[i]) + forward
+				after := dist(res[i-1], res[j]) + backward
+				if j+1 < len(res) {
+					before += dist(res[j], res[j+1])
+					after += dist(res[i], res[j+1])
+				}
+				if after < before-1e-9 {
+					for a, b := i, j; a < b; a, b = a+1, b-1 {
+						res[a], res[b] = res[b], res[a]
+					}
+					improved = true
+					forward, backward = 0, 0
+					for k := i + 1; k <= j; k++ {
+						forward += dist(res[k-1], res[k])
+						backward += dist(res[k], res[k-1])
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// Appends the moves of the operations in order, with a rapid to the start of each
+func appendOperations(res, segs []vm.Segment, ops []operation) []vm.Segment {
+	for _, op := range ops {
+		start := segs[op.start]
+		if res[len(res)-1].Vector() != start.Vector() {
+			res = append(res, start.Modify(func(st *vm.State) {
+				st.MoveMode = vm.MoveModeRapid
+			}))
+		}
+		res = append(res, segs[op.start+1:op.end+1]...)
+	}
+	return res
+}
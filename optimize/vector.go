@@ -6,20 +6,28 @@ import "github.com/joushou/gocnc/vector"
 // Kills redundant partial moves.
 // Calculates the unit-vector, and kills all incremental moves between A and B.
 func OptVector(machine *vm.Machine, tolerance float64) {
+	refuseSpilled(machine)
 	var (
 		vec1, vec2, vec3 vector.Vector
 		ready            int
 		length1, length2 float64
 		lastMoveMode     int
-		npos             []vm.Position = make([]vm.Position, 0)
+		lastAngles       [3]float64
+		npos             []vm.Segment = make([]vm.Segment, 0)
 	)
 
-	for _, m := range machine.Positions {
-		if m.State.MoveMode != vm.MoveModeLinear && m.State.MoveMode != vm.MoveModeRapid {
+	for _, m := range machine.Segments {
+		if m.Kind != vm.SegmentMove || (m.State.MoveMode != vm.MoveModeLinear && m.State.MoveMode != vm.MoveModeRapid) {
 			ready = 0
 			goto appendpos
 		}
 
+		if m.Angles() != lastAngles {
+			// Keep moves rotating the rotary axes
+			lastAngles = m.Angles()
+			ready = 0
+		}
+
 		if m.State.MoveMode != lastMoveMode {
 			lastMoveMode = m.State.MoveMode
 			ready = 0
@@ -53,5 +61,5 @@ func OptVector(machine *vm.Machine, tolerance float64) {
 	appendpos:
 		npos = append(npos, m)
 	}
-	machine.Positions = npos
+	machine.Segments = npos
 }
@@ -0,0 +1,197 @@
+package optimize
+
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "fmt"
+import "math"
+
+//
+// Verification
+//
+// Optimizations must not change what is cut. Verify compares the segments
+// from before and after optimizing:
+//
+//   - Every point of the feed moves of the original at or below Z0 must be
+//     within the tolerance of the optimized toolpath, so that nothing is
+//     left uncut.
+//   - Every point of the optimized toolpath at or below Z0 must be within the
+//     tolerance of the original toolpath, so that nothing new is cut.
+//   - The sequence of tool, spindle, coolant, compensation, override and
+//     torch height control changes, and of dwells, probes and rotations,
+//     must be unchanged.
+//
+// Like the optimizations, this assumes that the work is below Z0. Moves are
+// compared in machine coordinates, so that moves changed to another work
+// offset are still compared with where they cut.
+//
+// Moves are compared at points sampled along them, at most verifyStep apart,
+// so deviations shorter than that can go unnoticed. Order of moves is not
+// compared, as path grouping reorders operations.
+//
+
+// Distance between sampled points (mm)
+const verifyStep = 0.5
+
+// Verifies that the optimized segments cut the same as the original ones,
+// within the tolerance, returning an error describing the first difference
+func Verify(original, optimized []vm.Segment, tolerance float64) error {
+	motion := func(seg vm.Segment) bool {
+		return (seg.Kind == vm.SegmentMove || seg.Kind == vm.SegmentProbe) && seg.State.MoveMode != vm.MoveModeNone
+	}
+	origPath := newPathIndex(original, motion, tolerance)
+	optPath := newPathIndex(optimized, motion, tolerance)
+
+	for idx := 1; idx < len(original); idx++ {
+		seg := original[idx]
+		if seg.Kind != vm.SegmentMove || seg.State.MoveMode != vm.MoveModeLinear {
+			continue
+		}
+		p, ok := sample(original[idx-1].MachineVector(), seg.MachineVector(), func(p vector.Vector) bool {
+			return p.Z-seg.Offset.Z > 0 || optPath.near(p, tolerance)
+		})
+		if !ok {
+			return errors.New(fmt.Sprintf("Cut at X%g Y%g Z%g (line %d) missing after optimization", p.X, p.Y, p.Z, seg.Line))
+		}
+	}
+
+	for idx := 1; idx < len(optimized); idx++ {
+		seg := optimized[idx]
+		if !motion(seg) {
+			continue
+		}
+		p, ok := sample(optimized[idx-1].MachineVector(), seg.MachineVector(), func(p vector.Vector) bool {
+			return p.Z-seg.Offset.Z > 0 || origPath.near(p, tolerance)
+		})
+		if !ok {
+			return errors.New(fmt.Sprintf("Move through X%g Y%g Z%g (line %d) not in the original toolpath", p.X, p.Y, p.Z, seg.Line))
+		}
+	}
+
+	a, b := changes(original), changes(optimized)
+	for idx := 0; idx < len(a) || idx < len(b); idx++ {
+		if idx >= len(a) || idx >= len(b) || a[idx] != b[idx] {
+			return errors.New(fmt.Sprintf("Sequence of state changes, dwells, probes and rotations differs at change %d", idx+1))
+		}
+	}
+	return nil
+}
+
+// Calls fn for points along the line from a to b, returning the first point for which it returns false
+func sample(a, b vector.Vector, fn func(vector.Vector) bool) (vector.Vector, bool) {
+	d := b.Diff(a)
+	n := int(math.Ceil(d.Norm() / verifyStep))
+	for i := 0; i <= n; i++ {
+		p := a
+		if n > 0 {
+			t := float64(i) / float64(n)
+			p = a.Sum(vector.Vector{d.X * t, d.Y * t, d.Z * t})
+		}
+		if !fn(p) {
+			return p, false
+		}
+	}
+	return vector.Vector{}, true
+}
+
+// Something in the sequence compared by Verify
+type change struct {
+	kind                                       int
+	param                                      float64
+	axis                                       rune
+	tool                                       int
+	spindle, clockwise, flood, mist, over, thc bool
+	speed                                      float64
+	cutComp                                    int
+	css                                        bool
+	surface, maxSpeed                          float64
+}
+
+// Lists the state changes, dwells, probes and rotations of the segments
+func changes(segs []vm.Segment) []change {
+	var res []change
+	for _, seg := range segs {
+		st := seg.State
+		c := change{vm.SegmentMove, 0, 0, st.Tool, st.SpindleEnabled, st.SpindleClockwise,
+			st.FloodCoolant, st.MistCoolant, st.OverridesDisabled, st.THCDisabled, st.SpindleSpeed, st.CutterCompensation,
+			st.ConstantSurfaceSpeed, st.SurfaceSpeed, st.MaxSpindleSpeed}
+		if len(res) == 0 || c != res[len(res)-1] {
+			res = append(res, c)
+		}
+		if seg.Kind != vm.SegmentMove {
+			c.kind, c.param, c.axis = seg.Kind, seg.Param, seg.Axis
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Lines between segments, indexed by XY grid cells for finding the lines near a point
+type pathIndex struct {
+	cell  float64
+	lines [][2]vector.Vector
+	grid  map[[2]int][]int
+}
+
+// Indexes the lines to the segments accepted by include, for distances up to tolerance
+func newPathIndex(segs []vm.Segment, include func(vm.Segment) bool, tolerance float64) *pathIndex {
+	p := &pathIndex{
+		cell: math.Max(2*verifyStep, 2*tolerance),
+		grid: make(map[[2]int][]int),
+	}
+
+	for idx := 1; idx < len(segs); idx++ {
+		if !include(segs[idx]) {
+			continue
+		}
+		a, b := segs[idx-1].MachineVector(), segs[idx].MachineVector()
+		line := len(p.lines)
+		p.lines = append(p.lines, [2]vector.Vector{a, b})
+
+		// Points at most half a cell apart, each added with the surrounding cells, so
+		// that all points within the tolerance of the line are in a cell with the line
+		d := b.Diff(a)
+		n := int(math.Ceil(math.Hypot(d.X, d.Y) / (p.cell / 2)))
+		for i := 0; i <= n; i++ {
+			pt := a
+			if n > 0 {
+				pt = a.Sum(vector.Vector{d.X * float64(i) / float64(n), d.Y * float64(i) / float64(n), 0})
+			}
+			c := p.cellOf(pt)
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					k := [2]int{c[0] + dx, c[1] + dy}
+					if l := p.grid[k]; len(l) == 0 || l[len(l)-1] != line {
+						p.grid[k] = append(l, line)
+					}
+				}
+			}
+		}
+	}
+	return p
+}
+
+func (p *pathIndex) cellOf(v vector.Vector) [2]int {
+	return [2]int{int(math.Floor(v.X / p.cell)), int(math.Floor(v.Y / p.cell))}
+}
+
+// Tests if the point is within the tolerance of any of the lines
+func (p *pathIndex) near(v vector.Vector, tolerance float64) bool {
+	for _, idx := range p.grid[p.cellOf(v)] {
+		if distanceToLine(v, p.lines[idx][0], p.lines[idx][1]) <= tolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// Distance from a point to the line between a and b
+func distanceToLine(p, a, b vector.Vector) float64 {
+	d := b.Diff(a)
+	l := d.Dot(d)
+	if l == 0 {
+		return p.Diff(a).Norm()
+	}
+	t := math.Max(0, math.Min(1, p.Diff(a).Dot(d)/l))
+	return p.Diff(a.Sum(vector.Vector{d.X * t, d.Y * t, d.Z * t})).Norm()
+}
@@ -0,0 +1,34 @@
+package optimize
+
+import "testing"
+
+func TestVerify(t *testing.T) {
+	const (
+		cut     = "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nX10\nG0 Z1\n"
+		offset  = "G10 L2 P2 X5\n"
+		shifted = "G21 G90 G0 X5 Y0 Z1\nG1 Z-1 F100\nX15\nG0 Z1\n"
+	)
+	tests := []struct {
+		name      string
+		original  string
+		optimized string
+		ok        bool
+	}{
+		{"unchanged", cut, cut, true},
+		{"reversed", cut, "G21 G90 G0 X10 Y0 Z1\nG1 Z-1 F100\nX0\nG0 Z1\n", true},
+		{"missing cut", cut, "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nX5\nG0 Z1\n", false},
+		{"new cut", cut, "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nX10\nY5\nG0 Z1\n", false},
+		{"moves above the work", cut, "G21 G90 G0 X0 Y0 Z1\nG0 Y5 Z2\nY0 Z1\nG1 Z-1 F100\nX10\nG0 Z1\n", true},
+		{"other work offset", shifted, offset + "G55\n" + cut, true},
+		{"moved by the work offset", cut, offset + "G55\n" + cut, false},
+		{"spindle changed", cut, "M3 S1000\n" + cut, false},
+	}
+	for _, test := range tests {
+		original := processProgram(t, test.original)
+		optimized := processProgram(t, test.optimized)
+		err := Verify(original.Segments, optimized.Segments, 0.01)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package pipeline
+
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/optimize"
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/warnings"
+import "context"
+import "errors"
+import "fmt"
+import "io"
+
+//
+// High-level processing pipeline
+//
+// Wires parsing, the vm, optimization and export together:
+//
+//   err := pipeline.Parse(r).WithDialect(vm.DialectRS274NGC).Optimize().ExportTo(gen)
+//
+// Errors are kept in the pipeline, so steps can be chained freely. The first
+// error stops all following steps, and is returned by ExportTo, Machine and Err.
+//
+
+// An optimization or modification applied to the machine
+type Optimization func(*vm.Machine) error
+
+// Wraps optimizations without an error result
+func wrap(fn func(*vm.Machine)) Optimization {
+	return func(m *vm.Machine) error {
+		fn(m)
+		return nil
+	}
+}
+
+var (
+	DrillSpeed = wrap(optimize.OptDrillSpeed)
+	DrillOrder = wrap(optimize.OptDrillOrder)
+	FloatingZ  = wrap(optimize.OptFloatingZ)
+	BogusMoves = wrap(optimize.OptBogusMoves)
+	LiftSpeed  = wrap(optimize.OptLiftSpeed)
+	Prune      = wrap(optimize.OptPrune)
+)
+
+// Groups paths to minimize moves between operations
+func PathGrouping(tolerance float64) Optimization {
+	return func(m *vm.Machine) error {
+		return optimize.OptPathGrouping(m, tolerance)
+	}
+}
+
+// Orders independent operations to shorten the rapid moves between them
+func Travel(m *vm.Machine) error {
+	return optimize.OptTravel(m)
+}
+
+// Removes moves deviating less than tolerance from a straight line
+func Vector(tolerance float64) Optimization {
+	return func(m *vm.Machine) error {
+		optimize.OptVector(m, tolerance)
+		return nil
+	}
+}
+
+// Merges consecutive feed moves at the same state turning less than angle
+// (degrees) and deviating less than deviation from a straight line
+func Collinear(angle, deviation float64) Optimization {
+	return func(m *vm.Machine) error {
+		optimize.OptCollinear(m, angle, deviation)
+		return nil
+	}
+}
+
+// Replaces retracts between cuts at most distance apart in XY with hops at
+// the clearance height above Z0
+func Retracts(clearance, distance float64) Optimization {
+	return func(m *vm.Machine) error {
+		optimize.OptRetracts(m, clearance, distance)
+		return nil
+	}
+}
+
+// Lowers feedrates so that no axis exceeds its maximum feedrate in the profile
+func AxisFeedrate(profile machine.Profile) Optimization {
+	return func(m *vm.Machine) error {
+		optimize.OptAxisFeedrate(m, profile)
+		return nil
+	}
+}
+
+// Looks up a registered optimizer, such as one loaded from a plugin
+func Named(name string) Optimization {
+	return func(m *vm.Machine) error {
+		opt, err := optimize.Lookup(name)
+		if err != nil {
+			return err
+		}
+		return opt.Optimize(m)
+	}
+}
+
+// Records errors from the optimization as warnings, leaving the machine as the optimization left it
+func Optional(opt Optimization) Optimization {
+	return func(m *vm.Machine) error {
+		if err := opt(m); err != nil {
+			m.Warnings.Add(warnings.StageOptimize, 0, warnings.SeverityWarning, "%s", err)
+		}
+		return nil
+	}
+}
+
+// The optimizations applied by Optimize when none are given, same as the command line tool
+func Defaults() []Optimization {
+	return []Optimization{Prune, DrillSpeed, FloatingZ, Optional(PathGrouping(0.001)), Vector(0.0003), LiftSpeed}
+}
+
+type Pipeline struct {
+	r         io.Reader // Parsed when processing, using the dialect
+	doc       *gcode.Document
+	machine   vm.Machine
+	processed bool
+	tolerant  bool
+	verify    float64 // Tolerance for verifying optimizations, 0 if disabled
+	resume    int     // Line or segment index to export from, see ResumeAt and ResumeAtIndex
+	byIndex   bool    // Resuming at a segment index instead of a line
+	ctx       context.Context
+	err       error
+}
+
+// Creates a pipeline for a parsed document
+func FromDocument(doc *gcode.Document) *Pipeline {
+	p := &Pipeline{doc: doc, machine: *vm.New(), ctx: context.Background()}
+	return p
+}
+
+// Creates a pipeline reading gcode from r. The gcode is read and parsed one
+// line at a time when processing, according to the dialect, so the document
+// is never held in memory.
+func Parse(r io.Reader) *Pipeline {
+	p := &Pipeline{r: r, machine: *vm.New(), ctx: context.Background()}
+	return p
+}
+
+// Stores an error for misuse of the pipeline, unless one is already set
+func (p *Pipeline) fail(msg string) {
+	if p.err == nil {
+		p.err = errors.New(msg)
+	}
+}
+
+// Sets the context used by all following steps. If the context is cancelled,
+// the current step stops, and the context error becomes the pipeline error.
+func (p *Pipeline) WithContext(ctx context.Context) *Pipeline {
+	p.ctx = ctx
+	return p
+}
+
+// Sets the dialect used to parse and interpret the document. Must be called before Optimize.
+func (p *Pipeline) WithDialect(dialect int) *Pipeline {
+	if p.processed {
+		p.fail("Dialect must be set before processing")
+	}
+	p.machine.Dialect = dialect
+	return p
+}
+
+// Spills segments to disk when more than limit are held in memory, for programs
+// too large for memory. Spilled programs can be exported, but not optimized.
+// Must be called before Optimize.
+func (p *Pipeline) WithSpill(dir string, limit int) *Pipeline {
+	if p.processed {
+		p.fail("Spilling must be enabled before processing")
+	}
+	vm.WithSpill(dir, limit)(&p.machine)
+	return p
+}
+
+// Exports segments to the generators as they are produced, instead of keeping
+// them in memory. As the segments are gone after processing, streamed programs
+// cannot be optimized or exported again. Must be called before processing.
+func (p *Pipeline) WithStream(gens ...export.CodeGenerator) *Pipeline {
+	if p.processed {
+		p.fail("Streaming must be enabled before processing")
+	}
+	vm.WithStream(export.Stream(gens...))(&p.machine)
+	return p
+}
+
+// Skips lines that cannot be parsed, adding warnings, instead of failing. Must be called before Optimize.
+func (p *Pipeline) WithTolerantParsing() *Pipeline {
+	if p.processed {
+		p.fail("Tolerant parsing must be enabled before processing")
+	}
+	p.tolerant = true
+	return p
+}
+
+// Makes feed moves without a previously set feedrate errors instead of warnings.
+// Must be called before Optimize.
+func (p *Pipeline) WithStrictFeedrate() *Pipeline {
+	if p.processed {
+		p.fail("Strict feedrate must be enabled before processing")
+	}
+	p.machine.StrictFeedrate = true
+	return p
+}
+
+// Limits feedrates to the given maximum (mm/min), with a warning for every
+// feedrate limited. Must be called before Optimize.
+func (p *Pipeline) WithMaxFeedrate(feedrate float64) *Pipeline {
+	if p.processed {
+		p.fail("Maximum feedrate must be set before processing")
+	}
+	vm.WithMaxFeedrate(feedrate)(&p.machine)
+	return p
+}
+
+// Fails processing when more than max segments are produced. Must be called before processing.
+func (p *Pipeline) WithMaxSegments(max int) *Pipeline {
+	if p.processed {
+		p.fail("Maximum segments must be set before processing")
+	}
+	vm.WithMaxSegments(max)(&p.machine)
+	return p
+}
+
+// Stops the spindle and dwells for the given number of seconds before reversing it.
+// Must be called before Optimize.
+func (p *Pipeline) WithSafeReversal(dwell float64) *Pipeline {
+	if p.processed {
+		p.fail("Safe reversal must be enabled before processing")
+	}
+	vm.WithSafeReversal(dwell)(&p.machine)
+	return p
+}
+
+// Sets the tool table, used for tool length offsets (G43) and cutter
+// compensation. Must be called before Optimize.
+func (p *Pipeline) WithToolTable(tools vm.ToolTable) *Pipeline {
+	if p.processed {
+		p.fail("Tool table must be set before processing")
+	}
+	vm.WithToolTable(tools)(&p.machine)
+	return p
+}
+
+// Offsets the path for G41 and G42, using the diameters of the tool table,
+// instead of passing them on. Must be called before Optimize.
+func (p *Pipeline) WithCutterCompensation() *Pipeline {
+	if p.processed {
+		p.fail("Cutter compensation must be enabled before processing")
+	}
+	vm.WithCutterCompensation()(&p.machine)
+	return p
+}
+
+// Bakes G51 scaling into the positions only, instead of also passing it on to
+// generators scaling themselves. Must be called before processing.
+func (p *Pipeline) WithBakedScaling() *Pipeline {
+	if p.processed {
+		p.fail("Baked scaling must be enabled before processing")
+	}
+	vm.WithBakedScaling()(&p.machine)
+	return p
+}
+
+// Treats the spindle as a plasma torch with the given settings. Must be called before Optimize.
+// As plasma cuts above Z0, which FloatingZ and PathGrouping take for moves between operations,
+// these are left out of the default optimizations, and must not be given to Optimize.
+func (p *Pipeline) WithPlasma(settings vm.Plasma) *Pipeline {
+	if p.processed {
+		p.fail("Plasma settings must be set before processing")
+	}
+	vm.WithPlasma(settings)(&p.machine)
+	return p
+}
+
+// Sets the arc tolerances used to interpret the document. Must be called before Optimize.
+func (p *Pipeline) WithArcTolerance(maxDeviation, minLineLength float64) *Pipeline {
+	if p.processed {
+		p.fail("Arc tolerance must be set before processing")
+	}
+	p.machine.MaxArcDeviation = maxDeviation
+	p.machine.MinArcLineLength = minLineLength
+	return p
+}
+
+// Verifies every optimization applied by Optimize, failing if it changed the
+// toolpath by more than the tolerance or changed the sequence of states (see
+// optimize.Verify). Modifications applied with Apply are not verified.
+func (p *Pipeline) WithVerification(tolerance float64) *Pipeline {
+	if tolerance <= 0 {
+		p.fail("Verification tolerance must be positive")
+	}
+	p.verify = tolerance
+	return p
+}
+
+// Runs the document through the vm, if not already done
+func (p *Pipeline) process() {
+	if p.err != nil || p.processed {
+		return
+	}
+	p.processed = true
+	if p.doc == nil {
+		opts := vm.DialectOptions(p.machine.Dialect)
+		opts.Tolerant = p.tolerant
+		p.err = p.machine.ProcessReader(p.ctx, p.r, opts)
+		return
+	}
+	p.err = p.machine.ProcessContext(p.ctx, p.doc)
+}
+
+// Applies the optimizations in order, or the defaults if none are given
+func (p *Pipeline) Optimize(opts ...Optimization) *Pipeline {
+	if len(opts) == 0 && p.machine.Plasma != nil {
+		opts = []Optimization{DrillSpeed, Vector(0.0003), LiftSpeed}
+	} else if len(opts) == 0 {
+		opts = Defaults()
+	}
+	return p.apply(p.verify, opts)
+}
+
+// Applies modifications to the machine, such as optimizations, in order
+func (p *Pipeline) Apply(fns ...Optimization) *Pipeline {
+	return p.apply(0, fns)
+}
+
+// Applies the functions in order, verifying each if the tolerance is not 0
+func (p *Pipeline) apply(verify float64, fns []Optimization) *Pipeline {
+	p.process()
+	if len(fns) > 0 && p.machine.Spilled() && p.err == nil {
+		p.err = optimize.ErrSpilled
+	}
+	for idx, fn := range fns {
+		if p.err == nil {
+			p.err = p.ctx.Err()
+		}
+		if p.err != nil {
+			break
+		}
+		func() {
+			defer vm.Recover(&p.err)
+			var orig []vm.Segment
+			if verify > 0 {
+				orig = append(orig, p.machine.Segments...)
+			}
+			if p.err = fn(&p.machine); p.err == nil && verify > 0 {
+				if err := optimize.Verify(orig, p.machine.Segments, verify); err != nil {
+					p.err = fmt.Errorf("Optimization %d failed verification: %w", idx+1, err)
+				}
+			}
+		}()
+	}
+	if p.err == nil {
+		p.machine.UpdateElapsed(p.machine.Profile())
+	}
+	return p
+}
+
+// Returns the processed machine
+func (p *Pipeline) Machine() (*vm.Machine, error) {
+	p.process()
+	return &p.machine, p.err
+}
+
+// Returns the first error of the pipeline
+func (p *Pipeline) Err() error {
+	return p.err
+}
+
+// Returns the warnings of all steps so far
+func (p *Pipeline) Warnings() warnings.Warnings {
+	p.process()
+	return p.machine.Warnings
+}
+
+// Makes the export resume the program at the first segment of the line or a
+// line after it, starting with a safe-start prologue (see export/restart.go)
+// that brings the machine from an unknown state, such as after a crash, to
+// the state and position the program had there
+func (p *Pipeline) ResumeAt(line int) *Pipeline {
+	p.resume, p.byIndex = line, false
+	return p
+}
+
+// Like ResumeAt, resuming at a segment index instead of a line
+func (p *Pipeline) ResumeAtIndex(idx int) *Pipeline {
+	p.resume, p.byIndex = idx, true
+	return p
+}
+
+// The segment index to export from, 0 unless resuming
+func (p *Pipeline) start() (int, error) {
+	switch {
+	case p.resume <= 0:
+		return 0, nil
+	case p.byIndex && p.resume >= p.machine.Len():
+		return 0, errors.New(fmt.Sprintf("No segment at index %d", p.resume))
+	case p.byIndex:
+		return p.resume, nil
+	}
+	return p.machine.IndexOfLine(p.resume)
+}
+
+// Exports all positions to the code generators, or those from where the
+// export resumes
+func (p *Pipeline) ExportTo(gens ...export.CodeGenerator) error {
+	p.process()
+	if p.err != nil {
+		return p.err
+	}
+	start, err := p.start()
+	if err != nil {
+		return err
+	}
+	if start > 0 {
+		return export.HandleAllPositionsFrom(p.ctx, &p.machine, start, gens...)
+	}
+	return export.HandleAllPositionsContext(p.ctx, &p.machine, gens...)
+}
+
+// Exports the positions as a gcode string
+func (p *Pipeline) String(precision int) (string, error) {
+	g := export.StringCodeGenerator{Precision: precision}
+	g.Init()
+	if err := p.ExportTo(&g); err != nil {
+		return "", err
+	}
+	return g.Retrieve(), nil
+}
+
+// Exports the positions as gcode, written to w as they are exported. The
+// generator is the named one from the registry, or a StringCodeGenerator if
+// the name is empty.
+func (p *Pipeline) WriteTo(w io.Writer, generator string, precision int) error {
+	lw := export.NewLineWriter(w)
+	var g export.CodeGenerator = &export.StringCodeGenerator{Precision: precision, Write: lw.WriteLine}
+	if generator != "" {
+		var err error
+		if g, err = export.NewGenerator(generator, precision, lw.WriteLine); err != nil {
+			return err
+		}
+	}
+	g.Init()
+	if err := p.ExportTo(g); err != nil {
+		return err
+	}
+	if err := export.EndProgram(g); err != nil {
+		return err
+	}
+	return lw.Flush()
+}
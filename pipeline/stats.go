@@ -0,0 +1,76 @@
+package pipeline
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/warnings"
+import "strconv"
+
+// Job statistics, suitable for JSON encoding
+type Stats struct {
+	Moves         int                `json:"moves"`
+	Operations    int                `json:"operations"`
+	Arcs          int                `json:"arcs"`
+	Min           [3]float64         `json:"min"`
+	Max           [3]float64         `json:"max"`
+	Feedrates     []float64          `json:"feedrates"`
+	MinFeedrate   float64            `json:"minFeedrate"` // mm/min, of feed moves
+	MaxFeedrate   float64            `json:"maxFeedrate"`
+	MinZ          float64            `json:"minZ"` // Deepest feed move
+	ETA           float64            `json:"eta"`  // Seconds
+	Cutting       float64            `json:"cutting"`
+	Rapid         float64            `json:"rapid"`
+	Toolchange    float64            `json:"toolchange"`
+	CutDistance   float64            `json:"cutDistance"` // mm
+	RapidDistance float64            `json:"rapidDistance"`
+	SpindleOn     float64            `json:"spindleOn"`
+	Toolchanges   int                `json:"toolchanges"`
+	Tools         map[string]float64 `json:"tools"`   // Seconds per tool
+	ToolCut       map[string]float64 `json:"toolCut"` // Cutting distance per tool (mm)
+	Warnings      warnings.Warnings  `json:"warnings"`
+}
+
+// Collects statistics for the machine, using the profile for time estimation
+func NewStats(m *vm.Machine, profile machine.Profile) Stats {
+	minx, miny, minz, maxx, maxy, maxz, feedrates := m.Info()
+	report := m.TimeBreakdown(profile)
+	summary := m.Stats(profile)
+
+	stats := Stats{
+		Moves:         m.Len(),
+		Operations:    len(m.Operations()),
+		Arcs:          summary.Arcs,
+		Min:           [3]float64{minx, miny, minz},
+		Max:           [3]float64{maxx, maxy, maxz},
+		Feedrates:     feedrates,
+		MinFeedrate:   summary.MinFeedrate,
+		MaxFeedrate:   summary.MaxFeedrate,
+		MinZ:          summary.MinZ,
+		ETA:           report.Total().Seconds(),
+		Cutting:       report.Cutting.Time.Seconds(),
+		Rapid:         report.Rapid.Time.Seconds(),
+		Toolchange:    report.Toolchange.Time.Seconds(),
+		CutDistance:   summary.CutDistance,
+		RapidDistance: summary.RapidDistance,
+		SpindleOn:     summary.SpindleOn.Seconds(),
+		Toolchanges:   summary.Toolchanges,
+		Tools:         make(map[string]float64),
+		ToolCut:       make(map[string]float64),
+		Warnings:      m.Warnings,
+	}
+	for t, b := range report.Tools {
+		stats.Tools[strconv.Itoa(t)] = b.Total().Seconds()
+	}
+	for t, dist := range summary.ToolCut {
+		stats.ToolCut[strconv.Itoa(t)] = dist
+	}
+	return stats
+}
+
+// Collects statistics for the processed document
+func (p *Pipeline) Stats(profile machine.Profile) (Stats, error) {
+	m, err := p.Machine()
+	if err != nil {
+		return Stats{}, err
+	}
+	return NewStats(m, profile), nil
+}
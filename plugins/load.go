@@ -0,0 +1,17 @@
+//go:build (linux || darwin || freebsd) && cgo
+// +build linux darwin freebsd
+// +build cgo
+
+package plugins
+
+import "errors"
+import "fmt"
+import "plugin"
+
+// Loads a plugin, running its registrations
+func Load(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return errors.New(fmt.Sprintf("Could not load plugin %s: %s", path, err))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !((linux || darwin || freebsd) && cgo)
+// +build !linux,!darwin,!freebsd !cgo
+
+package plugins
+
+import "errors"
+import "fmt"
+
+// Plugins are not supported on this platform
+func Load(path string) error {
+	return errors.New(fmt.Sprintf("Could not load plugin %s: plugins are not supported on this platform", path))
+}
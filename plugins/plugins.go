@@ -0,0 +1,31 @@
+package plugins
+
+//
+// Plugin loading
+//
+// Plugins are Go plugins (go build -buildmode=plugin) that register code
+// generators and optimizers from their init functions, using
+// export.RegisterGenerator and optimize.Register:
+//
+//   package main
+//
+//   import "github.com/joushou/gocnc/export"
+//
+//   func init() {
+//       export.RegisterGenerator("mymachine", newMyMachineGenerator)
+//   }
+//
+// Plugins must be built with the same Go version and package versions as gocnc.
+// Alternatively, the same packages can be compiled in by importing them for
+// their side effects.
+//
+
+// Loads all plugins, stopping at the first error
+func LoadAll(paths []string) error {
+	for _, path := range paths {
+		if err := Load(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package server
+
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/pipeline"
+import "github.com/joushou/gocnc/wire"
+import "bytes"
+import "context"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "strings"
+
+//
+// gRPC
+//
+// The endpoints are also served as the gocnc.Gocnc service of wire/gocnc.proto,
+// on the same address. gRPC runs over HTTP/2, which ListenAndServe accepts
+// without TLS, as plaintext gRPC clients connect with HTTP/2 right away.
+// Messages are encoded by the wire package, so no generated code or gRPC
+// library is needed. Compressed messages are not supported.
+//
+// Errors are reported in the grpc-status and grpc-message trailers, also
+// after results have been streamed.
+//
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcCanceled          = 1
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+)
+
+// An error with a gRPC status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// The status code of an error
+func grpcCode(err error) int {
+	var ge *grpcError
+	switch {
+	case err == nil:
+		return grpcOK
+	case errors.As(err, &ge):
+		return ge.code
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return grpcCanceled
+	}
+	return grpcInvalidArgument
+}
+
+// Percent-encodes a grpc-message, which must be printable ASCII
+func grpcMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Tests if a request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// Writes length-prefixed messages to a gRPC response, flushing regularly
+type grpcStream struct {
+	w        http.ResponseWriter
+	messages int
+}
+
+func (st *grpcStream) send(msg []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := st.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := st.w.Write(msg); err != nil {
+		return err
+	}
+	st.messages++
+	if st.messages%flushInterval == 0 {
+		st.flush()
+	}
+	return nil
+}
+
+func (st *grpcStream) flush() {
+	if f, ok := st.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Reads the single request message of a call
+func (s *Server) readRequest(r io.Reader) (wire.Request, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return wire.Request{}, &grpcError{grpcInvalidArgument, fmt.Sprintf("Unable to read request: %s", err)}
+	}
+	if header[0] != 0 {
+		return wire.Request{}, &grpcError{grpcUnimplemented, "Compressed requests are not supported"}
+	}
+	l := binary.BigEndian.Uint32(header[1:])
+	if s.MaxSize > 0 && int64(l) > s.MaxSize {
+		return wire.Request{}, &grpcError{grpcResourceExhausted, fmt.Sprintf("Request of %d bytes exceeds the maximum of %d", l, s.MaxSize)}
+	}
+	msg := make([]byte, l)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return wire.Request{}, &grpcError{grpcInvalidArgument, fmt.Sprintf("Unable to read request: %s", err)}
+	}
+	return wire.UnmarshalRequest(msg)
+}
+
+// The options of a request, using the defaults for options not set
+func requestOptions(req wire.Request) options {
+	o := defaultOptions()
+	if req.NoOptimizations {
+		o.optimizations = nil
+	} else if len(req.Optimizations) > 0 {
+		o.optimizations = req.Optimizations
+	}
+	if req.Precision != 0 {
+		o.precision = req.Precision
+	}
+	for _, x := range []struct {
+		dst *float64
+		v   float64
+	}{
+		{&o.vtolerance, req.VTolerance},
+		{&o.rtolerance, req.RTolerance},
+		{&o.maxArcDeviation, req.MaxArcDeviation},
+		{&o.minArcLineLength, req.MinArcLineLength},
+	} {
+		if x.v != 0 {
+			*x.dst = x.v
+		}
+	}
+	return o
+}
+
+// A method of the service
+type grpcMethod func(s *Server, ctx context.Context, req wire.Request, st *grpcStream) error
+
+var grpcMethods = map[string]grpcMethod{
+	"/gocnc.Gocnc/Parse":    (*Server).grpcParse,
+	"/gocnc.Gocnc/Process":  grpcToolpath(false),
+	"/gocnc.Gocnc/Optimize": grpcToolpath(true),
+	"/gocnc.Gocnc/Export":   (*Server).grpcExport,
+	"/gocnc.Gocnc/Stats":    (*Server).grpcStats,
+}
+
+// Serves a gRPC call
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	err := func() error {
+		method, ok := grpcMethods[r.URL.Path]
+		if !ok {
+			return &grpcError{grpcUnimplemented, fmt.Sprintf("Unknown method %s", r.URL.Path)}
+		}
+		req, err := s.readRequest(r.Body)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := s.context(r)
+		defer cancel()
+		st := &grpcStream{w: w}
+		defer st.flush()
+		return method(s, ctx, req, st)
+	}()
+
+	w.Header().Set("Grpc-Status", fmt.Sprintf("%d", grpcCode(err)))
+	if err != nil {
+		w.Header().Set("Grpc-Message", grpcMessage(err.Error()))
+	}
+}
+
+func (s *Server) grpcParse(ctx context.Context, req wire.Request, st *grpcStream) error {
+	o := requestOptions(req)
+	doc, err := gcode.Parse(req.GCode)
+	if err != nil {
+		return err
+	}
+	for idx, b := range doc.Blocks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := st.send(wire.Block{Index: idx, Code: b.Export(o.precision)}.Marshal()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the method streaming the toolpath, optimized or as processed, in
+// chunks of flushInterval segments
+func grpcToolpath(optimized bool) grpcMethod {
+	return func(s *Server, ctx context.Context, req wire.Request, st *grpcStream) error {
+		doc, err := gcode.Parse(req.GCode)
+		if err != nil {
+			return err
+		}
+		m, err := s.process(ctx, doc, requestOptions(req), optimized)
+		if err != nil {
+			return err
+		}
+
+		var (
+			buf bytes.Buffer
+			e   = wire.NewEncoder(&buf)
+			n   = 0
+		)
+		for _, seg := range m.All() {
+			// Writes to bytes.Buffer never fail
+			e.Encode(seg)
+			if n++; n%flushInterval != 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := st.send(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			return st.send(buf.Bytes())
+		}
+		return nil
+	}
+}
+
+func (s *Server) grpcExport(ctx context.Context, req wire.Request, st *grpcStream) error {
+	o := requestOptions(req)
+	doc, err := gcode.Parse(req.GCode)
+	if err != nil {
+		return err
+	}
+	m, err := s.process(ctx, doc, o, true)
+	if err != nil {
+		return err
+	}
+
+	g := export.StringCodeGenerator{Precision: o.precision}
+	g.Init()
+	sent := 0
+	for _, seg := range m.All() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := export.HandleSegment(seg, &g); err != nil {
+			return err
+		}
+		for ; sent < len(g.Lines); sent++ {
+			if err := st.send(wire.MarshalText(g.Lines[sent])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) grpcStats(ctx context.Context, req wire.Request, st *grpcStream) error {
+	doc, err := gcode.Parse(req.GCode)
+	if err != nil {
+		return err
+	}
+	m, err := s.process(ctx, doc, requestOptions(req), true)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(pipeline.NewStats(m, s.Profile))
+	if err != nil {
+		return err
+	}
+	return st.send(wire.MarshalText(string(b)))
+}
@@ -0,0 +1,390 @@
+package server
+
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/optimize"
+import "github.com/joushou/gocnc/pipeline"
+import "github.com/joushou/gocnc/vm"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+//
+// Processing server
+//
+// Exposes parsing, processing, optimization, export and statistics
+// over HTTP, so that other tools can use gocnc without running the command line tool.
+// The same endpoints are served over gRPC, see grpc.go.
+//
+// All endpoints take gcode as the POST body, and options as query parameters:
+//
+//	precision         Precision of exported gcode (max mantissa digits)
+//	opt               Comma-separated optimizations (drill, float, path, bogus, vector, lifts or registered optimizers)
+//	vtolerance        Tolerance used by vector optimization (mm)
+//	rtolerance        Tolerance used by route grouping (mm)
+//	maxarcdeviation   Maximum deviation from an ideal arc (mm)
+//	minarclinelength  Minimum arc segment line length (mm)
+//
+// Endpoints:
+//
+//	POST /parse     Blocks, as a stream of JSON objects
+//	POST /process   Positions, as a stream of JSON objects
+//	POST /optimize  Optimized positions, as a stream of JSON objects
+//	POST /export    Optimized gcode, streamed as text
+//	POST /stats     Statistics, as a single JSON object
+//
+// Every request is processed within the time and segment budget of the
+// server, so programs expanding into endless moves fail instead of taking
+// the server down.
+//
+
+// Optimizations applied by default, in the same order as the command line tool
+var defaultOptimizations = []string{"drill", "float", "path", "vector", "lifts"}
+
+// Flush streamed responses after this many lines
+const flushInterval = 100
+
+type Server struct {
+	Profile     machine.Profile // Used for time estimation
+	MaxSize     int64           // Maximum request size (bytes, 0 for unlimited)
+	MaxSegments int             // Maximum segments per request (0 for unlimited)
+	Timeout     time.Duration   // Maximum time per request (0 for unlimited)
+}
+
+// Creates a server using the machine profile for statistics
+func New(profile machine.Profile) *Server {
+	return &Server{Profile: profile, MaxSize: 64 << 20, MaxSegments: 10000000, Timeout: time.Minute}
+}
+
+// Request options
+type options struct {
+	precision        int
+	optimizations    []string
+	vtolerance       float64
+	rtolerance       float64
+	maxArcDeviation  float64
+	minArcLineLength float64
+}
+
+func defaultOptions() options {
+	return options{
+		precision:        4,
+		optimizations:    defaultOptimizations,
+		vtolerance:       0.0003,
+		rtolerance:       0.001,
+		maxArcDeviation:  0.002,
+		minArcLineLength: 0.01,
+	}
+}
+
+func parseOptions(r *http.Request) (options, error) {
+	o := defaultOptions()
+	q := r.URL.Query()
+	if v, ok := q["opt"]; ok {
+		o.optimizations = nil
+		for _, x := range strings.Split(strings.Join(v, ","), ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				o.optimizations = append(o.optimizations, x)
+			}
+		}
+	}
+
+	if v := q.Get("precision"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			return o, errors.New(fmt.Sprintf("Invalid precision: %s", v))
+		}
+		o.precision = p
+	}
+
+	for name, dst := range map[string]*float64{
+		"vtolerance":       &o.vtolerance,
+		"rtolerance":       &o.rtolerance,
+		"maxarcdeviation":  &o.maxArcDeviation,
+		"minarclinelength": &o.minArcLineLength,
+	} {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return o, errors.New(fmt.Sprintf("Invalid %s: %s", name, v))
+			}
+			*dst = f
+		}
+	}
+	return o, nil
+}
+
+// Reads the request body
+func (s *Server) read(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := r.Body
+	if s.MaxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.MaxSize)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// Reads and parses the request body
+func (s *Server) parse(w http.ResponseWriter, r *http.Request) (*gcode.Document, error) {
+	code, err := s.read(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return gcode.Parse(string(code))
+}
+
+// The context of a request, ending when the time budget is spent
+func (s *Server) context(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.Timeout > 0 {
+		return context.WithTimeout(r.Context(), s.Timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// Looks up the requested optimizations
+func (o options) pipeline() ([]pipeline.Optimization, error) {
+	var res []pipeline.Optimization
+	for _, name := range o.optimizations {
+		switch name {
+		case "drill":
+			res = append(res, pipeline.DrillSpeed)
+		case "float":
+			res = append(res, pipeline.FloatingZ)
+		case "path":
+			res = append(res, pipeline.PathGrouping(o.rtolerance))
+		case "bogus":
+			res = append(res, pipeline.BogusMoves)
+		case "vector":
+			res = append(res, pipeline.Vector(o.vtolerance))
+		case "lifts":
+			res = append(res, pipeline.LiftSpeed)
+		default:
+			// Registered optimizers, such as ones loaded from plugins
+			opt, err := optimize.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, pipeline.Optimization(opt.Optimize))
+		}
+	}
+	return res, nil
+}
+
+// Runs the document through the VM within the budget of the server, optionally
+// applying the requested optimizations
+func (s *Server) process(ctx context.Context, doc *gcode.Document, o options, optimized bool) (*vm.Machine, error) {
+	p := pipeline.FromDocument(doc).
+		WithContext(ctx).
+		WithMaxSegments(s.MaxSegments).
+		WithArcTolerance(o.maxArcDeviation, o.minArcLineLength)
+	if optimized {
+		opts, err := o.pipeline()
+		if err != nil {
+			return nil, err
+		}
+		p.Apply(opts...)
+	}
+	return p.Machine()
+}
+
+//
+// Responses
+//
+
+// Writes lines to the response, flushing regularly
+type stream struct {
+	w     http.ResponseWriter
+	ctx   context.Context
+	lines int
+}
+
+func newStream(w http.ResponseWriter, r *http.Request, contentType string) *stream {
+	w.Header().Set("Content-Type", contentType)
+	return &stream{w: w, ctx: r.Context()}
+}
+
+// Tests if the client has gone away
+func (s *stream) cancelled() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *stream) line(l string) {
+	fmt.Fprintf(s.w, "%s\n", l)
+	s.lines++
+	if s.lines%flushInterval == 0 {
+		s.flush()
+	}
+}
+
+func (s *stream) json(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	s.line(string(b))
+}
+
+func (s *stream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wraps a handler, only allowing POST, and reporting errors
+func post(h func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := h(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+//
+// Handlers
+//
+
+// A parsed block
+type Block struct {
+	Index int    `json:"index"`
+	Code  string `json:"code"`
+}
+
+func (s *Server) handleParse(w http.ResponseWriter, r *http.Request) error {
+	o, err := parseOptions(r)
+	if err != nil {
+		return err
+	}
+	doc, err := s.parse(w, r)
+	if err != nil {
+		return err
+	}
+
+	st := newStream(w, r, "application/x-ndjson")
+	for idx, b := range doc.Blocks {
+		if st.cancelled() {
+			break
+		}
+		st.json(Block{idx, b.Export(o.precision)})
+	}
+	st.flush()
+	return nil
+}
+
+// Reads, parses and processes the request body, within the budget of the server
+func (s *Server) processRequest(w http.ResponseWriter, r *http.Request, o options, optimized bool) (*vm.Machine, error) {
+	doc, err := s.parse(w, r)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.context(r)
+	defer cancel()
+	return s.process(ctx, doc, o, optimized)
+}
+
+// Returns the handler streaming the positions, optimized or as processed
+func (s *Server) handlePositions(optimized bool) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		o, err := parseOptions(r)
+		if err != nil {
+			return err
+		}
+		m, err := s.processRequest(w, r, o, optimized)
+		if err != nil {
+			return err
+		}
+
+		st := newStream(w, r, "application/x-ndjson")
+		for _, seg := range m.All() {
+			if st.cancelled() {
+				break
+			}
+			st.json(seg.Position())
+		}
+		st.flush()
+		return nil
+	}
+}
+
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) error {
+	o, err := parseOptions(r)
+	if err != nil {
+		return err
+	}
+	m, err := s.processRequest(w, r, o, true)
+	if err != nil {
+		return err
+	}
+
+	g := export.StringCodeGenerator{Precision: o.precision}
+	g.Init()
+
+	// Stream the lines generated for every position as they appear
+	st := newStream(w, r, "text/plain")
+	sent := 0
+	for _, seg := range m.All() {
+		if st.cancelled() {
+			break
+		}
+		if err := export.HandleSegment(seg, &g); err != nil {
+			// The response has already started
+			st.line(fmt.Sprintf("(Error: %s)", err))
+			break
+		}
+		for ; sent < len(g.Lines); sent++ {
+			st.line(g.Lines[sent])
+		}
+	}
+	st.flush()
+	return nil
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) error {
+	o, err := parseOptions(r)
+	if err != nil {
+		return err
+	}
+	m, err := s.processRequest(w, r, o, true)
+	if err != nil {
+		return err
+	}
+
+	stats := pipeline.NewStats(m, s.Profile)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(stats)
+}
+
+// Returns the HTTP handler serving all endpoints, over REST and gRPC
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/parse", post(s.handleParse))
+	mux.HandleFunc("/process", post(s.handlePositions(false)))
+	mux.HandleFunc("/optimize", post(s.handlePositions(true)))
+	mux.HandleFunc("/export", post(s.handleExport))
+	mux.HandleFunc("/stats", post(s.handleStats))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGRPC(r) {
+			s.serveGRPC(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Listens on the address and serves requests, over HTTP/1 and HTTP/2 without TLS
+func (s *Server) ListenAndServe(addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s.Handler(), Protocols: new(http.Protocols)}
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return srv.ListenAndServe()
+}
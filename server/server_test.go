@@ -0,0 +1,281 @@
+package server
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/wire"
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+const program = "G21 G90\nG0 X0 Y0 Z5\nG1 Z-1 F100\nX10\nY10\nG0 Z5\nM2\n"
+
+// Programs that would hang or exhaust the memory of the server without its budget
+var runaway = []string{
+	"G21 G90 G0 Z10 F100\nG83 X1 Y1 Z-3 R1 Q0.00000000000000000001\n",
+	"G21 G90 G0 Z10 F100\nG81 X1 Y1 Z-3 R1 L1000000000\n",
+	"F100\nG2 X0 Y0 I1 J0 P100000000\n",
+	"G21 G91 F100\no100 repeat [100000]\nG1 X1\nX-1\no100 endrepeat\n",
+}
+
+// Posts the program to a REST endpoint
+func request(t *testing.T, s *Server, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return rec
+}
+
+// The number of blocks of the program
+func parsedBlocks(t *testing.T) int {
+	doc, err := gcode.Parse(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(doc.Blocks)
+}
+
+// Reads lines of JSON objects
+func decodeLines(t *testing.T, body string, fn func(dec *json.Decoder) error) int {
+	n := 0
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		if err := fn(json.NewDecoder(strings.NewReader(sc.Text()))); err != nil {
+			t.Fatalf("Invalid line %q: %s", sc.Text(), err)
+		}
+		n++
+	}
+	return n
+}
+
+func TestREST(t *testing.T) {
+	s := New(machine.Default())
+
+	rec := request(t, s, "/parse", program)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Parse failed: %s", rec.Body)
+	}
+	blocks := decodeLines(t, rec.Body.String(), func(dec *json.Decoder) error {
+		var b Block
+		return dec.Decode(&b)
+	})
+	if expected := parsedBlocks(t); blocks != expected {
+		t.Errorf("Got %d blocks, expected %d", blocks, expected)
+	}
+
+	positions := make(map[string]int)
+	for _, path := range []string{"/process", "/optimize?opt=", "/optimize"} {
+		rec := request(t, s, path, program)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s failed: %s", path, rec.Body)
+		}
+		positions[path] = decodeLines(t, rec.Body.String(), func(dec *json.Decoder) error {
+			var p vm.Position
+			return dec.Decode(&p)
+		})
+	}
+	if positions["/process"] == 0 || positions["/process"] != positions["/optimize?opt="] {
+		t.Errorf("Got %d positions processed and %d optimized without optimizations", positions["/process"], positions["/optimize?opt="])
+	}
+
+	rec = request(t, s, "/export?precision=3", program)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "X10") {
+		t.Errorf("Export failed: %s", rec.Body)
+	}
+
+	rec = request(t, s, "/stats", program)
+	var stats struct {
+		CutDistance float64 `json:"cutDistance"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.CutDistance != 21 {
+		t.Errorf("Got a cutting distance of %g, expected 21", stats.CutDistance)
+	}
+}
+
+func TestRESTErrors(t *testing.T) {
+	s := New(machine.Default())
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/process", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Got status %d for GET, expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	for _, path := range []string{"/process?precision=x", "/optimize?opt=unknown", "/stats?vtolerance=x"} {
+		if rec := request(t, s, path, program); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, expected %d", path, rec.Code, http.StatusBadRequest)
+		}
+	}
+
+	s.MaxSize = 10
+	if rec := request(t, s, "/process", program); rec.Code != http.StatusBadRequest {
+		t.Errorf("Got status %d for a request exceeding the maximum size", rec.Code)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	s := New(machine.Default())
+	s.MaxSegments = 10000
+	for _, p := range runaway {
+		if rec := request(t, s, "/process", p); rec.Code != http.StatusBadRequest {
+			t.Errorf("Got status %d for %q, expected %d", rec.Code, p, http.StatusBadRequest)
+		}
+	}
+
+	s.MaxSegments = 3
+	if rec := request(t, s, "/process", program); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "maximum of 3 segments") {
+		t.Errorf("Got status %d (%s) for a program exceeding the segment budget", rec.Code, rec.Body)
+	}
+}
+
+// Calls a method of the gRPC service, returning the replies and the status
+func call(t *testing.T, url, method string, req wire.Request) ([][]byte, string, string) {
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &p}}
+
+	msg := req.Marshal()
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+
+	hreq, err := http.NewRequest("POST", url+"/gocnc.Gocnc/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Got HTTP/%d, expected HTTP/2", resp.ProtoMajor)
+	}
+
+	var replies [][]byte
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(resp.Body, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(resp.Body, reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+// Starts a test server accepting HTTP/2 without TLS
+func grpcServer(t *testing.T, s *Server) *httptest.Server {
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestGRPC(t *testing.T) {
+	ts := grpcServer(t, New(machine.Default()))
+	req := wire.Request{GCode: program, Precision: 3}
+
+	replies, status, msg := call(t, ts.URL, "Parse", req)
+	if status != "0" {
+		t.Fatalf("Parse failed with status %s: %s", status, msg)
+	}
+	if expected := parsedBlocks(t); len(replies) != expected {
+		t.Errorf("Got %d blocks, expected %d", len(replies), expected)
+	}
+	if b, err := wire.UnmarshalBlock(replies[3]); err != nil || b.Index != 3 || b.Code != "X10" {
+		t.Errorf("Got block %+v (%v), expected X10 at 3", b, err)
+	}
+
+	counts := make(map[bool]int)
+	for _, r := range []wire.Request{req, {GCode: program, NoOptimizations: true}} {
+		method := "Optimize"
+		if r.NoOptimizations {
+			method = "Process"
+		}
+		replies, status, msg := call(t, ts.URL, method, r)
+		if status != "0" {
+			t.Fatalf("%s failed with status %s: %s", method, status, msg)
+		}
+		// Chunks concatenate to the toolpath
+		m, err := wire.Unmarshal(bytes.Join(replies, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[r.NoOptimizations] = len(m.Segments)
+	}
+	if counts[true] == 0 || counts[false] == 0 {
+		t.Errorf("Got toolpaths of %d and %d segments", counts[true], counts[false])
+	}
+
+	replies, status, msg = call(t, ts.URL, "Export", req)
+	if status != "0" {
+		t.Fatalf("Export failed with status %s: %s", status, msg)
+	}
+	var lines []string
+	for _, r := range replies {
+		line, err := wire.UnmarshalText(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "X10") {
+		t.Errorf("Got export %q", lines)
+	}
+
+	replies, status, msg = call(t, ts.URL, "Stats", req)
+	if status != "0" || len(replies) != 1 {
+		t.Fatalf("Stats failed with status %s: %s", status, msg)
+	}
+	text, _ := wire.UnmarshalText(replies[0])
+	var stats struct {
+		CutDistance float64 `json:"cutDistance"`
+	}
+	if err := json.Unmarshal([]byte(text), &stats); err != nil || stats.CutDistance != 21 {
+		t.Errorf("Got stats %s (%v)", text, err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	s := New(machine.Default())
+	s.MaxSegments = 10000
+	ts := grpcServer(t, s)
+
+	if _, status, _ := call(t, ts.URL, "Unknown", wire.Request{}); status != "12" {
+		t.Errorf("Got status %s for an unknown method, expected 12", status)
+	}
+	if _, status, msg := call(t, ts.URL, "Process", wire.Request{GCode: "G1 X1 F100\nG2 X0 Y0 I1 J0 P1.5\n"}); status != "3" || msg == "" {
+		t.Errorf("Got status %s (%s) for an invalid program, expected 3", status, msg)
+	}
+	if _, status, _ := call(t, ts.URL, "Optimize", wire.Request{GCode: program, Optimizations: []string{"unknown"}}); status != "3" {
+		t.Errorf("Got status %s for an unknown optimization, expected 3", status)
+	}
+	for _, p := range runaway {
+		if _, status, _ := call(t, ts.URL, "Stats", wire.Request{GCode: p}); status != "3" {
+			t.Errorf("Got status %s for %q, expected 3", status, p)
+		}
+	}
+
+	s.MaxSize = 10
+	if _, status, _ := call(t, ts.URL, "Process", wire.Request{GCode: program}); status != "8" {
+		t.Errorf("Got status %s for a request exceeding the maximum size, expected 8", status)
+	}
+}
@@ -0,0 +1,349 @@
+package streaming
+
+import "io"
+import "bufio"
+import "github.com/joushou/goserial"
+import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/machine"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "strings"
+import "sync"
+
+//
+// g2core streaming
+//
+// g2core (and TinyG) are driven in JSON mode, in which every block is sent as
+// a gcode command (see export/g2core.go), and answered with a response whose
+// footer carries a status code:
+//
+//   {"gc":"G1X10F500"}
+//   {"r":{"gc":"G1X10F500"},"f":[3,0,19]}
+//
+// Every response acknowledges the oldest command sent, so errors fail the
+// block causing them. Like the line mode protocol of g2core, a few commands
+// are kept in flight, so that the planner never runs dry on short moves.
+// g2core also sends queue reports ({"qr":n}) with the free slots of its
+// planner queue as it fills and drains, and no commands are sent while fewer
+// than QueueReserve are free, leaving room for commands that must get
+// through. Exception reports ({"er":...}) stop the stream.
+//
+// Connect enables JSON mode, footers, queue reports and status reports.
+// Hold, Resume and Stop are single character commands, which g2core acts on
+// at once.
+//
+// Program pauses (M0, M1 and M60) are passed to OnPause, if set, once g2core
+// has stopped on a program stop (M0) sent in their place, as told by the
+// machine state of its status reports. Streaming resumes with a cycle start
+// when OnPause returns, so it can wait for the operator.
+//
+
+// Commands kept in flight by default, as recommended for line mode by g2core
+const G2CoreLineWindow = 4
+
+// Free planner slots kept by default
+const G2CoreQueueReserve = 4
+
+// Machine state of g2core stopped by a program stop (M0)
+const g2coreStatProgramStop = 3
+
+type G2CoreStreamer struct {
+	export.G2CoreGenerator
+	Profile      *machine.Profile
+	LineWindow   int            // Commands sent but not yet acknowledged, G2CoreLineWindow if 0
+	QueueReserve int            // Free planner slots kept, G2CoreQueueReserve if 0, negative to ignore queue reports
+	Info         func(string)   // Receives messages from g2core, printed if nil
+	OnPause      func(code int) // Called with the M-code of program pauses, which are sent to g2core if nil
+
+	serialPort io.ReadWriteCloser
+	reader     *bufio.Reader
+	lock       sync.Mutex
+	cond       *sync.Cond
+	pending    []string // Commands sent but not yet acknowledged
+	queue      int      // Free planner slots of the last queue report, -1 if none
+	stat       int      // Machine state of the last status report, -1 if none
+	err        error    // Error or exception stopping the stream
+}
+
+// A response from g2core. Only the parts acted on are decoded.
+type g2coreResponse struct {
+	R  map[string]json.RawMessage `json:"r"`
+	F  []float64                  `json:"f"`
+	QR *int                       `json:"qr"`
+	SR map[string]json.RawMessage `json:"sr"`
+	ER *struct {
+		St  int    `json:"st"`
+		Msg string `json:"msg"`
+	} `json:"er"`
+}
+
+// The status code of a response, 0 being success
+func (r *g2coreResponse) status() int {
+	if len(r.F) < 2 {
+		return 0
+	}
+	return int(r.F[1])
+}
+
+// The message of a response, if any
+func (r *g2coreResponse) message() string {
+	var msg string
+	if m, ok := r.R["msg"]; ok {
+		_ = json.Unmarshal(m, &msg)
+	}
+	return msg
+}
+
+//
+// Serial handling
+//
+
+// Awaits and decodes a line from g2core. Lines that are not JSON, such as
+// the prompt of text mode, are returned as messages.
+func (s *G2CoreStreamer) readResponse() (*g2coreResponse, string, error) {
+	c, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, "", err
+	}
+	b := strings.TrimSpace(string(c))
+	if !strings.HasPrefix(b, "{") {
+		return nil, b, nil
+	}
+	var res g2coreResponse
+	if err := json.Unmarshal([]byte(b), &res); err != nil {
+		return nil, b, nil
+	}
+	return &res, "", nil
+}
+
+// Reads responses until the serial port fails or is closed
+func (s *G2CoreStreamer) readResponses() {
+	for {
+		res, msg, err := s.readResponse()
+
+		s.lock.Lock()
+		switch {
+		case err != nil:
+			s.fail(errors.New(fmt.Sprintf("Error while reading from CNC: %s", err)))
+		case res == nil:
+			s.info(msg)
+		default:
+			if res.QR != nil {
+				s.queue = *res.QR
+			}
+			if stat, ok := res.SR["stat"]; ok {
+				_ = json.Unmarshal(stat, &s.stat)
+			}
+			if res.ER != nil {
+				s.fail(errors.New(fmt.Sprintf("Received exception from CNC: %s (status %d)", res.ER.Msg, res.ER.St)))
+			}
+			if res.R != nil {
+				if len(s.pending) == 0 {
+					s.fail(errors.New("Unexpected response from CNC"))
+					break
+				}
+				if st := res.status(); st != 0 {
+					s.fail(errors.New(fmt.Sprintf("Received error from CNC: status %d %s, block: %s", st, res.message(), s.pending[0])))
+				} else if m := res.message(); m != "" {
+					s.info(m)
+				}
+				s.pending = s.pending[1:]
+			}
+		}
+		s.cond.Broadcast()
+		s.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Passes on a message from g2core
+func (s *G2CoreStreamer) info(msg string) {
+	if msg == "" {
+		return
+	}
+	if s.Info != nil {
+		s.Info(msg)
+	} else {
+		fmt.Printf("\nReceived info from CNC: %s\n", msg)
+	}
+}
+
+// Records the first error stopping the stream. Must be called with the lock held.
+func (s *G2CoreStreamer) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Tests if another command may be sent. Must be called with the lock held.
+func (s *G2CoreStreamer) ready() bool {
+	window, reserve := s.LineWindow, s.QueueReserve
+	if window <= 0 {
+		window = G2CoreLineWindow
+	}
+	if reserve == 0 {
+		reserve = G2CoreQueueReserve
+	}
+	if len(s.pending) >= window {
+		return false
+	}
+	// Queue reports lag behind, so one command is always let through
+	return reserve < 0 || s.queue < 0 || s.queue >= reserve || len(s.pending) == 0
+}
+
+// Sends a command once the window and the planner queue have room for it
+func (s *G2CoreStreamer) send(cmd string) {
+	s.lock.Lock()
+	for s.err == nil && !s.ready() {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		s.lock.Unlock()
+		panic(s.err)
+	}
+	s.pending = append(s.pending, cmd)
+	if s.queue > 0 {
+		s.queue--
+	}
+	s.lock.Unlock()
+
+	if _, err := s.serialPort.Write([]byte(cmd + "\n")); err != nil {
+		panic(errors.New(fmt.Sprintf("Error while sending data: %s", err)))
+	}
+}
+
+// Pauses the program, waiting for OnPause once the machine has stopped
+func (s *G2CoreStreamer) Pause(code int) {
+	if s.OnPause == nil {
+		s.G2CoreGenerator.Pause(code)
+		return
+	}
+	s.lock.Lock()
+	s.stat = -1
+	s.lock.Unlock()
+
+	s.G2CoreGenerator.Pause(0)
+
+	s.lock.Lock()
+	for s.err == nil && s.stat != g2coreStatProgramStop {
+		s.cond.Wait()
+	}
+	err := s.err
+	s.lock.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	s.OnPause(code)
+	s.Resume()
+}
+
+func (s *G2CoreStreamer) Init() {
+	s.cond = sync.NewCond(&s.lock)
+	s.queue, s.stat = -1, -1
+	// Init comes before Connect, so the header is left out
+	s.G2CoreGenerator.Write = func(string) {}
+	s.G2CoreGenerator.Init()
+	s.G2CoreGenerator.Write = s.send
+}
+
+// Waits until g2core has acknowledged all commands sent, returning the error
+// or exception that stopped the stream, if any
+func (s *G2CoreStreamer) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.err == nil && len(s.pending) > 0 {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
+// Takes the vm for a dry-run, to see if the states are compatible with g2core.
+// If a machine profile is set, the moves are also checked against its limits.
+func (s *G2CoreStreamer) Check(m *vm.Machine) (err error) {
+	defer vm.Recover(&err)
+	if s.Profile != nil {
+		if err := m.CheckLimits(*s.Profile); err != nil {
+			return err
+		}
+	}
+	gen := export.G2CoreGenerator{Write: func(string) {}}
+	gen.Precision = s.Precision
+	gen.Init()
+	return export.HandleAllPositions(m, &gen)
+}
+
+// Sends a configuration command during Connect, and waits for the response
+// to it, skipping other output such as the startup message
+func (s *G2CoreStreamer) configure(key, value string) (json.RawMessage, error) {
+	if _, err := s.serialPort.Write([]byte(fmt.Sprintf("{\"%s\":%s}\n", key, value))); err != nil {
+		return nil, err
+	}
+	for {
+		res, _, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if res == nil || res.R == nil {
+			continue
+		}
+		if v, ok := res.R[key]; ok {
+			if st := res.status(); st != 0 {
+				return nil, errors.New(fmt.Sprintf("Setting %s failed with status %d", key, st))
+			}
+			return v, nil
+		}
+	}
+}
+
+// Connect to a serial port at the given path and baudrate, and set up JSON
+// mode with footers (jv 4), queue reports (qv 1) and status reports (sv 1)
+func (s *G2CoreStreamer) Connect(name string, baud int) error {
+	c := &serial.Config{Name: name, Baud: baud}
+	var err error
+	s.serialPort, err = serial.OpenPort(c)
+	if err != nil {
+		return err
+	}
+
+	s.reader = bufio.NewReader(s.serialPort)
+
+	for _, setting := range [][2]string{{"ej", "1"}, {"jv", "4"}, {"qv", "1"}, {"sv", "1"}} {
+		if _, err := s.configure(setting[0], setting[1]); err != nil {
+			return errors.New(fmt.Sprintf("Unable to set up g2core: %s", err))
+		}
+	}
+	fb, err := s.configure("fb", "null")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to detect initialized g2core: %s", err))
+	}
+	fmt.Printf("g2core firmware build %s initialized\n", fb)
+
+	go s.readResponses()
+	return nil
+}
+
+// Resets g2core, stopping it at once. Works as emergency stop.
+func (s *G2CoreStreamer) Stop() {
+	_, _ = s.serialPort.Write([]byte("\x18"))
+	s.serialPort.Close()
+
+	s.lock.Lock()
+	s.fail(errors.New("Stopped"))
+	s.cond.Broadcast()
+	s.lock.Unlock()
+}
+
+// Issues a cycle start ("~"), resuming after Hold
+func (s *G2CoreStreamer) Resume() {
+	_, _ = s.serialPort.Write([]byte("~"))
+}
+
+// Issues a feedhold ("!")
+func (s *G2CoreStreamer) Hold() {
+	_, _ = s.serialPort.Write([]byte("!"))
+}
@@ -0,0 +1,81 @@
+package streaming
+
+import "bufio"
+import "context"
+import "fmt"
+import "strings"
+import "testing"
+
+// Streams the program to a fake g2core, which answers commands with reply.
+// Returns the most commands in flight, and the error of the stream.
+func streamG2Core(t *testing.T, window int, reply func(cmd string) string) (int, error) {
+	var (
+		s         = &G2CoreStreamer{LineWindow: window}
+		maxFlight int
+	)
+	f := newFakeSerial(func(lines <-chan string, respond func(string)) {
+		holdResponses(lines, respond, func(pending []string) {
+			if len(pending) > maxFlight {
+				maxFlight = len(pending)
+			}
+		}, reply)
+	})
+
+	s.Init()
+	s.serialPort, s.reader = f, bufio.NewReader(f)
+	go s.readResponses()
+
+	err := Run(context.Background(), s, streamMachine(t), nil, s)
+	f.wait()
+	return maxFlight, err
+}
+
+// A response to a gcode command with the given status
+func g2coreReply(cmd string, status int, msg string) string {
+	gc := strings.TrimSuffix(strings.TrimPrefix(cmd, `{"gc":`), "}")
+	return fmt.Sprintf(`{"r":{"gc":%s,"msg":%q},"f":[3,%d,4]}`, gc, msg, status)
+}
+
+func TestG2CoreWindow(t *testing.T) {
+	const window = 2
+	flight, err := streamG2Core(t, window, func(cmd string) string {
+		return g2coreReply(cmd, 0, "")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flight != window {
+		t.Errorf("Sent at most %d commands with a window of %d", flight, window)
+	}
+}
+
+func TestG2CoreErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		errors []string
+	}{
+		{"status", "", []string{"status 108 Bad number", "X3"}},
+		{"exception", `{"er":{"fb":100.00,"st":27,"msg":"Initializing"}}`, []string{"exception from CNC: Initializing (status 27)"}},
+	}
+	for _, test := range tests {
+		_, err := streamG2Core(t, 0, func(cmd string) string {
+			if !strings.Contains(cmd, "X3") {
+				return g2coreReply(cmd, 0, "")
+			}
+			if test.reply != "" {
+				return test.reply
+			}
+			return g2coreReply(cmd, 108, "Bad number")
+		})
+		if err == nil {
+			t.Errorf("%s: streamed without errors", test.name)
+			continue
+		}
+		for _, e := range test.errors {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: failed with %q, expected %q", test.name, err, e)
+			}
+		}
+	}
+}
@@ -5,8 +5,32 @@ import "bufio"
 import "github.com/joushou/goserial"
 import "github.com/joushou/gocnc/vm"
 import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/machine"
 import "errors"
 import "fmt"
+import "strings"
+import "sync"
+
+//
+// Grbl streaming
+//
+// Lines are sent using the character-counting protocol: instead of waiting
+// for the "ok" of every line, lines are sent as long as the lines not yet
+// acknowledged fit in the serial receive buffer of Grbl, so that its planner
+// never runs dry on short moves. Every "ok" or "error" acknowledges the
+// oldest line sent. Responses are read as they arrive, and errors and alarms
+// fail the next line sent, or Flush.
+//
+// Hold, Resume and Stop are real-time commands, which Grbl acts on at once,
+// regardless of the lines waiting in its buffer.
+//
+// Program pauses (M0, M1 and M60) are passed to OnPause, if set, once Grbl
+// has finished the moves before them, which a dwell waits for. Streaming
+// continues when OnPause returns, so it can wait for the operator.
+//
+
+// Size of the serial receive buffer of a default build of Grbl
+const GrblBufferSize = 128
 
 // A result struct used by serialReader
 type result struct {
@@ -16,10 +40,18 @@ type result struct {
 
 type GrblStreamer struct {
 	export.GrblGenerator
+	Profile    *machine.Profile
+	BufferSize int            // Serial receive buffer of Grbl, GrblBufferSize if 0
+	Info       func(string)   // Receives feedback messages from Grbl, printed if nil
+	OnPause    func(code int) // Called with the M-code of program pauses, which are sent to Grbl if nil
+
 	serialPort io.ReadWriteCloser
 	reader     *bufio.Reader
-	writer     *bufio.Writer
-	generator  *export.GrblGenerator
+	lock       sync.Mutex
+	cond       *sync.Cond
+	pending    []string // Lines sent but not yet acknowledged
+	inFlight   int      // Characters of the pending lines
+	err        error    // Error or alarm stopping the stream
 }
 
 //
@@ -32,62 +64,142 @@ func serialReader(reader *bufio.Reader) result {
 	if err != nil {
 		return result{"serial-error", fmt.Sprintf("%s", err)}
 	}
-	b := string(c)
-	if b == "ok\r\n" {
+	b := strings.TrimRight(string(c), "\r\n")
+	l := strings.ToLower(b)
+	if l == "ok" {
 		return result{"ok", ""}
-	} else if len(b) >= 5 && b[:5] == "error" {
-		return result{"error", b[6 : len(b)-1]}
-	} else if len(b) >= 5 && b[:5] == "alarm" {
-		return result{"alarm", b[6 : len(b)-1]}
+	} else if strings.HasPrefix(l, "error") {
+		return result{"error", responseMessage(b[len("error"):])}
+	} else if strings.HasPrefix(l, "alarm") {
+		return result{"alarm", responseMessage(b[len("alarm"):])}
 	} else {
-		return result{"info", b[:len(b)-1]}
+		return result{"info", b}
 	}
 }
 
-func (s *GrblStreamer) handleRes(str string) {
-	// Look for a response
-	res := serialReader(s.reader)
-
-	switch res.level {
-	case "error":
-		panic(fmt.Sprintf("Received error from CNC: %s, block: %s", res.message, str))
-	case "alarm":
-		panic(fmt.Sprintf("Received alarm from CNC: %s, block: %s", res.message, str))
-	case "info":
-		fmt.Printf("\nReceived info from CNC: %s\n", res.message)
-	default:
-	}
+// The message following "error" or "ALARM", such as the code of "error:9", or
+// "" for a bare "error"
+func responseMessage(rest string) string {
+	return strings.TrimSpace(strings.TrimPrefix(rest, ":"))
 }
 
-func (s *GrblStreamer) Init() {
-	s.Write = func(str string) {
-		str += "\n"
-
-		_, err := s.writer.WriteString(str)
-		if err != nil {
-			panic(fmt.Sprintf("Error while sending data: %s", err))
+// Reads responses until the serial port fails or is closed
+func (s *GrblStreamer) readResponses() {
+	for {
+		res := serialReader(s.reader)
+
+		s.lock.Lock()
+		switch res.level {
+		case "ok", "error":
+			if len(s.pending) == 0 {
+				s.fail(errors.New(fmt.Sprintf("Unexpected response from CNC: %s", res.level)))
+				break
+			}
+			if res.level == "error" {
+				s.fail(errors.New(fmt.Sprintf("Received error from CNC: %s, block: %s", res.message, s.pending[0])))
+			}
+			s.inFlight -= len(s.pending[0]) + 1
+			s.pending = s.pending[1:]
+		case "alarm":
+			s.fail(errors.New(fmt.Sprintf("Received alarm from CNC: %s", res.message)))
+		case "info":
+			if res.message != "" {
+				if s.Info != nil {
+					s.Info(res.message)
+				} else {
+					fmt.Printf("\nReceived info from CNC: %s\n", res.message)
+				}
+			}
+		case "serial-error":
+			s.fail(errors.New(fmt.Sprintf("Error while reading from CNC: %s", res.message)))
 		}
-		err = s.writer.Flush()
-		if err != nil {
-			panic(fmt.Sprintf("Error while flushing writer: %s", err))
+		s.cond.Broadcast()
+		s.lock.Unlock()
+
+		if res.level == "serial-error" {
+			return
 		}
-		s.handleRes(str)
 	}
+}
+
+// Records the first error stopping the stream. Must be called with the lock held.
+func (s *GrblStreamer) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Sends a line once there is room for it in the buffer of Grbl
+func (s *GrblStreamer) send(str string) {
+	size := s.BufferSize
+	if size <= 0 {
+		size = GrblBufferSize
+	}
+	if len(str)+1 > size {
+		panic(errors.New(fmt.Sprintf("Block longer than the buffer of the CNC: %s", str)))
+	}
+
+	s.lock.Lock()
+	for s.err == nil && s.inFlight+len(str)+1 > size {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		s.lock.Unlock()
+		panic(s.err)
+	}
+	s.pending = append(s.pending, str)
+	s.inFlight += len(str) + 1
+	s.lock.Unlock()
+
+	if _, err := s.serialPort.Write([]byte(str + "\n")); err != nil {
+		panic(errors.New(fmt.Sprintf("Error while sending data: %s", err)))
+	}
+}
+
+// Pauses the program, waiting for OnPause once the machine has stopped
+func (s *GrblStreamer) Pause(code int) {
+	if s.OnPause == nil {
+		s.GrblGenerator.Pause(code)
+		return
+	}
+	// Grbl acknowledges a dwell once it is done, after the moves before it
+	s.send("G4P0")
+	if err := s.Flush(); err != nil {
+		panic(err)
+	}
+	s.OnPause(code)
+}
+
+func (s *GrblStreamer) Init() {
+	s.cond = sync.NewCond(&s.lock)
+	s.Write = s.send
 	s.GrblGenerator.Init()
 }
 
+// Waits until Grbl has acknowledged all lines sent, returning the error or
+// alarm that stopped the stream, if any
+func (s *GrblStreamer) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.err == nil && len(s.pending) > 0 {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
 // Takes the vm for a dry-run, to see if the states are compatible with Grbl.
+// If a machine profile is set, the moves are also checked against its limits.
 func (s *GrblStreamer) Check(m *vm.Machine) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
+	defer vm.Recover(&err)
+	if s.Profile != nil {
+		if err := m.CheckLimits(*s.Profile); err != nil {
+			return err
 		}
-	}()
-	gen := export.GrblGenerator{}
+	}
+	gen := export.GrblGenerator{Settings: s.Settings}
 	gen.Init()
 	gen.Write = func(string) {}
-	export.HandleAllPositions(m, &gen)
-	return nil
+	return export.HandleAllPositions(m, &gen)
 }
 
 // Connect to a serial port at the given path and baudrate
@@ -100,7 +212,6 @@ func (s *GrblStreamer) Connect(name string, baud int) error {
 	}
 
 	s.reader = bufio.NewReader(s.serialPort)
-	s.writer = bufio.NewWriter(s.serialPort)
 
 	for {
 		c, err := s.reader.ReadBytes('\n')
@@ -117,6 +228,7 @@ func (s *GrblStreamer) Connect(name string, baud int) error {
 		}
 	}
 
+	go s.readResponses()
 	return nil
 }
 
@@ -124,14 +236,19 @@ func (s *GrblStreamer) Connect(name string, baud int) error {
 func (s *GrblStreamer) Stop() {
 	_, _ = s.serialPort.Write([]byte("\x18"))
 	s.serialPort.Close()
+
+	s.lock.Lock()
+	s.fail(errors.New("Stopped"))
+	s.cond.Broadcast()
+	s.lock.Unlock()
 }
 
-// Issues a cycle-start ("~")
-func (s *GrblStreamer) Start() {
+// Issues a cycle-start ("~"), resuming after Hold
+func (s *GrblStreamer) Resume() {
 	_, _ = s.serialPort.Write([]byte("~"))
 }
 
 // Issues a feed-hold ("!")
-func (s *GrblStreamer) Pause() {
+func (s *GrblStreamer) Hold() {
 	_, _ = s.serialPort.Write([]byte("!"))
 }
@@ -0,0 +1,208 @@
+package streaming
+
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "bufio"
+import "context"
+import "io"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+const streamProgram = "G21 G90\nG0 X0 Y0 Z1\nG1 Z-1 F100\nX1\nX2\nX3\nX4\nX5\nY1\nX0\nG0 Z1\n"
+
+// A serial port connected to a fake controller. Lines written are passed to
+// the controller, and its responses read back.
+type fakeSerial struct {
+	lines  chan string
+	r      *io.PipeReader
+	w      *io.PipeWriter
+	lock   sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+// Connects a fake controller, which is passed every line written, and the
+// function to write responses with
+func newFakeSerial(controller func(lines <-chan string, respond func(string))) *fakeSerial {
+	f := &fakeSerial{lines: make(chan string, 1024), done: make(chan struct{})}
+	f.r, f.w = io.Pipe()
+	go func() {
+		defer close(f.done)
+		controller(f.lines, func(res string) {
+			_, _ = io.WriteString(f.w, res+"\r\n")
+		})
+	}()
+	return f
+}
+
+func (f *fakeSerial) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+// Passes on lines, dropping real-time commands
+func (f *fakeSerial) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s := string(p); strings.HasSuffix(s, "\n") {
+		f.lines <- strings.TrimSuffix(s, "\n")
+	}
+	return len(p), nil
+}
+
+func (f *fakeSerial) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.lines)
+		f.w.Close()
+	}
+	return nil
+}
+
+// Closes the port, and waits for the controller to finish
+func (f *fakeSerial) wait() {
+	f.Close()
+	<-f.done
+}
+
+// Holds back responses while lines keep arriving, so that the buffer of the
+// controller fills up, then answers the oldest line with reply
+func holdResponses(lines <-chan string, respond func(string), received func(pending []string), reply func(line string) string) {
+	var pending []string
+	for {
+		var (
+			line string
+			ok   bool
+		)
+		if len(pending) == 0 {
+			line, ok = <-lines
+		} else {
+			select {
+			case line, ok = <-lines:
+			case <-time.After(10 * time.Millisecond):
+				respond(reply(pending[0]))
+				pending = pending[1:]
+				continue
+			}
+		}
+		if !ok {
+			return
+		}
+		pending = append(pending, line)
+		received(pending)
+	}
+}
+
+func streamMachine(t *testing.T) *vm.Machine {
+	doc, err := gcode.Parse(streamProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vm.New()
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Streams the program to a fake Grbl with a buffer of size characters, which
+// answers lines with reply. Returns the most characters held in the buffer,
+// and the error of the stream.
+func streamGrbl(t *testing.T, size int, reply func(line string) string) (int, error) {
+	var (
+		s       = &GrblStreamer{BufferSize: size}
+		maxUsed int
+	)
+	f := newFakeSerial(func(lines <-chan string, respond func(string)) {
+		holdResponses(lines, respond, func(pending []string) {
+			used := 0
+			for _, l := range pending {
+				used += len(l) + 1
+			}
+			if used > maxUsed {
+				maxUsed = used
+			}
+		}, reply)
+	})
+
+	s.Settings = export.DefaultGrblSettings()
+	s.Init()
+	s.serialPort, s.reader = f, bufio.NewReader(f)
+	go s.readResponses()
+
+	err := Run(context.Background(), s, streamMachine(t), nil, s)
+	f.wait()
+	return maxUsed, err
+}
+
+func TestGrblResponses(t *testing.T) {
+	tests := []struct {
+		line, level, message string
+	}{
+		{"ok\r\n", "ok", ""},
+		{"error:9\r\n", "error", "9"},
+		{"error: Bad number format\r\n", "error", "Bad number format"},
+		{"error\r\n", "error", ""},
+		{"ALARM:1\r\n", "alarm", "1"},
+		{"ALARM\r\n", "alarm", ""},
+		{"[MSG:Reset to continue]\r\n", "info", "[MSG:Reset to continue]"},
+	}
+	for _, test := range tests {
+		res := serialReader(bufio.NewReader(strings.NewReader(test.line)))
+		if res.level != test.level || res.message != test.message {
+			t.Errorf("%q: read %s %q, expected %s %q", test.line, res.level, res.message, test.level, test.message)
+		}
+	}
+}
+
+func TestGrblCharacterCounting(t *testing.T) {
+	const size = 32
+	used, err := streamGrbl(t, size, func(string) string {
+		return "ok"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used > size {
+		t.Errorf("Sent %d characters to a buffer of %d", used, size)
+	}
+	if used <= size/2 {
+		t.Errorf("Sent at most %d characters to a buffer of %d, expected it to fill", used, size)
+	}
+}
+
+func TestGrblErrors(t *testing.T) {
+	tests := []struct {
+		reply  string
+		errors []string
+	}{
+		{"error:20", []string{"error from CNC: 20", "block: X3"}},
+		{"error", []string{"error from CNC: ,", "block: X3"}},
+		{"ALARM:2", []string{"alarm from CNC: 2"}},
+		{"ALARM", []string{"alarm from CNC: "}},
+	}
+	for _, test := range tests {
+		_, err := streamGrbl(t, GrblBufferSize, func(line string) string {
+			if strings.Contains(line, "X3") {
+				return test.reply
+			}
+			return "ok"
+		})
+		if err == nil {
+			t.Errorf("%s: streamed without errors", test.reply)
+			continue
+		}
+		for _, e := range test.errors {
+			if !strings.Contains(err.Error(), e) {
+				t.Errorf("%s: failed with %q, expected %q", test.reply, err, e)
+			}
+		}
+	}
+}
@@ -1,11 +1,46 @@
 package streaming
 
 import "github.com/joushou/gocnc/vm"
+import "github.com/joushou/gocnc/export"
+import "context"
+import "errors"
 
 type Streamer interface {
 	Check(*vm.Machine) error
 	Connect(string, int) error
+	Flush() error // Waits until all sent code has been accepted
 	Stop()
-	Start()
-	Pause()
+	Resume()
+	Hold()
+}
+
+// Streams all positions through the code generators, which should include the streamer,
+// and waits for the streamer to flush. Progress is called with the index of every handled
+// position, if set. If the context is cancelled, the streamer is stopped and the context
+// error returned.
+func Run(ctx context.Context, s Streamer, m *vm.Machine, progress func(idx int), gens ...export.CodeGenerator) error {
+	return RunFrom(ctx, s, m, 0, progress, gens...)
+}
+
+// Like Run, but starts at the given position index. The generators are brought
+// to the restart point from the safety height before streaming the position.
+// Spilled programs cannot be streamed, as positions are handled by index.
+func RunFrom(ctx context.Context, s Streamer, m *vm.Machine, start int, progress func(idx int), gens ...export.CodeGenerator) error {
+	if m.Spilled() {
+		return errors.New("Cannot stream a spilled program")
+	}
+	for idx := start; idx < len(m.Segments); idx++ {
+		if err := ctx.Err(); err != nil {
+			s.Stop()
+			return err
+		}
+		if err := export.HandlePositionAtIndex(m, idx, gens...); err != nil {
+			s.Stop()
+			return err
+		}
+		if progress != nil {
+			progress(idx)
+		}
+	}
+	return s.Flush()
 }
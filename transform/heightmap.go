@@ -0,0 +1,244 @@
+package transform
+
+import "github.com/joushou/gocnc/vm"
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+
+//
+// Height maps
+//
+// Stock is never quite flat, and cuts that are only a fraction of a
+// millimeter deep, such as isolation milling of PCBs, come out too deep in
+// some places and not at all in others. Probing the surface on a grid gives
+// a height map, which Level follows by adding the height of the surface
+// under every position to its Z. Moves longer than the segment length are
+// split, so that they follow the surface between the probed points, which
+// are interpolated bilinearly. Outside the grid, the height at its nearest
+// edge is used.
+//
+// Height maps are read as lines of X, Y and Z, separated by commas or
+// spaces, as written by bCNC or a spreadsheet, or from the probe results
+// Grbl reports:
+//
+//   [PRB:10.000,20.000,-0.125:1]
+//
+// The points must form a rectangular grid, probed in any order. Positions
+// are in work coordinates, with Z relative to the work origin, so the map
+// must be probed after setting it.
+//
+
+// Surface heights probed on a grid
+type HeightMap struct {
+	X, Y []float64   // Coordinates of the columns and rows, ascending (mm)
+	Z    [][]float64 // Heights by row and column (mm)
+}
+
+// Default length moves are split into when leveling (mm)
+const DefaultLevelSegment = 1.0
+
+// Loads a height map from a file
+func LoadHeightMap(path string) (*HeightMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := ReadHeightMap(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid height map %s: %s", path, err))
+	}
+	return h, nil
+}
+
+// Reads a height map from probed points. Lines starting with # or ;, and a
+// first line not starting with a number, are skipped, as are Grbl responses
+// other than probe results.
+func ReadHeightMap(r io.Reader) (*HeightMap, error) {
+	var (
+		points [][3]float64
+		s      = bufio.NewScanner(r)
+	)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if idx := strings.Index(line, "[PRB:"); idx >= 0 {
+			// Grbl probe result, with the success flag after the last colon
+			line = strings.TrimSuffix(line[idx+5:], "]")
+			if c := strings.LastIndex(line, ":"); c >= 0 {
+				if line[c+1:] != "1" {
+					continue
+				}
+				line = line[:c]
+			}
+		} else if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '<' || line[0] == '[' || line == "ok" {
+			continue
+		}
+
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("Line %d: expected X, Y and Z, found %d fields", n, len(fields)))
+		}
+		var p [3]float64
+		for idx, f := range fields {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				if n == 1 {
+					break
+				}
+				return nil, errors.New(fmt.Sprintf("Line %d: invalid number %q", n, f))
+			}
+			p[idx] = v
+			if idx == 2 {
+				points = append(points, p)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return NewHeightMap(points)
+}
+
+// Creates a height map from probed X, Y and Z points, which must form a
+// rectangular grid of at least one point
+func NewHeightMap(points [][3]float64) (*HeightMap, error) {
+	if len(points) == 0 {
+		return nil, errors.New("No probed points")
+	}
+
+	// Coordinates of the columns and rows, merging those probed within a micron
+	coords := func(axis int) []float64 {
+		var res []float64
+		for _, p := range points {
+			res = append(res, p[axis])
+		}
+		sort.Float64s(res)
+		uniq := res[:1]
+		for _, v := range res[1:] {
+			if v-uniq[len(uniq)-1] > 0.001 {
+				uniq = append(uniq, v)
+			}
+		}
+		return uniq
+	}
+	h := &HeightMap{X: coords(0), Y: coords(1)}
+	if len(h.X)*len(h.Y) != len(points) {
+		return nil, errors.New(fmt.Sprintf("%d points do not form a grid of %d columns and %d rows", len(points), len(h.X), len(h.Y)))
+	}
+
+	h.Z = make([][]float64, len(h.Y))
+	set := make([][]bool, len(h.Y))
+	for row := range h.Z {
+		h.Z[row] = make([]float64, len(h.X))
+		set[row] = make([]bool, len(h.X))
+	}
+	for _, p := range points {
+		col, row := nearest(h.X, p[0]), nearest(h.Y, p[1])
+		if set[row][col] {
+			return nil, errors.New(fmt.Sprintf("Point X%g Y%g probed more than once", p[0], p[1]))
+		}
+		h.Z[row][col], set[row][col] = p[2], true
+	}
+	return h, nil
+}
+
+// Index of the coordinate nearest to v
+func nearest(coords []float64, v float64) int {
+	idx := sort.SearchFloat64s(coords, v)
+	if idx == len(coords) || idx > 0 && v-coords[idx-1] < coords[idx]-v {
+		return idx - 1
+	}
+	return idx
+}
+
+// Finds the cell of a coordinate, as the index of its lower edge and the
+// fraction of the way to the next, clamped to the grid
+func cell(coords []float64, v float64) (int, float64) {
+	if len(coords) == 1 || v <= coords[0] {
+		return 0, 0
+	}
+	last := len(coords) - 1
+	if v >= coords[last] {
+		return last - 1, 1
+	}
+	idx := sort.SearchFloat64s(coords, v) - 1
+	return idx, (v - coords[idx]) / (coords[idx+1] - coords[idx])
+}
+
+// The interpolated height of the surface at a position
+func (h *HeightMap) Height(x, y float64) float64 {
+	col, fx := cell(h.X, x)
+	row, fy := cell(h.Y, y)
+	next := func(idx int, coords []float64) int {
+		if idx+1 < len(coords) {
+			return idx + 1
+		}
+		return idx
+	}
+	col2, row2 := next(col, h.X), next(row, h.Y)
+	lower := h.Z[row][col]*(1-fx) + h.Z[row][col2]*fx
+	upper := h.Z[row2][col]*(1-fx) + h.Z[row2][col2]*fx
+	return lower*(1-fy) + upper*fy
+}
+
+// Adds the height of the surface to Z of every segment of the machine,
+// except the origin and segments in machine coordinates, splitting feed
+// moves into moves of at most segment length. Rapid moves are not split, as
+// they are expected to be well above the surface.
+func Level(machine *vm.Machine, h *HeightMap, segment float64) error {
+	if segment <= 0 {
+		return errors.New("Segment length must be positive")
+	}
+	if machine.Spilled() {
+		return errors.New("Spilled toolpaths cannot be leveled")
+	}
+
+	var (
+		res    = make([]vm.Segment, 0, len(machine.Segments))
+		starts = make([]int, len(machine.Segments)+1) // Index in res of every segment
+	)
+	for idx, seg := range machine.Segments {
+		starts[idx] = len(res)
+		if idx == 0 || seg.Machine {
+			res = append(res, seg)
+			continue
+		}
+
+		prev := machine.Segments[idx-1]
+		steps := 1
+		if seg.Kind == vm.SegmentMove && seg.State.MoveMode == vm.MoveModeLinear {
+			steps = int(math.Max(math.Ceil(math.Hypot(seg.X-prev.X, seg.Y-prev.Y)/segment), 1))
+		}
+		if steps > 1 && seg.State.FeedMode == vm.FeedModeInvTime {
+			// Each piece takes its share of the time of the move, see vm/feed.go
+			seg = seg.Modify(func(st *vm.State) {
+				st.Feedrate *= float64(steps)
+			})
+		}
+		for i := 1; i <= steps; i++ {
+			f := float64(i) / float64(steps)
+			p := seg
+			p.X, p.Y, p.Z = prev.X+(seg.X-prev.X)*f, prev.Y+(seg.Y-prev.Y)*f, prev.Z+(seg.Z-prev.Z)*f
+			if i == steps {
+				p.X, p.Y, p.Z = seg.X, seg.Y, seg.Z
+			}
+			p.Z += h.Height(p.X, p.Y)
+			res = append(res, p)
+		}
+	}
+	starts[len(machine.Segments)] = len(res)
+
+	for idx := range machine.Arcs {
+		a := &machine.Arcs[idx]
+		a.Start, a.End = starts[a.Start], starts[a.End]
+	}
+	machine.Segments = res
+	return nil
+}
@@ -0,0 +1,173 @@
+package transform
+
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "math"
+
+//
+// Lead-in and lead-out
+//
+// A tool plunging straight onto a profile, or retracting straight off it,
+// stops against the wall for a moment, leaving a mark. Leads move the tool on
+// and off the profile along a line at an angle to it, or along an arc
+// joining it tangentially. Profiles are closed loops of feed moves at the
+// same Z below Z0, possibly rising over holding tabs (see tabs.go). The moves into a loop at its start point,
+// such as the plunge, go to the start of the lead-in instead, and the moves
+// straight up out of the loop start at the end of the lead-out.
+//
+// Leads are on the left of the direction of travel, which is away from the
+// part when climb milling with a clockwise spindle, both for outside
+// profiles (clockwise) and holes (counterclockwise). There must be room for
+// them there, as they are cut at the depth of the profile.
+//
+// Loops moved into or out of in inverse time mode are left without leads, as
+// the moves changed would take the time of the moves they come from, see
+// vm/feed.go.
+//
+
+// Adds leads to closed loops below Z0: arcs of the radius sweeping the angle
+// (degrees) with a radius, and lines of the length at the angle to the
+// profile otherwise
+func Leads(machine *vm.Machine, length, radius, angle float64) error {
+	if angle <= 0 || angle > 180 {
+		return errors.New("Lead angle must be between 0 and 180 degrees")
+	}
+	if length <= 0 && radius <= 0 {
+		return errors.New("Lead length or radius must be positive")
+	}
+	if machine.Spilled() {
+		return errors.New("Spilled toolpaths cannot get leads")
+	}
+
+	var (
+		segs   = machine.Segments
+		res    = make([]vm.Segment, 0, len(segs))
+		starts = make([]int, len(segs)+1) // Index in res of every segment
+		a      = angle * math.Pi / 180
+	)
+
+	// Points of a lead from a point on the loop, with the tangent of the
+	// loop there, leaving it if out is set
+	lead := func(x, y, tx, ty float64, out bool) [][2]float64 {
+		nx, ny := -ty, tx // Left
+		if radius <= 0 {
+			if out {
+				return [][2]float64{{x + length*(math.Cos(a)*tx+math.Sin(a)*nx), y + length*(math.Cos(a)*ty+math.Sin(a)*ny)}}
+			}
+			return [][2]float64{{x - length*math.Cos(a)*tx + length*math.Sin(a)*nx, y - length*math.Cos(a)*ty + length*math.Sin(a)*ny}}
+		}
+
+		// Counterclockwise around a center on the left, at most the arc
+		// deviation from the arc
+		cx, cy := x+radius*nx, y+radius*ny
+		step := math.Pi / 8
+		if radius > machine.MaxArcDeviation {
+			step = math.Min(step, 2*math.Acos(1-machine.MaxArcDeviation/radius))
+		}
+		n := int(math.Ceil(a / step))
+		var res [][2]float64
+		for i := 0; i <= n; i++ {
+			theta := a * float64(i) / float64(n)
+			if !out {
+				theta -= a
+			}
+			sin, cos := math.Sincos(theta)
+			res = append(res, [2]float64{cx + radius*(-nx*cos+ny*sin), cy + radius*(-nx*sin-ny*cos)})
+		}
+		if out {
+			return res[1:]
+		}
+		return res[:n]
+	}
+
+	for idx := 0; idx < len(segs); idx++ {
+		starts[idx] = len(res)
+		res = append(res, segs[idx])
+		end, _ := findLoop(segs, idx, true)
+		start := segs[idx]
+		if end == idx || start.Z >= 0 || inverseTimeLoop(res, segs, idx, end) {
+			continue
+		}
+
+		// Tangents at the start and end of the loop
+		var tin, tout [2]float64
+		for i := idx + 1; i <= end; i++ {
+			if dx, dy := segs[i].X-segs[i-1].X, segs[i].Y-segs[i-1].Y; dx != 0 || dy != 0 {
+				l := math.Hypot(dx, dy)
+				if tin == [2]float64{} {
+					tin = [2]float64{dx / l, dy / l}
+				}
+				tout = [2]float64{dx / l, dy / l}
+			}
+		}
+
+		// Move the moves into the loop to the start of the lead-in
+		in := lead(start.X, start.Y, tin[0], tin[1], false)
+		for k := len(res) - 1; k > 0 && res[k].Kind == vm.SegmentMove && !res[k].Machine &&
+			res[k].X == start.X && res[k].Y == start.Y; k-- {
+			res[k].X, res[k].Y = in[0][0], in[0][1]
+		}
+		for _, p := range in[1:] {
+			s := segs[idx+1]
+			s.X, s.Y, s.Z = p[0], p[1], start.Z
+			res = append(res, s)
+		}
+		res = append(res, start)
+
+		for i := idx + 1; i <= end; i++ {
+			starts[i] = len(res)
+			res = append(res, segs[i])
+		}
+		out := lead(start.X, start.Y, tout[0], tout[1], true)
+		for _, p := range out {
+			s := segs[end]
+			s.X, s.Y = p[0], p[1]
+			res = append(res, s)
+		}
+
+		// Move the moves straight up out of the loop to the end of the lead-out
+		o := out[len(out)-1]
+		idx = end
+		for idx+1 < len(segs) && segs[idx+1].Kind == vm.SegmentMove && !segs[idx+1].Machine &&
+			segs[idx+1].X == start.X && segs[idx+1].Y == start.Y && segs[idx+1].Z >= start.Z {
+			idx++
+			starts[idx] = len(res)
+			s := segs[idx]
+			s.X, s.Y = o[0], o[1]
+			res = append(res, s)
+		}
+	}
+	starts[len(segs)] = len(res)
+
+	for idx := range machine.Arcs {
+		a := &machine.Arcs[idx]
+		a.Start, a.End = starts[a.Start], starts[a.End]
+	}
+	machine.Segments = res
+	return nil
+}
+
+// Tests if any feed move of the loop from idx to end, or of the moves into it
+// at the end of res, or straight up out of it after end, is in inverse time mode
+func inverseTimeLoop(res, segs []vm.Segment, idx, end int) bool {
+	var (
+		start   = segs[idx]
+		inverse = func(s vm.Segment) bool {
+			return s.State.FeedMode == vm.FeedModeInvTime && s.State.MoveMode != vm.MoveModeRapid
+		}
+		at = func(s vm.Segment) bool {
+			return s.Kind == vm.SegmentMove && !s.Machine && s.X == start.X && s.Y == start.Y
+		}
+	)
+	for k := len(res) - 1; k > 0 && at(res[k]); k-- {
+		if inverse(res[k]) {
+			return true
+		}
+	}
+	for i := idx + 1; i <= end || i < len(segs) && at(segs[i]) && segs[i].Z >= start.Z; i++ {
+		if inverse(segs[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package transform
+
+import "testing"
+
+func TestLeadsInverseTime(t *testing.T) {
+	const loop = "G1 X10\nY10\nX0\nY0\nG94 G0 Z5\n"
+	tests := []struct {
+		name    string
+		program string
+		leads   bool
+	}{
+		{"units per minute", "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\n" + loop, true},
+		{"inverse time loop", "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nG93 F10\n" + loop, false},
+		{"inverse time plunge", "G21 G90 G0 X0 Y0 Z1\nG93 G1 Z-1 F10\nG94 F100\n" + loop, false},
+	}
+	for _, test := range tests {
+		m := processProgram(t, test.program)
+		n := len(m.Segments)
+		if err := Leads(m, 2, 0, 90); err != nil {
+			t.Fatal(err)
+		}
+		if leads := len(m.Segments) != n; leads != test.leads {
+			t.Errorf("%s: got leads %t, expected %t", test.name, leads, test.leads)
+		}
+	}
+}
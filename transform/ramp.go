@@ -0,0 +1,121 @@
+package transform
+
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "math"
+
+//
+// Ramping
+//
+// Endmills that do not cut at the center cannot plunge straight into the
+// material. Straight feed plunges ending below Z0, the top of the work, and
+// followed by a feed move in XY, are replaced by ramps descending at most
+// the ramp angle from the horizontal:
+//
+//   - with a radius, a counterclockwise helix of that radius around the
+//     plunge point, starting with a move out to it and ending with a move
+//     back to the point at the bottom
+//   - without one, a zigzag back and forth along the move following the
+//     plunge, which is cut anyway
+//
+// The part of a plunge above Z0 is kept straight. Plunges not followed by
+// a move in XY, such as drilling, are left as they are. Helixes must fit in
+// the material to be removed around the plunge point, and are split into
+// lines at the arc deviation of the machine. In inverse time mode, the ramp
+// moves at the speed of the plunge.
+//
+
+// Replaces plunges into the work with ramps at the angle (degrees), helical
+// with a radius, and zigzag along the next move otherwise
+func Ramp(machine *vm.Machine, angle, radius float64) error {
+	if angle <= 0 || angle >= 90 {
+		return errors.New("Ramp angle must be between 0 and 90 degrees")
+	}
+	if radius < 0 {
+		return errors.New("Ramp radius must not be negative")
+	}
+	if machine.Spilled() {
+		return errors.New("Spilled toolpaths cannot be ramped")
+	}
+
+	var (
+		slope  = math.Tan(angle * math.Pi / 180)
+		segs   = machine.Segments
+		res    = make([]vm.Segment, 0, len(segs))
+		starts = make([]int, len(segs)+1) // Index in res of every segment
+	)
+	for idx, seg := range segs {
+		starts[idx] = len(res)
+		if !isPlunge(segs, idx) {
+			res = append(res, seg)
+			continue
+		}
+
+		prev, next := segs[idx-1], segs[idx+1]
+		top := math.Min(prev.Z, 0)
+		plunge := prev.Z - seg.Z
+		point := func(x, y, z float64) {
+			p := seg
+			p.X, p.Y, p.Z = x, y, z
+			res = append(res, piece(p, res[len(res)-1], plunge))
+		}
+		if prev.Z > top {
+			// Straight down to the work
+			point(seg.X, seg.Y, top)
+		}
+
+		if radius > 0 {
+			// Lines deviating at most the arc deviation from the helix
+			step := math.Pi / 8
+			if radius > machine.MaxArcDeviation {
+				step = math.Min(step, 2*math.Acos(1-machine.MaxArcDeviation/radius))
+			}
+			total := (top - seg.Z) / (radius * slope)
+			n := int(math.Ceil(total / step))
+			point(seg.X+radius, seg.Y, top)
+			for i := 1; i <= n; i++ {
+				f := float64(i) / float64(n)
+				sin, cos := math.Sincos(total * f)
+				point(seg.X+radius*cos, seg.Y+radius*sin, top+(seg.Z-top)*f)
+			}
+		} else {
+			// An even number of legs, ending back at the plunge point, no
+			// longer than needed to get down in two
+			dx, dy := next.X-seg.X, next.Y-seg.Y
+			length := math.Hypot(dx, dy)
+			leg := math.Min(length, (top-seg.Z)/(2*slope))
+			n := int(math.Ceil((top - seg.Z) / (leg * slope)))
+			n += n % 2
+			for i := 1; i < n; i += 2 {
+				point(seg.X+dx*leg/length, seg.Y+dy*leg/length, top+(seg.Z-top)*float64(i)/float64(n))
+				if i+1 < n {
+					point(seg.X, seg.Y, top+(seg.Z-top)*float64(i+1)/float64(n))
+				}
+			}
+		}
+		point(seg.X, seg.Y, seg.Z)
+	}
+	starts[len(segs)] = len(res)
+
+	for idx := range machine.Arcs {
+		a := &machine.Arcs[idx]
+		a.Start, a.End = starts[a.Start], starts[a.End]
+	}
+	machine.Segments = res
+	return nil
+}
+
+// Tests if the segment at idx is a straight feed plunge below Z0, followed by
+// a feed move in XY
+func isPlunge(segs []vm.Segment, idx int) bool {
+	if idx == 0 || idx+1 >= len(segs) {
+		return false
+	}
+	prev, seg, next := segs[idx-1], segs[idx], segs[idx+1]
+	feed := func(s vm.Segment) bool {
+		return s.Kind == vm.SegmentMove && s.State.MoveMode == vm.MoveModeLinear && !s.Machine
+	}
+	return feed(seg) && feed(next) && seg.Z < 0 && seg.Z < prev.Z &&
+		seg.X == prev.X && seg.Y == prev.Y && seg.Angles() == prev.Angles() && seg.Offset == prev.Offset &&
+		(next.X != seg.X || next.Y != seg.Y) && next.Angles() == seg.Angles() && next.Offset == seg.Offset
+}
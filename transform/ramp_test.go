@@ -0,0 +1,57 @@
+package transform
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vm"
+import "math"
+import "testing"
+
+// Runs the program through a vm
+func processProgram(t *testing.T, program string) *vm.Machine {
+	doc, err := gcode.Parse(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := vm.New()
+	if err := m.Process(doc); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Checks that the inverse time feed moves between the segments from and to
+// move at the speed (mm/min)
+func checkInverseTimeSpeed(t *testing.T, name string, segs []vm.Segment, from, to int, speed float64) {
+	for idx := from + 1; idx <= to; idx++ {
+		seg := segs[idx]
+		if seg.Kind != vm.SegmentMove || seg.State.MoveMode != vm.MoveModeLinear || seg.State.FeedMode != vm.FeedModeInvTime {
+			continue
+		}
+		l := seg.Vector().Diff(segs[idx-1].Vector()).Norm()
+		if l > 1e-9 && math.Abs(seg.State.Feedrate*l-speed) > 1e-6*speed {
+			t.Errorf("%s: move %d of length %g at F%g moves at %g mm/min, expected %g", name, idx, l, seg.State.Feedrate, seg.State.Feedrate*l, speed)
+		}
+	}
+}
+
+func TestRampInverseTime(t *testing.T) {
+	// The plunge of 2 mm at F50 moves at 100 mm/min, as does the move after it
+	const program = "G21 G90 G0 X0 Y0 Z1\nG1 Z0 F100\nG93 G1 Z-2 F50\nX10 F10\nG94 G0 Z5\n"
+	tests := []struct {
+		name   string
+		radius float64
+	}{
+		{"zigzag", 0},
+		{"helix", 1},
+	}
+	for _, test := range tests {
+		m := processProgram(t, program)
+		n := len(m.Segments)
+		if err := Ramp(m, 10, test.radius); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Segments) <= n {
+			t.Fatalf("%s: plunge not ramped", test.name)
+		}
+		checkInverseTimeSpeed(t, test.name, m.Segments, 1, len(m.Segments)-1, 100)
+	}
+}
@@ -0,0 +1,149 @@
+package transform
+
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "math"
+
+//
+// Holding tabs
+//
+// Parts cut out of thin stock come loose at the last pass, and get caught by
+// the tool. Tabs keep them attached: short stretches of the profile where
+// the tool rises to leave material standing. Profiles are closed loops of
+// feed moves at the same Z, ending where they start. The top of the tabs is
+// the tab height above the deepest feed move of the program, and loops below
+// it get count tabs of the given width, measured along the toolpath, evenly
+// spaced along the loop and away from its start. The tool leaves and enters
+// the tabs straight up and down.
+//
+// As the tabs follow the length along every loop, the passes of a profile
+// cut in several depths get the tabs at the same places, as long as they
+// follow the same path. Pockets below the top of the tabs get tabs too. In
+// inverse time mode, the pieces of a move, and the moves up and down at its
+// tabs, move at the speed of the move.
+//
+
+// Leaves count tabs of the width and height in closed loops at the bottom of the program
+func Tabs(machine *vm.Machine, count int, width, height float64) error {
+	if count <= 0 || width <= 0 || height <= 0 {
+		return errors.New("Tab count, width and height must be positive")
+	}
+	if machine.Spilled() {
+		return errors.New("Spilled toolpaths cannot get tabs")
+	}
+
+	var (
+		segs   = machine.Segments
+		res    = make([]vm.Segment, 0, len(segs))
+		starts = make([]int, len(segs)+1) // Index in res of every segment
+		bottom = math.Inf(1)
+	)
+	for _, seg := range segs {
+		if seg.Kind == vm.SegmentMove && seg.State.MoveMode == vm.MoveModeLinear {
+			bottom = math.Min(bottom, seg.Z)
+		}
+	}
+	top := bottom + height
+
+	for idx := 0; idx < len(segs); idx++ {
+		starts[idx] = len(res)
+		res = append(res, segs[idx])
+		end, length := findLoop(segs, idx, false)
+		if end == idx || segs[idx].Z >= top || float64(count)*width >= length {
+			continue
+		}
+
+		// Tabs are centered at (k + 0.5) * spacing along the loop
+		var (
+			spacing = length / float64(count)
+			dist    float64 // Along the loop to the start of the segment
+			inTab   bool
+		)
+		tab := func(d float64) bool {
+			return math.Abs(math.Mod(d, spacing)-spacing/2) < width/2
+		}
+		for i := idx + 1; i <= end; i++ {
+			starts[i] = len(res)
+			from, seg := segs[i-1], segs[i]
+			l := math.Hypot(seg.X-from.X, seg.Y-from.Y)
+			if l == 0 {
+				if inTab {
+					seg.Z = top
+				}
+				res = append(res, seg)
+				continue
+			}
+
+			// Split at the edges of the tabs
+			cuts := []float64{}
+			for k := 0; k < count; k++ {
+				for _, e := range []float64{spacing*(float64(k)+0.5) - width/2, spacing*(float64(k)+0.5) + width/2} {
+					if e > dist && e < dist+l {
+						cuts = append(cuts, e-dist)
+					}
+				}
+			}
+			cuts = append(cuts, l)
+
+			var prev float64
+			for _, c := range cuts {
+				in := tab(dist + (prev+c)/2)
+				p := seg
+				if in != inTab {
+					// Straight up or down at the edge of the tab
+					p.X, p.Y = from.X+(seg.X-from.X)*prev/l, from.Y+(seg.Y-from.Y)*prev/l
+					p.Z = seg.Z
+					if in {
+						p.Z = top
+					}
+					res = append(res, piece(p, res[len(res)-1], l))
+					inTab = in
+				}
+				p.X, p.Y = from.X+(seg.X-from.X)*c/l, from.Y+(seg.Y-from.Y)*c/l
+				if c == l {
+					p.X, p.Y = seg.X, seg.Y
+				}
+				p.Z = seg.Z
+				if in {
+					p.Z = top
+				}
+				res = append(res, piece(p, res[len(res)-1], l))
+				prev = c
+			}
+			dist += l
+		}
+		idx = end
+	}
+	starts[len(segs)] = len(res)
+
+	for idx := range machine.Arcs {
+		a := &machine.Arcs[idx]
+		a.Start, a.End = starts[a.Start], starts[a.End]
+	}
+	machine.Segments = res
+	return nil
+}
+
+// Finds the closed loop of feed moves at the same Z starting from the
+// segment at idx, returning its last segment, the last back at the start in
+// the run of moves, and its length, or idx if none. Loops with tabs may rise
+// above the Z of their start.
+func findLoop(segs []vm.Segment, idx int, tabbed bool) (int, float64) {
+	var (
+		start       = segs[idx]
+		end         = idx
+		length, run float64
+	)
+	for i := idx + 1; i < len(segs); i++ {
+		seg := segs[i]
+		if seg.Kind != vm.SegmentMove || seg.State.MoveMode != vm.MoveModeLinear || seg.Machine ||
+			seg.Z != start.Z && !(tabbed && seg.Z > start.Z) || seg.Offset != start.Offset || seg.Angles() != start.Angles() {
+			break
+		}
+		run += math.Hypot(seg.X-segs[i-1].X, seg.Y-segs[i-1].Y)
+		if i-idx >= 3 && seg.Z == start.Z && math.Hypot(seg.X-start.X, seg.Y-start.Y) <= 1e-6 {
+			end, length = i, run
+		}
+	}
+	return end, length
+}
@@ -0,0 +1,17 @@
+package transform
+
+import "testing"
+
+func TestTabsInverseTime(t *testing.T) {
+	// Every side of 10 mm at F10 moves at 100 mm/min
+	const program = "G21 G90 G0 X0 Y0 Z1\nG1 Z-1 F100\nG93 G1 X10 F10\nY10 F10\nX0 F10\nY0 F10\nG94 G0 Z5\n"
+	m := processProgram(t, program)
+	n := len(m.Segments)
+	if err := Tabs(m, 2, 2, 0.5); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != n+8 {
+		t.Fatalf("got %d segments with 2 tabs, expected %d", len(m.Segments), n+8)
+	}
+	checkInverseTimeSpeed(t, "tabs", m.Segments, 1, len(m.Segments)-1, 100)
+}
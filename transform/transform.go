@@ -0,0 +1,213 @@
+package transform
+
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "errors"
+import "fmt"
+import "math"
+
+//
+// Transforms
+//
+// Moves, rotates, scales or mirrors a toolpath before export, such as to
+// flip a part over, or to move a job to a corner of the stock, without
+// going back to CAM. Transforms are affine, and are combined with Then:
+//
+//   t := transform.Mirror('X').Then(transform.Translate(100, 0, 0))
+//   err := transform.Apply(&machine, t)
+//
+// Positions are transformed in work coordinates, so work offsets stay as
+// they are. Segments in machine coordinates (G53), such as moves to tool
+// change positions, and the origin of the toolpath, are left as they are.
+//
+// Arcs have already been split into lines by the vm, so they are transformed
+// like any other move. Mirroring reverses the direction of the moves around
+// the part, so cutter compensation passed on to the controller (G41/G42)
+// changes side, keeping the tool on the same side of the material.
+// Programs using rotary axes can only be translated and scaled, as rotating
+// or mirroring X and Y would need the rotary axes to follow.
+//
+
+// An affine transform, as a 3x4 matrix applied to X, Y, Z and 1
+type Transform struct {
+	m [3][4]float64
+}
+
+// The transform leaving positions as they are
+func Identity() Transform {
+	return Scale(1, 1, 1)
+}
+
+// Moves positions by the given distances (mm)
+func Translate(x, y, z float64) Transform {
+	t := Identity()
+	t.m[0][3], t.m[1][3], t.m[2][3] = x, y, z
+	return t
+}
+
+// Rotates positions counterclockwise about the Z axis by the given angle in degrees
+func RotateZ(angle float64) Transform {
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	t := Identity()
+	t.m[0][0], t.m[0][1] = cos, -sin
+	t.m[1][0], t.m[1][1] = sin, cos
+	return t
+}
+
+// Scales positions along each axis, about the origin
+func Scale(x, y, z float64) Transform {
+	var t Transform
+	t.m[0][0], t.m[1][1], t.m[2][2] = x, y, z
+	return t
+}
+
+// Mirrors positions along the X, Y or Z axis, about the origin
+func Mirror(axis rune) Transform {
+	switch axis {
+	case 'X', 'x':
+		return Scale(-1, 1, 1)
+	case 'Y', 'y':
+		return Scale(1, -1, 1)
+	case 'Z', 'z':
+		return Scale(1, 1, -1)
+	}
+	panic(fmt.Sprintf("Invalid mirror axis %c", axis))
+}
+
+// The transform applying t, and then u
+func (t Transform) Then(u Transform) Transform {
+	var res Transform
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 4; c++ {
+			for k := 0; k < 3; k++ {
+				res.m[r][c] += u.m[r][k] * t.m[k][c]
+			}
+		}
+		res.m[r][3] += u.m[r][3]
+	}
+	return res
+}
+
+// Transforms a position
+func (t Transform) Vector(v vector.Vector) vector.Vector {
+	p := [3]float64{v.X, v.Y, v.Z}
+	var res [3]float64
+	for r := 0; r < 3; r++ {
+		res[r] = t.m[r][0]*p[0] + t.m[r][1]*p[1] + t.m[r][2]*p[2] + t.m[r][3]
+	}
+	return vector.Vector{res[0], res[1], res[2]}
+}
+
+// Tests if the transform mirrors, reversing the direction of moves around a part
+func (t Transform) Mirrors() bool {
+	return t.m[0][0]*t.m[1][1]-t.m[0][1]*t.m[1][0] < 0
+}
+
+// Tests if the transform mixes X and Y, or mirrors them
+func (t Transform) turns() bool {
+	return t.m[0][1] != 0 || t.m[1][0] != 0 || t.m[0][0] < 0 || t.m[1][1] < 0
+}
+
+// Transforms a segment, failing on combinations the toolpath cannot follow
+func (t Transform) Segment(seg vm.Segment) (vm.Segment, error) {
+	if seg.Machine {
+		return seg, nil
+	}
+	if t.turns() && seg.Angles() != [3]float64{} {
+		return seg, errors.New(fmt.Sprintf("Line %d: rotary axes cannot follow rotating or mirroring X and Y", seg.Line))
+	}
+
+	v := t.Vector(seg.Vector())
+	seg.X, seg.Y, seg.Z = v.X, v.Y, v.Z
+	if t.Mirrors() && seg.State.CutterCompensation != vm.CutCompModeNone {
+		seg = seg.Modify(func(st *vm.State) {
+			if st.CutterCompensation == vm.CutCompModeOuter {
+				st.CutterCompensation = vm.CutCompModeInner
+			} else {
+				st.CutterCompensation = vm.CutCompModeOuter
+			}
+		})
+	}
+	return seg, nil
+}
+
+// A piece of a move of the length, from the segment before. In inverse time
+// mode, the feedrate is that of the whole move (see vm/feed.go), so it is
+// scaled to move the piece at the speed of the move.
+func piece(seg, from vm.Segment, length float64) vm.Segment {
+	if seg.State.FeedMode != vm.FeedModeInvTime || seg.State.MoveMode == vm.MoveModeRapid {
+		return seg
+	}
+	l := seg.Vector().Diff(from.Vector()).Norm()
+	if l < 1e-9 || length < 1e-9 {
+		return seg
+	}
+	return seg.Modify(func(st *vm.State) {
+		st.Feedrate *= length / l
+	})
+}
+
+// Transforms all segments of the machine, except the origin. Fails, leaving
+// the machine as it was, if the transform cannot be applied.
+func Apply(machine *vm.Machine, t Transform) error {
+	if machine.Spilled() {
+		return errors.New("Spilled toolpaths cannot be transformed")
+	}
+
+	var (
+		res    = make([]vm.Segment, len(machine.Segments))
+		states = make(map[*vm.State]*vm.State)
+	)
+	for idx, seg := range machine.Segments {
+		if idx == 0 {
+			res[idx] = seg
+			continue
+		}
+		n, err := t.Segment(seg)
+		if err != nil {
+			return err
+		}
+		// Keep shared states shared
+		if st, ok := states[seg.State]; ok {
+			n.State = st
+		}
+		states[seg.State] = n.State
+		res[idx] = n
+	}
+	machine.Segments = res
+
+	// Arcs scaled evenly in X and Y are still arcs
+	sx, sy := math.Hypot(t.m[0][0], t.m[1][0]), math.Hypot(t.m[0][1], t.m[1][1])
+	if math.Abs(sx-sy) > 1e-9 || math.Abs(t.m[0][0]*t.m[0][1]+t.m[1][0]*t.m[1][1]) > 1e-9 {
+		machine.Arcs = nil
+	}
+	for idx := range machine.Arcs {
+		machine.Arcs[idx].Radius *= sx
+		machine.Arcs[idx].Deviation *= sx
+	}
+	return nil
+}
+
+// Returns a function transforming segments before passing them on to fn, for
+// transforming segments as they are produced with vm.WithStream (see vm/spill.go)
+func Stream(t Transform, fn func(idx int, seg vm.Segment) error) func(idx int, seg vm.Segment) error {
+	return func(idx int, seg vm.Segment) error {
+		if idx > 0 {
+			var err error
+			if seg, err = t.Segment(seg); err != nil {
+				return err
+			}
+		}
+		return fn(idx, seg)
+	}
+}
+
+// The translation moving the lower left corner of the cutting moves of the
+// machine to the given position, for placing a job on the stock
+func Corner(machine *vm.Machine, x, y float64) (Transform, error) {
+	box := machine.Extents().Cutting
+	if box == nil {
+		return Identity(), errors.New("Toolpath has no cutting moves")
+	}
+	return Translate(x-box.Min.X, y-box.Min.Y, 0), nil
+}
@@ -47,6 +47,14 @@ func (v Vector) Divide(d float64) Vector {
 	}
 }
 
+func (v Vector) Scale(f float64) Vector {
+	return Vector{
+		X: v.X * f,
+		Y: v.Y * f,
+		Z: v.Z * f,
+	}
+}
+
 func (v Vector) String() string {
 	return fmt.Sprintf("Vector{X: %f, Y: %f, Z: %f}", v.X, v.Y, v.Z)
 }
@@ -0,0 +1,38 @@
+package vm
+
+// Information about an approximated arc
+type ArcInfo struct {
+	Start, End int     // Position indexes of the generated moves after Process, End is exclusive
+	Radius     float64 // Arc radius (mm)
+	Angle      float64 // Swept angle (radians)
+	Segments   int     // Number of line segments used
+	Deviation  float64 // Maximum chord deviation from the ideal arc (mm)
+}
+
+// Tests if the arc approximation is within the given tolerance
+func (a ArcInfo) WithinTolerance(tolerance float64) bool {
+	return a.Deviation <= tolerance
+}
+
+// Returns all approximated arcs whose chord deviation exceeds MaxArcDeviation.
+// This happens when MinArcLineLength prevents the use of enough segments.
+func (vm *Machine) ArcsOutOfTolerance() []ArcInfo {
+	var res []ArcInfo
+	for _, a := range vm.Arcs {
+		if !a.WithinTolerance(vm.MaxArcDeviation) {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// Returns the largest chord deviation of all approximated arcs
+func (vm *Machine) MaxArcChordDeviation() float64 {
+	var res float64
+	for _, a := range vm.Arcs {
+		if a.Deviation > res {
+			res = a.Deviation
+		}
+	}
+	return res
+}
@@ -0,0 +1,86 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "time"
+
+// Time and distance spent in a category
+type Usage struct {
+	Time     time.Duration
+	Distance float64
+}
+
+func (u *Usage) add(t time.Duration, dist float64) {
+	u.Time += t
+	u.Distance += dist
+}
+
+// Time and distance broken down by category
+type Breakdown struct {
+	Rapid      Usage
+	Cutting    Usage
+	Dwell      Usage
+	Toolchange Usage
+}
+
+// Total time of all categories
+func (b Breakdown) Total() time.Duration {
+	return b.Rapid.Time + b.Cutting.Time + b.Dwell.Time + b.Toolchange.Time
+}
+
+// Time and distance breakdown for an entire job
+type TimeReport struct {
+	Breakdown
+	Tools      map[int]Breakdown
+	Operations []Usage // Cutting of each operation, same order as Operations()
+}
+
+// Breaks down the estimated time and distance by rapid, cutting, dwell and tool changes,
+// for the entire job and per tool, and the cutting time and distance per operation. Tool changes
+// take the time given by the profile.
+func (vm *Machine) TimeBreakdown(profile machine.Profile) TimeReport {
+	var (
+		toolchange = time.Duration(profile.Toolchange.Time * float64(time.Second))
+		times      = vm.MoveTimes(profile)
+		ops        = vm.Operations()
+		opIdx      = 0
+	)
+
+	report := TimeReport{
+		Tools:      make(map[int]Breakdown),
+		Operations: make([]Usage, len(ops)),
+	}
+
+	vm.eachPair(func(idx int, from, to Segment) {
+		tool := report.Tools[to.State.Tool]
+
+		if to.State.Tool != from.State.Tool {
+			report.Toolchange.add(toolchange, 0)
+			tool.Toolchange.add(toolchange, 0)
+		}
+
+		if to.Kind == SegmentDwell {
+			report.Dwell.add(times[idx], 0)
+			tool.Dwell.add(times[idx], 0)
+		} else if to.State.MoveMode != MoveModeNone {
+			dist := to.MachineVector().Diff(from.MachineVector()).Norm()
+			if to.State.MoveMode == MoveModeRapid {
+				report.Rapid.add(times[idx], dist)
+				tool.Rapid.add(times[idx], dist)
+			} else {
+				report.Cutting.add(times[idx], dist)
+				tool.Cutting.add(times[idx], dist)
+
+				for opIdx < len(ops) && ops[opIdx].End <= idx {
+					opIdx++
+				}
+				if opIdx < len(ops) && ops[opIdx].Contains(idx) {
+					report.Operations[opIdx].add(times[idx], dist)
+				}
+			}
+		}
+
+		report.Tools[to.State.Tool] = tool
+	})
+
+	return report
+}
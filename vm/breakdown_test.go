@@ -0,0 +1,33 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "math"
+import "testing"
+import "time"
+
+func TestOperationBreakdown(t *testing.T) {
+	m, err := processProgram("G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F60\nX10\nY10\nG0 Z5\nX20\nG1 Z-1\nX30\nG0 Z5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := m.TimeBreakdown(machine.Default())
+	distances := []float64{26, 16}
+	if len(report.Operations) != len(distances) {
+		t.Fatalf("%d operations, expected %d", len(report.Operations), len(distances))
+	}
+
+	var total time.Duration
+	for idx, op := range report.Operations {
+		if math.Abs(op.Distance-distances[idx]) > 1e-9 {
+			t.Errorf("Operation %d: cuts %g mm, expected %g mm", idx, op.Distance, distances[idx])
+		}
+		if op.Time <= 0 {
+			t.Errorf("Operation %d: takes %s", idx, op.Time)
+		}
+		total += op.Time
+	}
+	if total != report.Cutting.Time {
+		t.Errorf("Operations take %s, while cutting takes %s", total, report.Cutting.Time)
+	}
+}
@@ -0,0 +1,62 @@
+package vm
+
+//
+// Callbacks
+//
+// Callbacks are fired while processing, as segments are added, so analyzers
+// can follow the program without walking the segments afterwards. Segments
+// passed to callbacks include the line that produced them. Callbacks must not
+// modify the machine.
+//
+
+type callbacks struct {
+	toolChange    []func(from, to Segment)
+	spindleChange []func(from, to Segment)
+	feedChange    []func(from, to Segment)
+	motion        []func(from, to Segment)
+}
+
+// Registers a callback fired when the tool changes
+func (vm *Machine) OnToolChange(fn func(from, to Segment)) {
+	vm.callbacks.toolChange = append(vm.callbacks.toolChange, fn)
+}
+
+// Registers a callback fired when the spindle is enabled, disabled, reversed or changes speed
+func (vm *Machine) OnSpindleChange(fn func(from, to Segment)) {
+	vm.callbacks.spindleChange = append(vm.callbacks.spindleChange, fn)
+}
+
+// Registers a callback fired when the feedrate or feed mode changes
+func (vm *Machine) OnFeedChange(fn func(from, to Segment)) {
+	vm.callbacks.feedChange = append(vm.callbacks.feedChange, fn)
+}
+
+// Registers a callback fired for every move
+func (vm *Machine) OnMotion(fn func(from, to Segment)) {
+	vm.callbacks.motion = append(vm.callbacks.motion, fn)
+}
+
+// Fires the callbacks for the transition between two segments
+func (vm *Machine) fire(from, to Segment) {
+	call := func(fns []func(from, to Segment)) {
+		for _, fn := range fns {
+			fn(from, to)
+		}
+	}
+
+	a, b := from.State, to.State
+	if a != b {
+		if a.Tool != b.Tool {
+			call(vm.callbacks.toolChange)
+		}
+		if a.SpindleEnabled != b.SpindleEnabled || a.SpindleClockwise != b.SpindleClockwise || a.SpindleSpeed != b.SpindleSpeed {
+			call(vm.callbacks.spindleChange)
+		}
+		if a.Feedrate != b.Feedrate || a.FeedMode != b.FeedMode {
+			call(vm.callbacks.feedChange)
+		}
+	}
+	if b.MoveMode != MoveModeNone && to.Kind != SegmentDwell {
+		call(vm.callbacks.motion)
+	}
+}
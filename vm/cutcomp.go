@@ -0,0 +1,247 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/warnings"
+import "math"
+
+//
+// Cutter compensation
+//
+// By default, G40, G41 and G42 are passed on to the machine as the
+// CutterCompensation state. With CompensateCutter, the vm offsets the path
+// itself instead, so controllers without cutter compensation, such as Grbl,
+// can run compensated programs:
+//
+//   G41 - offset to the left of the direction of travel
+//   G42 - offset to the right of the direction of travel
+//
+// G41 and G42 use the diameter of tool D from the tool table, or of the
+// current tool without D. G41.1 and G42.1 take the diameter as D.
+//
+// The moves of a compensated path are kept until G40, and then replaced:
+//
+//   the first move in the XY plane is the entry move, from the uncompensated
+//   position to the offset start of the next move
+//   inside corners are trimmed to where the offset moves meet
+//   outside corners are extended to where the offset moves meet if the
+//   corner is less than 90 degrees and the extension is within
+//   MaxArcDeviation, and rounded with lines around the corner otherwise
+//   the move after G40 is the exit move, from the offset position
+//
+// Offset moves that would run backwards, which happens where the tool does
+// not fit an inside corner or arc, are reported as gouges. Only the XY plane
+// is supported, and moves in Z keep the offset of the position they start
+// from. Callbacks see the programmed moves.
+//
+
+// Active cutter compensation
+type cutComp struct {
+	side   float64 // 1 for left (G41), -1 for right (G42), 0 if off
+	radius float64 // mm
+	start  int     // Index in Segments of the position compensation started from
+}
+
+// Handles G40, G41, G42, G41.1 and G42.1
+func (vm *Machine) cutterCompensation(stmt gcode.Block, g float64) {
+	if !vm.CompensateCutter {
+		switch g {
+		case 40:
+			vm.State.CutterCompensation = CutCompModeNone
+		case 41:
+			vm.State.CutterCompensation = CutCompModeOuter
+		case 42:
+			vm.State.CutterCompensation = CutCompModeInner
+		default:
+			panic(Errorf(ErrUnsupportedWord, "G%g requires cutter compensation by the vm", g))
+		}
+		return
+	}
+
+	vm.endCompensation()
+	if g == 40 {
+		return
+	}
+	if vm.MovePlane != PlaneXY {
+		panic(Errorf(ErrInvalidCompensation, "Cutter compensation is only supported in the XY plane"))
+	}
+
+	var diameter float64
+	if g == 41.1 || g == 42.1 {
+		d, err := stmt.GetWord('D')
+		if err != nil {
+			panic(Errorf(ErrInvalidCompensation, "G%g requires D", g))
+		}
+		diameter = vm.length(d).Millimeters()
+	} else {
+		number := int(stmt.GetWordDefault('D', float64(vm.State.Tool)))
+		tool, ok := vm.Tools.Get(number)
+		if !ok {
+			panic(Errorf(ErrInvalidCompensation, "Tool %d for cutter compensation is not in the tool table", number))
+		}
+		diameter = tool.Diameter
+	}
+	if diameter < 0 {
+		panic(Errorf(ErrInvalidCompensation, "Cutter compensation diameter must be non-negative"))
+	}
+
+	side := 1.0
+	if g == 42 || g == 42.1 {
+		side = -1
+	}
+	if vm.scaling.mirrored() {
+		// The path is offset after mirroring, see scaling.go
+		side = -side
+	}
+	vm.comp = cutComp{side, diameter / 2, len(vm.Segments) - 1}
+}
+
+// Replaces the moves since compensation started with the offset path, if active
+func (vm *Machine) endCompensation() {
+	c := vm.comp
+	vm.comp = cutComp{}
+	if c.side == 0 || c.radius == 0 {
+		return
+	}
+	vm.offsetPath(c.start, c.side*c.radius)
+}
+
+// Offsets the moves after the segment at start by o, to the left if positive
+func (vm *Machine) offsetPath(start int, o float64) {
+	var (
+		segs  = vm.Segments[start:]
+		out   []Segment
+		index = make([]int, len(segs)+1) // New index of every old segment
+		cur   = segs[0].Vector()
+		entry = true
+	)
+	for k := 1; k < len(segs); k++ {
+		seg := segs[k]
+		d, ok := direction(segs[k-1], seg)
+		if !ok {
+			if !seg.Machine {
+				seg.X, seg.Y = cur.X, cur.Y
+			}
+			out = append(out, seg)
+			index[k] = len(out)
+			continue
+		}
+
+		// Direction of the next move in the XY plane, if any
+		var next vector.Vector
+		found := false
+		for n := k + 1; n < len(segs) && !found; n++ {
+			next, found = direction(segs[n-1], segs[n])
+		}
+
+		var (
+			q      = seg.Vector()
+			points []vector.Vector
+		)
+		switch {
+		case !found:
+			points = []vector.Vector{q.Sum(normal(d).Scale(o))}
+		case entry:
+			points = []vector.Vector{q.Sum(normal(next).Scale(o))}
+		default:
+			var ok bool
+			if points, ok = vm.corner(q, d, next, o); !ok {
+				panic(Errorf(ErrInvalidCompensation, "Cutter compensation gouges the path at line %d, the tool does not fit the corner", seg.Line))
+			}
+		}
+
+		if !entry && points[0].Diff(cur).Dot(d) < -1e-9 {
+			panic(Errorf(ErrInvalidCompensation, "Cutter compensation gouges the path at line %d, the tool is too large", seg.Line))
+		}
+		entry = false
+
+		for _, p := range points {
+			s := seg
+			s.X, s.Y = p.X, p.Y
+			out = append(out, s)
+		}
+		cur = points[len(points)-1]
+		index[k] = len(out)
+	}
+
+	// Arc indexes after the start move with the segments
+	base := vm.offset() + start
+	for idx := range vm.Arcs {
+		a := &vm.Arcs[idx]
+		if a.Start > base {
+			a.Start = base + index[a.Start-base-1] + 1
+			a.End = base + index[a.End-base-1] + 1
+		}
+	}
+
+	vm.Segments = append(vm.Segments[:start+1], out...)
+}
+
+// The end points of the offset move to q, turning from direction d1 to d2 at
+// q, or false for an inside corner turning nearly all the way back, where the
+// offset moves meet arbitrarily far away
+func (vm *Machine) corner(q, d1, d2 vector.Vector, o float64) ([]vector.Vector, bool) {
+	var (
+		n1    = normal(d1)
+		n2    = normal(d2)
+		cross = d1.X*d2.Y - d1.Y*d2.X
+		dot   = d1.Dot(d2)
+		r     = math.Abs(o)
+		angle = math.Atan2(math.Abs(cross), dot)
+		b1    = q.Sum(n1.Scale(o))
+	)
+	switch {
+	case math.Abs(cross) < 1e-9 && dot > 0:
+		// Straight on
+		return []vector.Vector{b1}, true
+	case cross*o > 0 && 1+dot < 1e-6:
+		return nil, false
+	case cross*o > 0 || angle < math.Pi/2 && r/math.Cos(angle/2)-r <= vm.MaxArcDeviation:
+		// Inside corner, or outside corner extended to where the offset moves meet
+		return []vector.Vector{q.Sum(n1.Sum(n2).Scale(o / (1 + dot)))}, true
+	}
+
+	// Outside corner, rounded around q
+	var (
+		phi   = -math.Copysign(angle, o)
+		cos   = math.Max(1-vm.MaxArcDeviation/r, -1)
+		steps = int(math.Max(1, math.Ceil(angle/(2*math.Acos(cos)))))
+		v     = n1.Scale(o)
+		res   = []vector.Vector{b1}
+	)
+	for i := 1; i <= steps; i++ {
+		a := phi * float64(i) / float64(steps)
+		res = append(res, vector.Vector{
+			q.X + v.X*math.Cos(a) - v.Y*math.Sin(a),
+			q.Y + v.X*math.Sin(a) + v.Y*math.Cos(a),
+			q.Z,
+		})
+	}
+	return res, true
+}
+
+// The unit direction of a move in the XY plane, false if it does not move in the plane
+func direction(from, to Segment) (vector.Vector, bool) {
+	if to.Kind != SegmentMove || to.Machine || to.State.MoveMode == MoveModeNone {
+		return vector.Vector{}, false
+	}
+	d := vector.Vector{to.X - from.X, to.Y - from.Y, 0}
+	l := math.Hypot(d.X, d.Y)
+	if l < 1e-9 {
+		return vector.Vector{}, false
+	}
+	return d.Scale(1 / l), true
+}
+
+// The normal to the left of a direction in the XY plane
+func normal(d vector.Vector) vector.Vector {
+	return vector.Vector{-d.Y, d.X, 0}
+}
+
+// Ends compensation still active at the end of the program
+func (vm *Machine) finishCompensation() {
+	if vm.comp.side != 0 {
+		vm.warn(warnings.SeverityWarning, "Cutter compensation not cancelled with G40")
+		vm.endCompensation()
+	}
+}
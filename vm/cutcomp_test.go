@@ -0,0 +1,89 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "math"
+import "strings"
+import "testing"
+
+// Runs the program through a vm with the options
+func processProgram(program string, opts ...Option) (*Machine, error) {
+	doc, err := gcode.Parse(program)
+	if err != nil {
+		return nil, err
+	}
+	m := New(opts...)
+	return m, m.Process(doc)
+}
+
+// Tests if a point in the XY plane is among the segments
+func hasPoint(m *Machine, x, y float64) bool {
+	for _, seg := range m.Segments {
+		if math.Abs(seg.X-x) < 1e-6 && math.Abs(seg.Y-y) < 1e-6 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCutterCompensation(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		points  [][2]float64 // Expected among the segments
+		err     string       // Expected in the error, if failing
+	}{
+		{
+			"inside corners",
+			"G21 G90 G0 X0 Y-5 Z0\nG41.1 D2\nG1 X0 Y0 F100\nX10\nY10\nX0\nY0\nG40\nG0 X0 Y-5\n",
+			[][2]float64{{9, 1}, {9, 9}, {1, 9}},
+			"",
+		},
+		{
+			"outside corners",
+			"G21 G90 G0 X0 Y-5 Z0\nG42.1 D2\nG1 X0 Y0 F100\nX10\nY10\nX0\nY0\nG40\nG0 X0 Y-5\n",
+			[][2]float64{{10, -1}, {11, 0}, {11, 10}, {10, 11}},
+			"",
+		},
+		{
+			"reversing inside corner",
+			"G21 G90 G0 X0 Y-5 Z0\nG41.1 D2\nG1 X0 Y0 F100\nX10\nX0 Y0.00001\nY5\nG40\nG0 X0 Y-5\n",
+			nil,
+			"gouges",
+		},
+		{
+			"reversed inside corner",
+			"G21 G90 G0 X0 Y-5 Z0\nG41.1 D2\nG1 X0 Y0 F100\nX10\nX0 Y0.000000002\nY5\nG40\nG0 X0 Y-5\n",
+			nil,
+			"gouges",
+		},
+		{
+			"tool too large",
+			"G21 G90 G0 X0 Y-5 Z0\nG41.1 D20\nG1 X0 Y0 F100\nX10\nY1\nX0\nG40\nG0 X0 Y-5\n",
+			nil,
+			"gouges",
+		},
+	}
+	for _, test := range tests {
+		m, err := processProgram(test.program, WithCutterCompensation())
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, expected %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		for _, seg := range m.Segments {
+			if math.IsNaN(seg.X) || math.IsNaN(seg.Y) || math.IsInf(seg.X, 0) || math.IsInf(seg.Y, 0) {
+				t.Errorf("%s: invalid point X%g Y%g", test.name, seg.X, seg.Y)
+			}
+		}
+		for _, p := range test.points {
+			if !hasPoint(m, p[0], p[1]) {
+				t.Errorf("%s: no point at X%g Y%g", test.name, p[0], p[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/warnings"
+import "math"
+
+//
+// Canned cycles
+//
+// Drilling cycles are expanded into plain moves. A cycle is a motion mode,
+// so every following block with axis words repeats it at the new position,
+// until it is cancelled by G80 or another motion mode. R, Z, Q and P are
+// kept between the blocks of a cycle. For every hole (repeated L times):
+//
+//   rapid to R, if below it
+//   rapid to X and Y
+//   rapid to R
+//   the cycle, from R to Z
+//   retract, to R with G99, or to the higher of R and the Z at which the
+//   cycle mode was entered with G98
+//
+// The cycles:
+//
+//   G73 - peck drilling, with short retractions to break chips
+//   G81 - drilling
+//   G82 - drilling, dwelling P seconds at the bottom
+//   G83 - peck drilling, with retractions to R to clear chips
+//   G84 - tapping, reversing the spindle at the bottom
+//   G85 - boring, retracting at feed rate
+//   G86 - boring, stopping the spindle at the bottom
+//   G88 - boring, dwelling and stopping the spindle at the bottom
+//   G89 - boring, dwelling at the bottom and retracting at feed rate
+//
+// With G91, R is relative to the Z at the start of the block, Z is relative
+// to R, and every repetition moves by X and Y. Only the XY plane is supported.
+//
+
+const (
+	peckClearance = 0.254   // Distance kept by G73 retractions and G83 re-entries (0.010")
+	maxCycleMoves = 1000000 // Per block, to fail on runaway repetitions and pecks
+)
+
+// Canned cycle state
+type cycle struct {
+	code       float64 // Active cycle, 0 if none
+	retractR   bool    // G99 instead of G98
+	startZ     float64 // Z when the cycle mode was entered
+	r, z, q, p float64 // Words kept between blocks, in millimeters and seconds
+	hasR, hasZ bool
+	moves      int // Moves and dwells added by the current block
+}
+
+// Selects a canned cycle as motion mode
+func (vm *Machine) startCycle(g float64) {
+	if vm.cycle.code == 0 {
+		vm.cycle.startZ = vm.programPos().Z
+	}
+	vm.cycle.code = g
+}
+
+// Runs the active canned cycle for a block
+func (vm *Machine) cannedCycle(stmt gcode.Block) {
+	c := &vm.cycle
+	if vm.MovePlane != PlaneXY {
+		panic(Errorf(ErrUnsupportedWord, "Canned cycles are only supported in the XY plane"))
+	}
+	if vm.State.FeedMode == FeedModeInvTime {
+		panic(Errorf(ErrInvalidWord, "Canned cycles cannot be used in inverse time feed mode (G93)"))
+	}
+
+	if r, err := stmt.GetWord('R'); err == nil {
+		c.r, c.hasR = vm.length(r).Millimeters(), true
+	}
+	if z, err := stmt.GetWord('Z'); err == nil {
+		c.z, c.hasZ = vm.length(z).Millimeters(), true
+	}
+	if q, err := stmt.GetWord('Q'); err == nil {
+		if q <= 0 {
+			panic(Errorf(ErrInvalidWord, "Peck depth (Q) must be positive"))
+		}
+		c.q = vm.length(q).Millimeters()
+	}
+	if p, err := stmt.GetWord('P'); err == nil {
+		if p < 0 {
+			panic(Errorf(ErrInvalidWord, "Dwell time must be non-negative"))
+		}
+		c.p = p
+	}
+	if !c.hasR || !c.hasZ {
+		panic(Errorf(ErrUnsupportedWord, "G%g requires R and Z", c.code))
+	}
+	if (c.code == 73 || c.code == 83) && c.q == 0 {
+		panic(Errorf(ErrUnsupportedWord, "G%g requires Q", c.code))
+	}
+	l := stmt.GetWordDefault('L', 1)
+	if l < 1 || l != math.Trunc(l) {
+		panic(Errorf(ErrInvalidWord, "Repetitions (L) must be a positive integer"))
+	}
+	if l > maxCycleMoves {
+		panic(Errorf(ErrInvalidWord, "Repetitions (L) must be at most %d", maxCycleMoves))
+	}
+	c.moves = 0
+
+	if vm.scaling.Factors.Z < 0 {
+		panic(Errorf(ErrUnsupportedWord, "Canned cycles cannot be mirrored in Z"))
+	}
+
+	// Holes are placed in program coordinates, see positioning.go
+	var (
+		pos       = vm.programPos()
+		r, bottom = c.r, c.z
+		x, y      = pos.X, pos.Y
+		dx, dy    float64
+		xw, xerr  = stmt.GetWord('X')
+		yw, yerr  = stmt.GetWord('Y')
+	)
+	if vm.AbsoluteMove {
+		if xerr == nil {
+			x = vm.xLength(xw)
+		}
+		if yerr == nil {
+			y = vm.length(yw).Millimeters()
+		}
+	} else {
+		r = pos.Z + c.r
+		bottom = r + c.z
+		if xerr == nil {
+			dx = vm.xLength(xw)
+		}
+		if yerr == nil {
+			dy = vm.length(yw).Millimeters()
+		}
+	}
+	if bottom > r {
+		panic(Errorf(ErrUnsupportedWord, "Canned cycle bottom (Z) above R"))
+	}
+	clear := r
+	if !c.retractR && c.startZ > r {
+		clear = c.startZ
+	}
+
+	_, _, zr := vm.toWork(x, y, r)
+	_, _, zBottom := vm.toWork(x, y, bottom)
+	_, _, zClear := vm.toWork(x, y, clear)
+
+	if pos.Z < r {
+		work := vm.workPos()
+		vm.cycleMove(MoveModeRapid, work.X, work.Y, zr)
+	}
+	for n := 0; n < int(l); n++ {
+		x, y = x+dx, y+dy
+		hx, hy, _ := vm.toWork(x, y, 0)
+		vm.cycleMove(MoveModeRapid, hx, hy, vm.workPos().Z)
+		vm.cycleMove(MoveModeRapid, hx, hy, zr)
+		vm.cycleBody(hx, hy, zr, zBottom, zClear)
+	}
+}
+
+// Moves from R to the bottom of a hole and back out for the active cycle
+func (vm *Machine) cycleBody(x, y, r, bottom, clear float64) {
+	c := &vm.cycle
+	switch c.code {
+	case 73:
+		for depth := r; depth > bottom; {
+			depth = c.peck(depth, bottom)
+			vm.cycleMove(MoveModeLinear, x, y, depth)
+			if depth > bottom {
+				vm.cycleMove(MoveModeRapid, x, y, depth+peckClearance)
+			}
+		}
+	case 81:
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+	case 82:
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+		vm.cycleDwell(x, y, bottom)
+	case 83:
+		for depth := r; depth > bottom; {
+			if depth < r {
+				vm.cycleMove(MoveModeRapid, x, y, depth+peckClearance)
+			}
+			depth = c.peck(depth, bottom)
+			vm.cycleMove(MoveModeLinear, x, y, depth)
+			if depth > bottom {
+				vm.cycleMove(MoveModeRapid, x, y, r)
+			}
+		}
+	case 84:
+		if !vm.State.SpindleEnabled {
+			panic(Errorf(ErrUnsupportedWord, "G84 requires the spindle to be running"))
+		}
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+		vm.State.SpindleClockwise = !vm.State.SpindleClockwise
+		vm.cycleMove(MoveModeLinear, x, y, r)
+		vm.State.SpindleClockwise = !vm.State.SpindleClockwise
+	case 85:
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+		vm.cycleMove(MoveModeLinear, x, y, r)
+	case 86, 88:
+		enabled := vm.State.SpindleEnabled
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+		if c.code == 88 {
+			vm.cycleDwell(x, y, bottom)
+			vm.warn(warnings.SeverityWarning, "G88 manual retraction replaced by a rapid retraction")
+		}
+		vm.State.SpindleEnabled = false
+		vm.cycleMove(MoveModeRapid, x, y, clear)
+		vm.State.SpindleEnabled = enabled
+	case 89:
+		vm.cycleMove(MoveModeLinear, x, y, bottom)
+		vm.cycleDwell(x, y, bottom)
+		vm.cycleMove(MoveModeLinear, x, y, r)
+	}
+	vm.cycleMove(MoveModeRapid, x, y, clear)
+}
+
+// The depth of the next peck from depth, failing if Q is too small to advance
+func (c *cycle) peck(depth, bottom float64) float64 {
+	next := math.Max(depth-c.q, bottom)
+	if next >= depth {
+		panic(Errorf(ErrInvalidWord, "Peck depth (Q) of %gmm does not advance from Z%g", c.q, depth))
+	}
+	return next
+}
+
+// Counts a move or dwell of the current block, failing if there are too many
+func (c *cycle) count() {
+	c.moves++
+	if c.moves > maxCycleMoves {
+		panic(Errorf(ErrInvalidWord, "Canned cycle exceeded %d moves in one block", maxCycleMoves))
+	}
+}
+
+// Adds a move of a cycle, unless already there
+func (vm *Machine) cycleMove(mode int, x, y, z float64) {
+	if pos := vm.workPos(); pos.X == x && pos.Y == y && pos.Z == z {
+		return
+	}
+	vm.cycle.count()
+	vm.State.MoveMode = mode
+	vm.addPos(x, y, z)
+}
+
+// Adds the dwell of a cycle, if any
+func (vm *Machine) cycleDwell(x, y, z float64) {
+	if vm.cycle.p > 0 {
+		vm.cycle.count()
+		vm.add(Segment{Kind: SegmentDwell, X: x, Y: y, Z: z, Param: vm.cycle.p})
+	}
+}
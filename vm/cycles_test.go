@@ -0,0 +1,73 @@
+package vm
+
+import "errors"
+import "testing"
+
+// The Z of the moves of a program after the first line
+func cycleDepths(m *Machine) []float64 {
+	var res []float64
+	for _, seg := range m.Segments[1:] {
+		if seg.Kind == SegmentMove && seg.Line > 1 {
+			res = append(res, seg.Z)
+		}
+	}
+	return res
+}
+
+func TestCycles(t *testing.T) {
+	const setup = "G21 G90 G0 X0 Y0 Z10 F100 M3 S1000\n"
+	tests := []struct {
+		name    string
+		program string
+		depths  []float64
+	}{
+		{"G81", "G81 X1 Y1 Z-3 R1\n", []float64{10, 1, -3, 10}},
+		{"G81 G99", "G99 G81 X1 Y1 Z-3 R1\n", []float64{10, 1, -3, 1}},
+		{"G73", "G73 X1 Y1 Z-3 R1 Q2\n", []float64{10, 1, -1, -1 + peckClearance, -3, 10}},
+		{"G83", "G83 X1 Y1 Z-3 R1 Q2\n", []float64{10, 1, -1, 1, -1 + peckClearance, -3, 10}},
+		{"repeated", "G91 G81 X1 Z-4 R-9 L2\n", []float64{10, 1, -3, 10, 10, 1, -3, 10}},
+	}
+	for _, test := range tests {
+		m, err := processProgram(setup + test.program)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		depths := cycleDepths(m)
+		if len(depths) != len(test.depths) {
+			t.Errorf("%s: got depths %v, expected %v", test.name, depths, test.depths)
+			continue
+		}
+		for idx := range depths {
+			if depths[idx] != test.depths[idx] {
+				t.Errorf("%s: got depths %v, expected %v", test.name, depths, test.depths)
+				break
+			}
+		}
+	}
+}
+
+func TestCycleErrors(t *testing.T) {
+	const setup = "G21 G90 G0 X0 Y0 Z10 F100\n"
+	tests := []struct {
+		name    string
+		program string
+	}{
+		{"no R", "G81 X1 Y1 Z-3\n"},
+		{"bottom above R", "G81 X1 Y1 Z3 R1\n"},
+		{"no Q", "G83 X1 Y1 Z-3 R1\n"},
+		{"negative Q", "G83 X1 Y1 Z-3 R1 Q-1\n"},
+		{"non-advancing G83 peck", "G83 X1 Y1 Z-3 R1 Q0.00000000000000000001\n"},
+		{"non-advancing G73 peck", "G73 X1 Y1 Z-3 R1 Q0.00000000000000000001\n"},
+		{"too many pecks", "G83 X1 Y1 Z-3 R1 Q0.000001\n"},
+		{"fractional L", "G81 X1 Y1 Z-3 R1 L1.5\n"},
+		{"too many repetitions", "G81 X1 Y1 Z-3 R1 L1000000000\n"},
+		{"too many moves", "G91 G81 X1 Z-4 R-9 L500000\n"},
+	}
+	for _, test := range tests {
+		_, err := processProgram(setup + test.program)
+		if !errors.Is(err, ErrInvalidWord) && !errors.Is(err, ErrUnsupportedWord) {
+			t.Errorf("%s: got %v, expected an invalid or unsupported word", test.name, err)
+		}
+	}
+}
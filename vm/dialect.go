@@ -0,0 +1,102 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/warnings"
+import "strings"
+
+//
+// Dialects
+//
+// Controllers differ in which codes they accept and how they interpret them.
+// The dialect decides how a program is parsed and interpreted, so programs
+// written for other controllers can be converted correctly.
+//
+// Marlin and RepRap firmwares run one command per block, and have codes for
+// heaters, fans and the like, which do not affect the toolpath. The Marlin
+// dialect passes these on verbatim as passthrough segments, for exporters
+// targeting the same firmwares. G4 P is in milliseconds (see events.go).
+//
+
+// Constants for gcode dialects
+const (
+	DialectRS274NGC = iota // LinuxCNC and most other controllers
+	DialectMach     = iota // Mach3 and Mach4
+	DialectMarlin   = iota // Marlin and RepRap firmwares
+)
+
+// M-codes passed through by the Marlin dialect: heaters, fans, motors, beeps
+// and waits
+var marlinPassthrough = map[float64]bool{
+	17: true, 18: true, 84: true, // Motors
+	104: true, 109: true, 140: true, 190: true, // Heaters
+	106: true, 107: true, // Fans
+	300: true, 400: true, // Beep, wait for moves
+}
+
+// Returns the parser options for the dialect
+func DialectOptions(dialect int) gcode.Options {
+	switch dialect {
+	case DialectMach:
+		return gcode.Options{UnterminatedComments: true}
+	default:
+		return gcode.Options{}
+	}
+}
+
+// Adds a passthrough segment for blocks the dialect passes on verbatim,
+// returning false for other blocks
+func (vm *Machine) handleDialectBlock(stmt gcode.Block) bool {
+	if vm.Dialect != DialectMarlin {
+		return false
+	}
+	m, err := stmt.GetWord('M')
+	if err != nil || !marlinPassthrough[m] {
+		return false
+	}
+
+	var text []string
+	for _, n := range stmt.Nodes {
+		if w, ok := n.(*gcode.Word); ok {
+			text = append(text, w.Export(-1))
+		}
+	}
+	pos := vm.workPos()
+	vm.add(Segment{Kind: SegmentPassthrough, X: pos.X, Y: pos.Y, Z: pos.Z, Text: strings.Join(text, " ")})
+	return true
+}
+
+// Handles dialect-specific G-codes, returning false if unknown
+func (vm *Machine) handleDialectG(g float64) bool {
+	if vm.Dialect != DialectMach {
+		return false
+	}
+
+	// Mach posts emit these in program headers to reset the modal state. They are
+	// all either defaults, or things that do not affect the toolpath as seen by the vm.
+	switch g {
+	case 15:
+		// Polar coordinates off
+	case 61:
+		// Exact stop mode, like G64 this only affects blending
+	default:
+		return false
+	}
+	vm.warn(warnings.SeverityInfo, "G%g ignored by the Mach dialect", g)
+	return true
+}
+
+// Handles dialect-specific M-codes, returning false if unknown
+func (vm *Machine) handleDialectM(m float64) bool {
+	if vm.Dialect != DialectMach {
+		return false
+	}
+
+	switch m {
+	case 10, 11:
+		// Digital outputs (often used for laser/clamps), no effect on the toolpath
+	default:
+		return false
+	}
+	vm.warn(warnings.SeverityInfo, "M%g ignored by the Mach dialect", m)
+	return true
+}
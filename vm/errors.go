@@ -0,0 +1,102 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "errors"
+import "fmt"
+import "strings"
+
+//
+// Errors
+//
+// Failures are reported with a descriptive message wrapping one of the
+// sentinel errors below, so callers can test the class of a failure with
+// errors.Is, also after it has been recovered from a panic.
+//
+// Panics never leave Process, ProcessContext or ProcessReader. Failures of a
+// block are returned as a *BlockError, holding the line and text of the block,
+// and the text of the line as read:
+//
+//   var be *vm.BlockError
+//   if errors.As(err, &be) {
+//       fmt.Printf("%d: %s: %s\n", be.Line, be.Block, be.Err)
+//   }
+//   if errors.Is(err, vm.ErrInvalidArc) {
+//       ...
+//   }
+//
+
+var (
+	ErrInvalidWord         = errors.New("Invalid word")
+	ErrInvalidMove         = errors.New("Invalid move")
+	ErrInvalidArc          = errors.New("Invalid arc")
+	ErrRadiusMismatch      = errors.New("Arc radius mismatch")
+	ErrUnsupportedWord     = errors.New("Unsupported word")
+	ErrLimitExceeded       = errors.New("Machine limit exceeded")
+	ErrMissingFeedrate     = errors.New("Missing feedrate")
+	ErrInvalidExpression   = errors.New("Invalid expression")
+	ErrFlowControl         = errors.New("Invalid flow control")
+	ErrInvalidCompensation = errors.New("Invalid cutter compensation")
+)
+
+// An error of a sentinel class with a descriptive message
+type classError struct {
+	class error
+	msg   string
+}
+
+func (e *classError) Error() string {
+	return e.msg
+}
+
+func (e *classError) Unwrap() error {
+	return e.class
+}
+
+// Creates an error of the given class, formatting the message like fmt.Sprintf
+func Errorf(class error, format string, args ...interface{}) error {
+	return &classError{class, fmt.Sprintf(format, args...)}
+}
+
+// Recovers a panic as an error, setting *err to it. Must be deferred directly,
+// as recover only stops panics there:
+//
+//	defer vm.Recover(&err)
+func Recover(err *error) {
+	if r := recover(); r != nil {
+		*err = recovered(r)
+	}
+}
+
+// Converts a recovered value into an error
+func recovered(r interface{}) error {
+	if err, ok := r.(error); ok {
+		return err
+	}
+	return errors.New(fmt.Sprintf("%s", r))
+}
+
+// An error while running a block
+type BlockError struct {
+	Line   int    // Line of the block, starting at 1
+	Block  string // Text of the block, with expressions as written
+	Source string // Text of the line, including comments
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("line %d (%s): %s", e.Line, e.Block, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// Creates a block error, converting a recovered panic into an error
+func blockError(line int, b gcode.Block, r interface{}) error {
+	err := recovered(r)
+	words := make([]string, len(b.Nodes))
+	for idx, n := range b.Nodes {
+		words[idx] = n.Export(-1)
+	}
+	return &BlockError{line, strings.Join(words, " "), b.Source, err}
+}
@@ -0,0 +1,124 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+
+//
+// Dwell, probing, rotary axes and pauses
+//
+// These produce their own segment kinds instead of moves, so that exporters
+// supporting them can pass them on, while the rest can skip or refuse them.
+//
+// Program pauses (M0), optional pauses (M1), which the operator may have
+// the controller skip, and pallet changes (M60) stop the program until it is
+// resumed. They happen after the moves of their block, and are kept as pause
+// segments with the M-code, so that senders can wait for the operator.
+//
+// Blocks moving only rotary axes produce a rotation per axis. Blocks moving
+// rotary axes together with X, Y and Z produce a single linear or rapid move,
+// with the angles at its end in A, B and C. Every segment carries the angles
+// of the rotary axes, so exporters see them as part of the position.
+//
+// The kinematics of the machine are not known, so rotations are not part of
+// time estimates, limit checks or previews, which only see X, Y and Z.
+//
+
+// The dwell time of a G4 block in seconds, from P, or from S without P, as
+// written by some CAM posts and firmwares. P is in milliseconds in the Marlin
+// dialect. S in a dwell without P is not a spindle speed.
+func (vm *Machine) dwellTime(stmt gcode.Block) (float64, error) {
+	if !stmt.IncludesOneOf('P') {
+		return stmt.GetWord('S')
+	}
+	p, err := stmt.GetWord('P')
+	if vm.Dialect == DialectMarlin {
+		p /= 1000
+	}
+	return p, err
+}
+
+// Adds a dwell at the current position (G4)
+func (vm *Machine) dwell(stmt gcode.Block) {
+	p, err := vm.dwellTime(stmt)
+	if err != nil {
+		panic(Errorf(ErrInvalidWord, "Dwell requires a single P or S word"))
+	}
+	if p < 0 {
+		panic(Errorf(ErrInvalidWord, "Dwell time must be greater than or equal to zero"))
+	}
+	pos := vm.workPos()
+	vm.add(Segment{Kind: SegmentDwell, X: pos.X, Y: pos.Y, Z: pos.Z, Param: p})
+}
+
+// Finds the pause M-code (0, 1 or 60) of the block, or -1 if there is none
+func pauseCode(stmt gcode.Block) int {
+	for _, m := range stmt.GetAllWords('M') {
+		switch m {
+		case 0, 1, 60:
+			return int(m)
+		}
+	}
+	return -1
+}
+
+// Adds a program pause at the current position (M0, M1 or M60)
+func (vm *Machine) pause(code int) {
+	pos := vm.workPos()
+	vm.add(Segment{Kind: SegmentPause, X: pos.X, Y: pos.Y, Z: pos.Z, Param: float64(code)})
+}
+
+// Finds the probe code (38.2 to 38.5) of the block, or 0 if there is none
+func probeCode(stmt gcode.Block) float64 {
+	for _, g := range stmt.GetAllWords('G') {
+		switch g {
+		case 38.2, 38.3, 38.4, 38.5:
+			return g
+		}
+	}
+	return 0
+}
+
+// Adds a probing move towards the position of the statement. Where the probe
+// stops is only known when run, so the probe is assumed to reach the position.
+// The move mode is left unchanged.
+func (vm *Machine) probe(stmt gcode.Block, code float64) {
+	if !stmt.IncludesOneOf('X', 'Y', 'Z') {
+		panic(Errorf(ErrInvalidMove, "Probe attempted without a position"))
+	}
+	if stmt.IncludesOneOf('A', 'B', 'C') {
+		panic(Errorf(ErrUnsupportedWord, "Probing with rotary axes is not supported"))
+	}
+
+	x, y, z, _, _, _ := vm.calcPos(stmt)
+	x, y, z = vm.toWork(x, y, z)
+	mode := vm.State.MoveMode
+	vm.State.MoveMode = MoveModeLinear // Probing moves at the feedrate
+	vm.add(Segment{Kind: SegmentProbe, X: x, Y: y, Z: z, Param: code})
+	vm.State.MoveMode = mode
+}
+
+// Adds rotations of the A, B and C axes, in that order, or a move rotating
+// them if the block also moves X, Y or Z
+func (vm *Machine) rotate(stmt gcode.Block) {
+	if vm.State.MoveMode != MoveModeLinear && vm.State.MoveMode != MoveModeRapid {
+		panic(Errorf(ErrInvalidMove, "Rotary move attempted without a linear or rapid move mode"))
+	}
+
+	angles := vm.calcRotary(stmt)
+	if stmt.IncludesOneOf('X', 'Y', 'Z') {
+		if stmt.HasWord('G', 53) || vm.cycle.code != 0 {
+			panic(Errorf(ErrUnsupportedWord, "Rotary axes can only move together with X, Y and Z in linear and rapid moves"))
+		}
+		vm.rotary = angles
+		vm.move(stmt)
+		return
+	}
+
+	pos := vm.workPos()
+	for idx, axis := range "ABC" {
+		if !stmt.IncludesOneOf(axis) {
+			continue
+		}
+		vm.rotary[idx] = angles[idx]
+		vm.add(Segment{Kind: SegmentRotary, X: pos.X, Y: pos.Y, Z: pos.Z, Param: angles[idx], Axis: axis})
+	}
+}
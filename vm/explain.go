@@ -0,0 +1,150 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "errors"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+//
+// Explanation
+//
+// Explain writes the program with the interpretation of every line below it,
+// for finding out why a program behaves the way it does:
+//
+//	G1 X10 F100
+//	  ; -> G1 X10 Y0 Z0 F100 M5 T0 | 1 move, 6s (at 7s)
+//
+// Coordinates are absolute work coordinates in millimeters, and feedrates in
+// millimeters per minute, whatever the units and distance mode of the line.
+// Warnings for a line follow it, marked with "!".
+//
+
+// Writes the document annotated with the interpretation of the vm, which must
+// have processed the document without optimizations or other modifications.
+func (vm *Machine) Explain(doc *gcode.Document, w io.Writer) error {
+	if vm.Spilled() {
+		return errors.New("Cannot explain a spilled program")
+	}
+
+	// The first segment is the origin, not from any line
+	var (
+		idx  = 1
+		last = vm.Segments[0]
+	)
+
+	for n, b := range doc.Blocks {
+		line := n + 1
+		text := b.Export(4)
+		if b.BlockDelete {
+			text = "(block deleted)"
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", text); err != nil {
+			return err
+		}
+
+		// Segments are in the order of their lines
+		first := idx
+		for idx < len(vm.Segments) && vm.Segments[idx].Line <= line {
+			idx++
+		}
+		if segs := vm.Segments[first:idx]; len(segs) > 0 {
+			end := segs[len(segs)-1]
+			fmt.Fprintf(w, "  ; -> %s | %s, %s (at %s)\n", describeState(end), describeSegments(segs),
+				(end.Elapsed - last.Elapsed).Round(time.Millisecond), end.Elapsed.Round(time.Millisecond))
+			last = end
+		}
+
+		for _, x := range vm.Warnings {
+			if x.Line == line {
+				fmt.Fprintf(w, "  ;! %s\n", x.Message)
+			}
+		}
+	}
+	return nil
+}
+
+// Describes the position and modal state at the end of a segment
+func describeState(seg Segment) string {
+	f := func(v float64) string {
+		return gcode.FormatFloat(v, 4)
+	}
+	st := seg.State
+
+	var b strings.Builder
+	switch st.MoveMode {
+	case MoveModeRapid:
+		b.WriteString("G0 ")
+	case MoveModeLinear:
+		b.WriteString("G1 ")
+	}
+	fmt.Fprintf(&b, "X%s Y%s Z%s", f(seg.X), f(seg.Y), f(seg.Z))
+	if seg.Offset != (vector.Vector{}) {
+		fmt.Fprintf(&b, " (machine X%s Y%s Z%s)", f(seg.X+seg.Offset.X), f(seg.Y+seg.Offset.Y), f(seg.Z+seg.Offset.Z))
+	}
+
+	switch st.FeedMode {
+	case FeedModeInvTime:
+		fmt.Fprintf(&b, " G93 F%s", f(st.Feedrate))
+	case FeedModeUnitsRev:
+		fmt.Fprintf(&b, " G95 F%s", f(st.Feedrate))
+	default:
+		fmt.Fprintf(&b, " F%s", f(st.Feedrate))
+	}
+
+	if st.ConstantSurfaceSpeed {
+		fmt.Fprintf(&b, " G96 S%s", f(st.SurfaceSpeed))
+		if st.MaxSpindleSpeed > 0 {
+			fmt.Fprintf(&b, " D%s", f(st.MaxSpindleSpeed))
+		}
+	}
+	switch {
+	case !st.SpindleEnabled:
+		b.WriteString(" M5")
+	case st.SpindleClockwise:
+		fmt.Fprintf(&b, " M3 S%s", f(st.SpindleSpeed))
+	default:
+		fmt.Fprintf(&b, " M4 S%s", f(st.SpindleSpeed))
+	}
+	if st.MistCoolant {
+		b.WriteString(" M7")
+	}
+	if st.FloodCoolant {
+		b.WriteString(" M8")
+	}
+	fmt.Fprintf(&b, " T%d", st.Tool)
+	switch st.CutterCompensation {
+	case CutCompModeOuter:
+		b.WriteString(" G41")
+	case CutCompModeInner:
+		b.WriteString(" G42")
+	}
+	if sc := st.Scaling; sc.Active() {
+		fmt.Fprintf(&b, " G51 X%s Y%s Z%s I%s J%s K%s", f(sc.Center.X), f(sc.Center.Y), f(sc.Center.Z), f(sc.Factors.X), f(sc.Factors.Y), f(sc.Factors.Z))
+	}
+	return b.String()
+}
+
+// Describes the number of segments of each kind
+func describeSegments(segs []Segment) string {
+	var (
+		names  = []string{"move", "dwell", "probe", "rotation", "passthrough", "pause"}
+		counts = make([]int, len(names))
+	)
+	for _, s := range segs {
+		counts[s.Kind]++
+	}
+
+	var parts []string
+	for kind, name := range names {
+		switch n := counts[kind]; {
+		case n == 1:
+			parts = append(parts, "1 "+name)
+		case n > 1:
+			parts = append(parts, fmt.Sprintf("%d %ss", n, name))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,99 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/warnings"
+import "math"
+
+//
+// Feed modes
+//
+// In units per minute mode (G94), F is the feedrate in mm/min. In inverse
+// time mode (G93), F is the number of times per minute the move of the
+// block can be done, so the block takes 1/F minutes whatever its length. As
+// it belongs to the block, every feed move must have its own F. In units per
+// revolution mode (G95), F is the distance travelled per spindle turn, at
+// the spindle speed of the move (see lathe.go).
+//
+// Arcs are split into lines of equal length, so in inverse time mode, each
+// line gets the feedrate that makes the arc as a whole take 1/F minutes.
+// Segments keep the feed mode of their block, and the time estimation (see
+// timing.go) takes it into account.
+//
+// UnitsPerMinute converts all feedrates to units per minute, for controllers
+// only supporting G94, such as Marlin. Like LinuxCNC, the feedrate of a move
+// applies to X, Y and Z, and to the rotary axes, in degrees, only if X, Y
+// and Z do not move.
+//
+
+// Checks that inverse time feed moves give their feedrate
+func (vm *Machine) checkInverseTime(stmt gcode.Block) {
+	if vm.State.FeedMode != FeedModeInvTime || vm.State.MoveMode == MoveModeRapid || stmt.IncludesOneOf('F') {
+		return
+	}
+	if vm.StrictFeedrate {
+		panic(Errorf(ErrMissingFeedrate, "Inverse time feed move without a feedrate"))
+	}
+	vm.warn(warnings.SeverityWarning, "Inverse time feed move without a feedrate, using the previous one")
+}
+
+// Converts inverse time and units per revolution feedrates to units per
+// minute. Units per revolution feed moves without the spindle running have
+// no feedrate, and are warned about. Only segments in memory are converted.
+func (vm *Machine) UnitsPerMinute() {
+	var (
+		feedrate float64 // Converted feedrate of the last feed move
+		last     *State  // Last converted state, shared if unchanged
+		warned   bool
+	)
+	for idx := range vm.Segments {
+		seg := vm.Segments[idx]
+		st := *seg.State
+		if st.FeedMode == FeedModeUnitsMin {
+			feedrate = st.Feedrate
+			continue
+		}
+
+		if seg.Kind == SegmentMove && st.MoveMode == MoveModeLinear || seg.Kind == SegmentProbe {
+			switch st.FeedMode {
+			case FeedModeInvTime:
+				if idx == 0 {
+					break
+				}
+				if d := moveDistance(vm.Segments[idx-1], seg); d > 1e-9 {
+					// Moves without length keep the feedrate. Rounded, so the
+					// lines of an arc, being of almost equal length, share it.
+					feedrate = math.Round(st.Feedrate*d*1e6) / 1e6
+				}
+			case FeedModeUnitsRev:
+				if rpm := seg.SpindleRPM(); !st.SpindleEnabled || rpm <= 0 {
+					if !warned {
+						vm.Warnings.Add(warnings.StageVM, seg.Line, warnings.SeverityWarning, "Units per revolution feed move without the spindle running")
+						warned = true
+					}
+					feedrate = 0
+				} else {
+					feedrate = st.Feedrate * rpm
+				}
+			}
+		}
+		st.FeedMode, st.Feedrate = FeedModeUnitsMin, feedrate
+
+		if last == nil || *last != st {
+			last = &st
+		}
+		vm.Segments[idx].State = last
+	}
+}
+
+// The distance of a move for its feedrate: that of X, Y and Z in mm, or, if
+// they do not move, that of the rotary axes in degrees
+func moveDistance(from, to Segment) float64 {
+	if d := to.MachineVector().Diff(from.MachineVector()).Norm(); d > 0 {
+		return d
+	}
+	var sum float64
+	for idx, angle := range to.Angles() {
+		sum += math.Pow(angle-from.Angles()[idx], 2)
+	}
+	return math.Sqrt(sum)
+}
@@ -0,0 +1,49 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "math"
+import "testing"
+import "time"
+
+func TestFeedModeTimes(t *testing.T) {
+	// Fast enough for acceleration not to matter
+	profile := machine.Default()
+	for _, a := range []*machine.Axis{&profile.X, &profile.Y, &profile.Z} {
+		a.MaxFeedrate, a.Acceleration = 1e6, 1e9
+	}
+
+	tests := []struct {
+		name    string
+		program string
+		eta     time.Duration
+	}{
+		{"units per minute", "G21 G90 G0 X0 Y0 Z0\nG94 G1 X10 F60\n", 10 * time.Second},
+		{"inverse time line", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X10 F6\n", 10 * time.Second},
+		{"inverse time lines", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X10 F6\nX15 F12\n", 15 * time.Second},
+		{"inverse time arc", "G21 G90 G0 X0 Y0 Z0\nG93 G2 X20 Y0 I10 J0 F6\n", 10 * time.Second},
+		{"inverse time helix", "G21 G90 G0 X0 Y0 Z0\nG93 G3 X0 Y0 Z-2 I10 J0 F2\n", 30 * time.Second},
+		{"units per revolution", "G21 G90 G0 X0 Y0 Z0\nM3 S600\nG95 G1 X10 F0.1\n", 10 * time.Second},
+	}
+	for _, test := range tests {
+		m, err := processProgram(test.program)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if eta := m.ETAWithProfile(profile); math.Abs(float64(eta-test.eta)) > float64(10*time.Millisecond) {
+			t.Errorf("%s: takes %s, expected %s", test.name, eta, test.eta)
+		}
+
+		// Converted to units per minute, the moves take as long
+		m.UnitsPerMinute()
+		for _, seg := range m.Segments {
+			if seg.State.FeedMode != FeedModeUnitsMin {
+				t.Errorf("%s: feed mode %d left after conversion", test.name, seg.State.FeedMode)
+				break
+			}
+		}
+		if eta := m.ETAWithProfile(profile); math.Abs(float64(eta-test.eta)) > float64(10*time.Millisecond) {
+			t.Errorf("%s: takes %s in units per minute, expected %s", test.name, eta, test.eta)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "context"
+
+//
+// Flow control
+//
+// O-word subroutines, conditionals and loops (see gcode/oword.go) are run as
+// they are encountered, so the segments are those of the fully unrolled
+// program. The body of a construct is read in full before it is run, so with
+// ProcessReader, only the constructs are held in memory.
+//
+// Subroutines must be defined before they are called. Call arguments are
+// passed in #1 to #30, which are restored after the call, and the value of
+// "return [x]" or "endsub [x]" is set in #<_value>. Named parameters are all
+// global.
+//
+
+const (
+	maxCallDepth  = 64
+	maxIterations = 1000000 // Per loop, to fail on runaway loops
+	localParams   = 30      // Parameters local to a subroutine call
+)
+
+// A block with its line number
+type line struct {
+	number int
+	block  gcode.Block
+}
+
+// Supplies blocks to run, in order
+type source interface {
+	next() (line, bool, error)
+}
+
+// The blocks of a construct
+type lines struct {
+	list []line
+	pos  int
+}
+
+func (l *lines) next() (line, bool, error) {
+	if l.pos == len(l.list) {
+		return line{}, false, nil
+	}
+	l.pos++
+	return l.list[l.pos-1], true, nil
+}
+
+// The blocks of a document
+type docSource struct {
+	doc *gcode.Document
+	idx int
+}
+
+func (d *docSource) next() (line, bool, error) {
+	if d.idx == len(d.doc.Blocks) {
+		return line{}, false, nil
+	}
+	d.idx++
+	return line{d.idx, d.doc.Blocks[d.idx-1]}, true, nil
+}
+
+// The blocks read by a scanner, whose warnings are added to the machine
+type scanSource struct {
+	s  *gcode.Scanner
+	vm *Machine
+}
+
+func (s *scanSource) next() (line, bool, error) {
+	if !s.s.Scan() {
+		return line{}, false, s.s.Err()
+	}
+	s.vm.Warnings = append(s.vm.Warnings, s.s.Warnings()...)
+	return line{s.s.Line(), s.s.Block()}, true, nil
+}
+
+// A defined subroutine, with the O-word ending it
+type subroutine struct {
+	body []line
+	end  *gcode.OWord
+}
+
+// How running a sequence of blocks ended: at the end of the blocks (kind ""),
+// at the end of the program ("end"), or with break, continue or return
+type signal struct {
+	kind string
+	name string
+}
+
+// Runs all blocks of the source, and completes processing. Fails without
+// running any if an option was invalid.
+func (vm *Machine) processSource(ctx context.Context, src source) error {
+	if vm.optionErr != nil {
+		return vm.optionErr
+	}
+	sig, err := vm.exec(ctx, src)
+	if err != nil {
+		return err
+	}
+	if sig.kind == "break" || sig.kind == "continue" {
+		return Errorf(ErrFlowControl, "o%s %s outside of its loop", sig.name, sig.kind)
+	}
+	return vm.finish()
+}
+
+// Runs blocks from the source until it ends, or until a program end, break,
+// continue or return
+func (vm *Machine) exec(ctx context.Context, src source) (signal, error) {
+	for {
+		l, ok, err := src.next()
+		if err != nil || !ok {
+			return signal{}, err
+		}
+		if vm.executed%1024 == 0 && ctx.Err() != nil {
+			return signal{}, ctx.Err()
+		}
+		vm.executed++
+
+		var o *gcode.OWord
+		if !l.block.BlockDelete && !vm.Completed {
+			if o, err = l.block.GetOWord(); err != nil {
+				return signal{}, blockError(l.number, l.block, err)
+			}
+		}
+		if o == nil {
+			if more, err := vm.runLine(l.number, l.block); err != nil {
+				return signal{}, err
+			} else if !more {
+				return signal{"end", ""}, nil
+			}
+			continue
+		}
+
+		if sig, err := vm.control(ctx, src, l, o); err != nil || sig.kind != "" {
+			return sig, err
+		}
+	}
+}
+
+// Runs an O-word, reading the body of its construct from the source
+func (vm *Machine) control(ctx context.Context, src source, l line, o *gcode.OWord) (sig signal, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = blockError(l.number, l.block, r)
+		}
+	}()
+
+	vm.line, vm.source = l.number, l.block.Source
+	for _, n := range l.block.Nodes {
+		switch n := n.(type) {
+		case *gcode.Word:
+			if n.Address == 'N' {
+				continue
+			}
+		case *gcode.ExprWord, *gcode.Assignment:
+		default:
+			continue
+		}
+		panic(Errorf(ErrFlowControl, "O-words cannot be combined with other words"))
+	}
+
+	switch o.Keyword {
+	case "sub":
+		body, end := vm.gather(src, o, "endsub")
+		if vm.subs == nil {
+			vm.subs = make(map[string]subroutine)
+		}
+		vm.subs[o.Name] = subroutine{body, end}
+	case "call":
+		return vm.call(ctx, o)
+	case "return":
+		if vm.depth == 0 {
+			panic(Errorf(ErrFlowControl, "o%s return outside of a subroutine", o.Name))
+		}
+		vm.returnValue(o)
+		return signal{"return", o.Name}, nil
+	case "if":
+		body, _ := vm.gather(src, o, "endif")
+
+		// Split into branches at elseif and else, which has no condition
+		var (
+			conds    = []gcode.Expr{vm.arg(o)}
+			branches = make([][]line, 1)
+		)
+		for _, b := range body {
+			e, _ := b.block.GetOWord()
+			if e != nil && !b.block.BlockDelete && e.Name == o.Name && (e.Keyword == "elseif" || e.Keyword == "else") {
+				var cond gcode.Expr
+				if e.Keyword == "elseif" {
+					cond = vm.arg(e)
+				}
+				conds = append(conds, cond)
+				branches = append(branches, nil)
+				continue
+			}
+			branches[len(branches)-1] = append(branches[len(branches)-1], b)
+		}
+
+		for idx, cond := range conds {
+			if cond == nil || vm.eval(cond) != 0 {
+				return vm.exec(ctx, &lines{list: branches[idx]})
+			}
+		}
+	case "while":
+		cond := vm.arg(o)
+		body, _ := vm.gather(src, o, "endwhile")
+		return vm.loop(ctx, o, body, func(int) bool {
+			return vm.eval(cond) != 0
+		})
+	case "do":
+		body, end := vm.gather(src, o, "while")
+		cond := vm.arg(end)
+		return vm.loop(ctx, o, body, func(n int) bool {
+			return n == 0 || vm.eval(cond) != 0
+		})
+	case "repeat":
+		count := vm.eval(vm.arg(o))
+		body, _ := vm.gather(src, o, "endrepeat")
+		return vm.loop(ctx, o, body, func(n int) bool {
+			return float64(n) < count
+		})
+	case "break", "continue":
+		return signal{o.Keyword, o.Name}, nil
+	default:
+		panic(Errorf(ErrFlowControl, "o%s %s without its start", o.Name, o.Keyword))
+	}
+	return signal{}, nil
+}
+
+// The single argument of an O-word
+func (vm *Machine) arg(o *gcode.OWord) gcode.Expr {
+	if len(o.Args) != 1 {
+		panic(Errorf(ErrFlowControl, "o%s %s requires one argument", o.Name, o.Keyword))
+	}
+	return o.Args[0]
+}
+
+// Reads the blocks of a construct up to the O-word ending it, returning the
+// blocks and the ending O-word
+func (vm *Machine) gather(src source, o *gcode.OWord, end string) ([]line, *gcode.OWord) {
+	var body []line
+	for {
+		l, ok, err := src.next()
+		if err != nil {
+			panic(err)
+		} else if !ok {
+			panic(Errorf(ErrFlowControl, "o%s %s without o%s %s", o.Name, o.Keyword, o.Name, end))
+		}
+		if e, _ := l.block.GetOWord(); e != nil && !l.block.BlockDelete && e.Name == o.Name && e.Keyword == end {
+			return body, e
+		}
+		body = append(body, l)
+	}
+}
+
+// Runs the body of a loop while cond, given the number of iterations so far, is true
+func (vm *Machine) loop(ctx context.Context, o *gcode.OWord, body []line, cond func(int) bool) (signal, error) {
+	for n := 0; cond(n); n++ {
+		if n == maxIterations {
+			panic(Errorf(ErrFlowControl, "o%s %s exceeded %d iterations", o.Name, o.Keyword, maxIterations))
+		}
+		sig, err := vm.exec(ctx, &lines{list: body})
+		switch {
+		case err != nil:
+			return sig, err
+		case sig.kind == "break" && sig.name == o.Name:
+			return signal{}, nil
+		case sig.kind == "" || sig.kind == "continue" && sig.name == o.Name:
+		default:
+			return sig, nil
+		}
+	}
+	return signal{}, nil
+}
+
+// Calls a subroutine
+func (vm *Machine) call(ctx context.Context, o *gcode.OWord) (signal, error) {
+	sub, ok := vm.subs[o.Name]
+	if !ok {
+		panic(Errorf(ErrFlowControl, "o%s is not defined", o.Name))
+	}
+	if vm.depth == maxCallDepth {
+		panic(Errorf(ErrFlowControl, "Subroutine calls nested more than %d deep", maxCallDepth))
+	}
+	if len(o.Args) > localParams {
+		panic(Errorf(ErrFlowControl, "Subroutines take at most %d arguments", localParams))
+	}
+
+	args := make([]float64, len(o.Args))
+	for idx, a := range o.Args {
+		args[idx] = vm.eval(a)
+	}
+
+	// Save the parameters of the caller, and pass the arguments
+	saved := make(map[int]float64)
+	for idx := 1; idx <= localParams; idx++ {
+		if v, ok := vm.Parameters[idx]; ok {
+			saved[idx] = v
+			delete(vm.Parameters, idx)
+		}
+	}
+	for idx, v := range args {
+		vm.setParam(gcode.Parameter{gcode.Number(idx + 1), ""}, v)
+	}
+
+	vm.depth++
+	sig, err := vm.exec(ctx, &lines{list: sub.body})
+	if err == nil && sig.kind == "" {
+		vm.returnValue(sub.end)
+	}
+	vm.depth--
+
+	for idx := 1; idx <= localParams; idx++ {
+		delete(vm.Parameters, idx)
+	}
+	for idx, v := range saved {
+		vm.Parameters[idx] = v
+	}
+
+	switch {
+	case err != nil:
+		return sig, err
+	case sig.kind == "break" || sig.kind == "continue":
+		panic(Errorf(ErrFlowControl, "o%s %s outside of its loop", sig.name, sig.kind))
+	case sig.kind == "end":
+		return sig, nil
+	}
+	return signal{}, nil
+}
+
+// Sets #<_value> to the value of a return or endsub, if any
+func (vm *Machine) returnValue(o *gcode.OWord) {
+	if len(o.Args) > 0 {
+		vm.setParam(gcode.Parameter{nil, "_value"}, vm.eval(vm.arg(o)))
+	}
+}
@@ -0,0 +1,79 @@
+package vm
+
+import "errors"
+import "reflect"
+import "testing"
+
+// The X of the moves of a program after the first line
+func flowMoves(m *Machine) []float64 {
+	var res []float64
+	for _, seg := range m.Segments[1:] {
+		if seg.Kind == SegmentMove && seg.State.MoveMode != MoveModeNone && seg.Line > 1 {
+			res = append(res, seg.X)
+		}
+	}
+	return res
+}
+
+func TestFlowControl(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		moves   []float64
+	}{
+		{"call", "o100 sub\nG0 X#1\no100 endsub\no100 call [3]\no100 call [4]\n", []float64{3, 4}},
+		{"named sub", "o<move> sub\nG0 X[#1+#2]\no<move> endsub\no<move> call [1] [2]\n", []float64{3}},
+		{"nested call", "o1 sub\nG0 X#1\no1 endsub\no2 sub\no1 call [#1*2]\nG0 X#1\no2 endsub\no2 call [3]\n", []float64{6, 3}},
+		{"local parameters", "#1=7 #31=1\no100 sub\n#1=1 #31=2\no100 endsub\no100 call [2]\nG0 X[#1+#31]\n", []float64{9}},
+		{"unset local parameters", "#2=7\no100 sub\nG0 X#2\no100 endsub\no100 call [2]\n", []float64{0}},
+		{"return", "o100 sub\no100 return [#1*2]\nG0 X1\no100 endsub\no100 call [5]\nG0 X#<_value>\n", []float64{10}},
+		{"endsub value", "o100 sub\no100 endsub [#1+1]\no100 call [5]\nG0 X#<_value>\n", []float64{6}},
+		{"if", "#1=1\no1 if [#1 EQ 1]\nG0 X1\no1 elseif [#1 EQ 2]\nG0 X2\no1 else\nG0 X3\no1 endif\n", []float64{1}},
+		{"elseif", "#1=2\no1 if [#1 EQ 1]\nG0 X1\no1 elseif [#1 EQ 2]\nG0 X2\no1 else\nG0 X3\no1 endif\n", []float64{2}},
+		{"else", "#1=5\no1 if [#1 EQ 1]\nG0 X1\no1 elseif [#1 EQ 2]\nG0 X2\no1 else\nG0 X3\no1 endif\n", []float64{3}},
+		{"no branch", "o1 if [0]\nG0 X1\no1 endif\nG0 X2\n", []float64{2}},
+		{"while", "#1=0\no1 while [#1 LT 3]\nG0 X#1\n#1=[#1+1]\no1 endwhile\n", []float64{0, 1, 2}},
+		{"do", "#1=5\no1 do\nG0 X#1\n#1=[#1+1]\no1 while [#1 LT 3]\n", []float64{5}},
+		{"repeat", "G91\no1 repeat [3]\nG0 X1\no1 endrepeat\n", []float64{1, 2, 3}},
+		{"break", "#1=0\no1 while [1]\n#1=[#1+1]\no2 if [#1 GT 2]\no1 break\no2 endif\nG0 X#1\no1 endwhile\n", []float64{1, 2}},
+		{"continue", "#1=0\no1 while [#1 LT 4]\n#1=[#1+1]\no2 if [#1 EQ 2]\no1 continue\no2 endif\nG0 X#1\no1 endwhile\n", []float64{1, 3, 4}},
+		{"nested loops", "#1=0\no1 repeat [2]\no2 repeat [2]\n#1=[#1+1]\nG0 X#1\no2 endrepeat\no1 endrepeat\n", []float64{1, 2, 3, 4}},
+		{"end", "G0 X1\nM2\nG0 X2\n", []float64{1}},
+		{"end in sub", "o1 sub\nG0 X1\nM2\no1 endsub\no1 call\nG0 X2\n", []float64{1}},
+	}
+	for _, test := range tests {
+		m, err := processProgram("G21 G90 G0 X0 Y0 Z0\n" + test.program)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if moves := flowMoves(m); !reflect.DeepEqual(moves, test.moves) {
+			t.Errorf("%s: moved to X%v, expected X%v", test.name, moves, test.moves)
+		}
+	}
+}
+
+func TestFlowControlErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+	}{
+		{"undefined", "o1 call\n"},
+		{"call before sub", "o1 call\no1 sub\no1 endsub\n"},
+		{"unterminated sub", "o1 sub\nG0 X1\n"},
+		{"unterminated if", "o1 if [1]\nG0 X1\n"},
+		{"mismatched name", "o1 while [0]\no2 endwhile\n"},
+		{"end without start", "o1 endif\n"},
+		{"return outside sub", "o1 return\n"},
+		{"break outside loop", "o1 sub\no2 break\no1 endsub\no1 call\n"},
+		{"combined words", "o1 if [1] G0 X1\no1 endif\n"},
+		{"missing condition", "o1 while\no1 endwhile\n"},
+		{"recursion", "o1 sub\no1 call\no1 endsub\no1 call\n"},
+		{"runaway loop", "o1 while [1]\no1 endwhile\n"},
+	}
+	for _, test := range tests {
+		if _, err := processProgram("G21 G90\n" + test.program); !errors.Is(err, ErrFlowControl) {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, ErrFlowControl)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+
+//
+// Predefined positions
+//
+// G28 and G30 move at rapid to a stored position, in machine coordinates.
+// With axis words, they first move to the intermediate point given by the
+// words, in work coordinates and the current distance mode, and then only
+// the given axes move to the stored position. Without, all axes move:
+//
+//   G91 G28 Z0   - retract Z to the G28 position, leaving X and Y
+//   G28          - move all axes to the G28 position
+//
+// G28.1 and G30.1 store the current position. The moves to the stored
+// positions are marked as machine coordinate moves (see offsets.go), so
+// exporters can emit them as G53 moves, which go to the same place as long as
+// the controller has the same positions stored. The positions of the
+// controller are not known to the vm, and start at zero (machine home) unless
+// set with WithPredefinedPositions.
+//
+
+// Sets the positions stored for G28 and G30, in machine coordinates
+func WithPredefinedPositions(g28, g30 vector.Vector) Option {
+	return func(m *Machine) {
+		m.Predefined = [2]vector.Vector{g28, g30}
+	}
+}
+
+// The index in Predefined for G28 or G30, -1 if the block has neither
+func predefinedCode(stmt gcode.Block) int {
+	switch {
+	case stmt.HasWord('G', 28):
+		return 0
+	case stmt.HasWord('G', 30):
+		return 1
+	}
+	return -1
+}
+
+// Moves to a predefined position (G28 or G30)
+func (vm *Machine) predefined(stmt gcode.Block, idx int) {
+	if vm.comp.side != 0 || vm.State.CutterCompensation != CutCompModeNone {
+		panic(Errorf(ErrInvalidMove, "G28 and G30 cannot be used with cutter compensation"))
+	}
+	if stmt.IncludesOneOf('A', 'B', 'C') {
+		panic(Errorf(ErrUnsupportedWord, "G28 and G30 only support X, Y and Z"))
+	}
+
+	mode := vm.State.MoveMode
+	vm.State.MoveMode = MoveModeRapid
+
+	// Intermediate point
+	var (
+		pos      = vm.programPos()
+		to       vector.Vector
+		given, _ = vm.axisWords(stmt, vector.Vector{})
+		axes     = stmt.IncludesOneOf('X', 'Y', 'Z')
+	)
+	if vm.AbsoluteMove {
+		to, _ = vm.axisWords(stmt, pos)
+	} else {
+		to = pos.Sum(given)
+	}
+	if to != pos {
+		to.X, to.Y, to.Z = vm.toWork(to.X, to.Y, to.Z)
+		vm.addPos(to.X, to.Y, to.Z)
+	}
+
+	// Stored position, for the given axes
+	var (
+		target = vm.curPos().MachineVector()
+		stored = vm.Predefined[idx]
+		off    = vm.ActiveWorkOffset()
+	)
+	for _, a := range []struct {
+		address rune
+		value   *float64
+		stored  float64
+	}{{'X', &target.X, stored.X}, {'Y', &target.Y, stored.Y}, {'Z', &target.Z, stored.Z}} {
+		if !axes || stmt.IncludesOneOf(a.address) {
+			*a.value = a.stored
+		}
+	}
+	if target != vm.curPos().MachineVector() {
+		vm.add(Segment{Kind: SegmentMove, X: target.X - off.X, Y: target.Y - off.Y, Z: target.Z - off.Z, Machine: true})
+	}
+
+	vm.State.MoveMode = mode
+}
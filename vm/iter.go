@@ -0,0 +1,87 @@
+package vm
+
+import "iter"
+
+//
+// Iteration
+//
+// Segments can be traversed with range-over-func instead of index loops:
+//
+//	for idx, seg := range machine.All(vm.MotionOnly(), vm.ToolOnly(2)) {
+//		...
+//	}
+//
+// Indexes are those of the segment stack, so they can be used with Operations
+// and the other analyzers. Spilled segments are included (see spill.go).
+//
+
+// A filter for segment iteration, returning true for segments to keep
+type SegmentFilter func(idx int, seg Segment) bool
+
+// Keeps only segments that move the machine
+func MotionOnly() SegmentFilter {
+	return func(idx int, seg Segment) bool {
+		return seg.Kind == SegmentMove && seg.State.MoveMode != MoveModeNone
+	}
+}
+
+// Keeps only segments using the given tool
+func ToolOnly(tool int) SegmentFilter {
+	return func(idx int, seg Segment) bool {
+		return seg.State.Tool == tool
+	}
+}
+
+// Keeps only segments that are part of the given operation
+func OperationOnly(op Operation) SegmentFilter {
+	return func(idx int, seg Segment) bool {
+		return op.Contains(idx)
+	}
+}
+
+// Iterates over the index and segment of all segments matching every filter
+func (vm *Machine) All(filters ...SegmentFilter) iter.Seq2[int, Segment] {
+	return func(yield func(int, Segment) bool) {
+		done := false
+		visit := func(idx int, seg Segment) bool {
+			for _, f := range filters {
+				if !f(idx, seg) {
+					return true
+				}
+			}
+			done = !yield(idx, seg)
+			return !done
+		}
+
+		if vm.spill != nil {
+			vm.spill.each(visit)
+		}
+		offset := vm.offset()
+		for idx := 0; idx < len(vm.Segments) && !done; idx++ {
+			visit(offset+idx, vm.Segments[idx])
+		}
+	}
+}
+
+// Calls fn for every segment but the first, with the segment before it,
+// including spilled segments
+func (vm *Machine) eachPair(fn func(idx int, from, to Segment)) {
+	var from Segment
+	for idx, to := range vm.All() {
+		if idx > 0 {
+			fn(idx, from, to)
+		}
+		from = to
+	}
+}
+
+// Iterates over the index and position of all segments matching every filter
+func (vm *Machine) AllPositions(filters ...SegmentFilter) iter.Seq2[int, Position] {
+	return func(yield func(int, Position) bool) {
+		for idx, seg := range vm.All(filters...) {
+			if !yield(idx, seg.Position()) {
+				return
+			}
+		}
+	}
+}
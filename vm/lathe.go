@@ -0,0 +1,97 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "math"
+
+//
+// Lathe
+//
+// On a lathe, X is the distance of the tool from the axis of the spindle,
+// and Z the distance along it. Parts are measured and drawn by diameter, so
+// programs may give X as a diameter (G7) instead of a radius (G8, the
+// default). Positions are always radii, so diameter words are halved as they
+// are read. Arc center offsets (I) are radii in both modes.
+//
+// As the tool moves towards the axis, the surface of the part passes it
+// slower at the same spindle speed. In constant surface speed mode (G96),
+// S is the surface speed in m/min (ft/min with G20), and the controller sets
+// the spindle speed from X, up to the speed given with D, if any:
+//
+//   G96 S150 D2500
+//
+// G97 returns to spindle speeds in RPM. The modes are carried in the state
+// of the segments, for exporters to lathe controllers (see
+// export/capabilities.go), and SpindleRPM gives the spindle speed at a
+// segment for the time estimation and limits.
+//
+
+// Meters per foot, for surface speeds in imperial units
+const metersPerFoot = 0.3048
+
+// Converts an X word from the active input units and diameter mode
+func (vm *Machine) xLength(v float64) float64 {
+	x := vm.length(v).Millimeters()
+	if vm.State.DiameterMode {
+		x /= 2
+	}
+	return x
+}
+
+// Tests if the S words of a block are surface speeds. Called before the G
+// words of the block are handled.
+func (vm *Machine) surfaceSpeedWords(stmt gcode.Block) bool {
+	return stmt.HasWord('G', 96) || vm.State.ConstantSurfaceSpeed && !stmt.HasWord('G', 97)
+}
+
+// Enters constant surface speed mode (G96 S [D])
+func (vm *Machine) constantSurfaceSpeed(stmt gcode.Block) {
+	if !stmt.IncludesOneOf('S') {
+		panic(Errorf(ErrInvalidWord, "G96 requires a surface speed (S)"))
+	}
+	vm.State.ConstantSurfaceSpeed = true
+	vm.State.MaxSpindleSpeed = 0
+	if d, err := stmt.GetWord('D'); err == nil {
+		if d <= 0 {
+			panic(Errorf(ErrInvalidWord, "G96 maximum spindle speed (D) must be positive"))
+		}
+		vm.State.MaxSpindleSpeed = d
+	}
+}
+
+// Sets the surface speed from the S words of a block in constant surface
+// speed mode. Called after the G words of the block are handled.
+func (vm *Machine) handleSurfaceSpeed(stmt gcode.Block) {
+	if !vm.State.ConstantSurfaceSpeed {
+		return
+	}
+	for _, s := range stmt.GetAllWords('S') {
+		if s < 0 {
+			panic(Errorf(ErrInvalidWord, "Surface speed must be greater than or equal to zero"))
+		}
+		if vm.Imperial {
+			s *= metersPerFoot
+		}
+		vm.State.SurfaceSpeed = s
+	}
+}
+
+// The spindle speed in RPM at the end of the segment. In constant surface
+// speed mode, it is that giving the surface speed at X, limited to the
+// maximum spindle speed. At the axis, that is the maximum, or 0 without one.
+func (s Segment) SpindleRPM() float64 {
+	st := s.State
+	if !st.ConstantSurfaceSpeed {
+		return st.SpindleSpeed
+	}
+	rpm := math.Inf(1)
+	if r := math.Abs(s.X); r > 0 {
+		rpm = st.SurfaceSpeed * 1000 / (2 * math.Pi * r)
+	}
+	if st.MaxSpindleSpeed > 0 && rpm > st.MaxSpindleSpeed {
+		rpm = st.MaxSpindleSpeed
+	}
+	if math.IsInf(rpm, 1) {
+		return 0
+	}
+	return rpm
+}
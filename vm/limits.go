@@ -0,0 +1,154 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "fmt"
+import "math"
+
+//
+// Limits
+//
+// A machine profile describes the envelope of the machine: the travel of
+// the axes, the feedrates and the spindle speed range. Checking programs
+// against it catches moves that would trip the soft limits of the
+// controller, or crash a machine without them, before the program is run.
+//
+// LimitViolations reports every segment exceeding the envelope with the
+// line it came from, CheckLimits fails on the first, and ClipLimits moves
+// segments back within it. Positions are checked in machine coordinates.
+// The travel is a box, so moves between positions within it stay within it.
+//
+
+// A segment exceeding the machine envelope
+type LimitViolation struct {
+	Index  int    // Index of the segment
+	Line   int    // Line of the block of the segment, 0 if not from a block
+	Source string // Text of that line
+	Err    error  // Of class ErrLimitExceeded
+	fixed  bool   // Can be clipped
+}
+
+func (v *LimitViolation) Error() string {
+	if v.Line == 0 {
+		return v.Err.Error()
+	}
+	return fmt.Sprintf("line %d (%s): %s", v.Line, v.Source, v.Err)
+}
+
+func (v *LimitViolation) Unwrap() error {
+	return v.Err
+}
+
+// Checks that all positions, in machine coordinates, are within the travel of the machine, and that
+// feedrates and spindle speeds are within what the machine can do. Fails with the first violation.
+func (vm *Machine) CheckLimits(profile machine.Profile) error {
+	if v := vm.LimitViolations(profile); len(v) > 0 {
+		return v[0]
+	}
+	return nil
+}
+
+// Lists all violations of the limits of the machine, in order. A segment
+// may violate several limits. Feedrates in inverse time and units per
+// revolution mode are checked as the feedrate they come to.
+func (vm *Machine) LimitViolations(profile machine.Profile) []*LimitViolation {
+	var (
+		res         []*LimitViolation
+		maxFeedrate = maxFeedrate(profile)
+		from        Segment
+	)
+	for idx, pos := range vm.All() {
+		prev := from
+		from = pos
+		if pos.State.MoveMode == MoveModeNone {
+			continue
+		}
+		add := func(fixed bool, format string, args ...interface{}) {
+			res = append(res, &LimitViolation{idx, pos.Line, pos.Source, Errorf(ErrLimitExceeded, format, args...), fixed})
+		}
+
+		if mp := pos.MachineVector(); !profile.Contains(mp) {
+			add(true, "Move %d to machine X%g Y%g Z%g exceeds machine travel", idx, mp.X, mp.Y, mp.Z)
+		}
+		if pos.State.MoveMode != MoveModeRapid && idx > 0 {
+			// Only feedrates in units per minute mode can be clipped
+			length := pos.MachineVector().Diff(prev.MachineVector()).Norm()
+			if feed := feedFor(pos, length); feed > maxFeedrate {
+				add(pos.State.FeedMode == FeedModeUnitsMin, "Move %d feedrate of %g exceeds machine maximum of %g", idx, feed, maxFeedrate)
+			}
+		}
+		if pos.State.SpindleEnabled {
+			if rpm := pos.SpindleRPM(); rpm > profile.Spindle.MaxSpeed || rpm < profile.Spindle.MinSpeed {
+				// Constant surface speed can be limited, but not raised
+				add(!pos.State.ConstantSurfaceSpeed || rpm > profile.Spindle.MaxSpeed, "Move %d spindle speed of %g outside machine range", idx, rpm)
+			}
+			if !pos.State.SpindleClockwise && !profile.Spindle.Reversible {
+				add(false, "Move %d uses counter clockwise rotation on a non-reversible spindle", idx)
+			}
+		}
+	}
+	return res
+}
+
+// Moves positions outside the travel of the machine to the nearest position
+// within it, and limits feedrates and spindle speeds to the range of the
+// machine. Returns the violations clipped. Counter clockwise rotation on a
+// non-reversible spindle, spindle speeds below the range in constant
+// surface speed mode, and feedrates in inverse time and units per
+// revolution mode, cannot be clipped, and are left for CheckLimits.
+// Clipped positions change the toolpath, so the result is only as safe as
+// the program is with its moves flattened against the travel. Spilled
+// segments are reported, but not clipped.
+func (vm *Machine) ClipLimits(profile machine.Profile) []*LimitViolation {
+	var res []*LimitViolation
+	for _, v := range vm.LimitViolations(profile) {
+		if v.fixed {
+			res = append(res, v)
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+
+	var (
+		maxFeedrate = maxFeedrate(profile)
+		minTravel   = profile.MinTravel()
+		maxTravel   = profile.MaxTravel()
+		states      = make(map[*State]*State)
+	)
+	for idx, seg := range vm.Segments {
+		mp := seg.MachineVector()
+		seg.X = math.Min(math.Max(mp.X, minTravel.X), maxTravel.X) - seg.Offset.X
+		seg.Y = math.Min(math.Max(mp.Y, minTravel.Y), maxTravel.Y) - seg.Offset.Y
+		seg.Z = math.Min(math.Max(mp.Z, minTravel.Z), maxTravel.Z) - seg.Offset.Z
+
+		if st, ok := states[seg.State]; ok {
+			seg.State = st
+		} else {
+			old := seg.State
+			seg = seg.Modify(func(st *State) {
+				if st.MoveMode != MoveModeRapid && st.FeedMode == FeedModeUnitsMin && st.Feedrate > maxFeedrate {
+					st.Feedrate = maxFeedrate
+				}
+				if st.SpindleEnabled && st.ConstantSurfaceSpeed {
+					if st.MaxSpindleSpeed == 0 || st.MaxSpindleSpeed > profile.Spindle.MaxSpeed {
+						st.MaxSpindleSpeed = profile.Spindle.MaxSpeed
+					}
+				} else if st.SpindleEnabled {
+					st.SpindleSpeed = math.Min(math.Max(st.SpindleSpeed, profile.Spindle.MinSpeed), profile.Spindle.MaxSpeed)
+				}
+			})
+			if *seg.State == *old {
+				seg.State = old
+			}
+			states[old] = seg.State
+		}
+		vm.Segments[idx] = seg
+	}
+	return res
+}
+
+// The highest feedrate of the axes of the machine
+func maxFeedrate(profile machine.Profile) float64 {
+	maxFeed := profile.MaxFeedrate()
+	return math.Max(maxFeed.X, math.Max(maxFeed.Y, maxFeed.Z))
+}
@@ -0,0 +1,36 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "testing"
+
+func TestLimitFeedrates(t *testing.T) {
+	tests := []struct {
+		name       string
+		program    string
+		violations int // Feedrate violations
+		clipped    int
+	}{
+		{"units per minute", "G21 G90 G94 G0 X0 Y0 Z0\nG1 X10 F400\nX20 F1000\n", 1, 1},
+		{"inverse time within", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X10 F10\nG94\n", 0, 0},
+		{"inverse time exceeding", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X10 F100\nG94\n", 1, 0},
+		{"inverse time short move", "G21 G90 G0 X0 Y0 Z0\nG93 G1 X0.1 F100\nG94\n", 0, 0},
+		{"units per revolution", "G21 G90 G0 X0 Y0 Z0\nM3 S1000\nG95 G1 X10 F1\nG94\n", 1, 0},
+	}
+	profile := machine.Default()
+	for _, test := range tests {
+		m, err := processProgram(test.program)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if violations := len(m.LimitViolations(profile)); violations != test.violations {
+			t.Errorf("%s: got %d violations, expected %d", test.name, violations, test.violations)
+		}
+		if clipped := len(m.ClipLimits(profile)); clipped != test.clipped {
+			t.Errorf("%s: clipped %d violations, expected %d", test.name, clipped, test.clipped)
+		}
+		if v := m.LimitViolations(profile); len(v) != test.violations-test.clipped {
+			t.Errorf("%s: got %d violations after clipping, expected %d", test.name, len(v), test.violations-test.clipped)
+		}
+	}
+}
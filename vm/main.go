@@ -1,9 +1,12 @@
 package vm
 
 import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/machine"
 import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/warnings"
+import "context"
 import "fmt"
-import "errors"
+import "io"
 
 //
 // The CNC interpreter/"vm"
@@ -12,25 +15,65 @@ import "errors"
 //
 //   G00   - rapid move
 //   G01   - linear move
-//   G02   - cw arc
-//   G03   - ccw arc
+//   G02   - cw arc (center or radius format)
+//   G03   - ccw arc (center or radius format)
+//   G04   - dwell (P or S seconds)
+//   G10   - set work offset (L2 and L20)
 //   G17   - xy arc plane
 //   G18   - xz arc plane
 //   G19   - yz arc plane
 //   G20   - imperial mode
 //   G21   - metric mode
-//   G40   - cutter compensation
-//   G41   - cutter compensation
-//   G42   - cutter compensation
+//   G28   - go to predefined position, see home.go
+//   G28.1 - set predefined position
+//   G30   - go to predefined position
+//   G30.1 - set predefined position
+//   G38.2 - probe towards workpiece, error on failure
+//   G38.3 - probe towards workpiece
+//   G38.4 - probe away from workpiece, error on failure
+//   G38.5 - probe away from workpiece
+//   G40   - cutter compensation off
+//   G41   - cutter compensation left
+//   G41.1 - cutter compensation left, with diameter
+//   G42   - cutter compensation right
+//   G42.1 - cutter compensation right, with diameter
+//   G43   - tool length offset from the tool table
+//   G43.1 - tool length offset
+//   G49   - tool length offset off
+//   G53   - move in machine coordinates
+//   G54   - work offset 1
+//   G55   - work offset 2
+//   G56   - work offset 3
+//   G57   - work offset 4
+//   G58   - work offset 5
+//   G59   - work offset 6
+//   G59.1 - work offset 7
+//   G59.2 - work offset 8
+//   G59.3 - work offset 9
 //   G64   - tolerance
-//   G80   - cancel mode (?)
+//   G73   - peck drilling cycle, see cycles.go
+//   G80   - cancel canned cycle
+//   G81   - drilling cycle
+//   G82   - drilling cycle with dwell
+//   G83   - peck drilling cycle with full retraction
+//   G84   - tapping cycle
+//   G85   - boring cycle, feed out
+//   G86   - boring cycle, spindle stop
+//   G88   - boring cycle, dwell and spindle stop
+//   G89   - boring cycle, dwell and feed out
 //   G90   - absolute
 //   G90.1 - absolute arc
 //   G91   - relative
 //   G91.1 - relative arc
+//   G92   - axis offset
+//   G92.1 - clear axis offset
+//   G92.2 - suspend axis offset
+//   G92.3 - restore axis offset
 //   G93   - inverse feed mode
 //   G94   - units per minute feed mode
 //   G95   - units per revolution feed mode
+//   G98   - canned cycle retract to initial Z
+//   G99   - canned cycle retract to R
 //
 //   M02 - end of program
 //   M03 - spindle enable clockwise
@@ -41,18 +84,32 @@ import "errors"
 //   M08 - flood coolant enable
 //   M09 - coolant disable
 //   M30 - end of program
+//   M48 - enable feed and speed overrides
+//   M49 - disable feed and speed overrides
+//   M62 - disable torch height control (plasma only)
+//   M63 - enable torch height control (plasma only)
+//   M64 - disable torch height control (plasma only)
+//   M65 - enable torch height control (plasma only)
 //
 //   F - feedrate
 //   S - spindle speed
 //   P - parameter
 //   T - tool
 //   X, Y, Z - cartesian movement
+//   A, B, C - rotary movement
 //   I, J, K - arc center definition
 //
+//   #1, #<name> - parameters, see parameters.go
+//   [...] - expressions
+//   O - subroutines, conditionals and loops, see flow.go
+//
 // Notes:
-//   Dwell (G04) is ignored
+//   Rotary axes move with linear and rapid moves, see events.go
+//   Positions are in work coordinates, see offsets.go
 //   Tolerance (G64) is ignored
-//   Cutter compensation is just passed to machine
+//   Cutter compensation is passed to machine, or offset by the vm, see cutcomp.go
+//   Canned cycles are expanded into moves, see cycles.go
+//   Mach3/Mach4 and Marlin specific codes are handled in dialect.go
 //
 
 //
@@ -63,10 +120,6 @@ import "errors"
 //   Execution order
 //   Modal groups
 //   Better comments
-//   Implement various canned cycles
-//   Variables (basic support?)
-//   Subroutines
-//   A, B, C axes
 //
 
 //
@@ -115,12 +168,23 @@ type State struct {
 	MistCoolant        bool
 	Tool               int
 	CutterCompensation int
+	OverridesDisabled  bool // Feed and speed overrides disabled (M49)
+	THCDisabled        bool // Torch height control disabled, see plasma.go
+
+	// Lathe modes, see lathe.go
+	DiameterMode         bool    // X programmed as diameter (G7)
+	ConstantSurfaceSpeed bool    // Spindle speed set from the surface speed (G96)
+	SurfaceSpeed         float64 // Surface speed in constant surface speed mode (m/min)
+	MaxSpindleSpeed      float64 // Spindle speed limit in constant surface speed mode (RPM), 0 if none
+
+	Scaling Scaling // Scaling (G51) for exporters, unless baked, see scaling.go
 }
 
 // Position and state
 type Position struct {
 	State   State
 	X, Y, Z float64
+	A, B, C float64 // Degrees
 }
 
 func (p Position) Vector() vector.Vector {
@@ -139,7 +203,42 @@ type Machine struct {
 	MaxArcDeviation  float64
 	MinArcLineLength float64
 	Tolerance        float64
-	Positions        []Position
+	Dialect          int
+	Limits           *machine.Profile // Checked after processing, if set
+	Tools            ToolTable
+	StrictFeedrate   bool                        // Feed moves without a feedrate are errors instead of warnings
+	MaxFeedrate      float64                     // Feedrates above are limited to it (mm/min), if positive
+	MaxSegments      int                         // Processing fails when producing more segments, if positive
+	SafeReversal     bool                        // Stop the spindle before reversing it, see spindle.go
+	ReversalDwell    float64                     // Seconds to dwell after stopping the spindle for reversal
+	WorkOffsets      [CoordSystems]vector.Vector // G54 to G59.3
+	CoordSystem      int                         // Selected work offset, 0 for G54
+	AxisOffset       vector.Vector               // G92
+	Predefined       [2]vector.Vector            // G28 and G30 positions in machine coordinates, see home.go
+	ToolLength       float64                     // Tool length offset (G43), see tools.go
+	Plasma           *Plasma                     // Plasma torch settings, if the spindle is a torch
+	Parameters       map[int]float64             // Numbered parameters, see parameters.go
+	subs             map[string]subroutine       // Defined subroutines, see flow.go
+	depth            int                         // Subroutine call depth
+	executed         int                         // Blocks run, including repetitions
+	cycle            cycle                       // Canned cycle, see cycles.go
+	CompensateCutter bool                        // Offset the path for G41 and G42 instead of passing them on, see cutcomp.go
+	comp             cutComp                     // Active cutter compensation
+	rotation         coordRotation               // Active coordinate rotation (G68), see rotation.go
+	scaling          Scaling                     // Active scaling (G51), see scaling.go
+	BakeScaling      bool                        // Leave scaling out of the state, see scaling.go
+	NamedParameters  map[string]float64          // Named parameters, lower-case
+	Segments         []Segment
+	Arcs             []ArcInfo
+	Reordered        bool // Set by optimizations which may change the order of segments, see IndexOfLine
+	Warnings         warnings.Warnings
+	line             int        // Block being executed
+	source           string     // Text of the line of the block being executed
+	rotary           [3]float64 // Angles of the A, B and C axes
+	noFeed           bool       // Missing feedrate warned about
+	callbacks        callbacks
+	spill            *spill
+	optionErr        error // Invalid option, returned by processing
 }
 
 //
@@ -151,14 +250,22 @@ func (vm *Machine) handleG(stmt gcode.Block) {
 		switch g {
 		case 0:
 			vm.State.MoveMode = MoveModeRapid
+			vm.cycle.code = 0
 		case 1:
 			vm.State.MoveMode = MoveModeLinear
+			vm.cycle.code = 0
 		case 2:
 			vm.State.MoveMode = MoveModeCWArc
+			vm.cycle.code = 0
 		case 3:
 			vm.State.MoveMode = MoveModeCCWArc
-		case 4:
-			// TODO handle dwell?
+			vm.cycle.code = 0
+		case 4, 10, 28, 30, 38.2, 38.3, 38.4, 38.5, 43.1, 53, 92:
+			// Non-modal, executed by run after the rest of the block
+		case 7:
+			vm.State.DiameterMode = true
+		case 8:
+			vm.State.DiameterMode = false
 		case 17:
 			vm.MovePlane = PlaneXY
 		case 18:
@@ -169,16 +276,42 @@ func (vm *Machine) handleG(stmt gcode.Block) {
 			vm.Imperial = true
 		case 21:
 			vm.Imperial = false
-		case 40:
-			vm.State.CutterCompensation = CutCompModeNone
-		case 41:
-			vm.State.CutterCompensation = CutCompModeOuter
-		case 42:
-			vm.State.CutterCompensation = CutCompModeInner
+		case 28.1:
+			vm.Predefined[0] = vm.curPos().MachineVector()
+		case 30.1:
+			vm.Predefined[1] = vm.curPos().MachineVector()
+		case 40, 41, 42, 41.1, 42.1:
+			vm.cutterCompensation(stmt, g)
+		case 43:
+			vm.toolLength(stmt)
+		case 49:
+			vm.ToolLength = 0
+		case 54, 55, 56, 57, 58, 59:
+			vm.CoordSystem = int(g) - 54
+		case 59.1:
+			vm.CoordSystem = 6
+		case 59.2:
+			vm.CoordSystem = 7
+		case 59.3:
+			vm.CoordSystem = 8
 		case 64:
 			// TODO I presume this is safe to ignore?
+			vm.warn(warnings.SeverityInfo, "G64 path blending ignored")
+		case 50:
+			vm.setScaling(Scaling{})
+		case 51:
+			// Executed by run after the rest of the block, see scaling.go
+		case 68:
+			// Executed by run after the rest of the block, see rotation.go
+		case 69:
+			vm.rotation = coordRotation{}
+		case 73, 81, 82, 83, 84, 85, 86, 88, 89:
+			vm.startCycle(g)
 		case 80:
 			vm.State.MoveMode = MoveModeNone
+			vm.cycle.code = 0
+		case 87:
+			panic(Errorf(ErrUnsupportedWord, "G87 back boring not supported"))
 		case 90:
 			vm.AbsoluteMove = true
 		case 90.1:
@@ -187,14 +320,26 @@ func (vm *Machine) handleG(stmt gcode.Block) {
 			vm.AbsoluteMove = false
 		case 91.1:
 			vm.AbsoluteArc = false
+		case 92.1, 92.2, 92.3:
+			vm.axisOffset(g)
+		case 98:
+			vm.cycle.retractR = false
+		case 99:
+			vm.cycle.retractR = true
 		case 93:
 			vm.State.FeedMode = FeedModeInvTime
 		case 94:
 			vm.State.FeedMode = FeedModeUnitsMin
 		case 95:
 			vm.State.FeedMode = FeedModeUnitsRev
+		case 96:
+			vm.constantSurfaceSpeed(stmt)
+		case 97:
+			vm.State.ConstantSurfaceSpeed, vm.State.SurfaceSpeed, vm.State.MaxSpindleSpeed = false, 0, 0
 		default:
-			panic(fmt.Sprintf("G%g not supported", g))
+			if !vm.handleDialectG(g) {
+				panic(Errorf(ErrUnsupportedWord, "G%g not supported", g))
+			}
 		}
 	}
 }
@@ -202,12 +347,18 @@ func (vm *Machine) handleG(stmt gcode.Block) {
 func (vm *Machine) handleM(stmt gcode.Block) {
 	for _, m := range stmt.GetAllWords('M') {
 		switch m {
+		case 0, 1, 60:
+			// Pauses, executed by run after the rest of the block
 		case 2:
 			vm.Completed = true
 		case 3:
+			vm.reverseSpindle(true)
+			vm.pierce(true)
 			vm.State.SpindleEnabled = true
 			vm.State.SpindleClockwise = true
 		case 4:
+			vm.reverseSpindle(false)
+			vm.pierce(false)
 			vm.State.SpindleEnabled = true
 			vm.State.SpindleClockwise = false
 		case 5:
@@ -223,8 +374,16 @@ func (vm *Machine) handleM(stmt gcode.Block) {
 			vm.State.FloodCoolant = false
 		case 30:
 			vm.Completed = true
+		case 48:
+			vm.State.OverridesDisabled = false
+		case 49:
+			vm.State.OverridesDisabled = true
+		case 62, 63, 64, 65:
+			vm.digitalOutput(stmt, m)
 		default:
-			panic(fmt.Sprintf("M%g not supported", m))
+			if !vm.handleDialectM(m) {
+				panic(Errorf(ErrUnsupportedWord, "M%g not supported", m))
+			}
 		}
 	}
 }
@@ -232,7 +391,7 @@ func (vm *Machine) handleM(stmt gcode.Block) {
 func (vm *Machine) handleT(stmt gcode.Block) {
 	for _, t := range stmt.GetAllWords('T') {
 		if t < 0 {
-			panic("Tool must be non-negative")
+			panic(Errorf(ErrInvalidWord, "Tool must be non-negative"))
 		}
 		vm.NextTool = int(t)
 	}
@@ -240,20 +399,34 @@ func (vm *Machine) handleT(stmt gcode.Block) {
 
 func (vm *Machine) handleF(stmt gcode.Block) {
 	for _, f := range stmt.GetAllWords('F') {
-		if vm.Imperial {
-			f *= 25.4
-		}
 		if f <= 0 {
-			panic("Feedrate must be greater than zero")
+			panic(Errorf(ErrInvalidWord, "Feedrate must be greater than zero"))
+		}
+		if vm.State.FeedMode == FeedModeInvTime {
+			// Moves per minute, independent of units
+			vm.State.Feedrate = f
+		} else {
+			vm.State.Feedrate = vm.feed(f).MillimetersPerMinute()
+			if vm.MaxFeedrate > 0 && vm.State.Feedrate > vm.MaxFeedrate {
+				vm.warn(warnings.SeverityWarning, "Feedrate of %g mm/min limited to %g mm/min", vm.State.Feedrate, vm.MaxFeedrate)
+				vm.State.Feedrate = vm.MaxFeedrate
+			}
 		}
-		vm.State.Feedrate = f
 	}
 }
 
 func (vm *Machine) handleS(stmt gcode.Block) {
+	if stmt.HasWord('G', 4) && !stmt.IncludesOneOf('P') {
+		// Dwell time, see events.go
+		return
+	}
+	if vm.surfaceSpeedWords(stmt) {
+		// Surface speed, see lathe.go
+		return
+	}
 	for _, s := range stmt.GetAllWords('S') {
 		if s < 0 {
-			panic("Spindle speed must be greater than or equal to zero")
+			panic(Errorf(ErrInvalidWord, "Spindle speed must be greater than or equal to zero"))
 		}
 		vm.State.SpindleSpeed = s
 	}
@@ -265,63 +438,149 @@ func (vm *Machine) run(stmt gcode.Block) (err error) {
 		return
 	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New(fmt.Sprintf("%s", r))
-		}
-	}()
+	defer Recover(&err)
+
+	stmt = vm.evaluate(stmt)
+	if vm.handleDialectBlock(stmt) {
+		return nil
+	}
 
 	// This completely ignores modal groups, command order and extra arguments.
 	vm.handleT(stmt)
 	vm.handleS(stmt)
-	vm.handleF(stmt)
 	vm.handleG(stmt)
+	vm.handleF(stmt) // After G, so units set by the block apply to the feedrate
+	vm.handleSurfaceSpeed(stmt)
 	vm.handleM(stmt)
 
 	// S-codes
-	if stmt.IncludesOneOf('A', 'B', 'C', 'U', 'V', 'W') {
-		panic("Only X, Y and Z axes are supported")
+	if stmt.IncludesOneOf('U', 'V', 'W') {
+		panic(Errorf(ErrUnsupportedWord, "Only X, Y, Z, A, B and C axes are supported"))
 	}
 
-	if stmt.IncludesOneOf('X', 'Y', 'Z') {
-		if vm.State.MoveMode == MoveModeCWArc || vm.State.MoveMode == MoveModeCCWArc {
+	if stmt.HasWord('G', 4) {
+		vm.dwell(stmt)
+	}
+
+	if vm.offsets(stmt) {
+		// Axis words set offsets instead of moving
+	} else if stmt.HasWord('G', 51) {
+		vm.scale(stmt)
+	} else if stmt.HasWord('G', 68) {
+		vm.rotateCoordinates(stmt)
+	} else if idx := predefinedCode(stmt); idx >= 0 {
+		vm.predefined(stmt, idx)
+	} else if code := probeCode(stmt); code != 0 {
+		vm.probe(stmt, code)
+	} else if stmt.IncludesOneOf('A', 'B', 'C') {
+		vm.rotate(stmt)
+	} else if stmt.IncludesOneOf('X', 'Y', 'Z') {
+		if stmt.HasWord('G', 53) {
+			vm.machineMove(stmt)
+		} else if vm.cycle.code != 0 {
+			vm.cannedCycle(stmt)
+		} else if vm.State.MoveMode == MoveModeCWArc || vm.State.MoveMode == MoveModeCCWArc {
+			vm.checkInverseTime(stmt)
 			vm.arc(stmt)
 		} else if vm.State.MoveMode == MoveModeLinear || vm.State.MoveMode == MoveModeRapid {
+			vm.checkInverseTime(stmt)
 			vm.move(stmt)
 		} else {
-			panic("Move attempted without an active move mode")
+			panic(Errorf(ErrInvalidMove, "Move attempted without an active move mode"))
 		}
 	}
 
+	if code := pauseCode(stmt); code >= 0 {
+		vm.pause(code)
+	}
+
 	return nil
 }
 
+// Tests if the block has any words, as opposed to only comments and file markers
+func hasWords(b gcode.Block) bool {
+	for _, n := range b.Nodes {
+		switch n.(type) {
+		case *gcode.Word, *gcode.ExprWord, *gcode.Assignment, *gcode.OWord:
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a warning for the block being executed
+func (vm *Machine) warn(severity int, format string, args ...interface{}) {
+	vm.Warnings.Add(warnings.StageVM, vm.line, severity, format, args...)
+}
+
 // Ensure that machine state is correct after execution
 func (vm *Machine) finalize() {
-	if vm.State != vm.curPos().State {
+	if vm.State != *vm.curPos().State {
 		vm.State.MoveMode = MoveModeNone
-		vm.addPos(Position{State: vm.State})
+		vm.addPos(0, 0, 0)
 	}
 }
 
 // Process AST
 func (vm *Machine) Process(doc *gcode.Document) (err error) {
-	for idx, b := range doc.Blocks {
-		if b.BlockDelete {
-			continue
-		}
+	return vm.ProcessContext(context.Background(), doc)
+}
 
-		if err := vm.run(b); err != nil {
-			return errors.New(fmt.Sprintf("line %d: %s", idx+1, err))
+// Process AST, stopping with the context error if the context is cancelled
+func (vm *Machine) ProcessContext(ctx context.Context, doc *gcode.Document) (err error) {
+	vm.Warnings = append(vm.Warnings, doc.Warnings...)
+	return vm.processSource(ctx, &docSource{doc, 0})
+}
+
+// Parse and process gcode from a reader one block at a time, without holding
+// the document in memory. Combined with spilling (see WithSpill), programs of
+// any size can be processed. Stops with the context error if the context is
+// cancelled.
+func (vm *Machine) ProcessReader(ctx context.Context, r io.Reader, opts gcode.Options) error {
+	return vm.processSource(ctx, &scanSource{gcode.NewScanner(r, opts), vm})
+}
+
+// Runs the block of a line, returning false if the following lines are to be ignored
+func (vm *Machine) runLine(line int, b gcode.Block) (bool, error) {
+	if b.BlockDelete {
+		return true, nil
+	}
+
+	vm.line, vm.source = line, b.Source
+	if vm.Completed {
+		if hasWords(b) {
+			vm.warn(warnings.SeverityWarning, "Blocks after program end ignored")
+			return false, nil
 		}
+		return true, nil
+	}
+	if err := vm.run(b); err != nil {
+		return false, blockError(line, b, err)
 	}
+	return true, nil
+}
+
+// Completes processing after the last block
+func (vm *Machine) finish() (err error) {
+	defer Recover(&err)
+
+	vm.finishCompensation()
 	vm.finalize()
+	vm.flushStream()
+
+	if !vm.Spilled() {
+		vm.UpdateElapsed(vm.Profile())
+	}
+
+	if vm.Limits != nil {
+		return vm.CheckLimits(*vm.Limits)
+	}
 	return nil
 }
 
 // Initialize the VM to sane default values
 func (vm *Machine) Init() {
-	vm.Positions = append(vm.Positions, Position{})
+	vm.Segments = append(vm.Segments, NewSegment(Position{}))
 	vm.Imperial = false
 	vm.AbsoluteMove = true
 	vm.AbsoluteArc = false
@@ -356,7 +615,7 @@ func (m *Position) Dump() {
 
 // Dumps the entire machine
 func (vm *Machine) Dump() {
-	for _, m := range vm.Positions {
+	for _, m := range vm.Positions() {
 		m.Dump()
 	}
 }
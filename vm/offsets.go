@@ -0,0 +1,163 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+
+//
+// Work offsets
+//
+// Segment positions are in work coordinates, relative to the work offset in
+// effect when they were produced, which is recorded with every segment.
+// Machine coordinates are the work coordinates plus the offset, and are what
+// must be used to compare positions between segments with different offsets,
+// or with the travel of the machine.
+//
+// The work offset is that of the selected coordinate system (G54 to G59.3),
+// set with G10 L2 or L20, plus the axis offset set with G92, plus the tool
+// length offset set with G43 or G43.1 (see tools.go). As in LinuxCNC, the
+// axis offset is kept in parameters 5211 to 5213 (in mm), with 5210 set while
+// it is applied. G92.1 clears it, G92.2 stops applying it, and G92.3 applies
+// it again from the parameters. The axis offset is also recorded separately
+// with every segment, so exporters can set it as G92 or add it to positions. Moves in machine
+// coordinates (G53) are marked on their segments, so exporters can emit them
+// as such (see export/capabilities.go).
+//
+// The offsets of the controller are not known to the vm, and start at zero
+// unless set with WithWorkOffsets.
+//
+
+// Number of work coordinate systems (G54 to G59.3)
+const CoordSystems = 9
+
+// Codes selecting the work coordinate systems
+var coordSystemCodes = [CoordSystems]string{"G54", "G55", "G56", "G57", "G58", "G59", "G59.1", "G59.2", "G59.3"}
+
+// The code selecting a work coordinate system, such as G54 for 0
+func CoordSystemCode(idx int) string {
+	return coordSystemCodes[idx]
+}
+
+// Sets the initial offsets of the work coordinate systems, starting at G54
+func WithWorkOffsets(offsets ...vector.Vector) Option {
+	return func(m *Machine) {
+		if len(offsets) > CoordSystems {
+			panic("Too many work offsets")
+		}
+		copy(m.WorkOffsets[:], offsets)
+	}
+}
+
+// The work offset in effect, that of the selected coordinate system plus the
+// axis and tool length offsets
+func (vm *Machine) ActiveWorkOffset() vector.Vector {
+	return vm.WorkOffsets[vm.CoordSystem].Sum(vm.AxisOffset).Sum(vm.toolOffset())
+}
+
+// The current position in the current work coordinates
+func (vm *Machine) workPos() vector.Vector {
+	return vm.curPos().MachineVector().Diff(vm.ActiveWorkOffset())
+}
+
+// Reads the axis words of the block in millimeters, keeping the given values for missing axes
+func (vm *Machine) axisWords(stmt gcode.Block, v vector.Vector) (vector.Vector, bool) {
+	found := false
+	for _, a := range []struct {
+		address rune
+		value   *float64
+	}{{'X', &v.X}, {'Y', &v.Y}, {'Z', &v.Z}} {
+		if w, err := stmt.GetWord(a.address); err == nil {
+			if a.address == 'X' {
+				*a.value = vm.xLength(w)
+			} else {
+				*a.value = vm.length(w).Millimeters()
+			}
+			found = true
+		}
+	}
+	return v, found
+}
+
+// First of the parameters holding the axis offset, see above
+const axisOffsetParam = 5210
+
+// Handles G92.1, G92.2 and G92.3, and saves the offset set by G92
+func (vm *Machine) axisOffset(g float64) {
+	if vm.Parameters == nil {
+		vm.Parameters = make(map[int]float64)
+	}
+	p := vm.Parameters
+	switch g {
+	case 92:
+		p[axisOffsetParam+1], p[axisOffsetParam+2], p[axisOffsetParam+3] = vm.AxisOffset.X, vm.AxisOffset.Y, vm.AxisOffset.Z
+	case 92.1:
+		vm.AxisOffset = vector.Vector{}
+		p[axisOffsetParam+1], p[axisOffsetParam+2], p[axisOffsetParam+3] = 0, 0, 0
+	case 92.2:
+		vm.AxisOffset = vector.Vector{}
+	case 92.3:
+		vm.AxisOffset = vector.Vector{p[axisOffsetParam+1], p[axisOffsetParam+2], p[axisOffsetParam+3]}
+	}
+	p[axisOffsetParam] = truth(g == 92 || g == 92.3)
+}
+
+// Handles G10, G43.1 and G92, returning true if the block set offsets
+func (vm *Machine) offsets(stmt gcode.Block) bool {
+	switch {
+	case stmt.HasWord('G', 10):
+		l, err := stmt.GetWord('L')
+		if err != nil || (l != 2 && l != 20) {
+			panic(Errorf(ErrUnsupportedWord, "Only G10 L2 and L20 are supported"))
+		}
+		p := int(stmt.GetWordDefault('P', 0))
+		if p < 0 || p > CoordSystems {
+			panic(Errorf(ErrInvalidWord, "Coordinate system must be between 0 and %d", CoordSystems))
+		}
+		idx := vm.CoordSystem
+		if p > 0 {
+			idx = p - 1
+		}
+
+		if l == 20 && (vm.rotation.active() || vm.scaling.Active()) {
+			panic(Errorf(ErrUnsupportedWord, "G10 L20 cannot be used with coordinate rotation (G68) or scaling (G51)"))
+		}
+		if l == 2 {
+			vm.WorkOffsets[idx], _ = vm.axisWords(stmt, vm.WorkOffsets[idx])
+		} else {
+			// Offset so that the current position gets the given coordinates
+			machine := vm.curPos().MachineVector()
+			cur := machine.Diff(vm.WorkOffsets[idx]).Diff(vm.AxisOffset).Diff(vm.toolOffset())
+			want, _ := vm.axisWords(stmt, cur)
+			vm.WorkOffsets[idx] = machine.Diff(vm.AxisOffset).Diff(vm.toolOffset()).Diff(want)
+		}
+	case stmt.HasWord('G', 92):
+		if vm.rotation.active() || vm.scaling.Active() {
+			panic(Errorf(ErrUnsupportedWord, "G92 cannot be used with coordinate rotation (G68) or scaling (G51)"))
+		}
+		machine := vm.curPos().MachineVector()
+		want, found := vm.axisWords(stmt, vm.workPos())
+		if !found {
+			panic(Errorf(ErrInvalidWord, "G92 requires at least one axis word"))
+		}
+		vm.AxisOffset = machine.Diff(vm.WorkOffsets[vm.CoordSystem]).Diff(vm.toolOffset()).Diff(want)
+		vm.axisOffset(92)
+	case stmt.HasWord('G', 43.1):
+		z, err := stmt.GetWord('Z')
+		if err != nil || stmt.IncludesOneOf('X', 'Y') {
+			panic(Errorf(ErrInvalidWord, "G43.1 requires Z, and no other axis words"))
+		}
+		vm.ToolLength = vm.length(z).Millimeters()
+	default:
+		return false
+	}
+	return true
+}
+
+// Adds a move to absolute machine coordinates (G53)
+func (vm *Machine) machineMove(stmt gcode.Block) {
+	if vm.State.MoveMode != MoveModeRapid && vm.State.MoveMode != MoveModeLinear {
+		panic(Errorf(ErrUnsupportedWord, "G53 requires G0 or G1"))
+	}
+	off := vm.ActiveWorkOffset()
+	pos, _ := vm.axisWords(stmt, vm.curPos().MachineVector())
+	vm.add(Segment{Kind: SegmentMove, X: pos.X - off.X, Y: pos.Y - off.Y, Z: pos.Z - off.Z, Machine: true})
+}
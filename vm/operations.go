@@ -0,0 +1,78 @@
+package vm
+
+// A logical operation, such as a single profile pass or a drill.
+// Operations are contiguous regions of cutting moves in the position stack,
+// separated by rapid moves (retracts), tool changes and Z level changes
+// (Z-only cutting moves, such as plunges and step-downs).
+type Operation struct {
+	Start, End int // Position indexes of the operation, End is exclusive
+	Tool       int
+	MinZ, MaxZ float64
+}
+
+// Number of positions in the operation
+func (o Operation) Length() int {
+	return o.End - o.Start
+}
+
+// Tests if the position index is part of the operation
+func (o Operation) Contains(idx int) bool {
+	return idx >= o.Start && idx < o.End
+}
+
+// Segments the position stack into operations
+func (vm *Machine) Operations() []Operation {
+	var (
+		ops    []Operation
+		cur    *Operation
+		active bool
+	)
+
+	end := func() {
+		if active {
+			ops = append(ops, *cur)
+		}
+		active = false
+	}
+
+	vm.eachPair(func(idx int, from, to Segment) {
+		mode := to.State.MoveMode
+
+		if mode != MoveModeLinear && mode != MoveModeCWArc && mode != MoveModeCCWArc {
+			end()
+			return
+		}
+
+		levelChange := to.Z != from.Z && to.X == from.X && to.Y == from.Y
+		if active && (to.State.Tool != cur.Tool || levelChange) {
+			end()
+		}
+
+		if !active {
+			cur = &Operation{Start: idx, End: idx, Tool: to.State.Tool, MinZ: to.Z, MaxZ: to.Z}
+			active = true
+		}
+
+		cur.End = idx + 1
+		if to.Z < cur.MinZ {
+			cur.MinZ = to.Z
+		}
+		if to.Z > cur.MaxZ {
+			cur.MaxZ = to.Z
+		}
+	})
+	end()
+
+	return ops
+}
+
+// Finds the operation containing the position index, returning false if the
+// position is not part of any operation.
+func (vm *Machine) OperationAt(idx int) (Operation, bool) {
+	for _, op := range vm.Operations() {
+		if op.Contains(idx) {
+			return op, true
+		}
+	}
+	return Operation{}, false
+}
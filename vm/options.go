@@ -0,0 +1,103 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+
+//
+// Construction
+//
+// New creates an initialized machine, configured by options:
+//
+//	m := vm.New(vm.WithDialect(vm.DialectMach), vm.WithArcTolerance(0.01, 0.05))
+//
+// Options are applied in order after the defaults set by Init. Machines
+// should be created with New rather than as a Machine literal, so new
+// settings get their defaults.
+//
+
+// Configures a machine created by New
+type Option func(*Machine)
+
+// Creates an initialized machine with the given options applied
+func New(opts ...Option) *Machine {
+	m := &Machine{}
+	m.Init()
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Interprets coordinates as inches until G21 is encountered
+func WithImperialDefault() Option {
+	return func(m *Machine) {
+		m.Imperial = true
+	}
+}
+
+// Sets the maximum deviation and minimum line length used when interpolating arcs
+func WithArcTolerance(maxDeviation, minLineLength float64) Option {
+	return func(m *Machine) {
+		m.MaxArcDeviation = maxDeviation
+		m.MinArcLineLength = minLineLength
+	}
+}
+
+// Checks the result of processing against the limits of the machine profile,
+// which is also used for time estimation
+func WithLimits(profile machine.Profile) Option {
+	return func(m *Machine) {
+		m.Limits = &profile
+	}
+}
+
+// Sets the dialect used to interpret the document
+func WithDialect(dialect int) Option {
+	return func(m *Machine) {
+		m.Dialect = dialect
+	}
+}
+
+// Makes feed moves without a previously set feedrate errors instead of warnings
+func WithStrictFeedrate() Option {
+	return func(m *Machine) {
+		m.StrictFeedrate = true
+	}
+}
+
+// Limits feedrates to the given maximum (mm/min), warning when a feedrate is
+// limited. Inverse time feedrates are not limited.
+func WithMaxFeedrate(feedrate float64) Option {
+	return func(m *Machine) {
+		m.MaxFeedrate = feedrate
+	}
+}
+
+// Fails processing with ErrLimitExceeded when more than max segments are
+// produced, including spilled segments, to bound the work of untrusted programs
+func WithMaxSegments(max int) Option {
+	return func(m *Machine) {
+		m.MaxSegments = max
+	}
+}
+
+// Stops the spindle and dwells for the given number of seconds before reversing it
+func WithSafeReversal(dwell float64) Option {
+	return func(m *Machine) {
+		m.SafeReversal = true
+		m.ReversalDwell = dwell
+	}
+}
+
+// Offsets the path for G41 and G42 instead of passing them on to the machine
+func WithCutterCompensation() Option {
+	return func(m *Machine) {
+		m.CompensateCutter = true
+	}
+}
+
+// Sets the tool table
+func WithToolTable(tools ToolTable) Option {
+	return func(m *Machine) {
+		m.Tools = tools
+	}
+}
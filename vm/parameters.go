@@ -0,0 +1,221 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "math"
+
+//
+// Parameters and expressions
+//
+// Expressions in words are evaluated before a block is run, using the
+// parameter table of the machine (see gcode/expr.go for the syntax). As in
+// LinuxCNC, all expressions of a block are evaluated before its assignments
+// take effect, so "#1=2 #2=#1" sets #2 to the value #1 had before the block.
+//
+// Numbered parameters that have not been set read as 0, while reading an
+// unset named parameter is an error. System parameters are not maintained,
+// except for the axis offset (see offsets.go), so the stored positions of G28
+// and G30 are only in Machine.Predefined.
+//
+
+// Highest numbered parameter
+const MaxParameter = 5602
+
+// Sets parameters before processing, such as the inputs of a parametric
+// program. Invalid parameter numbers fail processing.
+func WithParameters(numbered map[int]float64, named map[string]float64) Option {
+	return func(m *Machine) {
+		for k, v := range numbered {
+			if k < 1 || k > MaxParameter {
+				m.optionErr = Errorf(ErrInvalidExpression, "Invalid parameter number %d", k)
+				return
+			}
+			m.setParam(gcode.Parameter{gcode.Number(k), ""}, v)
+		}
+		for k, v := range named {
+			m.setParam(gcode.Parameter{nil, k}, v)
+		}
+	}
+}
+
+// Evaluates the expressions of a block and applies its assignments, returning
+// the block with the expression words replaced by their values
+func (vm *Machine) evaluate(stmt gcode.Block) gcode.Block {
+	var (
+		res     = gcode.Block{BlockDelete: stmt.BlockDelete, Line: stmt.Line, Source: stmt.Source}
+		params  []gcode.Parameter
+		values  []float64
+		changed bool
+	)
+	for _, n := range stmt.Nodes {
+		switch n := n.(type) {
+		case *gcode.ExprWord:
+			res.AppendNode(&gcode.Word{n.Address, vm.eval(n.Value)})
+			changed = true
+		case *gcode.Assignment:
+			// Resolve indirect parameters before any assignment
+			p := n.Param
+			if p.Index != nil {
+				p.Index = gcode.Number(vm.paramIndex(p))
+			}
+			params = append(params, p)
+			values = append(values, vm.eval(n.Value))
+			changed = true
+		default:
+			res.AppendNode(n)
+		}
+	}
+
+	for idx, p := range params {
+		vm.setParam(p, values[idx])
+	}
+	if !changed {
+		return stmt
+	}
+	return res
+}
+
+// The index of a numbered parameter
+func (vm *Machine) paramIndex(p gcode.Parameter) int {
+	v := vm.eval(p.Index)
+	idx := int(math.Round(v))
+	if math.Abs(v-float64(idx)) > 1e-6 || idx < 1 || idx > MaxParameter {
+		panic(Errorf(ErrInvalidExpression, "Invalid parameter number %g", v))
+	}
+	return idx
+}
+
+func (vm *Machine) setParam(p gcode.Parameter, v float64) {
+	if p.Index == nil {
+		if vm.NamedParameters == nil {
+			vm.NamedParameters = make(map[string]float64)
+		}
+		vm.NamedParameters[p.Name] = v
+		return
+	}
+	if vm.Parameters == nil {
+		vm.Parameters = make(map[int]float64)
+	}
+	vm.Parameters[vm.paramIndex(p)] = v
+}
+
+func (vm *Machine) getParam(p gcode.Parameter) float64 {
+	if p.Index == nil {
+		v, ok := vm.NamedParameters[p.Name]
+		if !ok {
+			panic(Errorf(ErrInvalidExpression, "Parameter #<%s> not set", p.Name))
+		}
+		return v
+	}
+	return vm.Parameters[vm.paramIndex(p)]
+}
+
+// Converts a truth value to a number
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Evaluates an expression
+func (vm *Machine) eval(e gcode.Expr) float64 {
+	const deg = math.Pi / 180
+
+	switch e := e.(type) {
+	case gcode.Number:
+		return float64(e)
+	case *gcode.Parameter:
+		return vm.getParam(*e)
+	case *gcode.Unary:
+		if e.Op == "EXISTS" {
+			_, ok := vm.NamedParameters[e.X.(*gcode.Parameter).Name]
+			return truth(ok)
+		}
+
+		x := vm.eval(e.X)
+		var res float64
+		switch e.Op {
+		case "-":
+			res = -x
+		case "+":
+			res = x
+		case "ABS":
+			res = math.Abs(x)
+		case "ACOS":
+			res = math.Acos(x) / deg
+		case "ASIN":
+			res = math.Asin(x) / deg
+		case "COS":
+			res = math.Cos(x * deg)
+		case "EXP":
+			res = math.Exp(x)
+		case "FIX":
+			res = math.Floor(x)
+		case "FUP":
+			res = math.Ceil(x)
+		case "ROUND":
+			res = math.Round(x)
+		case "LN":
+			res = math.Log(x)
+		case "SIN":
+			res = math.Sin(x * deg)
+		case "SQRT":
+			res = math.Sqrt(x)
+		case "TAN":
+			res = math.Tan(x * deg)
+		default:
+			panic(Errorf(ErrInvalidExpression, "Unknown function %s", e.Op))
+		}
+		if math.IsNaN(res) || math.IsInf(res, 0) {
+			panic(Errorf(ErrInvalidExpression, "%s of %g is undefined", e.Op, x))
+		}
+		return res
+	case *gcode.Binary:
+		x, y := vm.eval(e.X), vm.eval(e.Y)
+		var res float64
+		switch e.Op {
+		case "**":
+			res = math.Pow(x, y)
+		case "*":
+			res = x * y
+		case "/":
+			res = x / y
+		case "MOD":
+			res = math.Mod(x, y)
+			if res < 0 {
+				res += math.Abs(y)
+			}
+		case "+":
+			res = x + y
+		case "-":
+			res = x - y
+		case "EQ":
+			res = truth(x == y)
+		case "NE":
+			res = truth(x != y)
+		case "GT":
+			res = truth(x > y)
+		case "GE":
+			res = truth(x >= y)
+		case "LT":
+			res = truth(x < y)
+		case "LE":
+			res = truth(x <= y)
+		case "AND":
+			res = truth(x != 0 && y != 0)
+		case "OR":
+			res = truth(x != 0 || y != 0)
+		case "XOR":
+			res = truth((x != 0) != (y != 0))
+		case "ATAN":
+			res = math.Atan2(x, y) / deg
+		default:
+			panic(Errorf(ErrInvalidExpression, "Unknown operator %s", e.Op))
+		}
+		if math.IsNaN(res) || math.IsInf(res, 0) {
+			panic(Errorf(ErrInvalidExpression, "[%g %s %g] is undefined", x, e.Op, y))
+		}
+		return res
+	}
+	panic(Errorf(ErrInvalidExpression, "Unknown expression %T", e))
+}
@@ -0,0 +1,130 @@
+package vm
+
+import "errors"
+import "math"
+import "testing"
+
+func TestWithParameters(t *testing.T) {
+	tests := []struct {
+		name     string
+		numbered map[int]float64
+		named    map[string]float64
+		x        float64 // Expected end position
+		err      error
+	}{
+		{"numbered", map[int]float64{1: 5}, nil, 5, nil},
+		{"named", nil, map[string]float64{"x": 7}, 7, nil},
+		{"zero", map[int]float64{0: 5}, nil, 0, ErrInvalidExpression},
+		{"too high", map[int]float64{MaxParameter + 1: 5}, nil, 0, ErrInvalidExpression},
+	}
+	for _, test := range tests {
+		program := "G21 G90 G0 X#1\n"
+		if test.named != nil {
+			program = "G21 G90 G0 X#<x>\n"
+		}
+		m, err := processProgram(program, WithParameters(test.numbered, test.named))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, expected %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && m.Segments[len(m.Segments)-1].X != test.x {
+			t.Errorf("%s: got X%g, expected X%g", test.name, m.Segments[len(m.Segments)-1].X, test.x)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	tests := []struct {
+		expr string
+		x    float64
+	}{
+		{"[1+2*3]", 7},
+		{"[[1+2]*3]", 9},
+		{"[2*3**2]", 18},
+		{"[8-2-1]", 5},
+		{"[7/2]", 3.5},
+		{"[7 MOD 3]", 1},
+		{"[-7 MOD 3]", 2},
+		{"[1+1 EQ 2]", 1},
+		{"[1 NE 1]", 0},
+		{"[2 GT 1]", 1},
+		{"[1 GE 2]", 0},
+		{"[1 LT 2]", 1},
+		{"[2 LE 2]", 1},
+		{"[1 AND 0]", 0},
+		{"[1 OR 0]", 1},
+		{"[1 XOR 1]", 0},
+		{"-[1+2]", -3},
+		{"ABS[-2]", 2},
+		{"ACOS[0]", 90},
+		{"ASIN[1]", 90},
+		{"COS[60]", 0.5},
+		{"SIN[30]", 0.5},
+		{"TAN[45]", 1},
+		{"ATAN[1]/[-1]", 135},
+		{"EXP[0]", 1},
+		{"LN[1]", 0},
+		{"SQRT[16]", 4},
+		{"FIX[-1.5]", -2},
+		{"FUP[1.2]", 2},
+		{"ROUND[2.5]", 3},
+		{"EXISTS[#<unset>]", 0},
+	}
+	for _, test := range tests {
+		m, err := processProgram("G21 G90 G0 X" + test.expr + "\n")
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		if x := m.Segments[len(m.Segments)-1].X; math.Abs(x-test.x) > 1e-9 {
+			t.Errorf("%s: got X%g, expected X%g", test.expr, x, test.x)
+		}
+	}
+}
+
+func TestParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		x       float64
+	}{
+		{"numbered", "#1=5\nG0 X#1\n", 5},
+		{"unset numbered", "G0 X[#1+1]\n", 1},
+		{"named", "#<Depth Of Cut>=2\nG0 X#<depthofcut>\n", 2},
+		{"expression", "#1=5\n#<half>=[#1/2]\nG0 X[#<half>*2+#1]\n", 10},
+		{"indirect", "#3=7\n#1=3\nG0 X#[#1]\n", 7},
+		{"indirect assignment", "#1=3\n#[#1+1]=9\nG0 X#4\n", 9},
+		{"double indirect", "#1=2\n#2=4\n#4=8\nG0 X##1\n", 4},
+		{"same block", "#1=1\n#1=2 #2=#1\nG0 X#2\n", 1},
+		{"exists", "#<x>=0\nG0 X[EXISTS[#<x>]+1]\n", 2},
+	}
+	for _, test := range tests {
+		m, err := processProgram("G21 G90\n" + test.program)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if x := m.Segments[len(m.Segments)-1].X; math.Abs(x-test.x) > 1e-9 {
+			t.Errorf("%s: got X%g, expected X%g", test.name, x, test.x)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, program := range []string{
+		"G0 X#<unset>\n",
+		"G0 X[1/0]\n",
+		"G0 X[1 MOD 0]\n",
+		"G0 XSQRT[-1]\n",
+		"G0 XLN[0]\n",
+		"G0 XACOS[2]\n",
+		"G0 X#0\n",
+		"G0 X#[1.5]\n",
+		"#1=-1\nG0 X#[#1]\n",
+		"G0 X#100000000\n",
+	} {
+		if _, err := processProgram("G21 G90\n" + program); !errors.Is(err, ErrInvalidExpression) {
+			t.Errorf("%q: got error %v, expected %v", program, err, ErrInvalidExpression)
+		}
+	}
+}
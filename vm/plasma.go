@@ -0,0 +1,78 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+
+//
+// Plasma cutting
+//
+// With plasma settings (see WithPlasma), the spindle is the torch: M3 or M4
+// fires it, and M5 extinguishes it. Firing the torch pierces the sheet at the
+// current XY position:
+//
+//   G0 Z<PierceHeight>      with the torch off
+//   G4 P<PierceDelay>       with the torch on
+//   G1 Z<CutHeight>
+//
+// The moves are left out if PierceHeight is 0, and the dwell if PierceDelay
+// is 0. Heights are in millimeters, in work coordinates with Z0 on the sheet.
+//
+// Torch height control (THC) is disabled by turning the THCOutput digital
+// output on (M62 or M64 P<THCOutput>), and enabled by turning it off (M63 or
+// M65), as with the LinuxCNC plasma configurations. Other digital outputs are
+// not supported.
+//
+
+// Plasma torch settings
+type Plasma struct {
+	PierceHeight float64 // Height to fire the torch at, 0 to fire at the current height
+	PierceDelay  float64 // Seconds to wait after firing the torch before moving
+	CutHeight    float64 // Height to cut at after piercing
+	THCOutput    int     // Digital output disabling torch height control, -1 for none
+}
+
+// Interprets the spindle as a plasma torch with the given settings
+func WithPlasma(p Plasma) Option {
+	return func(m *Machine) {
+		m.Plasma = &p
+	}
+}
+
+// Pierces the sheet if the torch is about to be fired
+func (vm *Machine) pierce(clockwise bool) {
+	if vm.Plasma == nil || vm.State.SpindleEnabled {
+		return
+	}
+
+	var (
+		p     = vm.Plasma
+		saved = vm.State
+		pos   = vm.workPos()
+	)
+	if p.PierceHeight > 0 {
+		vm.State.MoveMode = MoveModeRapid
+		pos.Z = p.PierceHeight
+		vm.add(Segment{Kind: SegmentMove, X: pos.X, Y: pos.Y, Z: pos.Z})
+	}
+
+	vm.State.SpindleEnabled = true
+	vm.State.SpindleClockwise = clockwise
+	if p.PierceDelay > 0 {
+		vm.State.MoveMode = MoveModeNone
+		vm.add(Segment{Kind: SegmentDwell, X: pos.X, Y: pos.Y, Z: pos.Z, Param: p.PierceDelay})
+	}
+
+	if p.PierceHeight > 0 {
+		vm.State.MoveMode = MoveModeLinear
+		vm.add(Segment{Kind: SegmentMove, X: pos.X, Y: pos.Y, Z: p.CutHeight})
+	}
+	vm.State = saved
+}
+
+// Handles digital outputs (M62 to M65), which only control torch height control
+func (vm *Machine) digitalOutput(stmt gcode.Block, m float64) {
+	p, err := stmt.GetWord('P')
+	if vm.Plasma == nil || vm.Plasma.THCOutput < 0 || err != nil || int(p) != vm.Plasma.THCOutput {
+		panic(Errorf(ErrUnsupportedWord, "M%g is only supported for torch height control", m))
+	}
+	vm.State.THCDisabled = m == 62 || m == 64
+}
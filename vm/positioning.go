@@ -1,52 +1,113 @@
 package vm
 
 import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/warnings"
 import "math"
 
-import "fmt"
+// Most lines an arc is approximated by, to fail on arcs of runaway turns (P)
+const maxArcLines = 1000000
 
-// Retrieves position from top of stack
-func (vm *Machine) curPos() Position {
-	return vm.Positions[len(vm.Positions)-1]
+// Retrieves the segment from top of stack
+func (vm *Machine) curPos() Segment {
+	return vm.Segments[len(vm.Segments)-1]
 }
 
-// Appends a position to the stack
-func (vm *Machine) addPos(pos Position) {
-	vm.Positions = append(vm.Positions, pos)
+// Appends a move segment to the current machine state to the stack
+func (vm *Machine) addPos(x, y, z float64) {
+	vm.add(Segment{Kind: SegmentMove, X: x, Y: y, Z: z})
 }
 
-// Calculates the absolute position of the given statement, including optional I, J, K parameters
+// Appends a segment with the current machine state to the stack, sharing
+// the state of the previous segment if unchanged
+func (vm *Machine) add(seg Segment) {
+	if seg.Kind != SegmentDwell {
+		vm.checkFeedrate()
+	}
+	seg.Line, seg.Source = vm.line, vm.source
+	seg.Offset = vm.ActiveWorkOffset()
+	seg.AxisOffset = vm.AxisOffset
+	seg.A, seg.B, seg.C = vm.rotary[0], vm.rotary[1], vm.rotary[2]
+	if last := vm.curPos().State; *last == vm.State {
+		seg.State = last
+	} else {
+		seg.SetState(vm.State)
+	}
+	if vm.MaxSegments > 0 && vm.Len() >= vm.MaxSegments {
+		panic(Errorf(ErrLimitExceeded, "Program exceeds the maximum of %d segments", vm.MaxSegments))
+	}
+	from := vm.curPos()
+	vm.Segments = append(vm.Segments, seg)
+	vm.fire(from, seg)
+	vm.maybeSpill()
+}
+
+// Checks that feed moves have a feedrate, as moves without one would be exported
+// without, and the controller would either refuse them or use whatever it had.
+// Inverse time feeds are given per move, and not checked.
+func (vm *Machine) checkFeedrate() {
+	if vm.State.MoveMode != MoveModeLinear || vm.State.FeedMode == FeedModeInvTime || vm.State.Feedrate > 0 {
+		return
+	}
+	if vm.StrictFeedrate {
+		panic(Errorf(ErrMissingFeedrate, "Feed move without a feedrate"))
+	}
+	if !vm.noFeed {
+		// Only the first, as all following moves are likely to lack it as well
+		vm.warn(warnings.SeverityWarning, "Feed move without a feedrate")
+		vm.noFeed = true
+	}
+}
+
+// Converts a position from program to work coordinates, applying the scaling
+// (G51) and rotation (G68) in effect
+func (vm *Machine) toWork(x, y, z float64) (float64, float64, float64) {
+	v := vm.scaling.Apply(vector.Vector{x, y, z})
+	v.X, v.Y = vm.rotation.apply(v.X, v.Y)
+	return v.X, v.Y, v.Z
+}
+
+// The current position in program coordinates, with the rotation and scaling
+// in effect reverted
+func (vm *Machine) programPos() vector.Vector {
+	pos := vm.workPos()
+	pos.X, pos.Y = vm.rotation.revert(pos.X, pos.Y)
+	return vm.scaling.Revert(pos)
+}
+
+// Calculates the absolute position of the given statement in millimeters and
+// program coordinates, including optional I, J, K parameters
 func (vm *Machine) calcPos(stmt gcode.Block) (newX, newY, newZ, newI, newJ, newK float64) {
-	pos := vm.curPos()
+	pos := vm.programPos()
 	var err error
 
+	// Missing axes stay where they are, which is no distance in relative mode
+	keep := pos
+	if !vm.AbsoluteMove {
+		keep = vector.Vector{}
+	}
+
 	if newX, err = stmt.GetWord('X'); err != nil {
-		newX = pos.X
-	} else if vm.Imperial {
-		newX *= 25.4
+		newX = keep.X
+	} else {
+		newX = vm.xLength(newX)
 	}
 
 	if newY, err = stmt.GetWord('Y'); err != nil {
-		newY = pos.Y
-	} else if vm.Imperial {
-		newY *= 25.4
+		newY = keep.Y
+	} else {
+		newY = vm.length(newY).Millimeters()
 	}
 
 	if newZ, err = stmt.GetWord('Z'); err != nil {
-		newZ = pos.Z
-	} else if vm.Imperial {
-		newZ *= 25.4
+		newZ = keep.Z
+	} else {
+		newZ = vm.length(newZ).Millimeters()
 	}
 
-	newI = stmt.GetWordDefault('I', 0.0)
-	newJ = stmt.GetWordDefault('J', 0.0)
-	newK = stmt.GetWordDefault('K', 0.0)
-
-	if vm.Imperial {
-		newI *= 25.4
-		newJ *= 25.4
-		newK *= 25.4
-	}
+	newI = vm.length(stmt.GetWordDefault('I', 0.0)).Millimeters()
+	newJ = vm.length(stmt.GetWordDefault('J', 0.0)).Millimeters()
+	newK = vm.length(stmt.GetWordDefault('K', 0.0)).Millimeters()
 
 	if !vm.AbsoluteMove {
 		newX += pos.X
@@ -63,89 +124,177 @@ func (vm *Machine) calcPos(stmt gcode.Block) (newX, newY, newZ, newI, newJ, newK
 	return newX, newY, newZ, newI, newJ, newK
 }
 
+// Calculates the absolute angles of the rotary axes of the given statement in
+// degrees, keeping the current angles of the axes not given
+func (vm *Machine) calcRotary(stmt gcode.Block) [3]float64 {
+	angles := vm.rotary
+	for idx, axis := range "ABC" {
+		words := stmt.GetAllWords(axis)
+		if len(words) == 0 {
+			continue
+		} else if len(words) > 1 {
+			panic(Errorf(ErrInvalidWord, "Multiple instances of address '%c' in block", axis))
+		}
+
+		if vm.AbsoluteMove {
+			angles[idx] = words[0]
+		} else {
+			angles[idx] += words[0]
+		}
+	}
+	return angles
+}
+
 // Adds a simple linear move
 func (vm *Machine) move(stmt gcode.Block) {
 	newX, newY, newZ, _, _, _ := vm.calcPos(stmt)
-	vm.addPos(Position{vm.State, newX, newY, newZ})
+	vm.addPos(vm.toWork(newX, newY, newZ))
+}
+
+// Finds the center of an arc of radius r in the plane of the arc. A positive
+// radius gives the arc of at most 180 degrees, a negative the arc of more.
+func arcCenter(s1, s2, e1, e2, r float64, clockwise bool) (float64, float64) {
+	d := math.Hypot(e1-s1, e2-s2)
+	if r == 0 || d == 0 {
+		panic(Errorf(ErrInvalidArc, "Radius format arcs require a non-zero radius and distinct end points"))
+	}
+	if d/2 > math.Abs(r)*1.01 {
+		panic(Errorf(ErrRadiusMismatch, "Arc radius %g too small for end points %g apart", math.Abs(r), d))
+	}
+
+	// Distance from the middle of the chord to the center, to the left
+	// of the chord for counterclockwise arcs of at most 180 degrees
+	h := math.Sqrt(math.Max(r*r-d*d/4, 0))
+	if clockwise != (r < 0) {
+		h = -h
+	}
+	return (s1+e1)/2 - h*(e2-s2)/d, (s2+e2)/2 + h*(e1-s1)/d
 }
 
 // Calculates an approximate arc from the provided statement
 func (vm *Machine) arc(stmt gcode.Block) {
 	var (
-		startPos                           Position = vm.curPos()
-		endX, endY, endZ, endI, endJ, endK float64  = vm.calcPos(stmt)
-		s1, s2, s3, e1, e2, e3, c1, c2, P  float64
+		startPos                           vector.Vector = vm.programPos()
+		endX, endY, endZ, endI, endJ, endK float64       = vm.calcPos(stmt)
+		s1, s2, s3, e1, e2, e3, c1, c2     float64
+		turns                              float64 = 1
 		add                                func(x, y, z float64)
 		clockwise                          bool = (vm.State.MoveMode == MoveModeCWArc)
 	)
 
 	vm.State.MoveMode = MoveModeLinear
 
-	// Read the additional rotation parameter
-	if pp, err := stmt.GetWord('P'); err == nil {
-		P = pp
+	// Read the number of turns, 1 being an arc of at most a full circle
+	if p, err := stmt.GetWord('P'); err == nil {
+		if p < 1 || p != math.Trunc(p) {
+			panic(Errorf(ErrInvalidArc, "Arc turns (P) must be a positive integer, got %g", p))
+		}
+		turns = p
 	}
 
-	//  Flip coordinate system for working in other planes
+	//  Flip coordinate system for working in other planes.
+	//  Points are absolute millimeters in program coordinates, so they are
+	//  added directly rather than through move, which would convert units and
+	//  relative coordinates again. Scaling and rotation apply to every point,
+	//  which makes ellipses of arcs scaled with unequal factors.
 	switch vm.MovePlane {
 	case PlaneXY:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.X, startPos.Y, startPos.Z, endX, endY, endZ, endI, endJ
 		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', x}, gcode.Word{'Y', y}, gcode.Word{'Z', z}
-			vm.move(gcode.Block{Nodes: []gcode.Node{&wx, &wy, &wz}})
+			vm.addPos(vm.toWork(x, y, z))
 		}
 	case PlaneXZ:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.Z, startPos.X, startPos.Y, endZ, endX, endY, endK, endI
 		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', y}, gcode.Word{'Y', z}, gcode.Word{'Z', x}
-			vm.move(gcode.Block{Nodes: []gcode.Node{&wx, &wy, &wz}})
-
+			vm.addPos(vm.toWork(y, z, x))
 		}
 	case PlaneYZ:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.Y, startPos.Z, startPos.X, endY, endZ, endX, endJ, endK
 		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', z}, gcode.Word{'Y', x}, gcode.Word{'Z', y}
-			vm.move(gcode.Block{Nodes: []gcode.Node{&wx, &wy, &wz}})
+			vm.addPos(vm.toWork(z, x, y))
+		}
+	}
+
+	// Radius format, where the center is found from the radius instead
+	if r, err := stmt.GetWord('R'); err == nil {
+		if stmt.IncludesOneOf('I', 'J', 'K') {
+			panic(Errorf(ErrInvalidArc, "Arc with both a radius (R) and a center (I, J, K)"))
 		}
+		c1, c2 = arcCenter(s1, s2, e1, e2, vm.length(r).Millimeters(), clockwise)
 	}
 
 	radius1 := math.Sqrt(math.Pow(c1-s1, 2) + math.Pow(c2-s2, 2))
 	radius2 := math.Sqrt(math.Pow(c1-e1, 2) + math.Pow(c2-e2, 2))
 	if radius1 == 0 || radius2 == 0 {
-		panic("Invalid arc statement")
+		panic(Errorf(ErrInvalidArc, "Invalid arc statement"))
 	}
 
 	if math.Abs((radius2-radius1)/radius1) > 0.01 {
-		panic(fmt.Sprintf("Radius deviation of %f percent", math.Abs((radius2-radius1)/radius1)*100))
+		panic(Errorf(ErrRadiusMismatch, "Radius deviation of %f percent", math.Abs((radius2-radius1)/radius1)*100))
 	}
 
 	theta1 := math.Atan2((s2 - c2), (s1 - c1))
 	theta2 := math.Atan2((e2 - c2), (e1 - c1))
 
+	// An end point equal to the start point is a full circle, not an empty arc.
+	// Comparing points avoids rounding in the angles turning it into either.
 	angleDiff := theta2 - theta1
-	if angleDiff < 0 && !clockwise {
+	if math.Hypot(e1-s1, e2-s2) < radius1*1e-9 {
+		angleDiff = 0
+	}
+	if angleDiff <= 0 && !clockwise {
 		angleDiff += 2 * math.Pi
-	} else if angleDiff > 0 && clockwise {
+	} else if angleDiff >= 0 && clockwise {
 		angleDiff -= 2 * math.Pi
 	}
 
+	// Additional turns, making a helix if the end point is at another height
 	if clockwise {
-		angleDiff -= P * 2 * math.Pi
+		angleDiff -= (turns - 1) * 2 * math.Pi
 	} else {
-		angleDiff += P * 2 * math.Pi
+		angleDiff += (turns - 1) * 2 * math.Pi
+	}
+	if turns > 1 && math.Abs(e3-s3) < vm.MinArcLineLength {
+		vm.warn(warnings.SeverityWarning, "Arc of %g turns without a helical pitch retraces itself", turns)
 	}
 
-	steps := 1
+	lines := 1.0
 	if vm.MaxArcDeviation < radius1 {
-		steps = int(math.Ceil(math.Abs(angleDiff / (2 * math.Acos(1-vm.MaxArcDeviation/radius1)))))
+		lines = math.Ceil(math.Abs(angleDiff / (2 * math.Acos(1-vm.MaxArcDeviation/radius1))))
 	}
 
 	// Enforce a minimum line length
 	arcLen := math.Abs(angleDiff) * math.Sqrt(math.Pow(radius1, 2)+math.Pow((e3-s3)/angleDiff, 2))
-	steps2 := int(arcLen / vm.MinArcLineLength)
+	if lines2 := math.Floor(arcLen / vm.MinArcLineLength); lines > lines2 {
+		lines = lines2
+	}
+	if lines > maxArcLines {
+		panic(Errorf(ErrInvalidArc, "Arc of %g turns needs %g lines, more than the maximum of %d", turns, lines, maxArcLines))
+	}
+	if !(lines >= 1) {
+		lines = 1
+	}
+	steps := int(lines)
+
+	arc := ArcInfo{
+		Start:     vm.Len(),
+		Radius:    radius1,
+		Angle:     math.Abs(angleDiff),
+		Segments:  steps,
+		Deviation: radius1 * (1 - math.Cos(math.Abs(angleDiff)/float64(2*steps))),
+	}
+	defer func() {
+		arc.End = vm.Len()
+		vm.Arcs = append(vm.Arcs, arc)
+	}()
 
-	if steps > steps2 {
-		steps = steps2
+	if vm.State.FeedMode == FeedModeInvTime {
+		// The arc takes 1/F minutes, and each line 1/steps of it, see feed.go
+		feedrate := vm.State.Feedrate
+		vm.State.Feedrate *= float64(steps)
+		defer func() {
+			vm.State.Feedrate = feedrate
+		}()
 	}
 
 	angle := 0.0
@@ -0,0 +1,38 @@
+package vm
+
+import "errors"
+import "testing"
+
+func TestArcTurns(t *testing.T) {
+	one, err := processProgram("F100\nG2 X0 Y0 I1 J0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := processProgram("F100\nG2 X0 Y0 Z-1 I1 J0 P2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(one.Arcs) != 1 || len(two.Arcs) != 1 {
+		t.Fatalf("Got %d and %d arcs, expected 1 each", len(one.Arcs), len(two.Arcs))
+	}
+	if got, expected := two.Arcs[0].Segments, 2*one.Arcs[0].Segments; got != expected {
+		t.Errorf("Got %d lines for two turns, expected %d", got, expected)
+	}
+}
+
+func TestArcTurnErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+	}{
+		{"zero turns", "F100\nG2 X0 Y0 I1 J0 P0\n"},
+		{"fractional turns", "F100\nG2 X0 Y0 I1 J0 P1.5\n"},
+		{"too many turns", "F100\nG2 X0 Y0 I1 J0 P100000000\n"},
+		{"too many helical turns", "F100\nG2 X0 Y0 Z-100 I1 J0 P1000000000000000\n"},
+	}
+	for _, test := range tests {
+		if _, err := processProgram(test.program); !errors.Is(err, ErrInvalidArc) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, ErrInvalidArc)
+		}
+	}
+}
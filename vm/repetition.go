@@ -0,0 +1,90 @@
+package vm
+
+import "github.com/joushou/gocnc/vector"
+import "math"
+
+//
+// Repetition detection
+//
+// CAM output for hole arrays, grid engraving and similar is the same motion
+// pattern repeated at regular intervals. Such a run is found as a periodic
+// sequence of segment deltas: if every segment moves by the same vector, with
+// the same state, as the segment one period later, each period is a copy of
+// the previous one moved by a constant offset.
+//
+// The repetitions are only reported for now. Exporters for dialects with
+// loops (O-words) could emit each as a loop over a relative (G91) body.
+//
+
+// A pattern of segments repeated at a constant offset
+type Repetition struct {
+	Start  int           // Index of the first segment of the first instance
+	Length int           // Segments per instance, including the move to the next instance
+	Count  int           // Number of instances
+	Offset vector.Vector // Offset between instances
+}
+
+// Index after the last segment of the repetition
+func (r Repetition) End() int {
+	return r.Start + r.Length*r.Count
+}
+
+// Longest pattern searched for, in segments
+const maxRepetitionLength = 64
+
+// Finds patterns of at least two segments repeated at least minCount times,
+// comparing positions within the tolerance. Repetitions do not overlap.
+func (vm *Machine) Repetitions(minCount int, tolerance float64) []Repetition {
+	if minCount < 2 {
+		minCount = 2
+	}
+
+	segs := vm.Segments
+	if vm.Spilled() {
+		// Runs may span the whole program, so spilled segments are read back
+		segs = make([]Segment, 0, vm.Len())
+		for _, seg := range vm.All() {
+			segs = append(segs, seg)
+		}
+	}
+
+	var (
+		res    []Repetition
+		deltas = make([]vector.Vector, len(segs))
+	)
+	for idx := 1; idx < len(segs); idx++ {
+		deltas[idx] = segs[idx].Vector().Diff(segs[idx-1].Vector())
+	}
+
+	same := func(a, b int) bool {
+		sa, sb := segs[a], segs[b]
+		d := deltas[a].Diff(deltas[b])
+		return sa.Kind == sb.Kind && sa.Param == sb.Param && sa.Axis == sb.Axis &&
+			*sa.State == *sb.State && sa.Offset == sb.Offset && sa.Machine == sb.Machine &&
+			math.Abs(d.X) <= tolerance && math.Abs(d.Y) <= tolerance && math.Abs(d.Z) <= tolerance
+	}
+
+	for idx := 1; idx < len(segs); {
+		best := Repetition{Start: idx}
+		for length := 2; length <= maxRepetitionLength && idx+2*length <= len(segs); length++ {
+			// Number of segments matching the segment one period later
+			run := 0
+			for idx+run+length < len(segs) && same(idx+run, idx+run+length) {
+				run++
+			}
+			count := run/length + 1
+			if count >= minCount && length*count > best.Length*best.Count {
+				best = Repetition{idx, length, count, vector.Vector{}}
+			}
+		}
+
+		if best.Count == 0 {
+			idx++
+			continue
+		}
+		best.Offset = segs[idx+best.Length].Vector().Diff(segs[idx].Vector())
+		res = append(res, best)
+		idx = best.End()
+	}
+	return res
+}
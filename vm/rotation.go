@@ -0,0 +1,69 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "math"
+
+//
+// Coordinate rotation
+//
+// G68 rotates the coordinates of the program in the XY plane, as on Fanuc and
+// Haas controllers, so that a pocket programmed square to the axes can be cut
+// at an angle. R is the angle in degrees, counterclockwise, and X and Y the
+// center of the rotation in work coordinates, the current position for the
+// axes not given. Both are absolute, also with G91:
+//
+//   G68 X10 Y10 R30
+//
+// G69 cancels the rotation, and a new G68 replaces it. Positions are computed
+// with the rotation applied, so segments are in unrotated work coordinates,
+// and the rotation is part of the exported moves for controllers without G68.
+// Only the XY plane is supported, and offsets cannot be set by position (G10
+// L20 and G92) while rotated. Scaling (G51, see scaling.go) is applied first.
+//
+
+// Active coordinate rotation
+type coordRotation struct {
+	angle  float64       // Radians counterclockwise, 0 if not rotated
+	center vector.Vector // Work coordinates, only X and Y used
+}
+
+// Rotates a point from program to work coordinates
+func (r coordRotation) apply(x, y float64) (float64, float64) {
+	return r.turn(x, y, r.angle)
+}
+
+// Rotates a point from work to program coordinates
+func (r coordRotation) revert(x, y float64) (float64, float64) {
+	return r.turn(x, y, -r.angle)
+}
+
+func (r coordRotation) turn(x, y, angle float64) (float64, float64) {
+	if angle == 0 {
+		return x, y
+	}
+	sin, cos := math.Sincos(angle)
+	dx, dy := x-r.center.X, y-r.center.Y
+	return r.center.X + dx*cos - dy*sin, r.center.Y + dx*sin + dy*cos
+}
+
+// Tests if a rotation is active
+func (r coordRotation) active() bool {
+	return r.angle != 0
+}
+
+// Starts a coordinate rotation (G68 [X] [Y] R)
+func (vm *Machine) rotateCoordinates(stmt gcode.Block) {
+	if vm.MovePlane != PlaneXY {
+		panic(Errorf(ErrUnsupportedWord, "G68 is only supported in the XY plane"))
+	}
+	if stmt.IncludesOneOf('Z') {
+		panic(Errorf(ErrInvalidWord, "G68 takes X, Y and R, but not Z"))
+	}
+	r, err := stmt.GetWord('R')
+	if err != nil {
+		panic(Errorf(ErrInvalidWord, "G68 requires a rotation angle (R)"))
+	}
+	center, _ := vm.axisWords(stmt, vm.workPos())
+	vm.rotation = coordRotation{r * math.Pi / 180, center}
+}
@@ -0,0 +1,107 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+
+//
+// Scaling
+//
+// G51 scales the coordinates of the program about a center, as on Fanuc and
+// Haas controllers, so that a program can be cut larger, smaller or mirrored
+// for the other side of a fixture. X, Y and Z are the center in work
+// coordinates, the current position for the axes not given, and P the
+// factor of all axes, or I, J and K those of X, Y and Z, 1 for those not
+// given. Negative factors mirror the axis:
+//
+//   G51 X50 Y0 P0.5     - half size about X50 Y0
+//   G51 X0 Y0 I-1 J1    - mirrored about the Y axis
+//
+// G50 cancels the scaling, and a new G51 replaces it. Scaling comes before
+// rotation (G68, see rotation.go), and is applied to the positions computed
+// for the program, so arcs become ellipses with unequal factors. Tool radii
+// of cutter compensation are not scaled, and G41 and G42 change sides when
+// mirrored in one of X and Y, to keep the tool outside the mirrored part.
+//
+// Unless the vm is told to bake the scaling into the positions with
+// BakeScaling, the scaling in effect is also kept in the state of the
+// segments, so exporters to controllers with scaling can pass it on (see
+// export/capabilities.go). Offsets cannot be set by position (G10 L20 and
+// G92) while scaled.
+//
+
+// Scaling of program coordinates about a center (G51)
+type Scaling struct {
+	Center  vector.Vector // Work coordinates
+	Factors vector.Vector // Factors of X, Y and Z, negative to mirror, all zero if not scaling
+}
+
+// Tests if the scaling is in effect
+func (s Scaling) Active() bool {
+	return s.Factors != vector.Vector{}
+}
+
+// Scales a point of the program
+func (s Scaling) Apply(v vector.Vector) vector.Vector {
+	if !s.Active() {
+		return v
+	}
+	return vector.Vector{
+		s.Center.X + (v.X-s.Center.X)*s.Factors.X,
+		s.Center.Y + (v.Y-s.Center.Y)*s.Factors.Y,
+		s.Center.Z + (v.Z-s.Center.Z)*s.Factors.Z,
+	}
+}
+
+// Reverts the scaling of a point
+func (s Scaling) Revert(v vector.Vector) vector.Vector {
+	if !s.Active() {
+		return v
+	}
+	return vector.Vector{
+		s.Center.X + (v.X-s.Center.X)/s.Factors.X,
+		s.Center.Y + (v.Y-s.Center.Y)/s.Factors.Y,
+		s.Center.Z + (v.Z-s.Center.Z)/s.Factors.Z,
+	}
+}
+
+// Tests if the scaling mirrors the XY plane, swapping left and right
+func (s Scaling) mirrored() bool {
+	return s.Active() && (s.Factors.X < 0) != (s.Factors.Y < 0)
+}
+
+// Bakes the scaling into the positions only, instead of also keeping it in
+// the state for exporters
+func WithBakedScaling() Option {
+	return func(m *Machine) {
+		m.BakeScaling = true
+	}
+}
+
+// Starts scaling (G51 [X] [Y] [Z] P or I J K)
+func (vm *Machine) scale(stmt gcode.Block) {
+	if stmt.IncludesOneOf('P') && stmt.IncludesOneOf('I', 'J', 'K') {
+		panic(Errorf(ErrInvalidWord, "G51 takes either a factor for all axes (P) or per axis (I, J, K)"))
+	}
+	if !stmt.IncludesOneOf('P', 'I', 'J', 'K') {
+		panic(Errorf(ErrInvalidWord, "G51 requires a scale factor (P, or I, J and K)"))
+	}
+	p := stmt.GetWordDefault('P', 1)
+	factors := vector.Vector{
+		stmt.GetWordDefault('I', p),
+		stmt.GetWordDefault('J', p),
+		stmt.GetWordDefault('K', p),
+	}
+	if factors.X == 0 || factors.Y == 0 || factors.Z == 0 {
+		panic(Errorf(ErrInvalidWord, "G51 scale factors must be non-zero"))
+	}
+	center, _ := vm.axisWords(stmt, vm.workPos())
+	vm.setScaling(Scaling{center, factors})
+}
+
+// Sets the scaling in effect, and in the state unless baked
+func (vm *Machine) setScaling(s Scaling) {
+	vm.scaling = s
+	if !vm.BakeScaling {
+		vm.State.Scaling = s
+	}
+}
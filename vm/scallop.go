@@ -0,0 +1,133 @@
+package vm
+
+import "github.com/joushou/gocnc/vector"
+import "math"
+
+// A pair of adjacent parallel passes
+type ScallopRegion struct {
+	Start, End int     // Position indexes of the second pass, End is exclusive
+	Stepover   float64 // Distance between the passes (mm)
+	Height     float64 // Estimated scallop height (mm)
+}
+
+// Scallop height estimation for parallel finishing passes
+type ScallopReport struct {
+	Passes    int             // Number of detected passes
+	MaxHeight float64         // Largest estimated scallop height (mm)
+	Regions   []ScallopRegion // Regions exceeding the target height
+}
+
+// Calculates the scallop height left by a ball-nose tool with the given radius and stepover
+func ScallopHeight(radius, stepover float64) float64 {
+	if stepover >= 2*radius {
+		return radius
+	}
+	return radius - math.Sqrt(radius*radius-stepover*stepover/4)
+}
+
+// A single pass, as detected by ScallopReport
+type pass struct {
+	start, end int
+	from, to   vector.Vector
+}
+
+// Direction of the pass in the XY plane
+func (p pass) dir() vector.Vector {
+	d := p.to.Diff(p.from)
+	d.Z = 0
+	if n := d.Norm(); n > 0 {
+		return d.Divide(n)
+	}
+	return d
+}
+
+// Length of the pass in the XY plane
+func (p pass) length() float64 {
+	d := p.to.Diff(p.from)
+	d.Z = 0
+	return d.Norm()
+}
+
+// Splits the cutting moves into passes at retracts and direction changes above 45 degrees
+func (vm *Machine) passes() []pass {
+	var (
+		res  []pass
+		cur  *pass
+		last vector.Vector
+	)
+
+	vm.eachPair(func(idx int, from, to Segment) {
+		d := to.Vector().Diff(from.Vector())
+		d.Z = 0
+
+		if to.State.MoveMode != MoveModeLinear || d.Norm() == 0 {
+			if to.State.MoveMode != MoveModeLinear && cur != nil {
+				res = append(res, *cur)
+				cur = nil
+			}
+			return
+		}
+
+		d = d.Divide(d.Norm())
+		if cur != nil && d.Dot(last) < math.Cos(math.Pi/4) {
+			res = append(res, *cur)
+			cur = nil
+		}
+		if cur == nil {
+			cur = &pass{start: idx, from: from.Vector()}
+		}
+		cur.end, cur.to = idx+1, to.Vector()
+		last = d
+	})
+	if cur != nil {
+		res = append(res, *cur)
+	}
+	return res
+}
+
+// Estimates the scallop height between adjacent parallel passes for a ball-nose
+// tool with the given radius, reporting all regions exceeding the target height.
+// Passes are considered parallel if their directions deviate less than 5 degrees.
+func (vm *Machine) ScallopReport(toolRadius, target float64) ScallopReport {
+	var (
+		report   ScallopReport
+		passes   = vm.passes()
+		maxCross = math.Sin(5 * math.Pi / 180)
+	)
+
+	report.Passes = len(passes)
+	for i := 1; i < len(passes); i++ {
+		b := passes[i]
+		db := b.dir()
+
+		// Compare with the closest previous parallel pass, skipping stepover moves
+		for j := i - 1; j >= 0 && j >= i-2; j-- {
+			a := passes[j]
+			da := a.dir()
+			if da.Norm() == 0 || db.Norm() == 0 || math.Abs(da.Cross(db).Z) > maxCross {
+				continue
+			}
+
+			// Perpendicular distance from the start of b to the line of a, in the XY plane
+			off := b.from.Diff(a.from)
+			off.Z = 0
+			stepover := math.Abs(da.Cross(off).Z)
+			if stepover == 0 {
+				break
+			} else if stepover >= math.Min(a.length(), b.length()) {
+				// Passes shorter than the stepover are likely stepover moves themselves
+				continue
+			}
+
+			h := ScallopHeight(toolRadius, stepover)
+			if h > report.MaxHeight {
+				report.MaxHeight = h
+			}
+			if h > target {
+				report.Regions = append(report.Regions, ScallopRegion{b.start, b.end, stepover, h})
+			}
+			break
+		}
+	}
+	return report
+}
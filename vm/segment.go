@@ -0,0 +1,169 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vector"
+import "errors"
+import "fmt"
+import "time"
+
+//
+// Segments
+//
+// The output of the vm is a list of segments. A segment is a typed record,
+// such as a motion to a position. Segments reference their machine state
+// instead of holding a copy, and consecutive segments with the same state
+// share it. States are immutable once referenced: to change the state of a
+// segment, replace the reference using Modify or SetState.
+//
+// Every segment also records what is needed to restart the job at it: the
+// line of the block that produced it, its state as a snapshot of all modal
+// settings, and the estimated time elapsed when it is reached.
+//
+// The angles of the rotary axes (A, B and C) at the end of every segment are
+// kept along with X, Y and Z, so moves may rotate while moving, see events.go.
+//
+
+// Constants for segment kinds
+const (
+	SegmentMove        = iota // Motion to X, Y, Z, A, B, C using the move mode of the state (MoveModeNone for pure state changes)
+	SegmentDwell       = iota // Dwell at X, Y, Z for Param seconds (G4)
+	SegmentProbe       = iota // Probing feed move towards X, Y, Z, Param being the probe code (38.2 to 38.5)
+	SegmentRotary      = iota // Rotation of Axis to the absolute angle Param in degrees, X, Y, Z unchanged
+	SegmentPassthrough = iota // Block passed on verbatim as Text, X, Y, Z unchanged (see dialect.go)
+	SegmentPause       = iota // Program pause at X, Y, Z, Param being the M-code (0, 1 or 60, see events.go)
+)
+
+// A segment of the toolpath
+type Segment struct {
+	Kind       int
+	State      *State // Shared, never modify through this reference
+	X, Y, Z    float64
+	A, B, C    float64       // Angles of the rotary axes, in degrees
+	Param      float64       // Kind specific parameter, see the segment kinds
+	Axis       rune          // Rotary axis (A, B or C) of SegmentRotary
+	Text       string        // Block of SegmentPassthrough
+	Offset     vector.Vector // Work offset, see offsets.go
+	AxisOffset vector.Vector // Part of Offset set with G92
+	Machine    bool          // Programmed in machine coordinates (G53)
+	Line       int           // Block number in the document, 0 if not from a block
+	Source     string        // Text of the line of the block, see gcode.Block
+	Elapsed    time.Duration // Estimated time from the start of the job to the end of the segment
+}
+
+// Creates a move segment from a position, with a newly allocated state
+func NewSegment(pos Position) Segment {
+	st := pos.State
+	return Segment{SegmentMove, &st, pos.X, pos.Y, pos.Z, pos.A, pos.B, pos.C, 0, 0, "", vector.Vector{}, vector.Vector{}, false, 0, "", 0}
+}
+
+// The position and state at the end of the segment
+func (s Segment) Position() Position {
+	return Position{*s.State, s.X, s.Y, s.Z, s.A, s.B, s.C}
+}
+
+func (s Segment) Vector() vector.Vector {
+	return vector.Vector{s.X, s.Y, s.Z}
+}
+
+// The angles of the rotary axes (A, B and C) at the end of the segment
+func (s Segment) Angles() [3]float64 {
+	return [3]float64{s.A, s.B, s.C}
+}
+
+// The position and state at the end of the segment, in machine coordinates
+func (s Segment) MachinePosition() Position {
+	return Position{*s.State, s.X + s.Offset.X, s.Y + s.Offset.Y, s.Z + s.Offset.Z, s.A, s.B, s.C}
+}
+
+func (s Segment) MachineVector() vector.Vector {
+	return s.Vector().Sum(s.Offset)
+}
+
+// Replaces the state of the segment
+func (s *Segment) SetState(st State) {
+	s.State = &st
+}
+
+// Returns a copy of the segment with a modified copy of its state
+func (s Segment) Modify(fn func(st *State)) Segment {
+	st := *s.State
+	fn(&st)
+	s.State = &st
+	return s
+}
+
+// Modifies the state of all segments, keeping states shared between segments that shared them before.
+// The states of spilled segments are kept in memory, so they are modified too.
+func (vm *Machine) ModifyStates(fn func(st *State)) {
+	done := make(map[*State]*State)
+	modify := func(old *State) *State {
+		if st, ok := done[old]; ok {
+			return st
+		}
+		st := *old
+		fn(&st)
+		done[old] = &st
+		return &st
+	}
+
+	if vm.spill != nil {
+		for idx, old := range vm.spill.states {
+			st := modify(old)
+			vm.spill.states[idx] = st
+			delete(vm.spill.stateIdx, old)
+			vm.spill.stateIdx[st] = uint32(idx)
+		}
+	}
+	for idx := range vm.Segments {
+		vm.Segments[idx].State = modify(vm.Segments[idx].State)
+	}
+}
+
+// Returns the positions of all segments
+func (vm *Machine) Positions() []Position {
+	res := make([]Position, vm.Len())
+	for idx, seg := range vm.All() {
+		res[idx] = seg.Position()
+	}
+	return res
+}
+
+// The profile set by WithLimits, or the default profile
+func (vm *Machine) Profile() machine.Profile {
+	if vm.Limits != nil {
+		return *vm.Limits
+	}
+	return machine.Default()
+}
+
+// Updates the elapsed time of all segments, using the machine profile for time estimation.
+// Must be called again after modifying the segments for the times to stay valid. Spilled
+// segments keep the times they were spilled with, as the spill file is not rewritten.
+func (vm *Machine) UpdateElapsed(profile machine.Profile) {
+	var (
+		elapsed time.Duration
+		offset  = vm.offset()
+	)
+	for idx, t := range vm.MoveTimes(profile) {
+		elapsed += t
+		if idx >= offset {
+			vm.Segments[idx-offset].Elapsed = elapsed
+		}
+	}
+}
+
+// Finds the index of the first segment produced by the given line or any line after it.
+// Fails if there is none, or if optimizations may have reordered the segments, as the
+// segments before the index would then include some of the line or after it, and those
+// after it some of the lines before.
+func (vm *Machine) IndexOfLine(line int) (int, error) {
+	if vm.Reordered {
+		return 0, errors.New(fmt.Sprintf("Cannot find line %d in a program reordered by optimizations", line))
+	}
+	for idx, seg := range vm.All() {
+		if seg.Line >= line {
+			return idx, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("No moves at or after line %d", line))
+}
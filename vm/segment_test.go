@@ -0,0 +1,82 @@
+package vm
+
+import "testing"
+
+const segmentProgram = "G21 G90 G0 X0 Y0 Z5\nG1 Z-1 F100\nX10\nG4 P2\nM0\nG38.2 Z-5\nG0 A90\n"
+
+// The last segment produced by a line
+func lineSegment(t *testing.T, m *Machine, line int) Segment {
+	for idx := len(m.Segments) - 1; idx >= 0; idx-- {
+		if m.Segments[idx].Line == line {
+			return m.Segments[idx]
+		}
+	}
+	t.Fatalf("No segment for line %d", line)
+	return Segment{}
+}
+
+func TestSegmentKinds(t *testing.T) {
+	m, err := processProgram(segmentProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line  int
+		kind  int
+		param float64
+	}{
+		{2, SegmentMove, 0},
+		{3, SegmentMove, 0},
+		{4, SegmentDwell, 2},
+		{5, SegmentPause, 0},
+		{6, SegmentProbe, 38.2},
+		{7, SegmentRotary, 90},
+	}
+	for _, test := range tests {
+		seg := lineSegment(t, m, test.line)
+		if seg.Kind != test.kind || seg.Param != test.param {
+			t.Errorf("Line %d: kind %d with param %g, expected kind %d with param %g", test.line, seg.Kind, seg.Param, test.kind, test.param)
+		}
+	}
+	if seg := lineSegment(t, m, 7); seg.Axis != 'A' || seg.A != 90 {
+		t.Errorf("Rotation of %c to A%g, expected A to A90", seg.Axis, seg.A)
+	}
+	if seg := lineSegment(t, m, 6); seg.Z != -5 || seg.State.MoveMode != MoveModeLinear {
+		t.Errorf("Probe to Z%g with move mode %d, expected a linear move to Z-5", seg.Z, seg.State.MoveMode)
+	}
+}
+
+func TestSegmentStates(t *testing.T) {
+	m, err := processProgram(segmentProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Moves with the same state share it
+	plunge, cut := lineSegment(t, m, 2), lineSegment(t, m, 3)
+	if plunge.State != cut.State {
+		t.Fatalf("Moves with the same state do not share it")
+	}
+
+	// Modify copies the state, leaving the shared one unchanged
+	modified := cut.Modify(func(st *State) {
+		st.Feedrate = 200
+	})
+	if modified.State == cut.State || cut.State.Feedrate != 100 || modified.State.Feedrate != 200 {
+		t.Errorf("Modify changed the shared state, or did not change the copy")
+	}
+
+	// ModifyStates replaces the states, keeping them shared
+	old := cut.State
+	m.ModifyStates(func(st *State) {
+		st.Feedrate *= 2
+	})
+	plunge, cut = lineSegment(t, m, 2), lineSegment(t, m, 3)
+	if plunge.State != cut.State {
+		t.Errorf("ModifyStates stopped sharing the state")
+	}
+	if cut.State == old || old.Feedrate != 100 || cut.State.Feedrate != 200 {
+		t.Errorf("ModifyStates changed the shared state, or did not replace it")
+	}
+}
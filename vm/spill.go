@@ -0,0 +1,224 @@
+package vm
+
+import "github.com/joushou/gocnc/vector"
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "time"
+
+//
+// Spilling
+//
+// Programs with hundreds of millions of segments do not fit in memory. With
+// WithSpill, the vm writes segments to a temporary file while processing,
+// keeping only the most recent ones in Segments. The complete stream is
+// available through All, AllPositions and Len, which read the spilled
+// segments back in order, so exporters using the iterator work unchanged.
+//
+// Spilling only supports reading: the analyzers, such as Stats, MoveTimes,
+// TimeBreakdown and Operations, and the exporters see every segment, and
+// ModifyStates changes the states of spilled segments too, as they are kept
+// in memory. Spilled segments cannot be rewritten, so the optimizers fail
+// with optimize.ErrSpilled, and the modifications changing positions, such
+// as ClipLimits, FlipXY, MoveMultiplier, DryRun, SetSafetyHeight and
+// UnitsPerMinute, only change the segments in memory. UpdateElapsed leaves
+// the elapsed times of spilled segments as they were spilled, which is 0.
+//
+// With WithStream, segments are passed to a function instead of a file, as
+// soon as the vm is done with them, so programs can be exported while they
+// are processed, with memory use independent of their length:
+//
+//   m := vm.New(vm.WithStream(export.Stream(gen)))
+//   err := m.ProcessReader(ctx, r, gcode.Options{})
+//
+// Streamed segments cannot be read back, so All and AllPositions only see the
+// segments still in memory. After processing, that is the last segment, which
+// has also been passed to the function. Segments are held back while cutter
+// compensation is active, as they are offset at G40 (see cutcomp.go).
+//
+
+// A spilled segment, as stored on disk
+type spillRecord struct {
+	Kind    int32
+	State   uint32
+	Line    int64
+	X, Y, Z float64
+	A, B, C float64
+	Param   float64
+	Axis    int32
+	Text    uint32 // Index into spill.texts
+	Offset  vector.Vector
+	AxisOff vector.Vector
+	Machine bool
+	Elapsed int64
+	Source  uint32 // Length of the source text following the record
+}
+
+type spill struct {
+	stream   func(idx int, seg Segment) error // Receives the segments instead of the file, if set
+	dir      string
+	limit    int
+	file     *os.File
+	w        *bufio.Writer
+	count    int
+	states   []*State
+	stateIdx map[*State]uint32
+	texts    []string // Texts of passthrough segments, "" first
+	textIdx  map[string]uint32
+}
+
+// Spills segments to a temporary file in dir (the default temporary directory
+// if empty) when more than limit segments are held in memory
+func WithSpill(dir string, limit int) Option {
+	return func(m *Machine) {
+		if limit < 2 {
+			limit = 2
+		}
+		m.spill = &spill{dir: dir, limit: limit, stateIdx: make(map[*State]uint32), texts: []string{""}, textIdx: map[string]uint32{"": 0}}
+	}
+}
+
+// Passes segments to the stream function, with the index of the first
+func (s *spill) send(idx int, segs []Segment) {
+	for n, seg := range segs {
+		if err := s.stream(idx+n, seg); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// The index of a text in texts, adding it if new
+func (s *spill) text(text string) uint32 {
+	idx, ok := s.textIdx[text]
+	if !ok {
+		idx = uint32(len(s.texts))
+		s.texts = append(s.texts, text)
+		s.textIdx[text] = idx
+	}
+	return idx
+}
+
+// Writes segments to the spill file, or passes them to the stream function
+func (s *spill) write(segs []Segment) {
+	if s.stream != nil {
+		s.send(s.count, segs)
+		s.count += len(segs)
+		return
+	}
+
+	if s.file == nil {
+		f, err := os.CreateTemp(s.dir, "gocnc-spill-")
+		if err != nil {
+			panic(err)
+		}
+		s.file, s.w = f, bufio.NewWriterSize(f, 1<<20)
+	}
+
+	for _, seg := range segs {
+		idx, ok := s.stateIdx[seg.State]
+		if !ok {
+			idx = uint32(len(s.states))
+			s.states = append(s.states, seg.State)
+			s.stateIdx[seg.State] = idx
+		}
+		r := spillRecord{int32(seg.Kind), idx, int64(seg.Line), seg.X, seg.Y, seg.Z, seg.A, seg.B, seg.C, seg.Param, int32(seg.Axis), s.text(seg.Text), seg.Offset, seg.AxisOffset, seg.Machine, int64(seg.Elapsed), uint32(len(seg.Source))}
+		if err := binary.Write(s.w, binary.LittleEndian, &r); err != nil {
+			panic(err)
+		}
+		if _, err := s.w.WriteString(seg.Source); err != nil {
+			panic(err)
+		}
+	}
+	s.count += len(segs)
+}
+
+// Calls fn for every spilled segment, in order. Streamed segments are gone.
+func (s *spill) each(fn func(idx int, seg Segment) bool) {
+	if s.count == 0 || s.stream != nil {
+		return
+	}
+	if err := s.w.Flush(); err != nil {
+		panic(err)
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		panic(err)
+	}
+	defer s.file.Seek(0, io.SeekEnd)
+
+	r := bufio.NewReaderSize(s.file, 1<<20)
+	for idx := 0; idx < s.count; idx++ {
+		var rec spillRecord
+		if err := binary.Read(r, binary.LittleEndian, &rec); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read spilled segment %d: %s", idx, err)))
+		}
+		source := make([]byte, rec.Source)
+		if _, err := io.ReadFull(r, source); err != nil {
+			panic(errors.New(fmt.Sprintf("Unable to read spilled segment %d: %s", idx, err)))
+		}
+		seg := Segment{int(rec.Kind), s.states[rec.State], rec.X, rec.Y, rec.Z, rec.A, rec.B, rec.C, rec.Param, rune(rec.Axis), s.texts[rec.Text], rec.Offset, rec.AxisOff, rec.Machine, int(rec.Line), string(source), time.Duration(rec.Elapsed)}
+		if !fn(idx, seg) {
+			return
+		}
+	}
+}
+
+// Passes segments to fn as they are produced, instead of keeping them in Segments
+func WithStream(fn func(idx int, seg Segment) error) Option {
+	return func(m *Machine) {
+		m.spill = &spill{stream: fn, limit: 2}
+	}
+}
+
+// Passes the segments left in memory to the stream function, if streaming,
+// keeping the last in Segments
+func (vm *Machine) flushStream() {
+	if vm.spill == nil || vm.spill.stream == nil {
+		return
+	}
+	last := len(vm.Segments) - 1
+	vm.spill.write(vm.Segments[:last])
+	vm.spill.send(vm.spill.count, vm.Segments[last:])
+	vm.Segments = append(vm.Segments[:0], vm.Segments[last])
+}
+
+// Moves all but the last segment to the spill file if over the limit
+func (vm *Machine) maybeSpill() {
+	if vm.spill == nil || len(vm.Segments) <= vm.spill.limit || vm.comp.side != 0 {
+		return
+	}
+	last := len(vm.Segments) - 1
+	vm.spill.write(vm.Segments[:last])
+	vm.Segments = append(vm.Segments[:0], vm.Segments[last])
+}
+
+// Tests if segments have been spilled to disk or streamed, leaving only the most recent in Segments
+func (vm *Machine) Spilled() bool {
+	return vm.spill != nil && vm.spill.count > 0
+}
+
+// Index of the first segment in Segments, which is 0 unless spilled
+func (vm *Machine) offset() int {
+	if vm.spill == nil {
+		return 0
+	}
+	return vm.spill.count
+}
+
+// Total number of segments, including spilled segments
+func (vm *Machine) Len() int {
+	return vm.offset() + len(vm.Segments)
+}
+
+// Removes the spill file, if any. The spilled segments are lost.
+func (vm *Machine) Close() error {
+	if vm.spill == nil || vm.spill.file == nil {
+		return nil
+	}
+	f := vm.spill.file
+	vm.spill.file, vm.spill.count = nil, 0
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,78 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "reflect"
+import "testing"
+
+const spillProgram = "G21 G90 M3 S1000\nG0 X0 Y0 Z5\nG1 Z-1 F100\nX10\nY1\nX0\nY2\nX10\nG4 P0.5\nG0 Z5\nT2 M6\nG0 X20 Y0\nG1 Z-2 F200\nG2 X20 Y10 I0 J5\nG0 Z5\nM5\n"
+
+// Processes the program with and without spilling
+func processSpilled(t *testing.T, program string) (plain, spilled *Machine) {
+	plain, err := processProgram(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spilled, err = processProgram(program, WithSpill(t.TempDir(), 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spilled.Close() })
+	if !spilled.Spilled() {
+		t.Fatal("Program not spilled")
+	}
+	return plain, spilled
+}
+
+func TestSpilledAnalyzers(t *testing.T) {
+	plain, spilled := processSpilled(t, spillProgram)
+	profile := machine.Default()
+
+	analyzers := []struct {
+		name string
+		fn   func(m *Machine) interface{}
+	}{
+		{"Len", func(m *Machine) interface{} { return m.Len() }},
+		{"BoundingBox", func(m *Machine) interface{} { return m.BoundingBox() }},
+		{"Extents", func(m *Machine) interface{} { return m.MachineExtents() }},
+		{"Stats", func(m *Machine) interface{} { return m.Stats(profile) }},
+		{"MoveTimes", func(m *Machine) interface{} { return m.MoveTimes(profile) }},
+		{"TimeBreakdown", func(m *Machine) interface{} { return m.TimeBreakdown(profile) }},
+		{"SpindleUsage", func(m *Machine) interface{} { return m.SpindleUsage(profile) }},
+		{"Operations", func(m *Machine) interface{} { return m.Operations() }},
+		{"DepthHistogram", func(m *Machine) interface{} { return m.DepthHistogram(0.5) }},
+		{"ScallopReport", func(m *Machine) interface{} { return m.ScallopReport(1, 0.01) }},
+		{"Repetitions", func(m *Machine) interface{} { return m.Repetitions(2, 0.0001) }},
+		{"Positions", func(m *Machine) interface{} { return m.Positions() }},
+		{"FindSafetyHeight", func(m *Machine) interface{} { return m.FindSafetyHeight() }},
+		{"IndexOfLine", func(m *Machine) interface{} {
+			idx, err := m.IndexOfLine(4)
+			return [2]interface{}{idx, err}
+		}},
+	}
+	for _, a := range analyzers {
+		if got, expected := a.fn(spilled), a.fn(plain); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v when spilled, expected %v", a.name, got, expected)
+		}
+	}
+}
+
+func TestSpilledModifyStates(t *testing.T) {
+	plain, spilled := processSpilled(t, spillProgram)
+	for _, m := range []*Machine{plain, spilled} {
+		m.ModifyStates(func(st *State) {
+			st.Feedrate *= 2
+		})
+	}
+
+	var expected []float64
+	for _, seg := range plain.Segments {
+		expected = append(expected, seg.State.Feedrate)
+	}
+	var got []float64
+	for _, seg := range spilled.All() {
+		got = append(got, seg.State.Feedrate)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got feedrates %v when spilled, expected %v", got, expected)
+	}
+}
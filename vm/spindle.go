@@ -0,0 +1,60 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/warnings"
+import "time"
+
+// Spindle usage statistics
+type SpindleUsage struct {
+	OnTime time.Duration             // Total time with the spindle enabled
+	Cycles int                       // Number of spindle starts, including direction changes
+	Speeds map[float64]time.Duration // Time spent at each spindle speed (RPM)
+}
+
+// Calculates spindle on-time, time at each speed and the number of start/stop cycles,
+// using the machine profile for time estimation.
+func (vm *Machine) SpindleUsage(profile machine.Profile) SpindleUsage {
+	var (
+		times = vm.MoveTimes(profile)
+		usage = SpindleUsage{Speeds: make(map[float64]time.Duration)}
+		last  State
+	)
+
+	for idx, pos := range vm.All() {
+		s := *pos.State
+		if s.SpindleEnabled && (!last.SpindleEnabled || s.SpindleClockwise != last.SpindleClockwise) {
+			usage.Cycles++
+		}
+
+		if s.SpindleEnabled {
+			usage.OnTime += times[idx]
+			usage.Speeds[s.SpindleSpeed] += times[idx]
+		}
+		last = s
+	}
+	return usage
+}
+
+// Handles reversal of a running spindle (M3 to M4 or M4 to M3). Many spindles and
+// drives cannot reverse instantly, so with SafeReversal the spindle is stopped, and
+// a dwell of ReversalDwell seconds is added for it to spin down, before it restarts
+// in the new direction. The dwell is added even if zero, as optimizations keep dwells
+// in place. Otherwise a warning is added.
+func (vm *Machine) reverseSpindle(clockwise bool) {
+	if !vm.State.SpindleEnabled || vm.State.SpindleClockwise == clockwise {
+		return
+	}
+	if !vm.SafeReversal {
+		vm.warn(warnings.SeverityWarning, "Spindle reversed without stopping")
+		return
+	}
+
+	var (
+		saved = vm.State
+		pos   = vm.workPos()
+	)
+	vm.State.SpindleEnabled = false
+	vm.State.MoveMode = MoveModeNone
+	vm.add(Segment{Kind: SegmentDwell, X: pos.X, Y: pos.Y, Z: pos.Z, Param: vm.ReversalDwell})
+	vm.State = saved
+}
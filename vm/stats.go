@@ -0,0 +1,207 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vector"
+import "math"
+import "sort"
+import "time"
+
+// An axis-aligned bounding box
+type BoundingBox struct {
+	Min, Max vector.Vector
+}
+
+// Grows the bounding box to include the given point
+func (b *BoundingBox) include(v vector.Vector) {
+	b.Min.X, b.Max.X = math.Min(b.Min.X, v.X), math.Max(b.Max.X, v.X)
+	b.Min.Y, b.Max.Y = math.Min(b.Min.Y, v.Y), math.Max(b.Max.Y, v.Y)
+	b.Min.Z, b.Max.Z = math.Min(b.Min.Z, v.Z), math.Max(b.Max.Z, v.Z)
+}
+
+// Size of the bounding box along each axis
+func (b BoundingBox) Size() vector.Vector {
+	return b.Max.Diff(b.Min)
+}
+
+// Tests if a point is within the bounding box
+func (b BoundingBox) Contains(v vector.Vector) bool {
+	return v.X >= b.Min.X && v.X <= b.Max.X &&
+		v.Y >= b.Min.Y && v.Y <= b.Max.Y &&
+		v.Z >= b.Min.Z && v.Z <= b.Max.Z
+}
+
+// The extents of a toolpath. Moves are included with the positions they start
+// from. Rapid and Cutting are nil if there are no such moves, and Tools only
+// holds tools that cut.
+type Extents struct {
+	All     BoundingBox         // All positions, including the origin
+	Rapid   *BoundingBox        // Rapid moves
+	Cutting *BoundingBox        // Feed moves
+	Tools   map[int]BoundingBox // Feed moves per tool
+}
+
+// Grows a bounding box, which is created if nil, to include a move
+func includeMove(b *BoundingBox, from, to vector.Vector) BoundingBox {
+	if b == nil {
+		b = &BoundingBox{from, from}
+	}
+	b.include(from)
+	b.include(to)
+	return *b
+}
+
+// A bin of the Z depth histogram.
+// Distance is the cutting distance travelled with Z in [Z, Z+binSize).
+type DepthBin struct {
+	Z        float64
+	Distance float64
+}
+
+// Calculates the bounding box of all positions, including the origin
+func (vm *Machine) BoundingBox() BoundingBox {
+	var box BoundingBox
+	for _, pos := range vm.All() {
+		box.include(pos.Vector())
+	}
+	return box
+}
+
+// Calculates the extents of the toolpath in work coordinates
+func (vm *Machine) Extents() Extents {
+	return vm.extents(Segment.Vector)
+}
+
+// Calculates the extents of the toolpath in machine coordinates (see offsets.go),
+// for comparing against the travel of the machine
+func (vm *Machine) MachineExtents() Extents {
+	return vm.extents(Segment.MachineVector)
+}
+
+func (vm *Machine) extents(coords func(Segment) vector.Vector) Extents {
+	res := Extents{Tools: make(map[int]BoundingBox)}
+	for _, pos := range vm.All() {
+		res.All.include(coords(pos))
+	}
+	vm.eachMove(func(from, to Segment) {
+		f, t := coords(from), coords(to)
+		if to.State.MoveMode == MoveModeRapid {
+			box := includeMove(res.Rapid, f, t)
+			res.Rapid = &box
+			return
+		}
+		box := includeMove(res.Cutting, f, t)
+		res.Cutting = &box
+		if tb, ok := res.Tools[to.State.Tool]; ok {
+			res.Tools[to.State.Tool] = includeMove(&tb, f, t)
+		} else {
+			res.Tools[to.State.Tool] = includeMove(nil, f, t)
+		}
+	})
+	return res
+}
+
+// Calls fn for every move, with the position it started from
+func (vm *Machine) eachMove(fn func(from, to Segment)) {
+	vm.eachPair(func(idx int, from, to Segment) {
+		if to.State.MoveMode != MoveModeNone {
+			fn(from, to)
+		}
+	})
+}
+
+// A summary of a job, for judging it before running it
+type Stats struct {
+	CutDistance   float64         // Distance of feed moves (mm)
+	RapidDistance float64         // Distance of rapid moves (mm)
+	Toolchanges   int             // Changes of the selected tool
+	ToolCut       map[int]float64 // Distance of feed moves per tool (mm)
+	MinFeedrate   float64         // Lowest feedrate of feed moves in units per minute mode (mm/min), 0 if none
+	MaxFeedrate   float64         // Highest feedrate of those moves (mm/min), 0 if none
+	MinZ          float64         // Lowest Z reached by feed moves (mm), 0 if none
+	SpindleOn     time.Duration   // Time with the spindle running, estimated with the profile
+	Arcs          int             // Arcs approximated by lines
+}
+
+// Collects the statistics of the toolpath. Feedrates of inverse time and units
+// per revolution moves are only included once converted by UnitsPerMinute.
+func (vm *Machine) Stats(profile machine.Profile) Stats {
+	res := Stats{
+		ToolCut:   vm.ToolDistance(),
+		SpindleOn: vm.SpindleUsage(profile).OnTime,
+		Arcs:      len(vm.Arcs),
+	}
+	res.CutDistance, res.RapidDistance = vm.TravelDistance()
+	if c := vm.Extents().Cutting; c != nil {
+		res.MinZ = c.Min.Z
+	}
+
+	first := true
+	vm.eachPair(func(idx int, prev, cur Segment) {
+		from, to := prev.State, cur.State
+		if to.Tool != from.Tool {
+			res.Toolchanges++
+		}
+		if to.MoveMode == MoveModeNone || to.MoveMode == MoveModeRapid || to.FeedMode != FeedModeUnitsMin {
+			return
+		}
+		if first || to.Feedrate < res.MinFeedrate {
+			res.MinFeedrate = to.Feedrate
+		}
+		if first || to.Feedrate > res.MaxFeedrate {
+			res.MaxFeedrate = to.Feedrate
+		}
+		first = false
+	})
+	return res
+}
+
+// Calculates the total cutting and rapid distance
+func (vm *Machine) TravelDistance() (cut, rapid float64) {
+	vm.eachMove(func(from, to Segment) {
+		dist := to.Vector().Diff(from.Vector()).Norm()
+		if to.State.MoveMode == MoveModeRapid {
+			rapid += dist
+		} else {
+			cut += dist
+		}
+	})
+	return
+}
+
+// Calculates the cutting distance for each tool
+func (vm *Machine) ToolDistance() map[int]float64 {
+	res := make(map[int]float64)
+	vm.eachMove(func(from, to Segment) {
+		if to.State.MoveMode == MoveModeRapid {
+			return
+		}
+		res[to.State.Tool] += to.Vector().Diff(from.Vector()).Norm()
+	})
+	return res
+}
+
+// Calculates a histogram of cutting distance per Z depth, sorted from the deepest bin.
+// Moves are attributed to the bin of their end position.
+func (vm *Machine) DepthHistogram(binSize float64) []DepthBin {
+	if binSize <= 0 {
+		return nil
+	}
+
+	bins := make(map[float64]float64)
+	vm.eachMove(func(from, to Segment) {
+		if to.State.MoveMode == MoveModeRapid {
+			return
+		}
+		z := math.Floor(to.Z/binSize) * binSize
+		bins[z] += to.Vector().Diff(from.Vector()).Norm()
+	})
+
+	res := make([]DepthBin, 0, len(bins))
+	for z, dist := range bins {
+		res = append(res, DepthBin{z, dist})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Z < res[j].Z
+	})
+	return res
+}
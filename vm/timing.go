@@ -0,0 +1,193 @@
+package vm
+
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/vector"
+import "math"
+import "time"
+
+//
+// Time estimation based on Grbl's planner.
+//
+// Every move is planned as a trapezoidal velocity profile. Entry speeds are
+// limited by the junction deviation model at corners, and by how fast the
+// machine can accelerate and decelerate along the neighbouring moves.
+//
+
+// Limits a per-axis value along the unit vector u, returning the highest
+// value allowed by all axes.
+func axisLimit(u, limits vector.Vector) float64 {
+	res := math.Inf(1)
+	for _, x := range [][2]float64{{u.X, limits.X}, {u.Y, limits.Y}, {u.Z, limits.Z}} {
+		if x[0] != 0 {
+			res = math.Min(res, x[1]/math.Abs(x[0]))
+		}
+	}
+	return res
+}
+
+// A planned move
+type plannedMove struct {
+	idx            int
+	length         float64
+	unit           vector.Vector
+	nominal, accel float64 // mm/s, mm/s^2
+	maxEntry       float64 // mm/s
+	entry          float64 // mm/s
+}
+
+// Tests if the machine will have to stop between two positions
+func isStop(a, b State) bool {
+	return a.SpindleEnabled != b.SpindleEnabled ||
+		a.SpindleClockwise != b.SpindleClockwise ||
+		a.SpindleSpeed != b.SpindleSpeed ||
+		a.FloodCoolant != b.FloodCoolant ||
+		a.MistCoolant != b.MistCoolant ||
+		a.Tool != b.Tool
+}
+
+// The programmed feedrate of a move in mm/min. In inverse time mode, the move
+// takes 1/F minutes, and in units per revolution mode, F is per spindle turn.
+func feedFor(seg Segment, length float64) float64 {
+	st := seg.State
+	switch st.FeedMode {
+	case FeedModeInvTime:
+		return st.Feedrate * length
+	case FeedModeUnitsRev:
+		return st.Feedrate * seg.SpindleRPM()
+	}
+	return st.Feedrate
+}
+
+// Calculates the time spent on a trapezoidal move
+func trapezoidTime(length, entry, exit, nominal, accel float64) float64 {
+	accelDist := (nominal*nominal - entry*entry) / (2 * accel)
+	decelDist := (nominal*nominal - exit*exit) / (2 * accel)
+	if accelDist+decelDist <= length {
+		return (nominal-entry)/accel + (nominal-exit)/accel + (length-accelDist-decelDist)/nominal
+	}
+
+	// Triangular profile, never reaching nominal speed
+	peak := math.Sqrt((2*accel*length + entry*entry + exit*exit) / 2)
+	return (peak-entry)/accel + (peak-exit)/accel
+}
+
+// Estimates the time spent on each position, using the feedrates, accelerations and
+// junction deviation of the machine profile. The result has the same length as the position stack,
+// including spilled segments.
+func (vm *Machine) MoveTimes(profile machine.Profile) []time.Duration {
+	var (
+		times = make([]time.Duration, vm.Len())
+		moves = make([]plannedMove, 0, vm.Len())
+	)
+
+	vm.eachPair(func(idx int, from, to Segment) {
+		if to.Kind == SegmentDwell || to.Kind == SegmentRotary || to.Kind == SegmentPassthrough || to.Kind == SegmentPause {
+			// Full stop. Rotation speeds, waits for heaters and the operator are not known, so they take no time
+			if len(moves) > 0 {
+				moves = append(moves, plannedMove{idx: -1})
+			}
+			if to.Kind == SegmentDwell {
+				times[idx] = time.Duration(to.Param * float64(time.Second))
+			}
+			return
+		}
+		if to.State.MoveMode == MoveModeNone || isStop(*from.State, *to.State) {
+			// Break the chain, forcing a full stop
+			if len(moves) > 0 {
+				moves = append(moves, plannedMove{idx: -1})
+			}
+			if to.State.MoveMode == MoveModeNone {
+				return
+			}
+		}
+
+		d := to.MachineVector().Diff(from.MachineVector())
+		length := d.Norm()
+		if length < 1e-9 {
+			// Rounding errors, such as at the start of arcs, which would take
+			// a full 1/F minutes in inverse time mode
+			return
+		}
+
+		u := d.Divide(length)
+		maxRate := axisLimit(u, profile.MaxFeedrate())
+		nominal := maxRate
+		if to.State.MoveMode != MoveModeRapid {
+			feed := feedFor(to, length)
+			if feed <= 0 {
+				// Just to use something...
+				feed = 300
+			}
+			nominal = math.Min(feed, maxRate)
+		}
+
+		moves = append(moves, plannedMove{
+			idx:     idx,
+			length:  length,
+			unit:    u,
+			nominal: nominal / 60,
+			accel:   axisLimit(u, profile.Acceleration()),
+		})
+	})
+
+	// Junction speeds
+	for i := 1; i < len(moves); i++ {
+		prev, cur := moves[i-1], &moves[i]
+		if prev.idx == -1 || cur.idx == -1 {
+			continue
+		}
+
+		cosTheta := -prev.unit.Dot(cur.unit)
+		maxEntry := math.Min(prev.nominal, cur.nominal)
+		if cosTheta > 0.999999 {
+			// Reversal
+			maxEntry = 0
+		} else if cosTheta > -0.999999 {
+			sinHalf := math.Sqrt(0.5 * (1 - cosTheta))
+			junction := math.Sqrt(cur.accel * profile.JunctionDeviation * sinHalf / (1 - sinHalf))
+			maxEntry = math.Min(maxEntry, junction)
+		}
+		cur.maxEntry = maxEntry
+	}
+
+	// Backward pass, ensuring that every move can decelerate to the entry of the next
+	exit := 0.0
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := &moves[i]
+		if m.idx == -1 {
+			exit = 0
+			continue
+		}
+		m.entry = math.Min(m.maxEntry, math.Sqrt(exit*exit+2*m.accel*m.length))
+		exit = m.entry
+	}
+
+	// Forward pass, ensuring that every move can accelerate to the exit speed
+	for i := 0; i < len(moves); i++ {
+		m := moves[i]
+		if m.idx == -1 {
+			continue
+		}
+
+		exit := 0.0
+		if i+1 < len(moves) && moves[i+1].idx != -1 {
+			next := &moves[i+1]
+			next.entry = math.Min(next.entry, math.Sqrt(m.entry*m.entry+2*m.accel*m.length))
+			exit = next.entry
+		}
+
+		t := trapezoidTime(m.length, m.entry, exit, m.nominal, m.accel)
+		times[m.idx] = time.Duration(t * float64(time.Second))
+	}
+
+	return times
+}
+
+// Estimate runtime for job, using the machine profile
+func (vm *Machine) ETAWithProfile(profile machine.Profile) time.Duration {
+	var eta time.Duration
+	for _, t := range vm.MoveTimes(profile) {
+		eta += t
+	}
+	return eta
+}
@@ -0,0 +1,166 @@
+package vm
+
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/warnings"
+import "encoding/csv"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+//
+// Tools
+//
+// The tool table holds the diameter and length offset of the tools, as
+// known to the controller. The diameters are used for cutter compensation
+// (see cutcomp.go), and are available to exporters and estimators through
+// Machine.Tools.
+//
+// G43 applies the length offset of tool H, or of the current tool without
+// H, to Z. Like work offsets, the length offset is part of the offset of
+// the segments (see offsets.go), so positions stay in tool tip coordinates,
+// and machine coordinates are those of the spindle. G43.1 takes the offset
+// as Z, and G49 cancels it.
+//
+// Tool tables are read from JSON, as a list of tools:
+//
+//   [{"Number": 1, "Diameter": 6, "Length": 42.5, "Description": "6mm flat"}]
+//
+// or from CSV, with one tool per line, and an optional header:
+//
+//   number,diameter,length,description
+//   1,6,42.5,6mm flat
+//
+
+// A tool in the tool table
+type Tool struct {
+	Number      int
+	Diameter    float64 // mm
+	Length      float64 // Length offset (mm)
+	Description string
+}
+
+// Tools by tool number
+type ToolTable map[int]Tool
+
+// Looks up a tool, returning false if the tool is not in the table
+func (t ToolTable) Get(number int) (Tool, bool) {
+	tool, ok := t[number]
+	return tool, ok
+}
+
+// Adds a tool, checking its number and diameter
+func (t ToolTable) add(tool Tool) error {
+	if tool.Number < 0 {
+		return errors.New(fmt.Sprintf("Invalid tool number %d", tool.Number))
+	}
+	if tool.Diameter < 0 {
+		return errors.New(fmt.Sprintf("Tool %d has a negative diameter", tool.Number))
+	}
+	if _, ok := t[tool.Number]; ok {
+		return errors.New(fmt.Sprintf("Tool %d defined more than once", tool.Number))
+	}
+	t[tool.Number] = tool
+	return nil
+}
+
+// Loads a tool table, read as CSV if the file name ends in .csv, and as JSON otherwise
+func LoadToolTable(path string) (ToolTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var t ToolTable
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		t, err = ReadToolTableCSV(f)
+	} else {
+		t, err = ReadToolTableJSON(f)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid tool table %s: %s", path, err))
+	}
+	return t, nil
+}
+
+// Reads a JSON encoded list of tools
+func ReadToolTableJSON(r io.Reader) (ToolTable, error) {
+	var tools []Tool
+	if err := json.NewDecoder(r).Decode(&tools); err != nil {
+		return nil, err
+	}
+	t := make(ToolTable)
+	for _, tool := range tools {
+		if err := t.add(tool); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Reads tools from CSV, as number, diameter, length and description. The
+// description, and the length, may be left out. Lines starting with # are
+// comments, and a first line not starting with a number is a header.
+func ReadToolTableCSV(r io.Reader) (ToolTable, error) {
+	c := csv.NewReader(r)
+	c.Comment = '#'
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+
+	t := make(ToolTable)
+	for n := 1; ; n++ {
+		rec, err := c.Read()
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 || len(rec) > 4 {
+			return nil, errors.New(fmt.Sprintf("Record %d: expected 2 to 4 fields, found %d", n, len(rec)))
+		}
+
+		number, err := strconv.Atoi(rec[0])
+		if err != nil {
+			if n == 1 {
+				continue
+			}
+			return nil, errors.New(fmt.Sprintf("Record %d: invalid tool number %q", n, rec[0]))
+		}
+		tool := Tool{Number: number}
+		for idx, v := range []*float64{&tool.Diameter, &tool.Length} {
+			if idx+1 >= len(rec) {
+				break
+			}
+			if *v, err = strconv.ParseFloat(rec[idx+1], 64); err != nil {
+				return nil, errors.New(fmt.Sprintf("Record %d: invalid number %q", n, rec[idx+1]))
+			}
+		}
+		if len(rec) == 4 {
+			tool.Description = rec[3]
+		}
+		if err := t.add(tool); err != nil {
+			return nil, errors.New(fmt.Sprintf("Record %d: %s", n, err))
+		}
+	}
+}
+
+// The offset of the tool length compensation in effect
+func (vm *Machine) toolOffset() vector.Vector {
+	return vector.Vector{0, 0, vm.ToolLength}
+}
+
+// Handles G43, applying the length offset of a tool from the tool table
+func (vm *Machine) toolLength(stmt gcode.Block) {
+	number := int(stmt.GetWordDefault('H', float64(vm.State.Tool)))
+	tool, ok := vm.Tools.Get(number)
+	if !ok {
+		vm.warn(warnings.SeverityWarning, "Tool %d is not in the tool table, using a length offset of 0", number)
+	}
+	vm.ToolLength = tool.Length
+}
@@ -0,0 +1,70 @@
+package vm
+
+//
+// Units
+//
+// The vm works in millimeters and millimeters per minute. Words are converted
+// from the active input units (G20/G21) exactly once, when they are read.
+// Values that are already canonical, such as interpolated arc points, must
+// never be converted again.
+//
+
+const MillimetersPerInch = 25.4
+
+// A length in millimeters
+type Length float64
+
+// A feedrate in millimeters per minute
+type Feed float64
+
+// Creates a length from millimeters
+func Millimeters(v float64) Length {
+	return Length(v)
+}
+
+// Creates a length from inches
+func Inches(v float64) Length {
+	return Length(v * MillimetersPerInch)
+}
+
+func (l Length) Millimeters() float64 {
+	return float64(l)
+}
+
+func (l Length) Inches() float64 {
+	return float64(l) / MillimetersPerInch
+}
+
+// Creates a feedrate from millimeters per minute
+func MillimetersPerMinute(v float64) Feed {
+	return Feed(v)
+}
+
+// Creates a feedrate from inches per minute
+func InchesPerMinute(v float64) Feed {
+	return Feed(v * MillimetersPerInch)
+}
+
+func (f Feed) MillimetersPerMinute() float64 {
+	return float64(f)
+}
+
+func (f Feed) InchesPerMinute() float64 {
+	return float64(f) / MillimetersPerInch
+}
+
+// Converts a length word from the active input units
+func (vm *Machine) length(v float64) Length {
+	if vm.Imperial {
+		return Inches(v)
+	}
+	return Millimeters(v)
+}
+
+// Converts a feedrate word from the active input units
+func (vm *Machine) feed(v float64) Feed {
+	if vm.Imperial {
+		return InchesPerMinute(v)
+	}
+	return MillimetersPerMinute(v)
+}
@@ -7,50 +7,71 @@ import "time"
 
 // Flips the X and Y axes of all moves
 func (vm *Machine) FlipXY() {
-	for idx, _ := range vm.Positions {
-		pos := vm.Positions[idx]
-		vm.Positions[idx].X, vm.Positions[idx].Y = pos.Y, pos.X
+	for idx, _ := range vm.Segments {
+		pos := vm.Segments[idx]
+		vm.Segments[idx].X, vm.Segments[idx].Y = pos.Y, pos.X
 	}
 }
 
 // Limit feedrate.
 func (vm *Machine) LimitFeedrate(feed float64) {
-	for idx, m := range vm.Positions {
-		if m.State.Feedrate > feed {
-			vm.Positions[idx].State.Feedrate = feed
+	vm.ModifyStates(func(st *State) {
+		if st.Feedrate > feed {
+			st.Feedrate = feed
 		}
-	}
+	})
 }
 
 // Increase feedrate
 func (vm *Machine) FeedrateMultiplier(feedMultiplier float64) {
-	for idx, _ := range vm.Positions {
-		vm.Positions[idx].State.Feedrate *= feedMultiplier
-	}
+	vm.ModifyStates(func(st *State) {
+		st.Feedrate *= feedMultiplier
+	})
 }
 
 // Multiply move distances - This makes no sense - Dangerous.
 func (vm *Machine) MoveMultiplier(moveMultiplier float64) {
-	for idx, _ := range vm.Positions {
-		vm.Positions[idx].X *= moveMultiplier
-		vm.Positions[idx].Y *= moveMultiplier
-		vm.Positions[idx].Z *= moveMultiplier
+	for idx, _ := range vm.Segments {
+		vm.Segments[idx].X *= moveMultiplier
+		vm.Segments[idx].Y *= moveMultiplier
+		vm.Segments[idx].Z *= moveMultiplier
 	}
 }
 
 // Enforce spindle mode
 func (vm *Machine) EnforceSpindle(enabled, clockwise bool, speed float64) {
-	for idx, _ := range vm.Positions {
-		vm.Positions[idx].State.SpindleSpeed = speed
-		vm.Positions[idx].State.SpindleEnabled = enabled
-		vm.Positions[idx].State.SpindleClockwise = clockwise
+	vm.ModifyStates(func(st *State) {
+		st.SpindleSpeed = speed
+		st.SpindleEnabled = enabled
+		st.SpindleClockwise = clockwise
+	})
+}
+
+// Prepares the program for a dry run in the air, such as to check that the
+// fixtures are clear of the toolpath. Positions below the height are raised
+// to it, keeping the XY motion, and the spindle and coolant are turned off.
+// Probing moves become plain feed moves, as the probe would never trip.
+func (vm *Machine) DryRun(height float64) {
+	for idx, seg := range vm.Segments {
+		if idx > 0 && seg.Z < height {
+			vm.Segments[idx].Z = height
+		}
+		if seg.Kind == SegmentProbe {
+			vm.Segments[idx].Kind = SegmentMove
+			vm.Segments[idx].Param = 0
+		}
 	}
+	vm.ModifyStates(func(st *State) {
+		st.SpindleEnabled = false
+		st.FloodCoolant = false
+		st.MistCoolant = false
+	})
 }
 
 // Detect the highest Z position
 func (vm *Machine) FindSafetyHeight() float64 {
 	var maxz float64
-	for _, m := range vm.Positions {
+	for _, m := range vm.All() {
 		if m.Z > maxz {
 			maxz = m.Z
 		}
@@ -66,7 +87,7 @@ func (vm *Machine) SetSafetyHeight(height float64) error {
 
 	maxz := vm.FindSafetyHeight()
 	nextz := 0.0
-	for _, m := range vm.Positions {
+	for _, m := range vm.Segments {
 		if m.Z < maxz && m.Z > nextz {
 			nextz = m.Z
 		}
@@ -78,9 +99,9 @@ func (vm *Machine) SetSafetyHeight(height float64) error {
 
 	// Apply the changes
 	var lastx, lasty float64
-	for idx, m := range vm.Positions {
+	for idx, m := range vm.Segments {
 		if lastx == m.X && lasty == m.Y && m.Z == maxz {
-			vm.Positions[idx].Z = height
+			vm.Segments[idx].Z = height
 		}
 		lastx, lasty = m.X, m.Y
 	}
@@ -91,15 +112,15 @@ func (vm *Machine) SetSafetyHeight(height float64) error {
 // Simply adds a what is necessary to move back to X0 Y0 Z0.
 func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 	var maxz float64
-	for _, m := range vm.Positions {
+	for _, m := range vm.Segments {
 		if m.Z > maxz {
 			maxz = m.Z
 		}
 	}
-	if len(vm.Positions) == 0 {
+	if len(vm.Segments) == 0 {
 		return
 	}
-	lastPos := vm.Positions[len(vm.Positions)-1]
+	lastPos := vm.Segments[len(vm.Segments)-1].Position()
 	if lastPos.X == 0 && lastPos.Y == 0 && lastPos.Z == 0 {
 		if disableSpindle {
 			lastPos.State.SpindleEnabled = false
@@ -108,7 +129,7 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 			lastPos.State.MistCoolant = false
 			lastPos.State.FloodCoolant = false
 		}
-		vm.Positions[len(vm.Positions)-1] = lastPos
+		vm.Segments[len(vm.Segments)-1] = NewSegment(lastPos)
 		return
 	} else if lastPos.X == 0 && lastPos.Y == 0 && lastPos.Z != 0 {
 		lastPos.Z = 0
@@ -120,7 +141,7 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 			lastPos.State.MistCoolant = false
 			lastPos.State.FloodCoolant = false
 		}
-		vm.Positions = append(vm.Positions, lastPos)
+		vm.Segments = append(vm.Segments, NewSegment(lastPos))
 		return
 	} else if lastPos.Z == maxz {
 		move1 := lastPos
@@ -136,8 +157,8 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 			move2.State.MistCoolant = false
 			move2.State.FloodCoolant = false
 		}
-		vm.Positions = append(vm.Positions, move1)
-		vm.Positions = append(vm.Positions, move2)
+		vm.Segments = append(vm.Segments, NewSegment(move1))
+		vm.Segments = append(vm.Segments, NewSegment(move2))
 		return
 	} else {
 		move1 := lastPos
@@ -155,16 +176,16 @@ func (vm *Machine) Return(disableSpindle, disableCoolant bool) {
 			move3.State.MistCoolant = false
 			move3.State.FloodCoolant = false
 		}
-		vm.Positions = append(vm.Positions, move1)
-		vm.Positions = append(vm.Positions, move2)
-		vm.Positions = append(vm.Positions, move3)
+		vm.Segments = append(vm.Segments, NewSegment(move1))
+		vm.Segments = append(vm.Segments, NewSegment(move2))
+		vm.Segments = append(vm.Segments, NewSegment(move3))
 		return
 	}
 }
 
 // Generate move information
 func (vm *Machine) Info() (minx, miny, minz, maxx, maxy, maxz float64, feedrates []float64) {
-	for _, pos := range vm.Positions {
+	for _, pos := range vm.All() {
 		if pos.X < minx {
 			minx = pos.X
 		} else if pos.X > maxx {
@@ -201,7 +222,7 @@ func (vm *Machine) Info() (minx, miny, minz, maxx, maxy, maxz float64, feedrates
 func (m *Machine) ETA() time.Duration {
 	var eta time.Duration
 	var lx, ly, lz float64
-	for _, pos := range m.Positions {
+	for _, pos := range m.All() {
 		feed := pos.State.Feedrate
 		if feed <= 0 {
 			// Just to use something...
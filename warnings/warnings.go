@@ -0,0 +1,71 @@
+package warnings
+
+import "fmt"
+
+//
+// Warnings
+//
+// Suspicious input that can still be processed is reported as a warning rather
+// than an error. Warnings are collected along with the result of every stage:
+// gcode.Document holds those of parsing, and vm.Machine those of processing,
+// optimization and export, including the ones of the document it processed.
+//
+
+// Constants for warning severities
+const (
+	SeverityInfo    = iota // Ignored codes that do not affect the toolpath
+	SeverityWarning = iota // Ignored or guessed input that may affect the result
+)
+
+// Constants for stages
+const (
+	StageParse    = "parse"
+	StageVM       = "vm"
+	StageOptimize = "optimize"
+	StageExport   = "export"
+)
+
+// A warning from one of the stages
+type Warning struct {
+	Stage    string `json:"stage"`
+	Line     int    `json:"line"` // Line of the input, 0 if unknown
+	Severity int    `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (w Warning) String() string {
+	sev := "warning"
+	if w.Severity == SeverityInfo {
+		sev = "info"
+	}
+	if w.Line > 0 {
+		return fmt.Sprintf("%s: %s: line %d: %s", w.Stage, sev, w.Line, w.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", w.Stage, sev, w.Message)
+}
+
+// A list of warnings
+type Warnings []Warning
+
+// Adds a warning, formatting the message like fmt.Sprintf. Duplicates are ignored,
+// so stages that run more than once do not repeat their warnings.
+func (w *Warnings) Add(stage string, line, severity int, format string, args ...interface{}) {
+	n := Warning{stage, line, severity, fmt.Sprintf(format, args...)}
+	for _, x := range *w {
+		if x == n {
+			return
+		}
+	}
+	*w = append(*w, n)
+}
+
+// Number of warnings with at least the given severity
+func (w Warnings) Count(severity int) int {
+	n := 0
+	for _, x := range w {
+		if x.Severity >= severity {
+			n++
+		}
+	}
+	return n
+}
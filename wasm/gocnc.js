@@ -0,0 +1,44 @@
+// Loads the gocnc WebAssembly module, resolving to an object with the
+// functions parse, stats, optimize and preview. Each takes gcode and an
+// optional options object ({precision, optimize}), and throws on errors.
+//
+// Requires wasm_exec.js from the Go distribution ($(go env GOROOT)/lib/wasm or misc/wasm).
+//
+//   const gocnc = await loadGocnc("gocnc.wasm");
+//   document.body.innerHTML = gocnc.preview(code);
+//
+async function loadGocnc(url) {
+  const go = new Go();
+  const ready = new Promise((resolve) => {
+    globalThis.gocnc = { onready: resolve };
+  });
+
+  let result;
+  if (WebAssembly.instantiateStreaming) {
+    result = await WebAssembly.instantiateStreaming(fetch(url), go.importObject);
+  } else {
+    const bytes = await (await fetch(url)).arrayBuffer();
+    result = await WebAssembly.instantiate(bytes, go.importObject);
+  }
+  go.run(result.instance);
+  await ready;
+
+  const call = (name) => (code, opts) => {
+    const res = globalThis.gocnc[name](code, opts);
+    if (res.error !== undefined) {
+      throw new Error(res.error);
+    }
+    return res.result;
+  };
+
+  return {
+    parse: call("parse"),
+    stats: call("stats"),
+    optimize: call("optimize"),
+    preview: call("preview"),
+  };
+}
+
+if (typeof module !== "undefined") {
+  module.exports = { loadGocnc };
+}
@@ -0,0 +1,122 @@
+//go:build js && wasm
+// +build js,wasm
+
+package main
+
+//
+// WebAssembly build
+//
+// Exposes parsing, statistics, optimization and SVG previews to JavaScript:
+//
+//   GOOS=js GOARCH=wasm go build -o gocnc.wasm ./wasm
+//
+// The functions are registered on the global gocnc object. See gocnc.js for a
+// wrapper loading the module.
+//
+
+import "github.com/joushou/gocnc/export"
+import "github.com/joushou/gocnc/gcode"
+import "github.com/joushou/gocnc/machine"
+import "github.com/joushou/gocnc/pipeline"
+import "encoding/json"
+import "fmt"
+import "strings"
+import "syscall/js"
+
+// Wraps a function taking gcode and an options object, returning {result} or {error}
+func wrap(fn func(code string, opts js.Value) (interface{}, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (res interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = map[string]interface{}{"error": fmt.Sprintf("%s", r)}
+			}
+		}()
+
+		if len(args) < 1 || args[0].Type() != js.TypeString {
+			return map[string]interface{}{"error": "Expected gcode as first argument"}
+		}
+		opts := js.Undefined()
+		if len(args) > 1 {
+			opts = args[1]
+		}
+
+		r, err := fn(args[0].String(), opts)
+		if err != nil {
+			return map[string]interface{}{"error": err.Error()}
+		}
+		return map[string]interface{}{"result": r}
+	})
+}
+
+// Reads an option, falling back to the default
+func option(opts js.Value, name string, def float64) float64 {
+	if opts.Type() != js.TypeObject {
+		return def
+	}
+	if v := opts.Get(name); v.Type() == js.TypeNumber {
+		return v.Float()
+	}
+	return def
+}
+
+// Creates a pipeline, applying the default optimizations unless disabled by {optimize: false}
+func load(code string, opts js.Value) *pipeline.Pipeline {
+	p := pipeline.Parse(strings.NewReader(code))
+	if opts.Type() != js.TypeObject || opts.Get("optimize").Type() != js.TypeBoolean || opts.Get("optimize").Bool() {
+		p.Optimize()
+	}
+	return p
+}
+
+func parse(code string, opts js.Value) (interface{}, error) {
+	doc, err := gcode.Parse(code)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Export(int(option(opts, "precision", 4))), nil
+}
+
+func stats(code string, opts js.Value) (interface{}, error) {
+	s, err := load(code, opts).Stats(machine.Default())
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert to plain JavaScript values through JSON
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return js.Global().Get("JSON").Call("parse", string(b)), nil
+}
+
+func optimize(code string, opts js.Value) (interface{}, error) {
+	return load(code, opts).String(int(option(opts, "precision", 4)))
+}
+
+func preview(code string, opts js.Value) (interface{}, error) {
+	g := export.SVGGenerator{Precision: int(option(opts, "precision", 3))}
+	g.Init()
+	if err := load(code, opts).ExportTo(&g); err != nil {
+		return nil, err
+	}
+	return g.Retrieve(), nil
+}
+
+func main() {
+	if js.Global().Get("gocnc").Type() == js.TypeUndefined {
+		js.Global().Set("gocnc", js.Global().Get("Object").New())
+	}
+	api := js.Global().Get("gocnc")
+	api.Set("parse", wrap(parse))
+	api.Set("stats", wrap(stats))
+	api.Set("optimize", wrap(optimize))
+	api.Set("preview", wrap(preview))
+
+	if ready := api.Get("onready"); ready.Type() == js.TypeFunction {
+		ready.Invoke()
+	}
+
+	// Keep the functions available
+	select {}
+}
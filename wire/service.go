@@ -0,0 +1,107 @@
+package wire
+
+//
+// Service messages
+//
+// Requests and replies of the Gocnc service of gocnc.proto. Toolpaths are
+// streamed with Encoder and Decoder.
+//
+
+// The request of every method
+type Request struct {
+	GCode            string
+	Optimizations    []string // Defaults if empty, unless NoOptimizations
+	NoOptimizations  bool
+	Precision        int
+	VTolerance       float64
+	RTolerance       float64
+	MaxArcDeviation  float64
+	MinArcLineLength float64
+}
+
+func (r Request) Marshal() []byte {
+	var b buffer
+	b.string(1, r.GCode)
+	for _, opt := range r.Optimizations {
+		// Repeated strings are written even if empty
+		b.message(2, buffer(opt))
+	}
+	b.bool(3, r.NoOptimizations)
+	b.int32(4, r.Precision)
+	b.double(5, r.VTolerance)
+	b.double(6, r.RTolerance)
+	b.double(7, r.MaxArcDeviation)
+	b.double(8, r.MinArcLineLength)
+	return b
+}
+
+func UnmarshalRequest(data []byte) (Request, error) {
+	var r Request
+	err := fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			r.GCode = string(f.bytes)
+		case 2:
+			r.Optimizations = append(r.Optimizations, string(f.bytes))
+		case 3:
+			r.NoOptimizations = f.value != 0
+		case 4:
+			r.Precision = f.int32()
+		case 5:
+			r.VTolerance = f.double()
+		case 6:
+			r.RTolerance = f.double()
+		case 7:
+			r.MaxArcDeviation = f.double()
+		case 8:
+			r.MinArcLineLength = f.double()
+		}
+		return nil
+	})
+	return r, err
+}
+
+// A parsed block, as streamed by Parse
+type Block struct {
+	Index int
+	Code  string
+}
+
+func (bl Block) Marshal() []byte {
+	var b buffer
+	b.int32(1, bl.Index)
+	b.string(2, bl.Code)
+	return b
+}
+
+func UnmarshalBlock(data []byte) (Block, error) {
+	var bl Block
+	err := fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			bl.Index = f.int32()
+		case 2:
+			bl.Code = string(f.bytes)
+		}
+		return nil
+	})
+	return bl, err
+}
+
+// Encodes a Line or StatsReply, both holding a single string
+func MarshalText(text string) []byte {
+	var b buffer
+	b.string(1, text)
+	return b
+}
+
+func UnmarshalText(data []byte) (string, error) {
+	var text string
+	err := fields(data, func(f field) error {
+		if f.num == 1 {
+			text = string(f.bytes)
+		}
+		return nil
+	})
+	return text, err
+}
@@ -0,0 +1,315 @@
+package wire
+
+import "github.com/joushou/gocnc/vm"
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+
+// Field numbers, see gocnc.proto
+const (
+	toolpathStates    = 1
+	toolpathPositions = 2
+)
+
+// Largest state or position message, to fail on corrupt lengths instead of
+// allocating them
+const maxMessageSize = 1 << 20
+
+func encodeState(s vm.State) buffer {
+	var b buffer
+	b.double(1, s.Feedrate)
+	b.double(2, s.SpindleSpeed)
+	b.int32(3, s.MoveMode)
+	b.int32(4, s.FeedMode)
+	b.bool(5, s.SpindleEnabled)
+	b.bool(6, s.SpindleClockwise)
+	b.bool(7, s.FloodCoolant)
+	b.bool(8, s.MistCoolant)
+	b.int32(9, s.Tool)
+	b.int32(10, s.CutterCompensation)
+	b.bool(11, s.OverridesDisabled)
+	b.bool(12, s.THCDisabled)
+	b.bool(13, s.DiameterMode)
+	b.bool(14, s.ConstantSurfaceSpeed)
+	b.double(15, s.SurfaceSpeed)
+	b.double(16, s.MaxSpindleSpeed)
+	b.double(17, s.Scaling.Center.X)
+	b.double(18, s.Scaling.Center.Y)
+	b.double(19, s.Scaling.Center.Z)
+	b.double(20, s.Scaling.Factors.X)
+	b.double(21, s.Scaling.Factors.Y)
+	b.double(22, s.Scaling.Factors.Z)
+	return b
+}
+
+func decodeState(data []byte) (vm.State, error) {
+	var s vm.State
+	err := fields(data, func(f field) error {
+		switch f.num {
+		case 1:
+			s.Feedrate = f.double()
+		case 2:
+			s.SpindleSpeed = f.double()
+		case 3:
+			s.MoveMode = f.int32()
+		case 4:
+			s.FeedMode = f.int32()
+		case 5:
+			s.SpindleEnabled = f.value != 0
+		case 6:
+			s.SpindleClockwise = f.value != 0
+		case 7:
+			s.FloodCoolant = f.value != 0
+		case 8:
+			s.MistCoolant = f.value != 0
+		case 9:
+			s.Tool = f.int32()
+		case 10:
+			s.CutterCompensation = f.int32()
+		case 11:
+			s.OverridesDisabled = f.value != 0
+		case 12:
+			s.THCDisabled = f.value != 0
+		case 13:
+			s.DiameterMode = f.value != 0
+		case 14:
+			s.ConstantSurfaceSpeed = f.value != 0
+		case 15:
+			s.SurfaceSpeed = f.double()
+		case 16:
+			s.MaxSpindleSpeed = f.double()
+		case 17:
+			s.Scaling.Center.X = f.double()
+		case 18:
+			s.Scaling.Center.Y = f.double()
+		case 19:
+			s.Scaling.Center.Z = f.double()
+		case 20:
+			s.Scaling.Factors.X = f.double()
+		case 21:
+			s.Scaling.Factors.Y = f.double()
+		case 22:
+			s.Scaling.Factors.Z = f.double()
+		}
+		return nil
+	})
+	return s, err
+}
+
+func encodePosition(state int, s vm.Segment) buffer {
+	var b buffer
+	b.varint(1, uint64(state))
+	b.double(2, s.X)
+	b.double(3, s.Y)
+	b.double(4, s.Z)
+	b.int32(5, s.Kind)
+	b.double(6, s.Param)
+	b.int32(7, int(s.Axis))
+	b.double(8, s.Offset.X)
+	b.double(9, s.Offset.Y)
+	b.double(10, s.Offset.Z)
+	b.bool(11, s.Machine)
+	b.double(12, s.A)
+	b.double(13, s.B)
+	b.double(14, s.C)
+	b.string(15, s.Text)
+	b.double(16, s.AxisOffset.X)
+	b.double(17, s.AxisOffset.Y)
+	b.double(18, s.AxisOffset.Z)
+	b.int32(19, s.Line)
+	b.string(20, s.Source)
+	return b
+}
+
+//
+// Encoding
+//
+
+// Writes positions as a Toolpath message, one field at a time
+type Encoder struct {
+	w      io.Writer
+	states map[vm.State]int
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, states: make(map[vm.State]int)}
+}
+
+// Writes a segment, and its state if not already written
+func (e *Encoder) Encode(s vm.Segment) error {
+	var b buffer
+	idx, ok := e.states[*s.State]
+	if !ok {
+		idx = len(e.states)
+		e.states[*s.State] = idx
+		b.message(toolpathStates, encodeState(*s.State))
+	}
+	b.message(toolpathPositions, encodePosition(idx, s))
+	_, err := e.w.Write(b)
+	return err
+}
+
+// Encodes all positions of the machine
+func Marshal(m *vm.Machine) []byte {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, s := range m.All() {
+		// Writes to bytes.Buffer never fail
+		e.Encode(s)
+	}
+	return buf.Bytes()
+}
+
+//
+// Decoding
+//
+
+// Reads positions from a Toolpath message, one field at a time
+type Decoder struct {
+	r      *bufio.Reader
+	states []*vm.State
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Reads a length-delimited field, skipping others. Returns io.EOF at the end of the message.
+func (d *Decoder) next() (int, []byte, error) {
+	for {
+		key, err := binary.ReadUvarint(d.r)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		num, wireType := int(key>>3), int(key&7)
+		switch wireType {
+		case typeVarint:
+			_, err = binary.ReadUvarint(d.r)
+		case typeFixed64:
+			_, err = d.r.Discard(8)
+		case typeFixed32:
+			_, err = d.r.Discard(4)
+		case typeBytes:
+			var l uint64
+			if l, err = binary.ReadUvarint(d.r); err != nil {
+				break
+			}
+			if l > maxMessageSize {
+				err = errors.New(fmt.Sprintf("Message of %d bytes exceeds the maximum of %d", l, maxMessageSize))
+				break
+			}
+			data := make([]byte, l)
+			if _, err = io.ReadFull(d.r, data); err == nil {
+				return num, data, nil
+			}
+		default:
+			err = errors.New(fmt.Sprintf("Unsupported wire type %d", wireType))
+		}
+
+		if err == io.EOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// Reads the next segment. Segments decoded from the same state share it.
+// Returns io.EOF when there are no more segments.
+func (d *Decoder) Decode() (vm.Segment, error) {
+	for {
+		num, data, err := d.next()
+		if err != nil {
+			return vm.Segment{}, err
+		}
+
+		switch num {
+		case toolpathStates:
+			s, err := decodeState(data)
+			if err != nil {
+				return vm.Segment{}, err
+			}
+			d.states = append(d.states, &s)
+		case toolpathPositions:
+			var (
+				p     vm.Segment
+				state uint64
+			)
+			err := fields(data, func(f field) error {
+				switch f.num {
+				case 1:
+					state = f.value
+				case 2:
+					p.X = f.double()
+				case 3:
+					p.Y = f.double()
+				case 4:
+					p.Z = f.double()
+				case 5:
+					p.Kind = f.int32()
+				case 6:
+					p.Param = f.double()
+				case 7:
+					p.Axis = rune(f.int32())
+				case 8:
+					p.Offset.X = f.double()
+				case 9:
+					p.Offset.Y = f.double()
+				case 10:
+					p.Offset.Z = f.double()
+				case 11:
+					p.Machine = f.value != 0
+				case 12:
+					p.A = f.double()
+				case 13:
+					p.B = f.double()
+				case 14:
+					p.C = f.double()
+				case 15:
+					p.Text = string(f.bytes)
+				case 16:
+					p.AxisOffset.X = f.double()
+				case 17:
+					p.AxisOffset.Y = f.double()
+				case 18:
+					p.AxisOffset.Z = f.double()
+				case 19:
+					p.Line = f.int32()
+				case 20:
+					p.Source = string(f.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return vm.Segment{}, err
+			}
+			if state >= uint64(len(d.states)) {
+				return vm.Segment{}, errors.New(fmt.Sprintf("Position references unknown state %d", state))
+			}
+			p.State = d.states[state]
+			return p, nil
+		}
+	}
+}
+
+// Decodes a toolpath into a machine, ready for optimization and export
+func Unmarshal(data []byte) (*vm.Machine, error) {
+	m := vm.New()
+	m.Segments = m.Segments[:0]
+
+	d := NewDecoder(bytes.NewReader(data))
+	for {
+		p, err := d.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		m.Segments = append(m.Segments, p)
+	}
+	return m, nil
+}
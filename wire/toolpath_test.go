@@ -0,0 +1,117 @@
+package wire
+
+import "github.com/joushou/gocnc/vector"
+import "github.com/joushou/gocnc/vm"
+import "reflect"
+import "strings"
+import "testing"
+
+func TestRoundTrip(t *testing.T) {
+	// Every field set, with negative values where allowed
+	full := vm.State{
+		Feedrate:             1200.5,
+		SpindleSpeed:         18000,
+		MoveMode:             vm.MoveModeCWArc,
+		FeedMode:             vm.FeedModeUnitsRev,
+		SpindleEnabled:       true,
+		SpindleClockwise:     true,
+		FloodCoolant:         true,
+		MistCoolant:          true,
+		Tool:                 7,
+		CutterCompensation:   -1,
+		OverridesDisabled:    true,
+		THCDisabled:          true,
+		DiameterMode:         true,
+		ConstantSurfaceSpeed: true,
+		SurfaceSpeed:         250,
+		MaxSpindleSpeed:      3000,
+		Scaling: vm.Scaling{
+			Center:  vector.Vector{X: 1, Y: -2, Z: 3},
+			Factors: vector.Vector{X: -1, Y: 2, Z: 0.5},
+		},
+	}
+	empty := vm.State{}
+	segs := []vm.Segment{
+		{Kind: vm.SegmentMove, State: &empty},
+		{
+			Kind:       vm.SegmentPassthrough,
+			State:      &full,
+			X:          1.5,
+			Y:          -2.25,
+			Z:          -0.125,
+			A:          90,
+			B:          -45,
+			C:          30,
+			Param:      2.5,
+			Axis:       'A',
+			Text:       "M100 P1",
+			Offset:     vector.Vector{X: 10, Y: -20, Z: 30},
+			AxisOffset: vector.Vector{X: -1, Y: 2, Z: -3},
+			Machine:    true,
+			Line:       42,
+			Source:     "M100 P1 (custom)",
+		},
+		{Kind: vm.SegmentMove, State: &full, X: 2, Line: -1},
+	}
+
+	m := vm.New()
+	m.Segments = segs
+	res, err := Unmarshal(Marshal(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Segments) != len(segs) {
+		t.Fatalf("Got %d segments, expected %d", len(res.Segments), len(segs))
+	}
+	for idx, seg := range res.Segments {
+		got, expected := seg, segs[idx]
+		if *got.State != *expected.State {
+			t.Errorf("Segment %d: got state %+v, expected %+v", idx, *got.State, *expected.State)
+		}
+		got.State, expected.State = nil, nil
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Segment %d: got %+v, expected %+v", idx, got, expected)
+		}
+	}
+	if res.Segments[1].State != res.Segments[2].State {
+		t.Error("Segments with the same state do not share it")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"huge length", []byte{0x12, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x40}},
+		{"truncated key", []byte{0x80}},
+		{"truncated length", []byte{0x12}},
+		{"truncated message", []byte{0x12, 0x05, 0x08}},
+		{"unsupported wire type", []byte{0x13}},
+		{"unknown state", []byte{0x12, 0x02, 0x08, 0x01}},
+		{"huge state", []byte{0x12, 0x0b, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"truncated double", []byte{0x0a, 0x03, 0x09, 0x00, 0x00}},
+		{"invalid varint", []byte{0x0a, 0x02, 0x18, 0x80}},
+		{"unsupported inner wire type", []byte{0x0a, 0x01, 0x0b}},
+	}
+	for _, test := range tests {
+		if _, err := Unmarshal(test.input); err == nil {
+			t.Errorf("%s: decoded without an error", test.name)
+		}
+	}
+
+	// Unknown fields are skipped
+	m, err := Unmarshal([]byte{0x18, 0x01, 0x0a, 0x00, 0x12, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Segments) != 1 {
+		t.Errorf("Got %d segments, expected 1", len(m.Segments))
+	}
+
+	long := []byte{0x12, 0x80, 0x80, 0x80, 0x01}
+	long = append(long, strings.Repeat("x", 1<<21)...)
+	if _, err := Unmarshal(long); err == nil {
+		t.Error("Decoded a message exceeding the maximum size")
+	}
+}
@@ -0,0 +1,130 @@
+package wire
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+
+//
+// Protocol buffer wire format
+//
+// Just enough of the encoding to read and write gocnc.proto, without
+// depending on generated code.
+//
+
+// Wire types
+const (
+	typeVarint  = 0
+	typeFixed64 = 1
+	typeBytes   = 2
+	typeFixed32 = 5
+)
+
+type buffer []byte
+
+func (b *buffer) tag(field, wireType int) {
+	*b = binary.AppendUvarint(*b, uint64(field<<3|wireType))
+}
+
+func (b *buffer) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, typeVarint)
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *buffer) int32(field int, v int) {
+	// Negative values are sign extended to 64 bits
+	b.varint(field, uint64(int64(v)))
+}
+
+func (b *buffer) bool(field int, v bool) {
+	if v {
+		b.varint(field, 1)
+	}
+}
+
+func (b *buffer) double(field int, v float64) {
+	if v == 0 && !math.Signbit(v) {
+		return
+	}
+	b.tag(field, typeFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+}
+
+func (b *buffer) string(field int, v string) {
+	if v == "" {
+		return
+	}
+	b.tag(field, typeBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *buffer) message(field int, msg buffer) {
+	b.tag(field, typeBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(msg)))
+	*b = append(*b, msg...)
+}
+
+// A decoded field
+type field struct {
+	num      int
+	wireType int
+	value    uint64 // Varints and fixed values
+	bytes    []byte // Length-delimited values
+}
+
+func (f field) double() float64 {
+	return math.Float64frombits(f.value)
+}
+
+func (f field) int32() int {
+	return int(int32(f.value))
+}
+
+// Reads fields from a byte slice
+func fields(data []byte, fn func(f field) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("Invalid field key")
+		}
+		data = data[n:]
+
+		f := field{num: int(key >> 3), wireType: int(key & 7)}
+		switch f.wireType {
+		case typeVarint:
+			f.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("Invalid varint")
+			}
+			data = data[n:]
+		case typeFixed64:
+			if len(data) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			f.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case typeFixed32:
+			if len(data) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			f.value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case typeBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return io.ErrUnexpectedEOF
+			}
+			f.bytes, data = data[n:n+int(l)], data[n+int(l):]
+		default:
+			return errors.New(fmt.Sprintf("Unsupported wire type %d", f.wireType))
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}